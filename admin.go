@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"net/http"
+)
+
+// adminOnly restricts h to the person hosting the share, i.e. requests coming
+// from the machine the server runs on, and to users with the admin role.
+func adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// isAdmin reports whether r comes from the person hosting the share, or a
+// user with the admin role.
+func isAdmin(r *http.Request) bool {
+	return (authEnabled() && hasRole(r, roleAdmin)) || isLocalRequest(r)
+}
+
+// isLocalRequest reports whether r was sent from this machine, either over
+// loopback or to one of its own interface addresses, and not just passed on
+// by a reverse proxy running there.
+func isLocalRequest(r *http.Request) bool {
+	ip := net.ParseIP(clientIP(r))
+	if ip == nil || viaProxy(r) {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, address := range addrs {
+		if ipnet, ok := address.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiFilesHandler lists the shared files as JSON, with ?hash along with
+// their SHA-256, waiting for any that haven't been worked out yet, and with
+// ?photos along with what photos say about themselves. They're sorted as
+// ?sort= and ?order= say, like the page, with ?tag= only those tagged so,
+// and with ?page= or ?per_page= split into pages, with a Link header to the
+// next.
+func apiFilesHandler(w http.ResponseWriter, r *http.Request) {
+	files, err := listEntries(r)
+	if err != nil {
+		http.Error(w, "Error listing files", http.StatusInternalServerError)
+		return
+	}
+	tag := r.URL.Query().Get("tag")
+	files = filterByTag(files, tag)
+	sort := parseSort(r.URL.Query())
+	sortEntries(files, sort)
+	if q := r.URL.Query(); q.Has("page") || q.Has("per_page") {
+		page, err := parsePage(q, defaultPerPage)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		files = page.slice(files)
+		w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+		var links []string
+		extra := func(n int) url.Values {
+			v := withTag(page.query(n), tag)
+			for _, k := range []string{"hash", "photos"} {
+				if q.Has(k) {
+					v.Set(k, "")
+				}
+			}
+			return v
+		}
+		if page.Page < page.Pages() {
+			links = append(links, "<"+sort.url(basePath+"/api/files", extra(page.Page+1))+`>; rel="next"`)
+		}
+		if page.Page > 1 {
+			links = append(links, "<"+sort.url(basePath+"/api/files", extra(page.Page-1))+`>; rel="prev"`)
+		}
+		if links != nil {
+			w.Header().Set("Link", strings.Join(links, ", "))
+		}
+	}
+	if r.URL.Query().Has("hash") {
+		for i, f := range files {
+			if !f.Folder && !f.Locked {
+				files[i].SHA256, _ = checksums.sum(r.Context(), f.Name)
+			}
+		}
+	}
+	if r.URL.Query().Has("photos") {
+		for i, f := range files {
+			if !f.Folder && !f.Locked && f.Photo == nil {
+				files[i].Photo = photoDetails(f.Name)
+			}
+		}
+	}
+	writeJSONTagged(w, r, files)
+}
+
+// fileInfo describes a shared file for GET /api/files/PATH.
+type fileInfo struct {
+	Name      string     `json:"name"`
+	Size      int64      `json:"size"`
+	HumanSize string     `json:"size_human"`
+	Modified  time.Time  `json:"modified"`
+	Type      string     `json:"type"`
+	SHA256    string     `json:"sha256,omitempty"` // With ?hash
+	Photo     *photoInfo `json:"photo,omitempty"`
+	Tags      []string   `json:"tags"`
+	Notes     []fileNote `json:"notes,omitempty"`
+}
+
+func apiFileInfo(w http.ResponseWriter, r *http.Request, name string) {
+	if receiveOnly {
+		http.NotFound(w, r)
+		return
+	}
+	if _, locked := lockedBy(r, name); locked {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	info, err := statShared(name)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	file := fileInfo{Name: name, Size: info.Size(), HumanSize: humanSize(info.Size()), Modified: info.ModTime(), Type: sharedFileType(name), Photo: photoDetails(name), Tags: tags.get(name), Notes: notes.list(name)}
+	if file.Tags == nil {
+		file.Tags = []string{}
+	}
+	if r.URL.Query().Has("hash") {
+		if file.SHA256, err = checksums.sum(r.Context(), name); err != nil {
+			http.Error(w, "Error reading "+name, http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, file)
+}
+
+// apiStatusHandler reports on the server, including for uploaders how much
+// they can still upload and where.
+func apiStatusHandler(w http.ResponseWriter, r *http.Request) {
+	status := struct {
+		Uptime        float64       `json:"uptime"` // Seconds
+		ExpiresAt     *time.Time    `json:"expires_at,omitempty"`
+		Uploads       bool          `json:"uploads"`
+		MaxUploadSize int64         `json:"max_upload_size,omitempty"`
+		QuotaLeft     *int64        `json:"quota_left,omitempty"` // Bytes left today
+		Folders       []folderSpace `json:"folders,omitempty"`
+	}{
+		Uptime:  time.Since(startTime).Seconds(),
+		Uploads: uploadsEnabled && hasRole(r, roleUploader),
+	}
+	if !expiresAt.IsZero() {
+		status.ExpiresAt = &expiresAt
+	}
+	if status.Uploads {
+		status.MaxUploadSize = maxUploadSize
+		if left := quotaLeft(r); left >= 0 {
+			status.QuotaLeft = &left
+		}
+		status.Folders = uploadSpace()
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
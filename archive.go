@@ -0,0 +1,277 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// An archive can be shared in place of a folder: its contents are listed
+// and downloaded as if they had been extracted, and nothing is written back.
+
+// archiveFS returns the backend for the .zip, .tar, .tar.gz or .tgz file
+// name.
+func archiveFS(name string) (fs.FS, error) {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		r, err := zip.OpenReader(name)
+		// Entries with names like ../x are left out of r's fs.FS anyway.
+		if err != nil && !errors.Is(err, zip.ErrInsecurePath) {
+			return nil, err
+		}
+		return r, nil
+	case strings.HasSuffix(lower, ".tar"):
+		return openTar(name, false)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return openTar(name, true)
+	}
+	return nil, fmt.Errorf("%s is not a folder or a .zip, .tar or .tar.gz archive", name)
+}
+
+// tarFS serves the regular files and folders in a tar archive, which it
+// reads through once up front to find where each file starts. Files in a
+// plain .tar are read straight from there; a .tar.gz has to be decompressed
+// from the start every time a file is opened.
+type tarFS struct {
+	name    string
+	file    *os.File // Open for as long as the share is, nil for .tar.gz
+	gzip    bool
+	entries map[string]*tarEntry // By fs.FS name, "." for the top
+}
+
+type tarEntry struct {
+	info     fs.FileInfo
+	offset   int64 // Where the data starts in the uncompressed archive
+	children []fs.DirEntry
+}
+
+func openTar(name string, compressed bool) (*tarFS, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	archiveInfo, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	t := &tarFS{name: name, gzip: compressed, entries: map[string]*tarEntry{}}
+	if err := t.index(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading %s: %w", name, err)
+	}
+	if compressed {
+		f.Close()
+	} else {
+		t.file = f
+	}
+
+	// Archives don't have to list the folders their files are in.
+	t.entries["."] = &tarEntry{info: tarDirInfo{".", archiveInfo.ModTime()}}
+	for p := range t.entries {
+		for dir := path.Dir(p); p != "."; p, dir = dir, path.Dir(dir) {
+			if _, ok := t.entries[dir]; !ok {
+				t.entries[dir] = &tarEntry{info: tarDirInfo{path.Base(dir), archiveInfo.ModTime()}}
+			}
+		}
+	}
+	for p, e := range t.entries {
+		if p != "." {
+			parent := t.entries[path.Dir(p)]
+			parent.children = append(parent.children, fs.FileInfoToDirEntry(e.info))
+		}
+	}
+	for _, e := range t.entries {
+		slices.SortFunc(e.children, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	}
+	return t, nil
+}
+
+// index records the files and folders in the archive f. Links and special
+// files are left out, and an entry that appears twice keeps its last copy,
+// as tar itself would extract it.
+func (t *tarFS) index(f *os.File) error {
+	var r io.Reader = f
+	if t.gzip {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		r = gz
+	}
+	counter := &countingReader{r: r}
+	tr := tar.NewReader(counter)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		info := hdr.FileInfo()
+		if name == "." || !fs.ValidPath(name) || !(info.IsDir() || info.Mode().IsRegular()) {
+			continue
+		}
+		t.entries[name] = &tarEntry{info: info, offset: counter.n}
+	}
+}
+
+func (t *tarFS) Open(name string) (fs.File, error) {
+	e, err := t.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.info.IsDir() {
+		return &tarDir{entry: e}, nil
+	}
+	if t.file != nil {
+		return &tarFile{io.NewSectionReader(t.file, e.offset, e.info.Size()), e.info}, nil
+	}
+
+	f, err := os.Open(t.name)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &tarStream{r: gz, f: f, skip: e.offset, left: e.info.Size(), info: e.info}, nil
+}
+
+func (t *tarFS) Stat(name string) (fs.FileInfo, error) {
+	e, err := t.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return e.info, nil
+}
+
+func (t *tarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := t.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return slices.Clone(e.children), nil
+}
+
+func (t *tarFS) lookup(op, name string) (*tarEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	e, ok := t.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// tarFile is a file in a plain .tar, which can seek.
+type tarFile struct {
+	*io.SectionReader
+	info fs.FileInfo
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *tarFile) Close() error               { return nil }
+
+// tarStream is a file in a .tar.gz, skipping the rest of the archive before
+// its first read.
+type tarStream struct {
+	r          io.Reader
+	f          *os.File
+	skip, left int64
+	info       fs.FileInfo
+}
+
+func (s *tarStream) Read(p []byte) (int, error) {
+	if s.skip > 0 {
+		if _, err := io.CopyN(io.Discard, s.r, s.skip); err != nil {
+			return 0, err
+		}
+		s.skip = 0
+	}
+	if s.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > s.left {
+		p = p[:s.left]
+	}
+	n, err := s.r.Read(p)
+	s.left -= int64(n)
+	if err == io.EOF && s.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (s *tarStream) Stat() (fs.FileInfo, error) { return s.info, nil }
+func (s *tarStream) Close() error               { return s.f.Close() }
+
+// tarDir is an open folder in a tar archive.
+type tarDir struct {
+	entry *tarEntry
+	pos   int
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) { return d.entry.info, nil }
+func (d *tarDir) Close() error               { return nil }
+
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.entry.info.Name(), Err: errors.New("is a directory")}
+}
+
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entry.children[d.pos:]
+	if n <= 0 {
+		d.pos += len(rest)
+		return slices.Clone(rest), nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	rest = rest[:min(n, len(rest))]
+	d.pos += len(rest)
+	return slices.Clone(rest), nil
+}
+
+// tarDirInfo describes a folder the archive doesn't have an entry for.
+type tarDirInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (i tarDirInfo) Name() string       { return i.name }
+func (i tarDirInfo) Size() int64        { return 0 }
+func (i tarDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0o555 }
+func (i tarDirInfo) ModTime() time.Time { return i.modTime }
+func (i tarDirInfo) IsDir() bool        { return true }
+func (i tarDirInfo) Sys() any           { return nil }
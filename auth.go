@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type contextKey int
+
+const userContextKey contextKey = 0
+
+// currentUser returns the account r was authenticated as, or nil when auth
+// is disabled or the request came in through a link.
+func currentUser(r *http.Request) *user {
+	u, _ := r.Context().Value(userContextKey).(*user)
+	return u
+}
+
+// authEnabled reports whether visitors have to sign in.
+func authEnabled() bool {
+	return users.enabled() || oidc != nil || ldap != nil
+}
+
+// authenticate checks a username and password against the local accounts,
+// then the LDAP directory if one is configured. It returns nil when the
+// credentials are wrong.
+func authenticate(name, password string) *user {
+	if users.lookup(name) != nil {
+		return users.authenticate(name, password)
+	}
+	if ldap == nil {
+		return nil
+	}
+	u, err := ldap.authenticate(name, password)
+	if err != nil {
+		log.Println("LDAP:", err)
+		return nil
+	}
+	return u
+}
+
+// setLoginSession signs the browser in as u.
+func setLoginSession(w http.ResponseWriter, u *user) {
+	if u.external {
+		setExternalSession(w, u)
+	} else {
+		setSession(w, u)
+	}
+}
+
+// hasRole reports whether r may do what role allows. Everyone may do
+// everything when no accounts are configured; features that change the
+// share have their own flags to turn them on.
+func hasRole(r *http.Request, role string) bool {
+	if !authEnabled() {
+		return true
+	}
+	u := currentUser(r)
+	return u != nil && roleAllows(u.Role, role)
+}
+
+// authMiddleware requires a signed-in user for every request except the
+// login page, share links and signed download URLs, which carry their own
+// authorization, and the tracker and DLNA server, which torrent clients and
+// TVs can't sign in to. Browsers are sent to the login form; scripts can
+// use HTTP basic auth, or an API token for /api/.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authEnabled() || isLoginPath(r.URL.Path) || strings.HasPrefix(r.URL.Path, "/s/") || validSignedURL(r) ||
+			r.URL.Path == "/announce" || dlnaEnabled && strings.HasPrefix(r.URL.Path, "/dlna/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if apiPath(r.URL.Path) {
+			if u, ok := bearerUser(r); ok {
+				if u == nil {
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+					http.Error(w, "Invalid API token", http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey, u)))
+				return
+			}
+		}
+
+		u := sessionUser(r)
+		if u == nil {
+			if name, pass, ok := r.BasicAuth(); ok {
+				if msg := lockoutError(w, r, name); msg != "" {
+					http.Error(w, msg, http.StatusTooManyRequests)
+					return
+				}
+				if u = basicAuthUser(name, pass); u != nil {
+					logins.succeed(clientIP(r), name)
+				} else {
+					logins.fail(clientIP(r), name)
+				}
+			}
+		}
+		if u != nil {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey, u)))
+			return
+		}
+
+		if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="File Sharing", charset="UTF-8"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// isLoginPath reports whether p is part of signing in, including the logo
+// and theme the login page shows.
+func isLoginPath(p string) bool {
+	switch p {
+	case "/login", "/theme.css", "/logo",
+		"/manifest.webmanifest", "/sw.js", "/icon-192.png", "/icon-512.png", "/offline":
+		return true
+	case "/oidc/login", "/oidc/callback":
+		return oidc != nil
+	}
+	return false
+}
+
+// Password hashing and LDAP binds are slow, so basic auth credentials that
+// checked out are remembered for a while instead of being verified again on
+// every request.
+var basicAuthCache = struct {
+	sync.Mutex
+	entries map[[32]byte]basicAuthEntry
+}{entries: make(map[[32]byte]basicAuthEntry)}
+
+type basicAuthEntry struct {
+	user    *user
+	hash    string // The local user's password hash when the entry was made
+	expires time.Time
+}
+
+const basicAuthCacheTTL = 5 * time.Minute
+
+func basicAuthUser(name, pass string) *user {
+	key := sha256.Sum256([]byte(name + "\x00" + pass))
+
+	basicAuthCache.Lock()
+	entry, ok := basicAuthCache.entries[key]
+	basicAuthCache.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		if entry.user.external {
+			return entry.user
+		}
+		if u := users.lookup(name); u != nil && u.Hash == entry.hash {
+			return u
+		}
+	}
+
+	// Basic auth has no room for a one-time code, so accounts with two-factor
+	// sign-in have to use the login page or an API token.
+	u := authenticate(name, pass)
+	if u == nil || u.TOTP != "" {
+		return nil
+	}
+	basicAuthCache.Lock()
+	for k, e := range basicAuthCache.entries {
+		if time.Now().After(e.expires) {
+			delete(basicAuthCache.entries, k)
+		}
+	}
+	basicAuthCache.entries[key] = basicAuthEntry{user: u, hash: u.Hash, expires: time.Now().Add(basicAuthCacheTTL)}
+	basicAuthCache.Unlock()
+	return u
+}
+
+// Browser sessions are signed cookies, so they survive restarts. The
+// signature covers the user's password hash, which logs out every session
+// when the password changes.
+const (
+	sessionCookie = "session"
+	sessionTTL    = 7 * 24 * time.Hour
+)
+
+func sessionSignature(u *user, exp int64) string {
+	return base64.RawURLEncoding.EncodeToString(sign([]byte("session\n" + u.Name + "\n" + strconv.FormatInt(exp, 10) + "\n" + u.Hash + "\n" + u.TOTP)))
+}
+
+func setSession(w http.ResponseWriter, u *user) {
+	exp := time.Now().Add(sessionTTL)
+	value := base64.RawURLEncoding.EncodeToString([]byte(u.Name)) + "." +
+		strconv.FormatInt(exp.Unix(), 10) + "." + sessionSignature(u, exp.Unix())
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     basePath + "/",
+		Expires:  exp,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sessionUser returns the user of a valid session cookie on r, or nil.
+func sessionUser(r *http.Request) *user {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	if strings.HasPrefix(c.Value, "ext.") {
+		return externalSessionUser(c.Value)
+	}
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	name, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return nil
+	}
+	u := users.lookup(string(name))
+	if u == nil || !hmac.Equal([]byte(parts[2]), []byte(sessionSignature(u, exp))) {
+		return nil
+	}
+	return u
+}
+
+// safeNext returns next, the page to go back to after signing in, if it's
+// one on this server, or else "/". Browsers read a backslash as a slash and
+// drop tabs and newlines, so /\evil.com would be another site.
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") ||
+		strings.ContainsFunc(next, func(c rune) bool { return c == '\\' || c < ' ' || c == 0x7f }) {
+		return "/"
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return "/"
+	}
+	return next
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	next := safeNext(r.FormValue("next"))
+	data := struct {
+		Next      string
+		User      string
+		Error     string
+		Passwords bool // Local accounts exist
+		SSO       bool
+		Code      bool // Asking for the second factor
+		CSRF      string
+		Title     string
+		Logo      bool
+	}{Next: next, User: r.FormValue("user"), Passwords: users.enabled() || ldap != nil, SSO: oidc != nil, CSRF: csrfToken(w, r), Title: siteTitle, Logo: logoFile != ""}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	var locked string
+	if r.Method == http.MethodPost {
+		target := data.User
+		if u := pendingLogin(r); u != nil && r.PostFormValue("code") != "" {
+			target = u.Name
+		}
+		locked = lockoutError(w, r, target)
+	}
+
+	switch {
+	case locked != "":
+		data.Code, data.Error = r.PostFormValue("code") != "", locked
+		w.WriteHeader(http.StatusTooManyRequests)
+
+	case r.Method == http.MethodPost && r.PostFormValue("code") != "":
+		u := pendingLogin(r)
+		if u == nil {
+			data.Error = "Sign-in took too long, please start again"
+			w.WriteHeader(http.StatusUnauthorized)
+			break
+		}
+		if users.checkSecondFactor(u.Name, r.PostFormValue("code")) {
+			logins.succeed(clientIP(r), u.Name)
+			clearPendingLogin(w)
+			setLoginSession(w, u)
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		logins.fail(clientIP(r), u.Name)
+		data.Code, data.Error = true, "Wrong code"
+		w.WriteHeader(http.StatusUnauthorized)
+
+	case r.Method == http.MethodPost && data.Passwords:
+		u := authenticate(data.User, r.FormValue("password"))
+		if u == nil {
+			logins.fail(clientIP(r), data.User)
+			data.Error = "Wrong username or password"
+			w.WriteHeader(http.StatusUnauthorized)
+			break
+		}
+		if u.TOTP != "" {
+			// The lockout keeps counting until the code is right too.
+			setPendingLogin(w, u)
+			data.Code = true
+			break
+		}
+		logins.succeed(clientIP(r), data.User)
+		setLoginSession(w, u)
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	err := loginTemplate.Execute(w, data)
+	if err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	}
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: basePath + "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+var loginTemplate = newPage("login", nil)
+
+// downloadSignature signs a download of the share-relative path p that is
+// valid until exp, in Unix seconds.
+func downloadSignature(p string, exp int64) string {
+	return base64.RawURLEncoding.EncodeToString(sign([]byte("download\n" + p + "\n" + strconv.FormatInt(exp, 10))))
+}
+
+// signedDownloadURL returns a /download/ URL for p under base that works
+// without credentials for the given duration.
+func signedDownloadURL(base, p string, d time.Duration) string {
+	p = cleanSharePath(p)
+	exp := time.Now().Add(d).Unix()
+	q := url.Values{}
+	q.Set("exp", strconv.FormatInt(exp, 10))
+	q.Set("sig", downloadSignature(p, exp))
+	u := url.URL{Path: "/download/" + p, RawQuery: q.Encode()}
+	return strings.TrimSuffix(base, "/") + u.String()
+}
+
+// validSignedURL reports whether r is a download carrying a valid, unexpired
+// signature from signedDownloadURL.
+func validSignedURL(r *http.Request) bool {
+	name, ok := strings.CutPrefix(r.URL.Path, "/download/")
+	if !ok {
+		return false
+	}
+	q := r.URL.Query()
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	want := downloadSignature(cleanSharePath(name), exp)
+	return hmac.Equal([]byte(q.Get("sig")), []byte(want))
+}
+
+// apiSignHandler returns a signed download URL for ?path= so an authenticated
+// user can hand out a single file to someone without credentials.
+func apiSignHandler(w http.ResponseWriter, r *http.Request) {
+	p := cleanSharePath(r.URL.Query().Get("path"))
+	if !sharedFileExists(p) {
+		http.NotFound(w, r)
+		return
+	}
+	if _, locked := lockedBy(r, p); locked {
+		http.Error(w, "File is password protected", http.StatusForbidden)
+		return
+	}
+
+	d := 24 * time.Hour
+	if s := r.URL.Query().Get("expire"); s != "" {
+		var err error
+		d, err = time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid expiry %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"url":     signedDownloadURL(externalBaseURL(r), p, d),
+		"expires": time.Now().Add(d),
+	})
+}
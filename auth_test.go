@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSafeNext(t *testing.T) {
+	tests := []struct{ next, want string }{
+		{"", "/"},
+		{"/", "/"},
+		{"/docs/a.txt", "/docs/a.txt"},
+		{"/?dir=docs&sort=name", "/?dir=docs&sort=name"},
+		{"/admin/links#new", "/admin/links#new"},
+		{"docs", "/"},
+		{"https://evil.com/", "/"},
+		{"//evil.com", "/"},
+		{"///evil.com", "/"},
+		{`/\evil.com`, "/"},
+		{`/\/evil.com`, "/"},
+		{"/\t/evil.com", "/"},
+		{"/\n/evil.com", "/"},
+		{"/\x00", "/"},
+		{"/%zz", "/"},
+		{"javascript:alert(1)", "/"},
+		{" /docs", "/"},
+	}
+	for _, tt := range tests {
+		if got := safeNext(tt.next); got != tt.want {
+			t.Errorf("safeNext(%q) = %q, want %q", tt.next, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := hashPassword("correct horse")
+	if hash == again {
+		t.Error("two hashes of the same password are the same, the salt isn't random")
+	}
+	parts := strings.Split(hash, "$")
+	tests := []struct {
+		name, hash, password string
+		want                 bool
+	}{
+		{"right password", hash, "correct horse", true},
+		{"wrong password", hash, "correct horse ", false},
+		{"empty password", hash, "", false},
+		{"empty hash", "", "correct horse", false},
+		{"other algorithm", strings.Replace(hash, "pbkdf2-sha256", "pbkdf2-sha1", 1), "correct horse", false},
+		{"fewer iterations", strings.Join([]string{parts[0], "1", parts[2], parts[3]}, "$"), "correct horse", false},
+		{"no iterations", strings.Join([]string{parts[0], "0", parts[2], parts[3]}, "$"), "correct horse", false},
+		{"bad salt", strings.Join([]string{parts[0], parts[1], "!", parts[3]}, "$"), "correct horse", false},
+		{"missing part", strings.Join(parts[:3], "$"), "correct horse", false},
+		{"plain text", "correct horse", "correct horse", false},
+	}
+	for _, tt := range tests {
+		if got := checkPassword(tt.hash, tt.password); got != tt.want {
+			t.Errorf("%s: checkPassword = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRoleAllows(t *testing.T) {
+	tests := []struct {
+		role, need string
+		want       bool
+	}{
+		{roleAdmin, roleAdmin, true},
+		{roleAdmin, roleViewer, true},
+		{roleUploader, roleViewer, true},
+		{roleUploader, roleAdmin, false},
+		{roleViewer, roleUploader, false},
+		{"", roleViewer, false},
+		{"root", roleViewer, false},
+	}
+	for _, tt := range tests {
+		if got := roleAllows(tt.role, tt.need); got != tt.want {
+			t.Errorf("roleAllows(%q, %q) = %v, want %v", tt.role, tt.need, got, tt.want)
+		}
+	}
+}
+
+// usersForTest keeps accounts in a new state directory for the length of
+// the test, holding the given ones.
+func usersForTest(t *testing.T, accounts ...*user) {
+	t.Helper()
+	s, err := openUsers(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range accounts {
+		s.users[u.Name] = u
+	}
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+	old := users
+	t.Cleanup(func() { users = old })
+	users = s
+}
+
+func TestSessionCookie(t *testing.T) {
+	secretForTest(t)
+	alice := &user{Name: "alice", Role: roleUploader, Hash: "pbkdf2-sha256$1$c2FsdA$aGFzaA"}
+	usersForTest(t, alice, &user{Name: "mallory", Role: roleViewer, Hash: "pbkdf2-sha256$1$c2FsdA$b3RoZXI"})
+
+	w := httptest.NewRecorder()
+	setSession(w, alice)
+	cookie := w.Result().Cookies()[0]
+	name, rest, _ := strings.Cut(cookie.Value, ".")
+	exp, sig, _ := strings.Cut(rest, ".")
+	mallory := base64.RawURLEncoding.EncodeToString([]byte("mallory"))
+	later := strconv.FormatInt(time.Now().Add(365*24*time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	expired := strings.Join([]string{name, past, sessionSignature(alice, time.Now().Add(-time.Minute).Unix())}, ".")
+
+	tests := []struct {
+		name, value string
+		want        string // The user signed in, "" for none
+	}{
+		{"valid", cookie.Value, "alice"},
+		{"other user", strings.Join([]string{mallory, exp, sig}, "."), ""},
+		{"longer expiry", strings.Join([]string{name, later, sig}, "."), ""},
+		{"expired", expired, ""},
+		{"no signature", name + "." + exp + ".", ""},
+		{"garbage", "x", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: tt.value})
+		got := ""
+		if u := sessionUser(r); u != nil {
+			got = u.Name
+		}
+		if got != tt.want {
+			t.Errorf("%s: signed in as %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Changing the password signs every session out.
+	users.lookup("alice").Hash = "pbkdf2-sha256$1$c2FsdA$bmV3"
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	if sessionUser(r) != nil {
+		t.Error("the session still works after the password changed")
+	}
+}
+
+func TestSignedDownloadURL(t *testing.T) {
+	secretForTest(t)
+	signed := func(p string, d time.Duration) *url.URL {
+		u, err := url.Parse(signedDownloadURL("http://192.0.2.1:8080/", p, d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	valid := signed("docs/report 2024.pdf", time.Hour)
+	if valid.Path != "/download/docs/report 2024.pdf" {
+		t.Fatalf("signed URL is for %q", valid.Path)
+	}
+	q := valid.Query()
+	with := func(key, value string) string {
+		q := valid.Query()
+		if value == "" {
+			q.Del(key)
+		} else {
+			q.Set(key, value)
+		}
+		return "?" + q.Encode()
+	}
+	later := strconv.FormatInt(time.Now().Add(365*24*time.Hour).Unix(), 10)
+	secretKey = bytes.Repeat([]byte{8}, 32)
+	otherKey := signed("docs/report 2024.pdf", time.Hour).RawQuery
+	secretForTest(t)
+
+	tests := []struct {
+		name, target string
+		want         bool
+	}{
+		{"valid", valid.EscapedPath() + "?" + valid.RawQuery, true},
+		{"same file, uncleaned path", "/download/docs/./report%202024.pdf?" + valid.RawQuery, true},
+		{"other file", "/download/docs/secret.pdf?" + valid.RawQuery, false},
+		{"other folder", "/download/report%202024.pdf?" + valid.RawQuery, false},
+		{"not a download", "/zip/docs/report%202024.pdf?" + valid.RawQuery, false},
+		{"longer expiry", valid.EscapedPath() + with("exp", later), false},
+		{"no expiry", valid.EscapedPath() + with("exp", ""), false},
+		{"no signature", valid.EscapedPath() + with("sig", ""), false},
+		{"signature cut short", valid.EscapedPath() + with("sig", q.Get("sig")[1:]), false},
+		{"signed with another key", valid.EscapedPath() + "?" + otherKey, false},
+		{"expired", signed("docs/report 2024.pdf", -time.Minute).EscapedPath() + "?" + signed("docs/report 2024.pdf", -time.Minute).RawQuery, false},
+	}
+	for _, tt := range tests {
+		if got := validSignedURL(httptest.NewRequest(http.MethodGet, tt.target, nil)); got != tt.want {
+			t.Errorf("%s: validSignedURL(%s) = %v, want %v", tt.name, tt.target, got, tt.want)
+		}
+	}
+}
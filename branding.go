@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"os"
+)
+
+var (
+	siteTitle string // Replaces "Shared Files" at the top of the page, --title
+	logoFile  string // Image shown above it, --logo
+	themeCSS  string // Stylesheet loaded into every page, --theme-css
+)
+
+// themeHandler serves --theme-css at /theme.css, which every page loads
+// before its own styles, or nothing if there isn't one. Its variables
+// set the colors, as in :root { --background: #ffffff; --text: #112240; }.
+func themeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	if themeCSS == "" {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFile(w, r, themeCSS)
+}
+
+// logoHandler serves --logo at /logo.
+func logoHandler(w http.ResponseWriter, r *http.Request) {
+	if logoFile == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFile(w, r, logoFile)
+}
+
+// checkBranding makes sure the files given for the logo and theme are
+// there, so a typo shows up at startup rather than as a broken page.
+func checkBranding() error {
+	for _, f := range []string{logoFile, themeCSS} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
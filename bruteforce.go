@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Password guessing is slowed down per client IP and account or protected
+// path: after loginMaxFailures wrong passwords in a row for one of them the
+// client is locked out of it, for twice as long each time it happens again,
+// up to loginMaxLockout. A correct password for it, or loginForgetAfter
+// without failures, wipes the slate clean. Signing in to something else,
+// like an account of the client's own, doesn't.
+const (
+	loginMaxFailures = 5
+	loginLockout     = time.Minute
+	loginMaxLockout  = time.Hour
+	loginForgetAfter = 24 * time.Hour
+)
+
+type loginFailures struct {
+	count       int // Failures since the last lockout
+	lockouts    int // Lockouts so far, for the backoff
+	lockedUntil time.Time
+	last        time.Time
+}
+
+type loginGuard struct {
+	mu      sync.Mutex
+	clients map[string]*loginFailures // By loginKey
+}
+
+var logins = &loginGuard{clients: make(map[string]*loginFailures)}
+
+// loginKey is what failures are counted by: the client and what it's trying
+// to get into, an account name, which may be any case with LDAP, or a path.
+func loginKey(ip, what string) string {
+	return ip + "\x00" + strings.ToLower(what)
+}
+
+// blocked returns how much longer ip is locked out of what, or 0.
+func (g *loginGuard) blocked(ip, what string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f := g.clients[loginKey(ip, what)]
+	if f == nil {
+		return 0
+	}
+	return max(time.Until(f.lockedUntil), 0)
+}
+
+// fail records a wrong password from ip for the named account or path.
+func (g *loginGuard) fail(ip, what string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for k, f := range g.clients {
+		if now.Sub(f.last) > loginForgetAfter {
+			delete(g.clients, k)
+		}
+	}
+
+	key := loginKey(ip, what)
+	f := g.clients[key]
+	if f == nil {
+		f = &loginFailures{}
+		g.clients[key] = f
+	}
+	f.count++
+	f.last = now
+	log.Printf("Failed sign-in from %s for %q (%d in a row)", ip, what, f.count)
+	if f.count < loginMaxFailures {
+		return
+	}
+
+	d := loginLockout * time.Duration(math.Pow(2, float64(min(f.lockouts, 10))))
+	d = min(d, loginMaxLockout)
+	f.lockedUntil = now.Add(d)
+	f.lockouts++
+	f.count = 0
+	log.Printf("Locked out %s of %q for %s after %d failed sign-ins", ip, what, d, loginMaxFailures)
+}
+
+// succeed clears the failures of ip for what after a correct password.
+func (g *loginGuard) succeed(ip, what string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.clients, loginKey(ip, what))
+}
+
+// lockoutError returns the message to show when the client of r is locked
+// out of what, setting Retry-After, or "" when it may try a password.
+func lockoutError(w http.ResponseWriter, r *http.Request, what string) string {
+	d := logins.blocked(clientIP(r), what)
+	if d == 0 {
+		return ""
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+	return fmt.Sprintf("Too many failed sign-ins, try again in %s", d.Round(time.Second))
+}
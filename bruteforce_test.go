@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginGuardLocksOutPerTarget(t *testing.T) {
+	g := &loginGuard{clients: make(map[string]*loginFailures)}
+	const ip = "192.0.2.1"
+	for range loginMaxFailures - 1 {
+		g.fail(ip, "alice")
+	}
+	// Signing in to an account of the client's own mustn't reset the
+	// count for the one it's guessing at.
+	g.succeed(ip, "mallory")
+	if d := g.blocked(ip, "alice"); d != 0 {
+		t.Fatalf("locked out after %d failures: %s", loginMaxFailures-1, d)
+	}
+	g.fail(ip, "Alice")
+	if d := g.blocked(ip, "alice"); d <= 0 || d > loginLockout {
+		t.Fatalf("blocked = %s after %d failures, want up to %s", d, loginMaxFailures, loginLockout)
+	}
+	if d := g.blocked(ip, "mallory"); d != 0 {
+		t.Errorf("the lockout spread to another account: %s", d)
+	}
+	if d := g.blocked("192.0.2.2", "alice"); d != 0 {
+		t.Errorf("the lockout spread to another client: %s", d)
+	}
+
+	g.succeed(ip, "alice")
+	if d := g.blocked(ip, "alice"); d != 0 {
+		t.Errorf("still locked out after a correct password: %s", d)
+	}
+}
+
+func TestLoginGuardBacksOff(t *testing.T) {
+	g := &loginGuard{clients: make(map[string]*loginFailures)}
+	const ip, what = "192.0.2.1", "/private"
+	for i, want := range []time.Duration{loginLockout, 2 * loginLockout, 4 * loginLockout} {
+		for range loginMaxFailures {
+			g.fail(ip, what)
+		}
+		if d := g.blocked(ip, what); d <= want/2 || d > want {
+			t.Errorf("lockout %d lasts %s, want %s", i+1, d, want)
+		}
+	}
+	for range 20 * loginMaxFailures {
+		g.fail(ip, what)
+	}
+	if d := g.blocked(ip, what); d > loginMaxLockout {
+		t.Errorf("lockout lasts %s, more than the %s cap", d, loginMaxLockout)
+	}
+}
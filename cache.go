@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	cacheDir     string // Where thumbnails are kept, --cache-dir
+	cacheMaxSize int64  // How big they may get in all, --cache-max-size
+)
+
+// previewCache keeps thumbnails and video stills on disk across restarts.
+// Each is stored under the shared file's path, size and modification time,
+// so once a file changes its old previews are never served again; they're
+// deleted as soon as a new one is made. When the cache grows past its
+// limit, the previews used least recently go first. A file's modification
+// time is when it was last used, which a restart doesn't lose.
+type previewCache struct {
+	mu      sync.Mutex
+	dir     string
+	maxSize int64 // 0 is unlimited
+	size    int64
+}
+
+var previews *previewCache
+
+func openPreviewCache(dir string, maxSize int64) (*previewCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	c := &previewCache{dir: dir, maxSize: maxSize}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if strings.Contains(e.Name(), ".tmp") {
+			os.Remove(filepath.Join(dir, e.Name())) // Left by a crash
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			c.size += info.Size()
+		}
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// previewKey names the preview variant of the shared file name, as it is
+// given info: its first part is the same for every version of the file,
+// and its second changes with it.
+func previewKey(name string, info os.FileInfo, variant string) (file, version string) {
+	sum := sha256.Sum256([]byte(name))
+	ver := sha256.Sum256(fmt.Appendf(nil, "%d\n%d", info.Size(), info.ModTime().UnixNano()))
+	return hex.EncodeToString(sum[:12]), hex.EncodeToString(ver[:6]) + "-" + variant
+}
+
+// get returns the cached preview, if there is one.
+func (c *previewCache) get(file, version string) ([]byte, bool) {
+	p := filepath.Join(c.dir, file+"-"+version)
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return data, true
+}
+
+// put saves a preview, removes those made from earlier versions of the
+// file, and makes room if the cache has grown too big.
+func (c *previewCache) put(file, version string, data []byte) {
+	p := filepath.Join(c.dir, file+"-"+version)
+	tmp := p + ".tmp" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		log.Println("Error caching a preview:", err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if info, err := os.Stat(p); err == nil {
+		c.size -= info.Size()
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		log.Println("Error caching a preview:", err)
+		return
+	}
+	c.size += int64(len(data))
+
+	stale, _ := filepath.Glob(filepath.Join(c.dir, file+"-*"))
+	ver, _, _ := strings.Cut(version, "-")
+	for _, s := range stale {
+		if strings.HasPrefix(filepath.Base(s), file+"-"+ver+"-") || strings.Contains(s, ".tmp") {
+			continue
+		}
+		c.remove(s)
+	}
+	c.evict()
+}
+
+func (c *previewCache) remove(p string) {
+	if info, err := os.Stat(p); err == nil && os.Remove(p) == nil {
+		c.size -= info.Size()
+	}
+}
+
+// evict deletes the least recently used previews until the cache fits in
+// nine tenths of its limit, so it isn't done again for every new preview.
+// c.mu must be held.
+func (c *previewCache) evict() {
+	if c.maxSize <= 0 || c.size <= c.maxSize {
+		return
+	}
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	type entry struct {
+		path string
+		used time.Time
+	}
+	var all []entry
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && !strings.Contains(e.Name(), ".tmp") {
+			all = append(all, entry{filepath.Join(c.dir, e.Name()), info.ModTime()})
+		}
+	}
+	slices.SortFunc(all, func(a, b entry) int { return a.used.Compare(b.used) })
+	for _, e := range all {
+		if c.size <= c.maxSize*9/10 {
+			break
+		}
+		c.remove(e.path)
+	}
+}
@@ -0,0 +1,705 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Videos are cast by having a Chromecast play the file's download URL
+// itself, straight from the server, while the page only sends it play,
+// pause and seek. The server does the talking, over the Cast protocol on
+// port 8009, so it works from any browser, not just Chrome.
+
+// castDevice is a Chromecast, or a TV with one built in, found on the LAN.
+type castDevice struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Model string `json:"model"`
+	addr  string
+}
+
+// castDevices are the Chromecasts last found, by ID, which requests to cast
+// pick from, so they can't point the server at any other address.
+var castDevices = struct {
+	sync.Mutex
+	byID  map[string]castDevice
+	found time.Time
+}{byID: map[string]castDevice{}}
+
+// findCastDevices asks the LAN over mDNS which Chromecasts are there, at
+// most every 15 seconds.
+func findCastDevices() ([]castDevice, error) {
+	castDevices.Lock()
+	defer castDevices.Unlock()
+	if time.Since(castDevices.found) > 15*time.Second {
+		found, err := browseMDNS("_googlecast._tcp.local", 2*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		castDevices.byID = map[string]castDevice{}
+		for _, svc := range found {
+			dev := castDevice{ID: svc.txt["id"], Name: svc.txt["fn"], Model: svc.txt["md"], addr: net.JoinHostPort(svc.ip.String(), fmt.Sprint(svc.port))}
+			if dev.ID == "" {
+				dev.ID = svc.instance
+			}
+			if dev.Name == "" {
+				dev.Name = strings.TrimSuffix(svc.instance, "._googlecast._tcp.local")
+			}
+			castDevices.byID[dev.ID] = dev
+		}
+		castDevices.found = time.Now()
+	}
+	devices := make([]castDevice, 0, len(castDevices.byID))
+	for _, dev := range castDevices.byID {
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+func lookupCastDevice(id string) (castDevice, bool) {
+	castDevices.Lock()
+	defer castDevices.Unlock()
+	dev, ok := castDevices.byID[id]
+	return dev, ok
+}
+
+// mdnsService is an instance of a service that answered an mDNS query.
+type mdnsService struct {
+	instance string
+	ip       net.IP
+	port     int
+	txt      map[string]string
+}
+
+// browseMDNS asks for the instances of service, like _googlecast._tcp.local,
+// and collects the answers that come in within wait. The query comes from
+// a port of its own rather than 5353, so devices answer it directly.
+func browseMDNS(service string, wait time.Duration) ([]mdnsService, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	query := []byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for label := range strings.SplitSeq(service, ".") {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0, 0, 12, 0, 1) // PTR, IN
+	if _, err := conn.WriteToUDP(query, &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}); err != nil {
+		return nil, err
+	}
+
+	services := map[string]*mdnsService{}
+	buf := make([]byte, 9000)
+	conn.SetReadDeadline(time.Now().Add(wait))
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break // The time's up
+		}
+		records, err := parseDNS(buf[:n])
+		if err != nil {
+			continue
+		}
+		// A device's records usually all come in one answer, from its own
+		// address, which is used if it doesn't include an A record.
+		hosts := map[string]net.IP{}
+		for _, rr := range records {
+			if rr.typ == 1 && len(rr.data) == 4 {
+				hosts[rr.name] = net.IP(rr.data)
+			}
+		}
+		get := func(name string) *mdnsService {
+			if services[name] == nil {
+				services[name] = &mdnsService{instance: name, ip: from.IP, port: 8009, txt: map[string]string{}}
+			}
+			return services[name]
+		}
+		for _, rr := range records {
+			switch {
+			case rr.typ == 12 && strings.EqualFold(rr.name, service):
+				get(rr.target)
+			case rr.typ == 33 && strings.HasSuffix(strings.ToLower(rr.name), "."+service):
+				svc := get(rr.name)
+				svc.port = rr.port
+				if ip, ok := hosts[rr.target]; ok {
+					svc.ip = ip
+				}
+			case rr.typ == 16 && strings.HasSuffix(strings.ToLower(rr.name), "."+service):
+				svc := get(rr.name)
+				for _, kv := range rr.txt {
+					k, v, _ := strings.Cut(kv, "=")
+					svc.txt[strings.ToLower(k)] = v
+				}
+			}
+		}
+	}
+	found := make([]mdnsService, 0, len(services))
+	for _, svc := range services {
+		found = append(found, *svc)
+	}
+	return found, nil
+}
+
+// dnsRecord is a resource record from a DNS message, with what's in it for
+// the types mDNS browsing needs: PTR and SRV targets, SRV ports, TXT
+// strings and A addresses.
+type dnsRecord struct {
+	name   string
+	typ    uint16
+	data   []byte
+	target string
+	port   int
+	txt    []string
+}
+
+var errBadDNS = errors.New("malformed DNS message")
+
+// parseDNS returns the records in all the sections of the DNS message msg.
+func parseDNS(msg []byte) ([]dnsRecord, error) {
+	if len(msg) < 12 {
+		return nil, errBadDNS
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	count := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	off := 12
+	for range questions {
+		_, n, err := dnsName(msg, off)
+		if err != nil || n+4 > len(msg) {
+			return nil, errBadDNS
+		}
+		off = n + 4
+	}
+	var records []dnsRecord
+	for range count {
+		name, n, err := dnsName(msg, off)
+		if err != nil || n+10 > len(msg) {
+			return nil, errBadDNS
+		}
+		rr := dnsRecord{name: name, typ: binary.BigEndian.Uint16(msg[n:])}
+		size := int(binary.BigEndian.Uint16(msg[n+8:]))
+		off = n + 10
+		if off+size > len(msg) {
+			return nil, errBadDNS
+		}
+		rr.data = msg[off : off+size]
+		switch rr.typ {
+		case 12:
+			rr.target, _, err = dnsName(msg, off)
+		case 33:
+			if size < 6 {
+				return nil, errBadDNS
+			}
+			rr.port = int(binary.BigEndian.Uint16(msg[off+4:]))
+			rr.target, _, err = dnsName(msg, off+6)
+		case 16:
+			for d := rr.data; len(d) > 0 && int(d[0]) < len(d); d = d[1+d[0]:] {
+				rr.txt = append(rr.txt, string(d[1:1+d[0]]))
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rr)
+		off += size
+	}
+	return records, nil
+}
+
+// dnsName reads the possibly compressed name at off in msg, returning it
+// and where what follows it starts.
+func dnsName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errBadDNS
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case length&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, errBadDNS
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errBadDNS
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+// The Cast protocol's namespaces, and the app every Chromecast has that
+// plays a media URL.
+const (
+	castConnection = "urn:x-cast:com.google.cast.tp.connection"
+	castHeartbeat  = "urn:x-cast:com.google.cast.tp.heartbeat"
+	castReceiver   = "urn:x-cast:com.google.cast.receiver"
+	castMedia      = "urn:x-cast:com.google.cast.media"
+	castMediaApp   = "CC1AD845"
+)
+
+// castStatus is what a Chromecast says it's playing.
+type castStatus struct {
+	State    string  `json:"state"` // starting, buffering, playing, paused or stopped
+	Title    string  `json:"title"`
+	Time     float64 `json:"time"`
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+	at       time.Time
+}
+
+// castSession is the server's connection to one Chromecast.
+type castSession struct {
+	dev  castDevice
+	conn net.Conn
+
+	mu           sync.Mutex // Guards the rest, and writes to conn
+	requestID    int
+	transport    string // The media app's connection, once it's running
+	launched     chan struct{}
+	mediaSession int
+	status       castStatus
+	closed       bool
+}
+
+var castSessions = struct {
+	sync.Mutex
+	byDevice map[string]*castSession
+}{byDevice: map[string]*castSession{}}
+
+// castTo returns the session with dev, connecting to it if there isn't one.
+func castTo(dev castDevice) (*castSession, error) {
+	castSessions.Lock()
+	defer castSessions.Unlock()
+	if s := castSessions.byDevice[dev.ID]; s != nil && !s.isClosed() {
+		return s, nil
+	}
+	// Chromecasts' certificates are Google's, for the device rather than
+	// its address, so there's nothing to check them against.
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", dev.addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return nil, err
+	}
+	s := &castSession{dev: dev, conn: conn, launched: make(chan struct{})}
+	castSessions.byDevice[dev.ID] = s
+	s.send("receiver-0", castConnection, map[string]any{"type": "CONNECT"})
+	go s.read()
+	go s.heartbeat()
+	return s, nil
+}
+
+func (s *castSession) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *castSession) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.conn.Close()
+	castSessions.Lock()
+	if castSessions.byDevice[s.dev.ID] == s {
+		delete(castSessions.byDevice, s.dev.ID)
+	}
+	castSessions.Unlock()
+}
+
+// send writes a message with payload, given a requestId, to dest.
+func (s *castSession) send(dest, namespace string, payload map[string]any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sendLocked(dest, namespace, payload)
+}
+
+// sendLocked must be called with s.mu held.
+func (s *castSession) sendLocked(dest, namespace string, payload map[string]any) error {
+	if namespace != castConnection && namespace != castHeartbeat {
+		s.requestID++
+		payload["requestId"] = s.requestID
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err = s.conn.Write(castFrame("sender-0", dest, namespace, string(data)))
+	return err
+}
+
+// heartbeat pings the Chromecast, which drops connections that go quiet,
+// and asks what's playing every few seconds, until the session closes.
+func (s *castSession) heartbeat() {
+	for !s.isClosed() {
+		if err := s.send("receiver-0", castHeartbeat, map[string]any{"type": "PING"}); err != nil {
+			s.close()
+			return
+		}
+		s.mu.Lock()
+		if s.transport != "" {
+			s.sendLocked(s.transport, castMedia, map[string]any{"type": "GET_STATUS"})
+		}
+		s.mu.Unlock()
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// read handles the Chromecast's messages until the connection drops.
+func (s *castSession) read() {
+	defer s.close()
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		_, namespace, payload, err := readCastFrame(s.conn)
+		if err != nil {
+			if !s.isClosed() && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Lost the connection to %s: %v", s.dev.Name, err)
+			}
+			return
+		}
+		var msg struct {
+			Type   string
+			Reason string
+			Status json.RawMessage
+		}
+		if json.Unmarshal([]byte(payload), &msg) != nil {
+			continue
+		}
+		switch {
+		case msg.Type == "PING":
+			s.send("receiver-0", castHeartbeat, map[string]any{"type": "PONG"})
+		case msg.Type == "RECEIVER_STATUS":
+			s.receiverStatus(msg.Status)
+		case msg.Type == "MEDIA_STATUS":
+			s.mediaStatus(msg.Status)
+		case msg.Type == "LOAD_FAILED" || msg.Type == "LOAD_CANCELLED" || msg.Type == "INVALID_REQUEST":
+			s.mu.Lock()
+			s.status.State, s.status.Error = "stopped", "The Chromecast couldn't play it"
+			s.mu.Unlock()
+		case msg.Type == "CLOSE" && namespace == castConnection:
+			s.mu.Lock()
+			s.transport, s.mediaSession = "", 0
+			s.status.State = "stopped"
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *castSession) receiverStatus(raw json.RawMessage) {
+	var status struct {
+		Applications []struct {
+			AppID       string
+			TransportID string
+		}
+	}
+	json.Unmarshal(raw, &status)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, app := range status.Applications {
+		if app.AppID != castMediaApp {
+			continue
+		}
+		if app.TransportID != s.transport {
+			s.transport = app.TransportID
+			s.sendLocked(s.transport, castConnection, map[string]any{"type": "CONNECT"})
+		}
+		select {
+		case <-s.launched:
+		default:
+			close(s.launched)
+		}
+		return
+	}
+	// Something else was cast to it since.
+	if s.transport != "" {
+		s.transport, s.mediaSession = "", 0
+		s.status.State = "stopped"
+		s.launched = make(chan struct{})
+	}
+}
+
+func (s *castSession) mediaStatus(raw json.RawMessage) {
+	var status []struct {
+		MediaSessionID int
+		PlayerState    string
+		IdleReason     string
+		CurrentTime    float64
+		Media          *struct{ Duration float64 }
+	}
+	if json.Unmarshal(raw, &status) != nil || len(status) == 0 {
+		return
+	}
+	st := status[0]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mediaSession = st.MediaSessionID
+	s.status.State = strings.ToLower(st.PlayerState)
+	s.status.Time, s.status.at = st.CurrentTime, time.Now()
+	if st.Media != nil && st.Media.Duration > 0 {
+		s.status.Duration = st.Media.Duration
+	}
+	switch st.IdleReason {
+	case "":
+	case "ERROR":
+		s.status.State, s.status.Error = "stopped", "The Chromecast couldn't play it"
+	default: // Finished, or stopped from the TV's remote
+		s.status.State = "stopped"
+	}
+}
+
+// play has the Chromecast start the media app, if it isn't running, and
+// play the file at url from the start.
+func (s *castSession) play(url, ctype, title string) error {
+	s.mu.Lock()
+	launched := s.launched
+	s.status = castStatus{State: "starting", Title: title, at: time.Now()}
+	s.mediaSession = 0
+	err := s.sendLocked("receiver-0", castReceiver, map[string]any{"type": "LAUNCH", "appId": castMediaApp})
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	select {
+	case <-launched:
+	case <-time.After(20 * time.Second):
+		return errors.New("the Chromecast didn't start its player")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sendLocked(s.transport, castMedia, map[string]any{
+		"type": "LOAD",
+		"media": map[string]any{
+			"contentId":   url,
+			"contentType": ctype,
+			"streamType":  "BUFFERED",
+			"metadata":    map[string]any{"metadataType": 0, "title": title},
+		},
+		"autoplay":    true,
+		"currentTime": 0,
+	})
+}
+
+// control sends play, pause, stop or a seek to the given seconds in.
+func (s *castSession) control(action string, seconds float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.transport == "" || s.mediaSession == 0 {
+		return errors.New("nothing is playing")
+	}
+	msg := map[string]any{"type": strings.ToUpper(action), "mediaSessionId": s.mediaSession}
+	if action == "seek" {
+		msg["currentTime"] = seconds
+	}
+	return s.sendLocked(s.transport, castMedia, msg)
+}
+
+// currentStatus is the last status, moved on by the time since if it's
+// playing, as Chromecasts only say when something changes.
+func (s *castSession) currentStatus() castStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.status
+	if st.State == "playing" {
+		st.Time += time.Since(st.at).Seconds()
+		if st.Duration > 0 {
+			st.Time = min(st.Time, st.Duration)
+		}
+	}
+	return st
+}
+
+// castFrame is a Cast message: a CastMessage protobuf with a string
+// payload, after its length.
+func castFrame(source, dest, namespace, payload string) []byte {
+	str := func(b []byte, field int, s string) []byte {
+		b = binary.AppendUvarint(b, uint64(field<<3|2))
+		b = binary.AppendUvarint(b, uint64(len(s)))
+		return append(b, s...)
+	}
+	m := []byte{1 << 3, 0} // protocol_version CASTV2_1_0
+	m = str(m, 2, source)
+	m = str(m, 3, dest)
+	m = str(m, 4, namespace)
+	m = append(m, 5<<3, 0) // payload_type STRING
+	m = str(m, 6, payload)
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(m))), m...)
+}
+
+// readCastFrame reads a Cast message, returning who it's from, its
+// namespace and its payload.
+func readCastFrame(r io.Reader) (source, namespace, payload string, err error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return "", "", "", err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > 64<<10 {
+		return "", "", "", errors.New("cast message too large")
+	}
+	m := make([]byte, n)
+	if _, err := io.ReadFull(r, m); err != nil {
+		return "", "", "", err
+	}
+	for len(m) > 0 {
+		key, k := binary.Uvarint(m)
+		if k <= 0 {
+			return "", "", "", errors.New("malformed cast message")
+		}
+		m = m[k:]
+		switch key & 7 {
+		case 0:
+			_, k = binary.Uvarint(m)
+			if k <= 0 {
+				return "", "", "", errors.New("malformed cast message")
+			}
+			m = m[k:]
+		case 2:
+			l, k := binary.Uvarint(m)
+			if k <= 0 || l > uint64(len(m)-k) {
+				return "", "", "", errors.New("malformed cast message")
+			}
+			v := string(m[k : k+int(l)])
+			m = m[k+int(l):]
+			switch key >> 3 {
+			case 2:
+				source = v
+			case 4:
+				namespace = v
+			case 6:
+				payload = v
+			}
+		default:
+			return "", "", "", errors.New("malformed cast message")
+		}
+	}
+	return source, namespace, payload, nil
+}
+
+// apiCastHandler casts videos to Chromecasts on the LAN:
+//
+//	GET  /api/cast/devices              the Chromecasts found
+//	POST /api/cast {"device": ID, "path": "films/a.mp4"}   plays the file on one
+//	POST /api/cast/control {"device": ID, "action": "pause"}   play, pause, stop, or seek with "time" in seconds
+//	GET  /api/cast/status?device=ID     {"state": "playing", "time": 12.5, "duration": 5400, ...}
+//
+// The Chromecast fetches the file from the server itself, so it plays at
+// full quality whatever the phone or laptop that cast it is doing.
+func apiCastHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/cast/devices":
+		devices, err := findCastDevices()
+		if err != nil {
+			http.Error(w, "Error looking for Chromecasts: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, devices)
+	case "/api/cast/status":
+		castSessions.Lock()
+		s := castSessions.byDevice[r.URL.Query().Get("device")]
+		castSessions.Unlock()
+		if s == nil {
+			writeJSON(w, http.StatusOK, castStatus{State: "stopped"})
+			return
+		}
+		writeJSON(w, http.StatusOK, s.currentStatus())
+	case "/api/cast", "/api/cast/control":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Device string  `json:"device"`
+			Path   string  `json:"path"`
+			Action string  `json:"action"`
+			Time   float64 `json:"time"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "Expected JSON with the device", http.StatusBadRequest)
+			return
+		}
+		dev, ok := lookupCastDevice(req.Device)
+		if !ok {
+			http.Error(w, "No such Chromecast", http.StatusNotFound)
+			return
+		}
+		if r.URL.Path == "/api/cast" {
+			castFile(w, r, dev, req.Path)
+			return
+		}
+		switch req.Action {
+		case "play", "pause", "stop", "seek":
+		default:
+			http.Error(w, "The action can be play, pause, stop or seek", http.StatusBadRequest)
+			return
+		}
+		castSessions.Lock()
+		s := castSessions.byDevice[dev.ID]
+		castSessions.Unlock()
+		if s == nil {
+			http.Error(w, "Nothing is being cast to "+dev.Name, http.StatusConflict)
+			return
+		}
+		if err := s.control(req.Action, req.Time); err != nil {
+			http.Error(w, "Error controlling "+dev.Name+": "+err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// castFile has dev play the shared file name.
+func castFile(w http.ResponseWriter, r *http.Request, dev castDevice, name string) {
+	name, ok := safeSharePath(name)
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if _, locked := lockedBy(r, name); locked {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	info, err := statShared(name)
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	s, err := castTo(dev)
+	if err == nil {
+		err = s.play(deviceDownloadURL(name), mediaType(sharedFileType(name)), path.Base(name))
+	}
+	if err != nil {
+		log.Printf("Error casting %s to %s: %v", name, dev.Name, err)
+		http.Error(w, "Error casting to "+dev.Name+": "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	log.Printf("Casting %s to %s, for %s", name, dev.Name, clientIP(r))
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxChatMessages = 100 // Kept for people who join later
+	maxChatLength   = 500 // Runes
+	maxChatName     = 30
+)
+
+// chatEnabled adds the chat panel to the file list, --chat.
+var chatEnabled bool
+
+// chatMessage is one line said in the chat.
+type chatMessage struct {
+	From string    `json:"from"`
+	Text string    `json:"text"`
+	At   time.Time `json:"at"`
+}
+
+// chat holds the latest messages in a ring, only in memory: the chat is
+// for coordinating while the share is up, not a record.
+var chat struct {
+	sync.Mutex
+	ring  [maxChatMessages]chatMessage
+	next  int // Where the next message goes
+	count int
+}
+
+var chatHub wsHub
+
+// chatHistory returns the messages kept, oldest first.
+func chatHistory() []chatMessage {
+	chat.Lock()
+	defer chat.Unlock()
+	list := make([]chatMessage, 0, chat.count)
+	for i := range chat.count {
+		list = append(list, chat.ring[(chat.next-chat.count+i+maxChatMessages)%maxChatMessages])
+	}
+	return list
+}
+
+func addChatMessage(m chatMessage) {
+	chat.Lock()
+	chat.ring[chat.next] = m
+	chat.next = (chat.next + 1) % maxChatMessages
+	chat.count = min(chat.count+1, maxChatMessages)
+	chat.Unlock()
+	data, _ := json.Marshal(struct {
+		Message chatMessage `json:"message"`
+	}{m})
+	chatHub.broadcast(string(data))
+}
+
+// chatName is who a message from r is shown as: their account when
+// signing in, or else the name they gave, or else their address.
+func chatName(r *http.Request, given string) string {
+	if name := uploaderName(r); name != "" {
+		return name
+	}
+	given = strings.TrimSpace(given)
+	if given == "" || utf8.RuneCountInString(given) > maxChatName {
+		return clientIP(r)
+	}
+	return given
+}
+
+// chatSocketHandler is the chat panel's WebSocket. It's sent
+// {"messages": [...]}, oldest first, as soon as it connects, then
+// {"message": {...}} for each one said, and sends
+// {"text": "...", "name": "..."} to say something.
+func chatSocketHandler(w http.ResponseWriter, r *http.Request) {
+	if !chatEnabled {
+		http.NotFound(w, r)
+		return
+	}
+	c, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go c.keepAlive(done)
+
+	chatHub.add(c)
+	defer chatHub.remove(c)
+	data, _ := json.Marshal(struct {
+		Messages []chatMessage `json:"messages"`
+	}{chatHistory()})
+	if c.writeMessage(string(data)) != nil {
+		return
+	}
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return
+		}
+		var req struct {
+			Text string `json:"text"`
+			Name string `json:"name"`
+		}
+		if json.Unmarshal([]byte(msg), &req) != nil || !canTag(r) {
+			continue
+		}
+		text := strings.TrimSpace(req.Text)
+		if text == "" || utf8.RuneCountInString(text) > maxChatLength {
+			continue
+		}
+		addChatMessage(chatMessage{From: chatName(r, req.Name), Text: text, At: time.Now()})
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checksum is a file's SHA-256, along with the size and modification time
+// it had then, so it's worked out again once the file changes.
+type checksum struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256"`
+}
+
+// checksumStore keeps the SHA-256 of shared files by share path, saved to
+// the state directory so big files aren't read again after a restart. A
+// background worker works them out for files that have been listed.
+type checksumStore struct {
+	mu      sync.Mutex
+	path    string
+	sums    map[string]checksum
+	running map[string]chan struct{} // Closed when the file has been read
+	queued  map[string]bool
+	queue   chan string
+	saving  bool       // A save is due
+	saveMu  sync.Mutex // Held while writing the file
+}
+
+// checksumSaveDelay is how long new checksums wait to be saved, so hashing
+// a whole share writes the file every so often rather than for each file.
+const checksumSaveDelay = 5 * time.Second
+
+var checksums *checksumStore
+
+func openChecksums(dir string) (*checksumStore, error) {
+	c := &checksumStore{
+		path:    filepath.Join(dir, "checksums.json"),
+		sums:    make(map[string]checksum),
+		running: make(map[string]chan struct{}),
+		queued:  make(map[string]bool),
+		queue:   make(chan string, 1000),
+	}
+	go c.work()
+	data, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.sums); err != nil {
+		// They can all be worked out again.
+		log.Println("Ignoring unreadable checksums:", err)
+		c.sums = make(map[string]checksum)
+	}
+	return c, nil
+}
+
+// save has the checksums saved in a while, if that isn't due already. It
+// must be called with c.mu held.
+func (c *checksumStore) save() {
+	if !c.saving {
+		c.saving = true
+		time.AfterFunc(checksumSaveDelay, c.flush)
+	}
+}
+
+// flush saves the checksums now.
+func (c *checksumStore) flush() {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+	c.mu.Lock()
+	c.saving = false
+	data, err := json.Marshal(c.sums)
+	c.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(c.path, data)
+	}
+	if err != nil {
+		log.Println("Error saving checksums:", err)
+	}
+}
+
+// known returns the SHA-256 of the shared file p if it has been worked out
+// since the file last changed, or else queues it and returns "".
+func (c *checksumStore) known(p string) string {
+	info, err := statShared(p)
+	if err != nil || info.IsDir() {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.sums[p]; ok && s.Size == info.Size() && s.ModTime.Equal(info.ModTime()) {
+		return s.SHA256
+	}
+	if !c.queued[p] && c.running[p] == nil {
+		select {
+		case c.queue <- p:
+			c.queued[p] = true
+		default: // Busy, it'll be asked for again
+		}
+	}
+	return ""
+}
+
+func (c *checksumStore) work() {
+	for p := range c.queue {
+		c.mu.Lock()
+		delete(c.queued, p)
+		c.mu.Unlock()
+		if _, err := c.sum(context.Background(), p); err != nil {
+			log.Printf("Error working out the checksum of %s: %v", p, err)
+		}
+	}
+}
+
+// sum returns the SHA-256 of the shared file p, reading it if need be.
+func (c *checksumStore) sum(ctx context.Context, p string) (string, error) {
+	for {
+		info, err := statShared(p)
+		if err != nil {
+			return "", err
+		}
+		c.mu.Lock()
+		if s, ok := c.sums[p]; ok && s.Size == info.Size() && s.ModTime.Equal(info.ModTime()) {
+			c.mu.Unlock()
+			return s.SHA256, nil
+		}
+		if done := c.running[p]; done != nil {
+			// Someone else is reading it, wait and look again.
+			c.mu.Unlock()
+			select {
+			case <-done:
+				continue
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+		done := make(chan struct{})
+		c.running[p] = done
+		c.mu.Unlock()
+
+		sum, err := hashShared(p)
+		c.mu.Lock()
+		if err == nil {
+			c.sums[p] = checksum{info.Size(), info.ModTime(), sum}
+			c.save()
+		}
+		delete(c.running, p)
+		close(done)
+		c.mu.Unlock()
+		return sum, err
+	}
+}
+
+// checksumsHandler streams a manifest of /checksums/PATH, or of the whole
+// share, in the format of sha256sum, so a folder that's been downloaded can
+// be checked with sha256sum -c. Paths are relative to the folder.
+func checksumsHandler(w http.ResponseWriter, r *http.Request) {
+	dir, ok := safeSharePath(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/checksums"), "/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if p, locked := lockedBy(r, dir); locked {
+		redirectToUnlock(w, r, p)
+		return
+	}
+	files, err := listFiles(dir)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rc := http.NewResponseController(w)
+	for _, name := range files {
+		name = filepath.ToSlash(name)
+		p := path.Join(dir, name)
+		if strings.HasSuffix(name, "/") {
+			continue // A folder past --max-depth
+		}
+		if _, locked := lockedBy(r, p); locked {
+			continue
+		}
+		sum, err := checksums.sum(r.Context(), p)
+		if r.Context().Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Error working out the checksum of %s: %v", p, err)
+			continue
+		}
+		fmt.Fprintln(w, sha256sumLine(sum, name))
+		rc.Flush()
+	}
+}
+
+// sha256sumLine formats a line of sha256sum's output. Like sha256sum, it
+// escapes names with backslashes or line breaks and marks the line with a
+// leading backslash.
+func sha256sumLine(sum, name string) string {
+	if !strings.ContainsAny(name, "\\\n\r") {
+		return sum + "  " + name
+	}
+	name = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`).Replace(name)
+	return `\` + sum + "  " + name
+}
+
+// record saves sum as the SHA-256 of the shared file p, just written by an
+// upload that worked it out on the way in.
+func (c *checksumStore) record(p, sum string) {
+	info, err := statShared(p)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sums[p] = checksum{info.Size(), info.ModTime(), sum}
+	c.save()
+}
+
+// parseSHA256 reads a SHA-256 a client sent, in hex or base64, and returns
+// it in hex.
+func parseSHA256(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if b, err := hex.DecodeString(s); err == nil && len(b) == sha256.Size {
+		return strings.ToLower(s), true
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == sha256.Size {
+		return hex.EncodeToString(b), true
+	}
+	return "", false
+}
+
+// checksumMismatchError is returned for an upload that doesn't match the
+// SHA-256 the client sent with it.
+type checksumMismatchError struct{ name, got, want string }
+
+func (e *checksumMismatchError) Error() string {
+	return fmt.Sprintf("%s doesn't match its checksum: it arrived with SHA-256 %s, not %s; upload it again", e.name, e.got, e.want)
+}
+
+// hashingReader works out the SHA-256 of an upload as it's read. With want
+// set, the upload fails at the end if it doesn't match, before whatever it's
+// being saved by can put it in place. late, if set, gives want once the
+// upload has been read, for a checksum sent after it as a trailer.
+type hashingReader struct {
+	r    io.Reader
+	h    hash.Hash
+	name string
+	want string
+	late func() (string, error)
+}
+
+func newHashingReader(r io.Reader, name, want string) *hashingReader {
+	return &hashingReader{r: r, h: sha256.New(), name: name, want: want}
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.h.Write(p[:n])
+	if err == io.EOF && h.want == "" && h.late != nil {
+		var lerr error
+		if h.want, lerr = h.late(); lerr != nil {
+			return n, lerr
+		}
+	}
+	if err == io.EOF && h.want != "" && h.want != h.sum() {
+		return n, &checksumMismatchError{h.name, h.sum(), h.want}
+	}
+	return n, err
+}
+
+func (h *hashingReader) sum() string {
+	return hex.EncodeToString(h.h.Sum(nil))
+}
+
+func hashShared(p string) (string, error) {
+	f, err := openShared(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if g, ok := f.(growingFile); ok && g.growing() {
+		return "", errors.New("the file is still being written")
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
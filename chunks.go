@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Large files are uploaded in chunks, each its own request, so a dropped
+// connection costs one chunk rather than the whole file and no request has
+// to be bigger than a chunk:
+//
+//	POST   /upload/chunked            {"dir", "name", "size"} → {"id", "chunk_size", "transfer"}
+//	PUT    /upload/chunked/ID/N       bytes of chunk N, optionally with X-Chunk-SHA256
+//	GET    /upload/chunked/ID         → {"received": [N, ...]}, to resume
+//	POST   /upload/chunked/ID/finish  {"sha256"} → {"saved"}
+//	DELETE /upload/chunked/ID         gives up
+//
+// Chunks can come in any order and are put together in a temporary file,
+// which is checked against the optional SHA-256 of the whole file before
+// being stored in the share.
+const (
+	defaultChunkSize = 8 << 20
+	maxChunkSize     = 64 << 20
+	chunkIdleTimeout = time.Hour // Uploads untouched for this long are abandoned
+)
+
+type chunkSession struct {
+	ID        string
+	Dir       string // Share folder the file goes into
+	Name      string
+	Size      int64
+	ChunkSize int64
+	owner     string // User name, "" without accounts
+	quota     string // Client the size is reserved against, "" without a quota
+
+	mu       sync.Mutex
+	file     *os.File
+	received []bool
+	updated  time.Time
+	t        *transfer
+}
+
+func (s *chunkSession) chunks() int {
+	return int(max((s.Size+s.ChunkSize-1)/s.ChunkSize, 1))
+}
+
+var (
+	chunkSessionsMu sync.Mutex
+	chunkSessions   = map[string]*chunkSession{}
+)
+
+func init() {
+	go func() {
+		for range time.Tick(time.Minute) {
+			expireChunkSessions(time.Now().Add(-chunkIdleTimeout))
+		}
+	}()
+}
+
+// expireChunkSessions drops uploads nothing has happened to since before.
+func expireChunkSessions(before time.Time) {
+	chunkSessionsMu.Lock()
+	var stale []*chunkSession
+	for _, s := range chunkSessions {
+		s.mu.Lock()
+		if s.updated.Before(before) {
+			stale = append(stale, s)
+		}
+		s.mu.Unlock()
+	}
+	chunkSessionsMu.Unlock()
+	for _, s := range stale {
+		log.Printf("Abandoning chunked upload of %s after %s without activity", s.Name, chunkIdleTimeout)
+		endChunkSession(s, false)
+	}
+}
+
+// endChunkSession forgets s and removes its temporary file.
+func endChunkSession(s *chunkSession, saved bool) {
+	chunkSessionsMu.Lock()
+	delete(chunkSessions, s.ID)
+	chunkSessionsMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+		s.file = nil
+	}
+	if !saved {
+		// Expect more than was received, which makes the transfer a failed one.
+		s.t.size.Store(s.t.bytes.Load() + 1)
+	}
+	if s.quota != "" {
+		quotas.settle(s.quota, s.Size, saved)
+		s.quota = ""
+	}
+	transfers.finish(s.t)
+}
+
+// uploaderName returns who is signed in to r, "" without accounts.
+func uploaderName(r *http.Request) string {
+	if u := currentUser(r); u != nil {
+		return u.Name
+	}
+	return ""
+}
+
+// chunkedUploadHandler serves /upload/chunked and everything under it.
+func chunkedUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !uploadsEnabled {
+		http.NotFound(w, r)
+		return
+	}
+	if !hasRole(r, roleUploader) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/upload/chunked"), "/")
+	if rest == "" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		startChunkedUpload(w, r)
+		return
+	}
+
+	id, action, _ := strings.Cut(rest, "/")
+	chunkSessionsMu.Lock()
+	s := chunkSessions[id]
+	chunkSessionsMu.Unlock()
+	if s == nil || s.owner != uploaderName(r) {
+		http.Error(w, "No such upload, it may have expired", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		s.mu.Lock()
+		received := []int{}
+		for n, ok := range s.received {
+			if ok {
+				received = append(received, n)
+			}
+		}
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]any{"id": s.ID, "chunk_size": s.ChunkSize, "transfer": s.t.ID, "received": received})
+	case action == "" && r.Method == http.MethodDelete:
+		endChunkSession(s, false)
+		w.WriteHeader(http.StatusNoContent)
+	case action == "finish" && r.Method == http.MethodPost:
+		finishChunkedUpload(w, r, s)
+	case action != "finish" && r.Method == http.MethodPut:
+		n, err := strconv.Atoi(action)
+		if err != nil || n < 0 || n >= s.chunks() {
+			http.Error(w, "Invalid chunk number", http.StatusBadRequest)
+			return
+		}
+		putChunk(w, r, s, n)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func startChunkedUpload(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Dir       string `json:"dir"`
+		Name      string `json:"name"`
+		Size      int64  `json:"size"`
+		ChunkSize int64  `json:"chunk_size"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil || req.Size < 0 {
+		http.Error(w, "Expected JSON with dir, name and size", http.StatusBadRequest)
+		return
+	}
+	dir, ok := safeSharePath(req.Dir)
+	fsys, _, writable := uploadTarget(dir)
+	if !ok || !writable {
+		http.Error(w, "Uploads aren't allowed in that folder", http.StatusForbidden)
+		return
+	}
+	name, ok := uploadName(req.Name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Can't accept a file named %q", req.Name), http.StatusBadRequest)
+		return
+	}
+	if msg := tooLargeMessage(r, req.Size); msg != "" {
+		uploadTooLarge(w, r, msg)
+		return
+	}
+	// Chunks wait in the temporary folder until they're all in.
+	if msg := cmp.Or(spaceMessage(fsys, req.Size), tempSpaceMessage(req.Size)); msg != "" {
+		uploadTooLarge(w, r, msg)
+		return
+	}
+	// The whole file is held against the quota from the start, so uploads
+	// in parallel can't get past it together.
+	quota := ""
+	if uploadQuota > 0 {
+		quota = quotaClient(r)
+		if !quotas.reserve(quota, req.Size) {
+			uploadTooLarge(w, r, quotaMessage(quotas.left(quota)))
+			return
+		}
+	}
+	if req.ChunkSize <= 0 {
+		req.ChunkSize = defaultChunkSize
+	}
+	req.ChunkSize = min(req.ChunkSize, maxChunkSize)
+
+	f, err := os.CreateTemp("", "lanshare-chunks-*")
+	if err != nil {
+		if quota != "" {
+			quotas.settle(quota, req.Size, false)
+		}
+		http.Error(w, "Error starting upload", http.StatusInternalServerError)
+		return
+	}
+	s := &chunkSession{
+		ID:        rand.Text(),
+		Dir:       dir,
+		Name:      name,
+		Size:      req.Size,
+		ChunkSize: req.ChunkSize,
+		owner:     uploaderName(r),
+		quota:     quota,
+		file:      f,
+		updated:   time.Now(),
+	}
+	s.received = make([]bool, s.chunks())
+	// The transfer outlives this request, it ends with the finish request.
+	s.t = transfers.start(context.Background(), r, "upload", strings.TrimPrefix(dir+"/"+name, "/"), req.Size)
+
+	chunkSessionsMu.Lock()
+	chunkSessions[s.ID] = s
+	chunkSessionsMu.Unlock()
+	writeJSON(w, http.StatusCreated, map[string]any{"id": s.ID, "chunk_size": s.ChunkSize, "transfer": s.t.ID})
+}
+
+func putChunk(w http.ResponseWriter, r *http.Request, s *chunkSession, n int) {
+	if s.t.ctx.Err() != nil {
+		endChunkSession(s, false)
+		http.Error(w, "Upload cancelled", http.StatusGone)
+		return
+	}
+	want := min(s.ChunkSize, s.Size-int64(n)*s.ChunkSize)
+	if r.ContentLength >= 0 && r.ContentLength != want {
+		http.Error(w, fmt.Sprintf("Chunk %d should be %d bytes", n, want), http.StatusBadRequest)
+		return
+	}
+	// Read the chunk before writing any of it, so a broken request or wrong
+	// checksum leaves what was there before.
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, want))
+	var tooLong *http.MaxBytesError
+	if errors.As(err, &tooLong) {
+		http.Error(w, fmt.Sprintf("Chunk %d should be %d bytes", n, want), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error reading chunk", http.StatusBadRequest)
+		return
+	}
+	if int64(len(data)) != want {
+		http.Error(w, fmt.Sprintf("Chunk %d should be %d bytes", n, want), http.StatusBadRequest)
+		return
+	}
+	if sum := r.Header.Get("X-Chunk-SHA256"); sum != "" {
+		got := sha256.Sum256(data)
+		if subtle.ConstantTimeCompare([]byte(strings.ToLower(sum)), []byte(hex.EncodeToString(got[:]))) != 1 {
+			http.Error(w, fmt.Sprintf("Chunk %d doesn't match its checksum", n), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		http.Error(w, "No such upload, it may have expired", http.StatusNotFound)
+		return
+	}
+	if _, err := s.file.WriteAt(data, int64(n)*s.ChunkSize); err != nil {
+		log.Println("Error writing chunk:", err)
+		http.Error(w, "Error saving chunk", http.StatusInternalServerError)
+		return
+	}
+	if !s.received[n] {
+		s.t.bytes.Add(want)
+	}
+	s.received[n] = true
+	s.updated = time.Now()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func finishChunkedUpload(w http.ResponseWriter, r *http.Request, s *chunkSession) {
+	var req struct {
+		SHA256 string `json:"sha256"`
+	}
+	json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req)
+	want, ok := "", true
+	if sent := cmp.Or(r.Header.Get(contentSHA256), req.SHA256); sent != "" {
+		if want, ok = parseSHA256(sent); !ok {
+			http.Error(w, "Invalid SHA-256", http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	for n, ok := range s.received {
+		if !ok {
+			s.mu.Unlock()
+			http.Error(w, fmt.Sprintf("Chunk %d is missing", n), http.StatusConflict)
+			return
+		}
+	}
+	f := s.file
+	s.updated = time.Now()
+	s.mu.Unlock()
+	if f == nil {
+		http.Error(w, "No such upload, it may have expired", http.StatusNotFound)
+		return
+	}
+
+	sum := ""
+	if want != "" {
+		h := sha256.New()
+		s.t.setPhase("verifying", s.Size)
+		if _, err := io.Copy(h, s.t.phaseReader(io.NewSectionReader(f, 0, s.Size))); err != nil {
+			http.Error(w, "Error checking upload", http.StatusInternalServerError)
+			return
+		}
+		if sum = hex.EncodeToString(h.Sum(nil)); sum != want {
+			endChunkSession(s, false)
+			http.Error(w, (&checksumMismatchError{s.Name, sum, want}).Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	fsys, rel, ok := uploadTarget(s.Dir)
+	if !ok {
+		endChunkSession(s, false)
+		http.Error(w, "Uploads aren't allowed in that folder", http.StatusForbidden)
+		return
+	}
+	if scanEnabled() {
+		name := strings.TrimPrefix(s.Dir+"/"+s.Name, "/")
+		if err := scanUpload(s.t, f, name); err != nil {
+			endChunkSession(s, false)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	sharePath, fsPath := reserveName(r, fsys, s.Dir, rel, s.Name)
+	kept := keepVersion(r, fsys, sharePath, fsPath)
+	s.t.setPhase("saving", s.Size)
+	hashed := newHashingReader(s.t.phaseReader(io.NewSectionReader(f, 0, s.Size)), s.Name, "")
+	err := fsys.Create(fsPath, hashed, s.Size)
+	kept.done(err == nil)
+	saved, duplicate := sharePath, ""
+	if err == nil {
+		var skipped bool
+		if duplicate, skipped = dedupeSaved(r, fsys, sharePath, fsPath, hashed.sum(), kept != nil); skipped {
+			saved = duplicate
+		} else {
+			checksums.record(sharePath, hashed.sum())
+		}
+	}
+	release(sharePath)
+	endChunkSession(s, err == nil)
+	if err != nil {
+		log.Printf("Error saving upload %s: %v", sharePath, err)
+		http.Error(w, "Error saving "+s.Name, http.StatusInternalServerError)
+		return
+	}
+	if saved != duplicate {
+		log.Printf("Received %s from %s", saved, clientIP(r))
+		shareChanged()
+	}
+	resp := map[string]string{"saved": saved, "sha256": hashed.sum()}
+	if duplicate != "" {
+		resp["already_present"] = duplicate
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// uploadCommand implements the "upload" subcommand, a client sending files
+// to a lanshare server with the chunked protocol, retrying chunks that fail.
+func uploadCommand(args []string) {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	dir := fs.String("dir", "", "folder in the share to upload into")
+	token := fs.String("token", os.Getenv("LANSHARE_TOKEN"), "API token, see lanshare token (also read from $LANSHARE_TOKEN)")
+	auth := fs.String("auth", "", "user:password to sign in with instead of a token")
+	chunkSize := fs.Int64("chunk-size", defaultChunkSize, "bytes per request")
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fmt.Fprintln(fs.Output(), "Usage: upload [options] URL file...")
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+
+	c := &chunkClient{base: strings.TrimSuffix(fs.Arg(0), "/"), token: *token, auth: *auth}
+	for _, name := range fs.Args()[1:] {
+		saved, err := c.upload(name, *dir, *chunkSize)
+		if err != nil {
+			log.Fatalf("Uploading %s: %v", name, err)
+		}
+		fmt.Printf("%s → %s\n", name, saved)
+	}
+}
+
+type chunkClient struct {
+	base  string
+	token string
+	auth  string
+}
+
+func (c *chunkClient) upload(name, dir string, chunkSize int64) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	var session struct {
+		ID        string `json:"id"`
+		ChunkSize int64  `json:"chunk_size"`
+	}
+	init := map[string]any{"dir": dir, "name": filepath.Base(name), "size": info.Size(), "chunk_size": chunkSize}
+	if err := c.call(http.MethodPost, "/upload/chunked", init, &session); err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	buf := make([]byte, session.ChunkSize)
+	for n := 0; ; n++ {
+		size, err := io.ReadFull(f, buf)
+		if err == io.EOF && n > 0 {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return "", err
+		}
+		chunk := buf[:size]
+		h.Write(chunk)
+		sum := sha256.Sum256(chunk)
+		for attempt := 1; ; attempt++ {
+			err = c.putChunk(session.ID, n, chunk, hex.EncodeToString(sum[:]))
+			if err == nil {
+				break
+			}
+			if attempt == 5 {
+				c.call(http.MethodDelete, "/upload/chunked/"+session.ID, nil, nil)
+				return "", err
+			}
+			log.Printf("Chunk %d failed (%v), retrying", n, err)
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		fmt.Fprintf(os.Stderr, "\r%s: %d%%", name, 100*min(int64(n+1)*session.ChunkSize, info.Size())/max(info.Size(), 1))
+		if int64(size) < session.ChunkSize {
+			break
+		}
+	}
+	fmt.Fprintln(os.Stderr)
+
+	var done struct {
+		Saved string `json:"saved"`
+	}
+	finish := map[string]string{"sha256": hex.EncodeToString(h.Sum(nil))}
+	if err := c.call(http.MethodPost, "/upload/chunked/"+session.ID+"/finish", finish, &done); err != nil {
+		return "", err
+	}
+	return done.Saved, nil
+}
+
+func (c *chunkClient) putChunk(id string, n int, chunk []byte, sum string) error {
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/upload/chunked/%s/%d", c.base, id, n), bytes.NewReader(chunk))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Chunk-SHA256", sum)
+	return c.do(req, nil)
+}
+
+// call sends body as JSON and decodes the JSON reply into out, if not nil.
+func (c *chunkClient) call(method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.base+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req, out)
+}
+
+func (c *chunkClient) do(req *http.Request, out any) error {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if name, password, ok := strings.Cut(c.auth, ":"); ok {
+		req.SetBasicAuth(name, password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxClipLength       = 64 << 10 // Bytes
+	maxClipboardHistory = 20
+)
+
+// clipboardEnabled turns on the shared clipboard at /clipboard, --clipboard.
+var clipboardEnabled bool
+
+// clip is something a device put on the shared clipboard.
+type clip struct {
+	Text string    `json:"text"`
+	From string    `json:"from"` // Who sent it, or the address it came from
+	At   time.Time `json:"at"`
+}
+
+// clipboard is what's been put on the shared clipboard, newest first. It
+// only lives in memory, as clipboards are often passwords.
+var clipboard struct {
+	sync.Mutex
+	history []clip
+}
+
+// clipboardHub is the clipboard pages open, which are sent the history
+// each time something new goes on it.
+var clipboardHub wsHub
+
+func clipboardHistory() []clip {
+	clipboard.Lock()
+	defer clipboard.Unlock()
+	return slices.Clone(clipboard.history)
+}
+
+// pushClip puts text on the shared clipboard for r, and sends it to every
+// open clipboard page. It returns why not if it can't.
+func pushClip(r *http.Request, text string) string {
+	if strings.TrimSpace(text) == "" || len(text) > maxClipLength {
+		return fmt.Sprintf("The clipboard takes from 1 byte to %s", humanSize(maxClipLength))
+	}
+	from := uploaderName(r)
+	if from == "" {
+		from = clientIP(r)
+	}
+	clipboard.Lock()
+	clipboard.history = slices.Insert(clipboard.history, 0, clip{Text: text, From: from, At: time.Now()})
+	if len(clipboard.history) > maxClipboardHistory {
+		clipboard.history = clipboard.history[:maxClipboardHistory]
+	}
+	clipboard.Unlock()
+	log.Printf("Put %s on the clipboard, for %s", humanSize(int64(len(text))), clientIP(r))
+	clipboardHub.broadcast(clipboardMessage())
+	return ""
+}
+
+// clipboardMessage is what the clipboard page is sent over its WebSocket,
+// and what GET /api/clipboard answers: {"history": [newest, ...]}.
+func clipboardMessage() string {
+	history := clipboardHistory()
+	if history == nil {
+		history = []clip{}
+	}
+	data, _ := json.Marshal(struct {
+		History []clip `json:"history"`
+	}{history})
+	return string(data)
+}
+
+// clipboardPageHandler serves the shared clipboard page, which keeps
+// itself up to date over a WebSocket at /clipboard/ws.
+func clipboardPageHandler(w http.ResponseWriter, r *http.Request) {
+	if !clipboardEnabled {
+		http.NotFound(w, r)
+		return
+	}
+	data := struct {
+		CSRF    string
+		CanPush bool
+	}{csrfToken(w, r), canTag(r)}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := clipboardTemplate.Execute(w, data); err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	}
+}
+
+var clipboardTemplate = newPage("clipboard", nil)
+
+// clipboardSocketHandler sends the clipboard page the history as soon as
+// it connects and again whenever it changes. The page sends
+// {"text": "..."} to put something on the clipboard.
+func clipboardSocketHandler(w http.ResponseWriter, r *http.Request) {
+	if !clipboardEnabled {
+		http.NotFound(w, r)
+		return
+	}
+	c, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go c.keepAlive(done)
+
+	clipboardHub.add(c)
+	defer clipboardHub.remove(c)
+	if c.writeMessage(clipboardMessage()) != nil {
+		return
+	}
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return
+		}
+		var req struct {
+			Text string `json:"text"`
+		}
+		if json.Unmarshal([]byte(msg), &req) != nil || !canTag(r) {
+			continue
+		}
+		if problem := pushClip(r, req.Text); problem != "" {
+			data, _ := json.Marshal(struct {
+				Error string `json:"error"`
+			}{problem})
+			c.writeMessage(string(data))
+		}
+	}
+}
+
+// apiClipboardHandler lets scripts use the shared clipboard:
+// GET /api/clipboard returns the history, newest first, and
+// POST /api/clipboard with {"text": "..."} puts something on it.
+func apiClipboardHandler(w http.ResponseWriter, r *http.Request) {
+	if !clipboardEnabled {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, clipboardMessage())
+	case http.MethodPost:
+		if !canTag(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Text string `json:"text"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 2*maxClipLength)).Decode(&req); err != nil {
+			http.Error(w, "Expected JSON with the text to put on the clipboard", http.StatusBadRequest)
+			return
+		}
+		if msg := pushClip(r, req.Text); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressResponses gzips pages, JSON and text for clients that accept it,
+// --compress, which on a slow phone's Wi-Fi makes a big folder's listing
+// come up a lot sooner.
+var compressResponses = true
+
+// minCompressSize is the smallest response worth compressing; below it the
+// gzip header and CPU time cost more than they save.
+const minCompressSize = 1024
+
+var gzipWriters = sync.Pool{New: func() any {
+	gz, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+	return gz
+}}
+
+// compressible reports whether responses of type ctype shrink when gzipped.
+// Photos, video, music and archives are compressed already.
+func compressible(ctype string) bool {
+	t := mediaType(ctype)
+	switch {
+	case t == "text/event-stream":
+		return false // Sent in small pieces as things happen
+	case strings.HasPrefix(t, "text/"), strings.HasSuffix(t, "+json"), strings.HasSuffix(t, "+xml"):
+		return true
+	}
+	switch t {
+	case "application/json", "application/javascript", "application/xml", "image/svg+xml", "image/bmp", "application/wasm":
+		return true
+	}
+	return false
+}
+
+// acceptsGzip reports whether the client said it can take gzip.
+func acceptsGzip(r *http.Request) bool {
+	for part := range strings.SplitSeq(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") && strings.TrimSpace(coding) != "*" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		return !ok || strings.Trim(q, "0.") != ""
+	}
+	return false
+}
+
+// compressMiddleware gzips responses that are worth it for clients that
+// accept it, and says so with Vary: Accept-Encoding so caches keep the two
+// apart. Ranges and files downloaded as attachments are sent as they are,
+// so downloads can be resumed and browsers show how far along they are.
+func compressMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, accepts: acceptsGzip(r)}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter decides on the first write whether to gzip what follows.
+type compressWriter struct {
+	http.ResponseWriter
+	accepts bool
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if !w.decided {
+		w.decide(code, nil)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		w.decide(http.StatusOK, p)
+		w.ResponseWriter.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// decide starts gzipping if the response is one to compress, first is the
+// start of the body if it's known yet.
+func (w *compressWriter) decide(code int, first []byte) {
+	w.decided = true
+	h := w.Header()
+	if code < http.StatusOK || code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent {
+		return
+	}
+	if h.Get("Content-Encoding") != "" || strings.HasPrefix(h.Get("Content-Disposition"), "attachment") {
+		return
+	}
+	ctype := h.Get("Content-Type")
+	if ctype == "" && first != nil {
+		ctype = http.DetectContentType(first)
+		h.Set("Content-Type", ctype)
+	}
+	if !compressible(ctype) {
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); !w.accepts || err == nil && n < minCompressSize {
+		return
+	}
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	h.Set("Content-Encoding", "gzip")
+	// The gzipped bytes differ from the file's, so its tag is only a weak
+	// match for them.
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	w.gz = gzipWriters.Get().(*gzip.Writer)
+	w.gz.Reset(w.ResponseWriter)
+}
+
+// ReadFrom keeps the server's sendfile for files that aren't compressed.
+func (w *compressWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !w.decided && w.Header().Get("Content-Type") != "" {
+		w.WriteHeader(http.StatusOK)
+	}
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok && w.decided && w.gz == nil {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(struct{ io.Writer }{w}, src)
+}
+
+func (w *compressWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the connection, for
+// WebSockets and deadlines.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressWriter) close() {
+	if w.gz == nil {
+		return
+	}
+	w.gz.Close()
+	w.gz.Reset(io.Discard)
+	gzipWriters.Put(w.gz)
+	w.gz = nil
+}
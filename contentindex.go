@@ -0,0 +1,296 @@
+package main
+
+import (
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var indexContents bool // Look inside documents for searches, --index-contents
+
+const (
+	maxIndexedText = 5 << 20  // Bigger text files are left out of the index
+	maxIndexedPDF  = 50 << 20 // And bigger PDFs
+	reindexEvery   = 5 * time.Minute
+)
+
+// contentIndex is an inverted index of the words in the text files and
+// PDFs in the share, in memory, for finding them by what's in them. Each
+// file is indexed again if its size or modification time changes.
+type contentIndex struct {
+	mu    sync.RWMutex
+	docs  map[string]*indexedDoc
+	words map[string]map[string]bool // Word to the files it's in
+	done  int                        // Files indexed in the current pass
+	todo  int                        // Of how many, 0 once it's over
+	poke  chan struct{}
+}
+
+type indexedDoc struct {
+	size    int64
+	modTime time.Time
+	words   []string
+}
+
+var contents = &contentIndex{
+	docs:  make(map[string]*indexedDoc),
+	words: make(map[string]map[string]bool),
+	poke:  make(chan struct{}, 1),
+}
+
+// startContentIndex indexes the share in the background, again every few
+// minutes and whenever files change.
+func startContentIndex() {
+	go func() {
+		for {
+			contents.update()
+			select {
+			case <-contents.poke:
+			case <-time.After(reindexEvery):
+			}
+		}
+	}()
+}
+
+// changed has the index look over the share again soon.
+func (c *contentIndex) changed() {
+	select {
+	case c.poke <- struct{}{}:
+	default:
+	}
+}
+
+// indexable reports whether the shared file name is one the index reads.
+func indexable(name string) bool {
+	ctype := sharedFileType(name)
+	_, code := syntaxFor(name)
+	return code || mediaType(ctype) == "application/pdf" || mediaType(ctype) == "text/plain" || showAsText(ctype)
+}
+
+// update indexes the files that are new or changed since the last pass
+// and forgets the ones that are gone.
+func (c *contentIndex) update() {
+	files, err := indexedFiles()
+	if err != nil {
+		log.Println("Error listing files to index:", err)
+		return
+	}
+	var todo []string
+	seen := make(map[string]bool)
+	c.mu.RLock()
+	for _, name := range files {
+		if strings.HasSuffix(name, "/") || !indexable(name) {
+			continue
+		}
+		seen[name] = true
+		info, err := statShared(name)
+		if err != nil {
+			continue
+		}
+		if d := c.docs[name]; d == nil || d.size != info.Size() || !d.modTime.Equal(info.ModTime()) {
+			todo = append(todo, name)
+		}
+	}
+	var gone []string
+	for name := range c.docs {
+		if !seen[name] {
+			gone = append(gone, name)
+		}
+	}
+	c.mu.RUnlock()
+
+	c.mu.Lock()
+	for _, name := range gone {
+		c.remove(name)
+	}
+	c.done, c.todo = 0, len(todo)
+	c.mu.Unlock()
+	for _, name := range todo {
+		c.index(name)
+		c.mu.Lock()
+		c.done++
+		c.mu.Unlock()
+	}
+	c.mu.Lock()
+	c.todo = 0
+	c.mu.Unlock()
+}
+
+// index reads the shared file name and adds its words.
+func (c *contentIndex) index(name string) {
+	info, err := statShared(name)
+	if err != nil {
+		return
+	}
+	d := &indexedDoc{size: info.Size(), modTime: info.ModTime()}
+	if text, ok := documentText(name, info.Size()); ok {
+		seen := make(map[string]bool)
+		for _, w := range searchWords(text) {
+			if !seen[w] {
+				seen[w] = true
+				d.words = append(d.words, w)
+			}
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(name)
+	c.docs[name] = d
+	for _, w := range d.words {
+		if c.words[w] == nil {
+			c.words[w] = make(map[string]bool)
+		}
+		c.words[w][name] = true
+	}
+}
+
+// remove forgets the file name. c.mu must be held.
+func (c *contentIndex) remove(name string) {
+	d := c.docs[name]
+	if d == nil {
+		return
+	}
+	for _, w := range d.words {
+		delete(c.words[w], name)
+		if len(c.words[w]) == 0 {
+			delete(c.words, w)
+		}
+	}
+	delete(c.docs, name)
+}
+
+// documentText returns the text in a shared file the index reads, unless
+// it's too big.
+func documentText(name string, size int64) (string, bool) {
+	pdf := mediaType(sharedFileType(name)) == "application/pdf"
+	if pdf && size > maxIndexedPDF || !pdf && size > maxIndexedText {
+		return "", false
+	}
+	f, err := openShared(name)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return "", false
+	}
+	if pdf {
+		return pdfText(data), true
+	}
+	return strings.ToValidUTF8(string(data), " "), true
+}
+
+// searchWords splits text into lowercase words for the index: runs of
+// letters, digits and the marks that go with letters in scripts like
+// Bangla, from 2 to 40 runes long.
+func searchWords(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r)
+	})
+	return slices.DeleteFunc(words, func(w string) bool {
+		n := len([]rune(w))
+		return n < 2 || n > 40
+	})
+}
+
+// search returns the files with every word of query in them, the last
+// word also matching longer words it starts, so results come while it's
+// being typed.
+func (c *contentIndex) search(query string) []string {
+	words := searchWords(query)
+	if len(words) == 0 {
+		return nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var found map[string]bool
+	for i, w := range words {
+		matches := make(map[string]bool)
+		for name := range c.words[w] {
+			matches[name] = true
+		}
+		if i == len(words)-1 {
+			for word, names := range c.words {
+				if strings.HasPrefix(word, w) {
+					for name := range names {
+						matches[name] = true
+					}
+				}
+			}
+		}
+		if found == nil {
+			found = matches
+			continue
+		}
+		for name := range found {
+			if !matches[name] {
+				delete(found, name)
+			}
+		}
+	}
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// progress reports how far the index has got with a pass, todo being 0
+// when it's not busy.
+func (c *contentIndex) progress() (done, todo int) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.done, c.todo
+}
+
+// snippet finds the first of words in the shared file name and returns
+// the text around it, with the words marked.
+func snippet(name string, words []string) []matchPart {
+	info, err := statShared(name)
+	if err != nil || len(words) == 0 {
+		return nil
+	}
+	text, ok := documentText(name, info.Size())
+	if !ok {
+		return nil
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	lower := lowerRunes(text)
+	runes := []rune(text)
+	at := -1
+	for _, w := range words {
+		if i := runeIndex(lower, []rune(w)); i >= 0 && (at < 0 || i < at) {
+			at = i
+		}
+	}
+	if at < 0 {
+		return nil
+	}
+	start, end := max(0, at-60), min(len(runes), at+100)
+	marks := make([]bool, end-start)
+	window := lower[start:end]
+	for _, w := range words {
+		wr := []rune(w)
+		for i := 0; i+len(wr) <= len(window); i++ {
+			if slices.Equal(window[i:i+len(wr)], wr) {
+				for j := range wr {
+					marks[i+j] = true
+				}
+			}
+		}
+	}
+	parts := highlightParts(string(runes[start:end]), marks)
+	if start > 0 {
+		parts = append([]matchPart{{Text: "…"}}, parts...)
+	}
+	if end < len(runes) {
+		parts = append(parts, matchPart{Text: "…"})
+	}
+	return parts
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// corsOrigins are the other sites whose pages may call the JSON API and
+// uploads from the browser, --cors-origins, like a separate front end or
+// another internal tool. "*" lets any site read, without credentials.
+var corsOrigins originsFlag
+
+// originsFlag collects origins such as https://tools.corp.example from a
+// repeatable comma-separated option.
+type originsFlag []string
+
+func (f *originsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *originsFlag) Set(value string) error {
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSuffix(strings.TrimSpace(s), "/")
+		if s == "" {
+			continue
+		}
+		if s != "*" {
+			u, err := url.Parse(s)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+				return fmt.Errorf("expected an origin like https://tools.example.com, or *, got %q", s)
+			}
+			s = strings.ToLower(u.Scheme + "://" + u.Host)
+		}
+		*f = append(*f, s)
+	}
+	return nil
+}
+
+// corsListed reports whether origin was named in --cors-origins, rather
+// than only let in by "*". Listed origins may send cookies and passwords.
+func corsListed(origin string) bool {
+	return origin != "" && origin != "*" && slices.Contains(corsOrigins, strings.ToLower(origin))
+}
+
+// apiPath reports whether p is part of the JSON API or uploads, which
+// take API tokens and calls from other sites.
+func apiPath(p string) bool {
+	return strings.HasPrefix(p, "/api/") || p == "/upload" || strings.HasPrefix(p, "/upload/")
+}
+
+const (
+	corsMethods = "GET, HEAD, POST, PUT, PATCH, DELETE"
+	corsHeaders = "Authorization, Content-Type, If-None-Match, " + csrfHeader + ", X-Chunk-SHA256"
+	corsExpose  = "Content-Disposition, ETag, Link, Retry-After, X-Total-Count"
+)
+
+// corsMiddleware adds the CORS headers letting pages on --cors-origins read
+// the API's answers, and answers their preflight requests itself, before
+// sign-in, as browsers send those without credentials. Listed origins get
+// their own name back and Access-Control-Allow-Credentials, so cookies and
+// basic auth work; anything only "*" lets in gets "*", which browsers won't
+// send credentials to, leaving API tokens.
+func corsMiddleware(next http.Handler) http.Handler {
+	if len(corsOrigins) == 0 {
+		return next
+	}
+	wildcard := slices.Contains(corsOrigins, "*")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !apiPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		origin := r.Header.Get("Origin")
+		listed := corsListed(origin)
+		if len(corsOrigins) > 1 || !wildcard {
+			h.Add("Vary", "Origin")
+		}
+		switch {
+		case origin == "" || !listed && !wildcard:
+			next.ServeHTTP(w, r)
+			return
+		case listed:
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Allow-Credentials", "true")
+		default:
+			h.Set("Access-Control-Allow-Origin", "*")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Add("Vary", "Access-Control-Request-Method, Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", corsMethods)
+			h.Set("Access-Control-Allow-Headers", corsHeaders)
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.Set("Access-Control-Expose-Headers", corsExpose)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// Forms and scripts that change something send a CSRF token, checked
+// against a random cookie the page was served with (the "double submit"
+// pattern). A page on another site can make the browser send the cookie, but
+// can't read it to put the same value in the form.
+const (
+	csrfCookie = "csrf"
+	csrfField  = "csrf"         // Form field
+	csrfHeader = "X-CSRF-Token" // For fetch() calls
+)
+
+// csrfToken returns the token to embed in a page for r, setting the cookie
+// on w if the browser doesn't have one yet.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(csrfCookie); err == nil && len(c.Value) >= 32 {
+		return c.Value
+	}
+	b := make([]byte, 24)
+	rand.Read(b)
+	token := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     basePath + "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token
+}
+
+// csrfMiddleware rejects POST, PUT, PATCH and DELETE requests from browsers
+// that don't carry the page's CSRF token. Requests with an API token, and
+// scripts that send neither cookies nor the Origin and Sec-Fetch-Site
+// headers browsers add, can't be forged this way and are let through, as
+// are API calls from pages on --cors-origins, which browsers name in Origin.
+func csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") ||
+			(corsListed(r.Header.Get("Origin")) && apiPath(r.URL.Path)) ||
+			(len(r.Cookies()) == 0 && r.Header.Get("Origin") == "" && r.Header.Get("Sec-Fetch-Site") == "") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		c, err := r.Cookie(csrfCookie)
+		sent := r.Header.Get(csrfHeader)
+		switch ctype := r.Header.Get("Content-Type"); {
+		case sent != "":
+		case strings.HasPrefix(ctype, "application/x-www-form-urlencoded"):
+			sent = r.PostFormValue(csrfField)
+		case strings.HasPrefix(ctype, "multipart/form-data"):
+			// Uploads are read as they stream in, so their forms carry the
+			// token in the URL rather than a field.
+			sent = r.URL.Query().Get(csrfField)
+		}
+		if err != nil || sent == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(c.Value)) != 1 {
+			http.Error(w, "Invalid or missing CSRF token, reload the page and try again", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
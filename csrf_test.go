@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFToken(t *testing.T) {
+	w := httptest.NewRecorder()
+	token := csrfToken(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != token || !cookies[0].HttpOnly {
+		t.Fatalf("csrfToken set %+v, want an HttpOnly cookie holding %q", cookies, token)
+	}
+
+	// A browser that has the cookie keeps it.
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookies[0])
+	if got := csrfToken(w, r); got != token || len(w.Result().Cookies()) != 0 {
+		t.Errorf("csrfToken with the cookie = %q and set %d cookies, want %q and none", got, len(w.Result().Cookies()), token)
+	}
+	// One too short to be ours is replaced.
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: "x"})
+	if got := csrfToken(httptest.NewRecorder(), r); got == "x" {
+		t.Error("csrfToken kept a short cookie")
+	}
+}
+
+func TestCSRFMiddleware(t *testing.T) {
+	h := csrfMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	const token = "0123456789abcdef0123456789abcdef"
+	form := func(v string) string { return url.Values{csrfField: {v}, "name": {"a.txt"}}.Encode() }
+	tests := []struct {
+		name, method, target string
+		cookie               string // The csrf cookie, "" for none
+		header               map[string]string
+		body                 string
+		status               int
+	}{
+		{"GET needs no token", http.MethodGet, "/", token, nil, "", http.StatusOK},
+		{"form with the token", http.MethodPost, "/api/mkdir", token, map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, form(token), http.StatusOK},
+		{"form with another token", http.MethodPost, "/api/mkdir", token, map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, form(strings.ToUpper(token)), http.StatusForbidden},
+		{"form without a token", http.MethodPost, "/api/mkdir", token, map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, "name=a.txt", http.StatusForbidden},
+		{"token but no cookie", http.MethodPost, "/api/mkdir", "", map[string]string{"Content-Type": "application/x-www-form-urlencoded", "Origin": "https://evil.example"}, form(token), http.StatusForbidden},
+		{"header with the token", http.MethodDelete, "/api/files/a.txt", token, map[string]string{csrfHeader: token}, "", http.StatusOK},
+		{"header with another token", http.MethodDelete, "/api/files/a.txt", token, map[string]string{csrfHeader: token[1:] + "x"}, "", http.StatusForbidden},
+		{"upload with the token in the URL", http.MethodPost, "/upload?csrf=" + token, token, map[string]string{"Content-Type": "multipart/form-data; boundary=x"}, "", http.StatusOK},
+		{"upload with the token in a field", http.MethodPost, "/upload", token, map[string]string{"Content-Type": "multipart/form-data; boundary=x"}, "--x\r\nContent-Disposition: form-data; name=\"csrf\"\r\n\r\n" + token + "\r\n--x--\r\n", http.StatusForbidden},
+		{"cross-site, no cookies", http.MethodPost, "/api/mkdir", "", map[string]string{"Sec-Fetch-Site": "cross-site"}, "", http.StatusForbidden},
+		{"script without cookies", http.MethodPost, "/api/mkdir", "", nil, "", http.StatusOK},
+		{"API token", http.MethodPost, "/api/mkdir", token, map[string]string{"Authorization": "Bearer abc"}, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: csrfCookie, Value: tt.cookie})
+		}
+		for k, v := range tt.header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+)
+
+// dedupeMode is what happens to an upload identical to a file already in
+// the share, --dedupe.
+type dedupeMode string
+
+const (
+	dedupeOff  dedupeMode = "off"
+	dedupeLink dedupeMode = "link" // Saved under its name as a hard link to the other file
+	dedupeSkip dedupeMode = "skip" // Not saved at all
+)
+
+var dedupe = dedupeOff
+
+func (d *dedupeMode) String() string { return string(*d) }
+
+func (d *dedupeMode) Set(value string) error {
+	switch dedupeMode(value) {
+	case dedupeOff, dedupeLink, dedupeSkip:
+		*d = dedupeMode(value)
+		return nil
+	}
+	return fmt.Errorf("expected off, link or skip, got %q", value)
+}
+
+// find returns a shared file r can see with the SHA-256 sum, other than
+// exclude, going by the checksums worked out so far. Those that are hidden,
+// excluded or locked for r are left out.
+func (c *checksumStore) find(r *http.Request, sum, exclude string) string {
+	c.mu.Lock()
+	var candidates []string
+	for p, s := range c.sums {
+		if s.SHA256 == sum && p != exclude {
+			candidates = append(candidates, p)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, p := range candidates {
+		if _, locked := lockedBy(r, p); locked || !visible(p, false) {
+			continue
+		}
+		info, err := statShared(p)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		c.mu.Lock()
+		s := c.sums[p]
+		c.mu.Unlock()
+		if s.Size == info.Size() && s.ModTime.Equal(info.ModTime()) {
+			return p
+		}
+	}
+	return ""
+}
+
+// linkDuplicate makes sharePath, fsPath in fsys, a hard link to the shared
+// file existing, replacing whatever is there, if they're on the same disk.
+func linkDuplicate(fsys fs.FS, existing, sharePath, fsPath string) bool {
+	em, erel, _ := resolve(existing)
+	m, _, _ := resolve(sharePath)
+	linker, canLink := fsys.(linkFS)
+	renamer, canRename := fsys.(renameFS)
+	if em != m || !canLink || !canRename {
+		return false
+	}
+	if info, err := fs.Lstat(fsys, erel); err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	tmp := path.Join(path.Dir(fsPath), ".lanshare-upload-"+rand.Text())
+	if err := linker.Link(erel, tmp); err != nil {
+		return false
+	}
+	if err := renamer.Rename(tmp, fsPath); err != nil {
+		log.Printf("Error linking %s to %s: %v", sharePath, existing, err)
+		if remover, ok := fsys.(removableFS); ok {
+			remover.RemoveAll(tmp)
+		}
+		return false
+	}
+	return true
+}
+
+// dedupeSaved deals with an upload just saved as sharePath, fsPath in fsys,
+// and hashed as sum, that turns out to be identical to another file. It
+// returns that file's path, or "" if there's none or --dedupe is off, and
+// whether the upload was dropped rather than linked to it. One that replaced
+// a file is always linked, so the file it replaced stays replaced, and so
+// is one sent with --receive-only, where the uploader isn't told about it.
+func dedupeSaved(r *http.Request, fsys fs.FS, sharePath, fsPath, sum string, replaced bool) (existing string, skipped bool) {
+	if dedupe == dedupeOff {
+		return "", false
+	}
+	if existing = checksums.find(r, sum, sharePath); existing == "" {
+		return "", false
+	}
+	if dedupe == dedupeSkip && !replaced && !receiveOnly {
+		if remover, ok := fsys.(removableFS); ok && remover.RemoveAll(fsPath) == nil {
+			log.Printf("Upload %s from %s was already present as %s", sharePath, clientIP(r), existing)
+			return existing, true
+		}
+	}
+	if linkDuplicate(fsys, existing, sharePath, fsPath) {
+		log.Printf("Upload %s from %s is the same as %s, linked them", sharePath, clientIP(r), existing)
+		if receiveOnly {
+			return "", false
+		}
+		return existing, false
+	}
+	return "", false
+}
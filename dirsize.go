@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log"
+	"maps"
+	"net/http"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// folderSize is how much is in a shared folder, counting the folders in it.
+type folderSize struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	HumanSize string `json:"size_human"`
+	Files     int    `json:"files"`
+}
+
+// folderSizes adds up the size of every folder in the share in the
+// background, as that means going through all of it, and keeps the totals
+// until something is uploaded, moved or deleted.
+type folderSizes struct {
+	mu      sync.Mutex
+	sizes   map[string]folderSize // nil until worked out
+	busy    bool
+	changes int // Bumped by changed, so a pass that overlaps one is redone
+}
+
+var dirSizes = &folderSizes{}
+
+// get returns the size of each folder, or false if they're still being
+// worked out, which it starts if they aren't yet.
+func (c *folderSizes) get() (map[string]folderSize, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sizes != nil {
+		return c.sizes, true
+	}
+	if !c.busy {
+		c.busy = true
+		go c.update()
+	}
+	return nil, false
+}
+
+// changed forgets the totals, which are worked out again when next asked
+// for.
+func (c *folderSizes) changed() {
+	c.mu.Lock()
+	c.sizes = nil
+	c.changes++
+	c.mu.Unlock()
+}
+
+func (c *folderSizes) update() {
+	for {
+		c.mu.Lock()
+		changes := c.changes
+		c.mu.Unlock()
+		files, err := listFileInfos("")
+		if err != nil {
+			log.Println("Error listing files for folder sizes:", err)
+		}
+		sizes := make(map[string]folderSize)
+		for _, f := range files {
+			if f.info == nil {
+				continue // Past --max-depth, and not shared
+			}
+			for dir := path.Dir(filepath.ToSlash(f.name)); dir != "."; dir = path.Dir(dir) {
+				s := sizes[dir]
+				s.Name = dir
+				s.Size += f.info.Size()
+				s.Files++
+				sizes[dir] = s
+			}
+		}
+		for dir, s := range sizes {
+			s.HumanSize = humanSize(s.Size)
+			sizes[dir] = s
+		}
+		c.mu.Lock()
+		if c.changes == changes {
+			c.sizes, c.busy = sizes, false
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+	}
+}
+
+// sharedFolders returns the folders the files in the list are in, leaving
+// out those past --max-depth, whose contents aren't shared.
+func sharedFolders(files []fileEntry) []string {
+	seen := make(map[string]bool)
+	for _, f := range files {
+		if f.Folder {
+			continue
+		}
+		for dir := folderOf(f.Name); dir != "" && !seen[dir]; dir = folderOf(dir) {
+			seen[dir] = true
+		}
+	}
+	return slices.Sorted(maps.Keys(seen))
+}
+
+// folderSizeList returns the sizes of folders, with only their names if
+// they're still being worked out.
+func folderSizeList(folders []string) ([]folderSize, bool) {
+	sizes, ok := dirSizes.get()
+	list := make([]folderSize, len(folders))
+	for i, dir := range folders {
+		list[i] = folderSize{Name: dir}
+		if ok {
+			list[i] = sizes[dir]
+			list[i].Name = dir
+			list[i].HumanSize = humanSize(list[i].Size)
+		}
+	}
+	return list, ok
+}
+
+// apiFoldersHandler lists the shared folders with how much is in each, as
+// JSON, "calculating" being true and the sizes left out while they're
+// being added up; asking again a moment later gets them.
+func apiFoldersHandler(w http.ResponseWriter, r *http.Request) {
+	files, err := listEntries(r)
+	if err != nil {
+		http.Error(w, "Error listing files", http.StatusInternalServerError)
+		return
+	}
+	folders := sharedFolders(files)
+	if dir := strings.Trim(r.URL.Query().Get("path"), "/"); dir != "" {
+		folders = slices.DeleteFunc(folders, func(f string) bool { return f != dir && !strings.HasPrefix(f, dir+"/") })
+	}
+	list, ok := folderSizeList(folders)
+	resp := struct {
+		Calculating bool         `json:"calculating"`
+		Folders     []folderSize `json:"folders"`
+	}{Calculating: !ok, Folders: list}
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
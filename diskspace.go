@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minFreeSpace is how much disk space uploads must leave free.
+var minFreeSpace int64
+
+// diskFree returns the bytes that can still be written to the file system
+// holding dir. It asks df, or PowerShell on Windows: the system calls differ
+// per platform and would need build-tagged files, which go run *.go doesn't
+// honour. Answers are reused for a couple of seconds.
+func diskFree(dir string) (int64, error) {
+	diskFreeMu.Lock()
+	defer diskFreeMu.Unlock()
+	if c, ok := diskFreeCache[dir]; ok && time.Since(c.at) < 2*time.Second {
+		return c.free, c.err
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("powershell", "-NoProfile", "-Command", "(Get-Item -LiteralPath $env:LANSHARE_DIR).PSDrive.Free")
+		cmd.Env = append(os.Environ(), "LANSHARE_DIR="+dir)
+	} else {
+		cmd = exec.Command("df", "-P", "-k", dir)
+	}
+	out, err := cmd.Output()
+	free := int64(-1)
+	if err == nil {
+		free, err = parseFree(string(out), runtime.GOOS == "windows")
+	}
+	diskFreeCache[dir] = cachedFree{free, err, time.Now()}
+	return free, err
+}
+
+var (
+	diskFreeMu    sync.Mutex
+	diskFreeCache = map[string]cachedFree{}
+)
+
+type cachedFree struct {
+	free int64
+	err  error
+	at   time.Time
+}
+
+// parseFree reads the free space from PowerShell, a number of bytes, or df's
+// POSIX output, where it's the kilobytes just before the "Capacity" column.
+func parseFree(out string, bytes bool) (int64, error) {
+	if bytes {
+		return strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	for i := 1; i < len(fields); i++ {
+		if strings.HasSuffix(fields[i], "%") {
+			kb, err := strconv.ParseInt(fields[i-1], 10, 64)
+			return kb * 1024, err
+		}
+	}
+	return 0, fmt.Errorf("unexpected df output %q", out)
+}
+
+// spaceReporter is implemented by backends that know how much room they
+// have left, such as folders on disk. Others aren't checked.
+type spaceReporter interface {
+	free() (int64, error)
+}
+
+func (r rootFS) free() (int64, error) { return diskFree(r.root.Name()) }
+
+// freeSpace returns the room left in fsys, if it can be told.
+func freeSpace(fsys fs.FS) (int64, bool) {
+	s, ok := fsys.(spaceReporter)
+	if !ok {
+		return 0, false
+	}
+	n, err := s.free()
+	return n, err == nil
+}
+
+// uploadFolderSpace returns the room left in the share folder dir for
+// uploads, after the safety margin.
+func uploadFolderSpace(dir string) (int64, bool) {
+	fsys, _, ok := uploadTarget(dir)
+	if !ok {
+		return 0, false
+	}
+	free, ok := freeSpace(fsys)
+	return max(free-minFreeSpace, 0), ok
+}
+
+// folderSpace is the room left for uploads in a share folder.
+type folderSpace struct {
+	Path string `json:"path"`
+	Free int64  `json:"free"`
+}
+
+func uploadSpace() []folderSpace {
+	var list []folderSpace
+	for _, dir := range uploadDirs() {
+		if free, ok := uploadFolderSpace(dir); ok {
+			list = append(list, folderSpace{dir, free})
+		}
+	}
+	return list
+}
+
+// uploadSpaceSummary describes the room left for uploads for the page
+// footer, e.g. "3.2 GiB", or "3.2 GiB in /photos, 40.0 GiB in /docs".
+func uploadSpaceSummary() string {
+	list := uploadSpace()
+	if len(list) == 1 {
+		return humanSize(list[0].Free)
+	}
+	var parts []string
+	for _, f := range list {
+		parts = append(parts, humanSize(f.Free)+" in /"+f.Path)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// spaceMessage explains why size more bytes don't fit in fsys, or returns
+// "" if they do or it can't be told.
+func spaceMessage(fsys fs.FS, size int64) string {
+	free, ok := freeSpace(fsys)
+	if !ok || size <= free-minFreeSpace {
+		return ""
+	}
+	return fmt.Sprintf("There isn't enough disk space left on the server: %s can still be uploaded.", humanSize(max(free-minFreeSpace, 0)))
+}
+
+// tempSpaceMessage is spaceMessage for the temporary folder, where chunked
+// uploads are put together.
+func tempSpaceMessage(size int64) string {
+	free, err := diskFree(os.TempDir())
+	if err != nil || size <= free-minFreeSpace {
+		return ""
+	}
+	return fmt.Sprintf("There isn't enough room on the server to put together a file of %s.", humanSize(size))
+}
+
+// spaceGuard fails an upload of unknown size once it has brought the disk
+// down to the safety margin, checking every few megabytes.
+type spaceGuard struct {
+	r         io.Reader
+	fsys      fs.FS
+	uncounted int64 // Bytes since the last check
+}
+
+const spaceCheckEvery = 16 << 20
+
+func (g *spaceGuard) Read(p []byte) (int, error) {
+	if g.uncounted >= spaceCheckEvery {
+		g.uncounted = 0
+		if free, ok := freeSpace(g.fsys); ok && free < minFreeSpace {
+			return 0, &uploadTooLargeError{spaceMessage(g.fsys, 1)}
+		}
+	}
+	n, err := g.r.Read(p)
+	g.uncounted += int64(n)
+	return n, err
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// dlnaEnabled makes the share a DLNA media server, --dlna, so smart TVs and
+// consoles on the LAN find it and play its videos, music and photos
+// themselves. It's just enough UPnP for that: SSDP to be found, a device
+// description, and a ContentDirectory that can be browsed.
+var dlnaEnabled bool
+
+// dlnaUpdateID changes whenever the share does, so TVs know to browse again.
+var dlnaUpdateID atomic.Uint32
+
+var ssdpAddr = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+const (
+	dlnaDeviceType = "urn:schemas-upnp-org:device:MediaServer:1"
+	dlnaDirectory  = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	dlnaConnection = "urn:schemas-upnp-org:service:ConnectionManager:1"
+	dlnaServer     = "lanshare UPnP/1.0 DLNADOC/1.50"
+	ssdpMaxAge     = 1800 // Seconds
+)
+
+// dlnaUUID names this server to TVs. It's made from the host name and port,
+// so it stays the same from one run to the next and TVs don't list the
+// share twice.
+func dlnaUUID() string {
+	host, _ := os.Hostname()
+	sum := sha1.Sum([]byte("lanshare\n" + host + "\n" + baseURL))
+	return fmt.Sprintf("uuid:%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+func dlnaName() string {
+	if siteTitle != "" {
+		return siteTitle
+	}
+	host, _ := os.Hostname()
+	return "lanshare on " + host
+}
+
+// serveSSDP answers TVs searching the LAN for media servers and announces
+// the share every few minutes, until the program stops.
+func serveSSDP() {
+	conn, err := net.ListenMulticastUDP("udp4", nil, ssdpAddr)
+	if err != nil {
+		log.Print("Error starting DLNA, TVs won't find the share: ", err)
+		return
+	}
+	uuid := dlnaUUID()
+	go func() {
+		for {
+			for _, nt := range []string{"upnp:rootdevice", uuid, dlnaDeviceType, dlnaDirectory, dlnaConnection} {
+				conn.WriteToUDP([]byte(ssdpMessage("NOTIFY * HTTP/1.1", uuid, "NT", nt,
+					"HOST: 239.255.255.250:1900", "NTS: ssdp:alive")), ssdpAddr)
+			}
+			time.Sleep(ssdpMaxAge / 3 * time.Second)
+		}
+	}()
+
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Print("Error reading SSDP: ", err)
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("Man") != `"ssdp:discover"` {
+			continue
+		}
+		var targets []string
+		switch st := req.Header.Get("St"); st {
+		case "ssdp:all":
+			targets = []string{"upnp:rootdevice", uuid, dlnaDeviceType, dlnaDirectory, dlnaConnection}
+		case "upnp:rootdevice", uuid, dlnaDeviceType, dlnaDirectory, dlnaConnection:
+			targets = []string{st}
+		default:
+			continue
+		}
+		// Answer within the MX seconds asked for, at a random moment, so
+		// every device on the LAN doesn't answer at once.
+		mx, _ := strconv.Atoi(req.Header.Get("Mx"))
+		delay := time.Duration(rand.Int64N(int64(max(min(mx, 3), 1)) * int64(time.Second)))
+		time.AfterFunc(delay, func() {
+			for _, st := range targets {
+				conn.WriteToUDP([]byte(ssdpMessage("HTTP/1.1 200 OK", uuid, "ST", st, "EXT:")), from)
+			}
+		})
+	}
+}
+
+// ssdpMessage is an SSDP announcement or search answer for target, which
+// goes in the header kind, NT or ST.
+func ssdpMessage(first, uuid, kind, target string, extra ...string) string {
+	usn := uuid
+	if target != uuid {
+		usn += "::" + target
+	}
+	lines := append([]string{first}, extra...)
+	lines = append(lines,
+		fmt.Sprintf("CACHE-CONTROL: max-age=%d", ssdpMaxAge),
+		"LOCATION: "+baseURL+"dlna/device.xml",
+		"SERVER: "+dlnaServer,
+		kind+": "+target,
+		"USN: "+usn,
+	)
+	return strings.Join(lines, "\r\n") + "\r\n\r\n"
+}
+
+// dlnaHandler serves the device description, the services' descriptions
+// and their SOAP control URLs under /dlna/.
+func dlnaHandler(w http.ResponseWriter, r *http.Request) {
+	if !dlnaEnabled {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("Server", dlnaServer)
+	switch r.URL.Path {
+	case "/dlna/device.xml":
+		fmt.Fprintf(w, dlnaDeviceXML, xmlText(dlnaName()), dlnaUUID())
+	case "/dlna/ContentDirectory.xml":
+		io.WriteString(w, dlnaDirectoryXML)
+	case "/dlna/ConnectionManager.xml":
+		io.WriteString(w, dlnaConnectionXML)
+	case "/dlna/control/ContentDirectory", "/dlna/control/ConnectionManager":
+		dlnaControl(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// dlnaControl carries out a SOAP action a TV sent.
+func dlnaControl(w http.ResponseWriter, r *http.Request) {
+	service, action, _ := strings.Cut(strings.Trim(r.Header.Get("SOAPAction"), `"`), "#")
+	var env struct {
+		Body struct {
+			Args struct {
+				ObjectID       string
+				BrowseFlag     string
+				StartingIndex  int
+				RequestedCount int
+			} `xml:",any"`
+		}
+	}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&env); err != nil {
+		dlnaFault(w, 401, "Invalid Action")
+		return
+	}
+	args := env.Body.Args
+	var reply string
+	switch action {
+	case "Browse":
+		result, returned, total, ok := dlnaBrowse(r, args.ObjectID, args.BrowseFlag, args.StartingIndex, args.RequestedCount)
+		if !ok {
+			dlnaFault(w, 701, "No such object")
+			return
+		}
+		reply = fmt.Sprintf("<Result>%s</Result><NumberReturned>%d</NumberReturned><TotalMatches>%d</TotalMatches><UpdateID>%d</UpdateID>",
+			xmlText(result), returned, total, dlnaUpdateID.Load())
+	case "GetSystemUpdateID":
+		reply = fmt.Sprintf("<Id>%d</Id>", dlnaUpdateID.Load())
+	case "GetSearchCapabilities":
+		reply = "<SearchCaps></SearchCaps>"
+	case "GetSortCapabilities":
+		reply = "<SortCaps></SortCaps>"
+	case "GetProtocolInfo":
+		reply = "<Source>http-get:*:*:*</Source><Sink></Sink>"
+	case "GetCurrentConnectionIDs":
+		reply = "<ConnectionIDs>0</ConnectionIDs>"
+	default:
+		dlnaFault(w, 401, "Invalid Action")
+		return
+	}
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body></s:Envelope>`,
+		action, xmlText(service), reply, action)
+}
+
+func dlnaFault(w http.ResponseWriter, code int, desc string) {
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`,
+		code, desc)
+}
+
+// dlnaObject is a folder, or a video, song or photo, as TVs see it. Its ID
+// is its share path, with "0" for the top of the share.
+type dlnaObject struct {
+	id, parent string
+	title      string
+	folder     bool
+	class      string // The UPnP class of a file
+	ctype      string
+	size       int64
+}
+
+// dlnaBrowse answers a Browse action on the object with the given id: the
+// object itself for BrowseMetadata, or for BrowseDirectChildren up to count
+// of what's in it from start on, as DIDL-Lite.
+func dlnaBrowse(r *http.Request, id, flag string, start, count int) (didl string, returned, total int, ok bool) {
+	p := id
+	if id == "0" {
+		p = ""
+	}
+	p, ok = safeSharePath(p)
+	if !ok {
+		return "", 0, 0, false
+	}
+	if _, locked := lockedBy(r, p); locked {
+		return "", 0, 0, false
+	}
+	info, err := statShared(p)
+	if err != nil {
+		return "", 0, 0, false
+	}
+	var objects []dlnaObject
+	if flag == "BrowseMetadata" {
+		obj, ok := dlnaObjectFor(p, info.IsDir(), info.Size())
+		if !ok {
+			return "", 0, 0, false
+		}
+		objects, total = []dlnaObject{obj}, 1
+	} else {
+		if !info.IsDir() {
+			return "", 0, 0, false
+		}
+		entries, err := readDirShared(p)
+		if err != nil {
+			return "", 0, 0, false
+		}
+		for _, e := range entries {
+			child := path.Join(p, e.Name())
+			if _, locked := lockedBy(r, child); locked {
+				continue
+			}
+			info, err := statShared(child)
+			if err != nil {
+				continue
+			}
+			if obj, ok := dlnaObjectFor(child, info.IsDir(), info.Size()); ok {
+				objects = append(objects, obj)
+			}
+		}
+		// Folders first, then by name, as file browsers do.
+		slices.SortFunc(objects, func(a, b dlnaObject) int {
+			if a.folder != b.folder {
+				if a.folder {
+					return -1
+				}
+				return 1
+			}
+			return strings.Compare(strings.ToLower(a.title), strings.ToLower(b.title))
+		})
+		total = len(objects)
+		start = min(max(start, 0), total)
+		end := total
+		if count > 0 {
+			end = min(start+count, total)
+		}
+		objects = objects[start:end]
+	}
+
+	var b strings.Builder
+	b.WriteString(`<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">`)
+	for _, obj := range objects {
+		if obj.folder {
+			fmt.Fprintf(&b, `<container id="%s" parentID="%s" restricted="1"><dc:title>%s</dc:title><upnp:class>object.container.storageFolder</upnp:class></container>`,
+				xmlText(obj.id), xmlText(obj.parent), xmlText(obj.title))
+			continue
+		}
+		fmt.Fprintf(&b, `<item id="%s" parentID="%s" restricted="1"><dc:title>%s</dc:title><upnp:class>%s</upnp:class><res protocolInfo="http-get:*:%s:*" size="%d">%s</res></item>`,
+			xmlText(obj.id), xmlText(obj.parent), xmlText(obj.title), obj.class, xmlText(obj.ctype), obj.size, xmlText(deviceDownloadURL(obj.id)))
+	}
+	b.WriteString(`</DIDL-Lite>`)
+	return b.String(), len(objects), total, true
+}
+
+// dlnaObjectFor describes the share path p to TVs, if it's something they
+// can play or show.
+func dlnaObjectFor(p string, isDir bool, size int64) (dlnaObject, bool) {
+	obj := dlnaObject{id: p, parent: path.Dir(p), title: path.Base(p), folder: isDir, size: size}
+	if p == "" {
+		obj.id, obj.parent, obj.title = "0", "-1", dlnaName()
+	} else if obj.parent == "." {
+		obj.parent = "0"
+	}
+	if isDir {
+		return obj, true
+	}
+	obj.ctype = mediaType(sharedFileType(p))
+	switch kind, _, _ := strings.Cut(obj.ctype, "/"); kind {
+	case "video":
+		obj.class = "object.item.videoItem"
+	case "audio":
+		obj.class = "object.item.audioItem.musicTrack"
+	case "image":
+		obj.class = "object.item.imageItem.photo"
+	default:
+		return obj, false
+	}
+	return obj, true
+}
+
+// deviceDownloadURL is where a TV or Chromecast plays the shared file p
+// from. They can't sign in, so with accounts the link works without for a
+// day.
+func deviceDownloadURL(p string) string {
+	if authEnabled() {
+		return signedDownloadURL(baseURL, p, 24*time.Hour)
+	}
+	return baseURL + "download/" + escapePath(p)
+}
+
+// xmlText escapes s for XML text and attributes.
+func xmlText(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+const dlnaDeviceXML = `<?xml version="1.0" encoding="utf-8"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0" xmlns:dlna="urn:schemas-dlna-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:MediaServer:1</deviceType>
+    <friendlyName>%s</friendlyName>
+    <manufacturer>lanshare</manufacturer>
+    <modelName>lanshare</modelName>
+    <UDN>%s</UDN>
+    <dlna:X_DLNADOC>DMS-1.50</dlna:X_DLNADOC>
+    <iconList>
+      <icon><mimetype>image/png</mimetype><width>192</width><height>192</height><depth>24</depth><url>/icon-192.png</url></icon>
+    </iconList>
+    <serviceList>
+      <service>
+        <serviceType>urn:schemas-upnp-org:service:ContentDirectory:1</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ContentDirectory</serviceId>
+        <SCPDURL>/dlna/ContentDirectory.xml</SCPDURL>
+        <controlURL>/dlna/control/ContentDirectory</controlURL>
+        <eventSubURL>/dlna/events/ContentDirectory</eventSubURL>
+      </service>
+      <service>
+        <serviceType>urn:schemas-upnp-org:service:ConnectionManager:1</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ConnectionManager</serviceId>
+        <SCPDURL>/dlna/ConnectionManager.xml</SCPDURL>
+        <controlURL>/dlna/control/ConnectionManager</controlURL>
+        <eventSubURL>/dlna/events/ConnectionManager</eventSubURL>
+      </service>
+    </serviceList>
+  </device>
+</root>`
+
+const dlnaDirectoryXML = `<?xml version="1.0" encoding="utf-8"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action><name>Browse</name><argumentList>
+      <argument><name>ObjectID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ObjectID</relatedStateVariable></argument>
+      <argument><name>BrowseFlag</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_BrowseFlag</relatedStateVariable></argument>
+      <argument><name>Filter</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Filter</relatedStateVariable></argument>
+      <argument><name>StartingIndex</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Index</relatedStateVariable></argument>
+      <argument><name>RequestedCount</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>SortCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SortCriteria</relatedStateVariable></argument>
+      <argument><name>Result</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Result</relatedStateVariable></argument>
+      <argument><name>NumberReturned</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>TotalMatches</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>UpdateID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_UpdateID</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetSystemUpdateID</name><argumentList>
+      <argument><name>Id</name><direction>out</direction><relatedStateVariable>SystemUpdateID</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetSearchCapabilities</name><argumentList>
+      <argument><name>SearchCaps</name><direction>out</direction><relatedStateVariable>SearchCapabilities</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetSortCapabilities</name><argumentList>
+      <argument><name>SortCaps</name><direction>out</direction><relatedStateVariable>SortCapabilities</relatedStateVariable></argument>
+    </argumentList></action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ObjectID</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_BrowseFlag</name><dataType>string</dataType>
+      <allowedValueList><allowedValue>BrowseMetadata</allowedValue><allowedValue>BrowseDirectChildren</allowedValue></allowedValueList></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Filter</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Index</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Count</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_SortCriteria</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Result</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_UpdateID</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SystemUpdateID</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>SearchCapabilities</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>SortCapabilities</name><dataType>string</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>`
+
+const dlnaConnectionXML = `<?xml version="1.0" encoding="utf-8"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action><name>GetProtocolInfo</name><argumentList>
+      <argument><name>Source</name><direction>out</direction><relatedStateVariable>SourceProtocolInfo</relatedStateVariable></argument>
+      <argument><name>Sink</name><direction>out</direction><relatedStateVariable>SinkProtocolInfo</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetCurrentConnectionIDs</name><argumentList>
+      <argument><name>ConnectionIDs</name><direction>out</direction><relatedStateVariable>CurrentConnectionIDs</relatedStateVariable></argument>
+    </argumentList></action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="yes"><name>SourceProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SinkProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>CurrentConnectionIDs</name><dataType>string</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>`
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Phones refreshing the file list, and galleries scrolled back and forth,
+// ask again and again for what they already have. Pages, listings and
+// thumbnails carry an ETag so they can be answered with a 304 instead.
+
+// cachePolicies are the Cache-Control headers sent with each kind of
+// response, --cache-policy. Out of the box everything is checked again
+// each time, which the ETags make cheap, apart from thumbnails, which are
+// kept for a few minutes, as files on an ad-hoc share come and go.
+var cachePolicies = map[string]string{
+	"pages":      "private, no-cache",    // The file list and API listings
+	"thumbnails": "private, max-age=300", // /thumb/
+	"previews":   "private, no-cache",    // Files opened in the browser, and the pages showing them
+	"downloads":  "private, no-cache",    // Files saved to disk, and folder archives
+}
+
+// cachePolicyFlag collects --cache-policy "class=Cache-Control value"
+// options. A value of none sends no Cache-Control for the class.
+type cachePolicyFlag struct{}
+
+func (cachePolicyFlag) String() string { return "" }
+
+func (cachePolicyFlag) Set(value string) error {
+	class, policy, ok := strings.Cut(value, "=")
+	class, policy = strings.TrimSpace(class), strings.TrimSpace(policy)
+	if _, known := cachePolicies[class]; !known || !ok || policy == "" {
+		return fmt.Errorf(`expected "pages", "thumbnails", "previews" or "downloads", then = and a Cache-Control value, got %q`, value)
+	}
+	if policy == "none" {
+		policy = ""
+	}
+	cachePolicies[class] = policy
+	return nil
+}
+
+// setCachePolicy sets the Cache-Control for a response of class.
+func setCachePolicy(w http.ResponseWriter, class string) {
+	if policy := cachePolicies[class]; policy != "" {
+		w.Header().Set("Cache-Control", policy)
+	}
+}
+
+// contentETag tags a response by what's in it.
+func contentETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:12]) + `"`
+}
+
+// fileETag tags what's made from the file info describes, by its size and
+// when it changed, along with anything else the response depends on, like
+// a thumbnail's size.
+func fileETag(info fs.FileInfo, extra ...any) string {
+	tag := fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size())
+	if len(extra) > 0 {
+		sum := sha256.Sum256(fmt.Append(nil, extra...))
+		tag += "-" + base64.RawURLEncoding.EncodeToString(sum[:6])
+	}
+	return `"` + tag + `"`
+}
+
+// notModified sets the ETag, and Last-Modified unless modified is zero, and
+// answers 304 if the request says the client has that already.
+// If-None-Match wins over If-Modified-Since, as RFC 9110 has it.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	match := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for tag := range strings.SplitSeq(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				match = true
+				break
+			}
+		}
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.IsZero() {
+		match = !modified.Truncate(time.Second).After(ims)
+	}
+	if !match {
+		return false
+	}
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// writeTagged sends body, tagged by what's in it, or a 304 if the client
+// has it already.
+func writeTagged(w http.ResponseWriter, r *http.Request, ctype string, body []byte) {
+	w.Header().Set("Content-Type", ctype)
+	setCachePolicy(w, "pages")
+	if notModified(w, r, contentETag(body), time.Time{}) {
+		return
+	}
+	w.Write(body)
+}
+
+// writeJSONTagged is writeJSON for a 200 the client may have already.
+func writeJSONTagged(w http.ResponseWriter, r *http.Request, v any) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	writeTagged(w, r, "application/json", buf.Bytes())
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// photoInfo is what a photo says about itself, from its EXIF data when it
+// has some.
+type photoInfo struct {
+	Camera string       `json:"camera,omitempty"`
+	Taken  time.Time    `json:"taken,omitzero"` // By the camera's clock
+	Width  int          `json:"width,omitempty"`
+	Height int          `json:"height,omitempty"`
+	GPS    *gpsPosition `json:"gps,omitempty"`
+}
+
+type gpsPosition struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// MapURL links to where the photo was taken on OpenStreetMap.
+func (p gpsPosition) MapURL() string {
+	return fmt.Sprintf("https://www.openstreetmap.org/?mlat=%.6f&mlon=%.6f#map=16/%.6f/%.6f", p.Latitude, p.Longitude, p.Latitude, p.Longitude)
+}
+
+// maxPhotoHeader is how much of a photo is read for its details. EXIF
+// data has to fit in the first 64 KB of a JPEG, and the size follows it.
+const maxPhotoHeader = 256 << 10
+
+// photos remembers the details of photos already read, until they change.
+var photos = struct {
+	mu    sync.Mutex
+	known map[string]photoEntry
+}{known: make(map[string]photoEntry)}
+
+type photoEntry struct {
+	size    int64
+	modTime time.Time
+	info    *photoInfo
+}
+
+// photoDetails returns the details of the shared image name, or nil if it
+// isn't one the server can read.
+func photoDetails(name string) *photoInfo {
+	if !canResize(sharedFileType(name)) {
+		return nil
+	}
+	info, err := statShared(name)
+	if err != nil {
+		return nil
+	}
+	photos.mu.Lock()
+	e, ok := photos.known[name]
+	photos.mu.Unlock()
+	if ok && e.size == info.Size() && e.modTime.Equal(info.ModTime()) {
+		return e.info
+	}
+
+	f, err := openShared(name)
+	if err != nil {
+		return nil
+	}
+	head, err := io.ReadAll(io.LimitReader(f, maxPhotoHeader))
+	f.Close()
+	if err != nil {
+		return nil
+	}
+	p := readPhotoInfo(head)
+	photos.mu.Lock()
+	photos.known[name] = photoEntry{info.Size(), info.ModTime(), p}
+	photos.mu.Unlock()
+	return p
+}
+
+// readPhotoInfo reads the details of the image that head is the start of.
+func readPhotoInfo(head []byte) *photoInfo {
+	p := &photoInfo{}
+	if config, _, err := image.DecodeConfig(bytes.NewReader(head)); err == nil {
+		p.Width, p.Height = config.Width, config.Height
+	}
+	t, ok := jpegEXIF(head)
+	if !ok {
+		return p
+	}
+	ifd0 := t.ifd(t.order.Uint32(t.data[4:]))
+	maker, model := t.text(ifd0[0x010f]), t.text(ifd0[0x0110])
+	if strings.HasPrefix(strings.ToLower(model), strings.ToLower(maker)) {
+		maker = "" // "Canon" and "Canon EOS R6"
+	}
+	p.Camera = strings.TrimSpace(maker + " " + model)
+	if o := t.number(ifd0[0x0112]); o >= 5 && o <= 8 {
+		p.Width, p.Height = p.Height, p.Width // Turned on its side
+	}
+
+	taken := t.text(ifd0[0x0132])
+	if e, ok := ifd0[0x8769]; ok {
+		exif := t.ifd(uint32(t.number(e)))
+		taken = cmp.Or(t.text(exif[0x9003]), taken)
+	}
+	if tm, err := time.ParseInLocation("2006:01:02 15:04:05", taken, time.Local); err == nil {
+		p.Taken = tm
+	}
+
+	if e, ok := ifd0[0x8825]; ok {
+		gps := t.ifd(uint32(t.number(e)))
+		lat, lon := t.degrees(gps[2]), t.degrees(gps[4])
+		if !math.IsNaN(lat) && !math.IsNaN(lon) && (lat != 0 || lon != 0) {
+			if t.text(gps[1]) == "S" {
+				lat = -lat
+			}
+			if t.text(gps[3]) == "W" {
+				lon = -lon
+			}
+			p.GPS = &gpsPosition{lat, lon}
+		}
+	}
+	return p
+}
+
+// jpegEXIF finds the EXIF data in the JPEG that head is the start of.
+func jpegEXIF(head []byte) (tiff, bool) {
+	if len(head) < 4 || head[0] != 0xff || head[1] != 0xd8 {
+		return tiff{}, false
+	}
+	for i := 2; i+4 <= len(head); {
+		if head[i] != 0xff {
+			return tiff{}, false
+		}
+		marker := head[i+1]
+		if marker == 0xff {
+			i++ // Padding
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 {
+			break // The image itself, which the EXIF data comes before
+		}
+		n := int(binary.BigEndian.Uint16(head[i+2:]))
+		if n < 2 || i+2+n > len(head) {
+			break
+		}
+		seg := head[i+4 : i+2+n]
+		if marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return newTIFF(seg[6:])
+		}
+		i += 2 + n
+	}
+	return tiff{}, false
+}
+
+// tiff is EXIF data, laid out like a TIFF file: folders (IFDs) of tagged
+// values, which point at each other by offset.
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type tiffValue struct {
+	kind  uint16 // 2 is text, 3 and 4 whole numbers, 5 fractions
+	count uint32
+	data  []byte
+}
+
+func newTIFF(data []byte) (tiff, bool) {
+	if len(data) < 8 {
+		return tiff{}, false
+	}
+	switch string(data[:4]) {
+	case "II*\x00":
+		return tiff{data, binary.LittleEndian}, true
+	case "MM\x00*":
+		return tiff{data, binary.BigEndian}, true
+	}
+	return tiff{}, false
+}
+
+// ifd reads the values in the IFD at off, by tag.
+func (t tiff) ifd(off uint32) map[uint16]tiffValue {
+	values := make(map[uint16]tiffValue)
+	if uint64(off)+2 > uint64(len(t.data)) {
+		return values
+	}
+	n := int(t.order.Uint16(t.data[off:]))
+	for i := range n {
+		e := uint64(off) + 2 + uint64(i)*12
+		if e+12 > uint64(len(t.data)) {
+			break
+		}
+		entry := t.data[e : e+12]
+		v := tiffValue{kind: t.order.Uint16(entry[2:]), count: t.order.Uint32(entry[4:])}
+		size := uint64(v.count)
+		switch v.kind {
+		case 3:
+			size *= 2
+		case 4:
+			size *= 4
+		case 5, 10:
+			size *= 8
+		}
+		if size <= 4 {
+			v.data = entry[8 : 8+size]
+		} else if at := uint64(t.order.Uint32(entry[8:])); at+size <= uint64(len(t.data)) {
+			v.data = t.data[at : at+size]
+		} else {
+			continue
+		}
+		values[t.order.Uint16(entry)] = v
+	}
+	return values
+}
+
+func (t tiff) text(v tiffValue) string {
+	if v.kind != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(v.data), "\x00"))
+}
+
+// number returns a whole-number value, or -1.
+func (t tiff) number(v tiffValue) int64 {
+	switch {
+	case v.kind == 3 && len(v.data) >= 2:
+		return int64(t.order.Uint16(v.data))
+	case v.kind == 4 && len(v.data) >= 4:
+		return int64(t.order.Uint32(v.data))
+	}
+	return -1
+}
+
+// degrees reads a GPS coordinate, stored as degrees, minutes and seconds.
+func (t tiff) degrees(v tiffValue) float64 {
+	if v.kind != 5 || len(v.data) < 24 {
+		return math.NaN()
+	}
+	var dms [3]float64
+	for i := range dms {
+		num, den := t.order.Uint32(v.data[i*8:]), t.order.Uint32(v.data[i*8+4:])
+		if den == 0 {
+			return math.NaN()
+		}
+		dms[i] = float64(num) / float64(den)
+	}
+	return dms[0] + dms[1]/60 + dms[2]/3600
+}
+
+// sortByTaken puts the photos in each folder in the order they were taken,
+// or the other way round, filling in their details. Other files, and photos
+// without a date, stay where they are.
+func sortByTaken(files []fileEntry, desc bool) {
+	slots := make(map[string][]int) // Indexes of each folder's dated photos
+	for i, f := range files {
+		if f.Folder || f.Locked {
+			continue
+		}
+		if files[i].Photo = photoDetails(f.Name); files[i].Photo != nil && !files[i].Photo.Taken.IsZero() {
+			dir := path.Dir(f.Name)
+			slots[dir] = append(slots[dir], i)
+		}
+	}
+	for _, idx := range slots {
+		dated := make([]fileEntry, len(idx))
+		for j, i := range idx {
+			dated[j] = files[i]
+		}
+		slices.SortStableFunc(dated, func(a, b fileEntry) int {
+			if desc {
+				return b.Photo.Taken.Compare(a.Photo.Taken)
+			}
+			return a.Photo.Taken.Compare(b.Photo.Taken)
+		})
+		for j, i := range idx {
+			files[i] = dated[j]
+		}
+	}
+}
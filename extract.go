@@ -0,0 +1,314 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// maxExtractSize is the most an archive may unpack to, --max-extract-size,
+// so a small zip bomb can't fill the disk. 0 is unlimited.
+var maxExtractSize int64
+
+// maxExtractFiles is the most files and folders an archive may unpack to.
+const maxExtractFiles = 10000
+
+// canExtract reports whether r may unpack archives in the share, which
+// like uploading adds files to it.
+func canExtract(r *http.Request) bool {
+	return uploadsEnabled && !receiveOnly && hasRole(r, roleUploader)
+}
+
+var archiveExtensions = []string{".zip", ".tar", ".tar.gz", ".tgz"}
+
+// extractable reports whether name is an archive that can be unpacked.
+func extractable(name string) bool {
+	return archiveExtension(name) != ""
+}
+
+func archiveExtension(name string) string {
+	lower := strings.ToLower(name)
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(lower, ext) {
+			return name[len(name)-len(ext):]
+		}
+	}
+	return ""
+}
+
+// errOutsideArchive is returned for an archive with an entry like
+// ../../etc/passwd, which would be written outside the folder it's
+// extracted to.
+var errOutsideArchive = errors.New("outside the folder")
+
+// apiExtractHandler unpacks the archive at POST /api/extract/PATH into a new
+// folder next to it, named after it, so the files in it can be browsed and
+// downloaded one by one. It answers 201 with the folder's path and how many
+// files were in the archive. Archives that would unpack to more than
+// --max-extract-size or maxExtractFiles are refused with a 413, and ones
+// with entries that lead outside the folder with a 422; either way nothing
+// is left behind.
+func apiExtractHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, ok := safeSharePath(strings.TrimPrefix(r.URL.Path, "/api/extract/"))
+	if !ok || name == "" {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if !canExtract(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if _, locked := lockedBy(r, name); locked {
+		http.Error(w, "Unlock this folder first", http.StatusForbidden)
+		return
+	}
+	info, err := statShared(name)
+	if err != nil || info.IsDir() || !visible(name, false) {
+		http.NotFound(w, r)
+		return
+	}
+	ext := archiveExtension(name)
+	if ext == "" {
+		http.Error(w, "Only .zip, .tar and .tar.gz files can be extracted", http.StatusBadRequest)
+		return
+	}
+	dir := path.Dir(name)
+	if dir == "." {
+		dir = ""
+	}
+	fsys, rel, writable := uploadTarget(dir)
+	mk, canMkdir := fsys.(mkdirFS)
+	if !writable || !canMkdir {
+		http.Error(w, "Files can't be extracted in this folder", http.StatusForbidden)
+		return
+	}
+	f, err := openShared(name)
+	if err != nil {
+		http.Error(w, "Error reading "+name, http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	m, _, _ := resolve(dir)
+	base := strings.TrimSuffix(path.Base(name), ext)
+	folder := path.Join(dir, base)
+	for i := 1; sharedPathTaken(m, folder); i++ {
+		folder = path.Join(dir, fmt.Sprintf("%s (%d)", base, i))
+	}
+	dest := path.Join(rel, path.Base(folder))
+	if err := mk.Mkdir(dest); err != nil {
+		log.Printf("Error making folder %s: %v", folder, err)
+		http.Error(w, "Error making "+folder, http.StatusInternalServerError)
+		return
+	}
+
+	files, err := extractArchive(r, f, info.Size(), strings.ToLower(ext), fsys, dest, folder)
+	if err != nil {
+		if rm, ok := fsys.(removableFS); ok {
+			rm.RemoveAll(dest)
+		}
+		log.Printf("Error extracting %s: %v", name, err)
+		var tooLarge *uploadTooLargeError
+		switch {
+		case errors.As(err, &tooLarge):
+			http.Error(w, tooLarge.Error(), http.StatusRequestEntityTooLarge)
+		case errors.Is(err, errOutsideArchive), errors.Is(err, zip.ErrFormat), errors.Is(err, gzip.ErrHeader), errors.Is(err, tar.ErrHeader):
+			http.Error(w, name+" can't be extracted: "+err.Error(), http.StatusUnprocessableEntity)
+		default:
+			http.Error(w, "Error extracting "+name, http.StatusInternalServerError)
+		}
+		return
+	}
+	log.Printf("Extracted %s into %s (%d files), for %s", name, folder, files, clientIP(r))
+	shareChanged()
+	writeJSON(w, http.StatusCreated, map[string]any{"path": folder, "files": files})
+}
+
+// extractArchive unpacks the archive f, size bytes long, into the folder
+// dest of fsys, which is folder in the share, and returns how many files it
+// held. Hidden files, like the __MACOSX/._ ones macOS adds, and anything
+// that isn't a file or folder, like symlinks, are left out. What's unpacked
+// counts against the --upload-quota of whoever asked, as uploads do, once
+// it's all been extracted.
+func extractArchive(r *http.Request, f fs.File, size int64, ext string, fsys writableFS, dest, folder string) (files int, err error) {
+	var (
+		entries int
+		total   int64
+		charged []*limitedUpload
+		sums    = map[string]string{}
+	)
+	defer func() {
+		for _, l := range charged {
+			l.settle(err == nil)
+		}
+		if err == nil {
+			for p, sum := range sums {
+				checksums.record(p, sum)
+			}
+		}
+	}()
+	limit := &extractLimit{}
+	guard := &spaceGuard{r: limit, fsys: fsys}
+	put := func(name string, isDir bool, size int64, open func() (io.ReadCloser, error)) error {
+		name, keep, err := extractedName(name)
+		if err != nil || !keep {
+			return err
+		}
+		if entries++; entries > maxExtractFiles {
+			return &uploadTooLargeError{fmt.Sprintf("The archive has more than %d files in it", maxExtractFiles)}
+		}
+		if isDir {
+			return mkdirAll(fsys, path.Join(dest, name))
+		}
+		if total += max(size, 0); maxExtractSize > 0 && total > maxExtractSize {
+			return limit.tooLarge()
+		}
+		src, err := open()
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		hashed := newHashingReader(src, name, "")
+		charge := newLimitedUpload(r, hashed)
+		charged = append(charged, charge)
+		limit.r = charge
+		files++
+		if err := fsys.Create(path.Join(dest, name), guard, size); err != nil {
+			return err
+		}
+		sums[path.Join(folder, name)] = hashed.sum()
+		return nil
+	}
+
+	switch ext {
+	case ".zip":
+		ra, ok := f.(io.ReaderAt)
+		if !ok {
+			return 0, errors.New("the archive can't be read in place")
+		}
+		zr, err := zip.NewReader(ra, size)
+		if err != nil && !errors.Is(err, zip.ErrInsecurePath) {
+			return 0, err
+		}
+		// A zip lists its files up front, so one that's too big can be
+		// turned down before anything is written.
+		var claimed uint64
+		for _, zf := range zr.File {
+			claimed += zf.UncompressedSize64
+		}
+		if maxExtractSize > 0 && claimed > uint64(maxExtractSize) {
+			return 0, limit.tooLarge()
+		}
+		if left := quotaLeft(r); left >= 0 && claimed > uint64(left) {
+			return 0, &uploadTooLargeError{quotaMessage(left)}
+		}
+		if msg := spaceMessage(fsys, int64(min(claimed, 1<<62))); msg != "" {
+			return 0, &uploadTooLargeError{msg}
+		}
+		for _, zf := range zr.File {
+			mode := zf.Mode()
+			if !mode.IsDir() && !mode.IsRegular() {
+				continue
+			}
+			if err := put(zf.Name, mode.IsDir(), int64(zf.UncompressedSize64), zf.Open); err != nil {
+				return files, err
+			}
+		}
+	default:
+		var src io.Reader = f
+		if ext != ".tar" {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				return 0, err
+			}
+			defer gz.Close()
+			src = gz
+		}
+		tr := tar.NewReader(src)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return files, err
+			}
+			if h.Typeflag != tar.TypeDir && h.Typeflag != tar.TypeReg {
+				continue
+			}
+			open := func() (io.ReadCloser, error) { return io.NopCloser(tr), nil }
+			if err := put(h.Name, h.Typeflag == tar.TypeDir, h.Size, open); err != nil {
+				return files, err
+			}
+		}
+	}
+	return files, nil
+}
+
+// extractedName checks the name of an entry in an archive, returning it
+// cleaned up and whether it should be extracted at all.
+func extractedName(name string) (string, bool, error) {
+	name = strings.Trim(strings.ReplaceAll(name, `\`, "/"), "/")
+	clean := path.Clean(name)
+	if clean == "." {
+		return "", false, nil
+	}
+	if !fs.ValidPath(clean) || strings.ContainsRune(clean, 0) {
+		return "", false, fmt.Errorf("%q is %w", name, errOutsideArchive)
+	}
+	for elem := range strings.SplitSeq(clean, "/") {
+		if _, ok := uploadName(elem); !ok || elem == "__MACOSX" {
+			return "", false, nil
+		}
+	}
+	return clean, true, nil
+}
+
+// mkdirAll makes the folder name in fsys along with any folders it's in.
+func mkdirAll(fsys writableFS, name string) error {
+	mk, ok := fsys.(mkdirFS)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	p := ""
+	for elem := range strings.SplitSeq(name, "/") {
+		p = path.Join(p, elem)
+		if err := mk.Mkdir(p); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractLimit counts what's unpacked, as archives can claim their files
+// are smaller than they are, and stops at --max-extract-size.
+type extractLimit struct {
+	r    io.Reader
+	read int64
+}
+
+func (l *extractLimit) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if maxExtractSize > 0 && l.read > maxExtractSize {
+		return n, l.tooLarge()
+	}
+	return n, err
+}
+
+func (l *extractLimit) tooLarge() error {
+	return &uploadTooLargeError{"The archive unpacks to more than " + humanSize(maxExtractSize)}
+}
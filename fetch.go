@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+)
+
+// fetchClient downloads files for /api/fetch. There's no overall timeout,
+// as big files take a while, but a server has to start answering in time.
+var fetchClient = &http.Client{Transport: fetchTransport()}
+
+func fetchTransport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = 30 * time.Second
+	return t
+}
+
+// apiFetchHandler downloads a file from the web into the share for the
+// host, so the machine with the fast connection does the downloading and
+// everyone else gets it over the LAN:
+//
+//	POST /api/fetch {"url": "https://...", "dir": "isos", "name": "debian.iso"}
+//
+// dir and name are optional; without a name the file is called what the
+// server or the URL calls it. Once the server answers, it replies 202 with
+// the transfer's id and the share path it's being saved as, and carries on
+// with the download in the background, which shows on the transfer
+// dashboard and can be followed at /progress/ID.
+func apiFetchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		URL  string `json:"url"`
+		Dir  string `json:"dir"`
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "Expected JSON with the url to fetch", http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		http.Error(w, "The url has to be an http or https one", http.StatusBadRequest)
+		return
+	}
+	dir, ok := safeSharePath(req.Dir)
+	fsys, rel, writable := uploadTarget(dir)
+	if !ok || !writable {
+		http.Error(w, "Files can't be saved in that folder", http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	get, _ := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	resp, err := fetchClient.Do(get)
+	if err != nil {
+		cancel()
+		http.Error(w, "Error fetching "+u.Redacted()+": "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		http.Error(w, fmt.Sprintf("%s answered %s", u.Redacted(), resp.Status), http.StatusBadGateway)
+		return
+	}
+	name := req.Name
+	if name == "" {
+		name = fetchedName(resp)
+	}
+	name, ok = uploadName(name)
+	if !ok {
+		resp.Body.Close()
+		cancel()
+		http.Error(w, "Give the file a name to save it as", http.StatusBadRequest)
+		return
+	}
+	if msg := spaceMessage(fsys, resp.ContentLength); msg != "" {
+		resp.Body.Close()
+		cancel()
+		http.Error(w, msg, http.StatusInsufficientStorage)
+		return
+	}
+	if msg := tooLargeMessage(r, resp.ContentLength); msg != "" {
+		resp.Body.Close()
+		cancel()
+		http.Error(w, msg, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	sharePath, fsPath := reserveName(r, fsys, dir, rel, name)
+	kept := keepVersion(r, fsys, sharePath, fsPath)
+	t := transfers.start(ctx, r, "fetch", sharePath, resp.ContentLength)
+	log.Printf("Fetching %s into %s, for %s", u.Redacted(), sharePath, clientIP(r))
+	// Fetched files go through the same limits and scan as uploads.
+	hashed := newHashingReader(resp.Body, name, "")
+	limited := newLimitedUpload(r, hashed)
+	go func() {
+		defer cancel()
+		defer resp.Body.Close()
+		defer release(sharePath)
+		body := &uploadReader{r: &spaceGuard{r: limited, fsys: fsys}, t: t}
+		var err error
+		if scanEnabled() {
+			err = receiveScanned(t, fsys, fsPath, sharePath, body)
+		} else {
+			err = fsys.Create(fsPath, body, resp.ContentLength)
+		}
+		kept.done(err == nil)
+		limited.settle(err == nil)
+		if err != nil {
+			// Expect more than was received, which makes the transfer a failed one.
+			t.size.Store(t.bytes.Load() + 1)
+		}
+		transfers.finish(t)
+		if err != nil {
+			log.Printf("Error fetching %s: %v", u.Redacted(), err)
+			return
+		}
+		checksums.record(sharePath, hashed.sum())
+		shareChanged()
+		log.Printf("Fetched %s into %s", u.Redacted(), sharePath)
+	}()
+	writeJSON(w, http.StatusAccepted, map[string]any{
+		"id":       t.ID,
+		"path":     sharePath,
+		"size":     resp.ContentLength,
+		"progress": fmt.Sprintf("%s/progress/%d", basePath, t.ID),
+	})
+}
+
+// fetchedName is what a fetched file is called: the filename the server
+// gives it, or else the last part of the URL it ended up at.
+func fetchedName(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	if name := path.Base(resp.Request.URL.Path); name != "/" && name != "." {
+		return name
+	}
+	return ""
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+)
+
+var (
+	allowDelete bool // Admins can delete files and folders, --allow-delete
+	allowRename bool // and rename and move them, --allow-rename
+)
+
+// canDelete reports whether r may delete things from the share.
+func canDelete(r *http.Request) bool {
+	return allowDelete && isAdmin(r)
+}
+
+// canRename reports whether r may rename and move things in the share.
+func canRename(r *http.Request) bool {
+	return allowRename && isAdmin(r)
+}
+
+// apiFileHandler describes or changes the file or folder at /api/files/PATH:
+//
+//	GET    /api/files/PATH                 describes a file, with ?hash its SHA-256 too
+//	DELETE /api/files/PATH                 deletes it, and everything in it for a folder
+//	PATCH  /api/files/PATH {"path": "NEW"} renames or moves it, into NEW if that's a folder
+//	PATCH  /api/files/PATH {"tags": [...]} replaces the tags on a file
+//	PATCH  /api/files/PATH {"pinned": true} pins a file to the top of the page, for the host
+//	MKCOL  /api/files/PATH                 makes a new folder there, for uploaders
+func apiFileHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := safeSharePath(strings.TrimPrefix(r.URL.Path, "/api/files/"))
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		apiFileInfo(w, r, name)
+	case http.MethodDelete:
+		deleteFile(w, r, name)
+	case http.MethodPatch:
+		patchFile(w, r, name)
+	case "MKCOL":
+		makeFolder(w, r, name)
+	default:
+		w.Header().Set("Allow", "GET, DELETE, PATCH, MKCOL")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// changeTarget finds the mount holding name, which must be something in the
+// share that r can see, and not the top of a mount.
+func changeTarget(w http.ResponseWriter, r *http.Request, name string) (*mount, string, bool) {
+	m, rel, ok := resolve(name)
+	if !ok || rel == "" {
+		http.Error(w, "The top of the share can't be changed", http.StatusForbidden)
+		return nil, "", false
+	}
+	if _, err := statShared(name); err != nil {
+		http.NotFound(w, r)
+		return nil, "", false
+	}
+	if _, locked := lockedBy(r, name); locked {
+		http.Error(w, "Unlock this folder first", http.StatusForbidden)
+		return nil, "", false
+	}
+	if m.ReadOnly {
+		http.Error(w, "This folder is read-only", http.StatusForbidden)
+		return nil, "", false
+	}
+	return m, rel, true
+}
+
+func deleteFile(w http.ResponseWriter, r *http.Request, name string) {
+	if !canDelete(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	m, rel, ok := changeTarget(w, r, name)
+	if !ok {
+		return
+	}
+	fsys, ok := m.fsys.(removableFS)
+	if !ok {
+		http.Error(w, "Files can't be deleted from this folder", http.StatusForbidden)
+		return
+	}
+	if trashRetention > 0 && canTrash(m) {
+		if err := moveToTrash(r, m, rel, name); err != nil {
+			log.Printf("Error moving %s to the trash: %v", name, err)
+			http.Error(w, "Error deleting "+name, http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Moved %s to the trash, for %s", name, clientIP(r))
+		shareChanged()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := fsys.RemoveAll(rel); err != nil {
+		log.Printf("Error deleting %s: %v", name, err)
+		code := http.StatusInternalServerError
+		if errors.Is(err, fs.ErrPermission) {
+			code = http.StatusForbidden
+		}
+		http.Error(w, "Error deleting "+name, code)
+		return
+	}
+	log.Printf("Deleted %s, for %s", name, clientIP(r))
+	shareChanged()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// patchFile tags, pins or renames name, as the JSON sent says.
+func patchFile(w http.ResponseWriter, r *http.Request, name string) {
+	var req struct {
+		Path   string    `json:"path"`
+		Tags   *[]string `json:"tags"`
+		Pinned *bool     `json:"pinned"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil || req.Path == "" && req.Tags == nil && req.Pinned == nil {
+		http.Error(w, "Expected JSON with the new path, tags or whether it's pinned", http.StatusBadRequest)
+		return
+	}
+	if req.Tags != nil && !tagFile(w, r, name, *req.Tags) {
+		return
+	}
+	if req.Pinned != nil && !pinFile(w, r, name, *req.Pinned) {
+		return
+	}
+	if req.Path == "" {
+		list := tags.get(name)
+		if list == nil {
+			list = []string{}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"path": name, "tags": list, "pinned": pins.pinned(name)})
+		return
+	}
+	renameFile(w, r, name, req.Path)
+}
+
+func renameFile(w http.ResponseWriter, r *http.Request, name, newPath string) {
+	if !canRename(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	m, rel, ok := changeTarget(w, r, name)
+	if !ok {
+		return
+	}
+	fsys, ok := m.fsys.(renameFS)
+	if !ok {
+		http.Error(w, "Files can't be renamed in this folder", http.StatusForbidden)
+		return
+	}
+	info, err := statShared(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	dest, ok := safeSharePath(newPath)
+	if !ok || dest == "" {
+		http.Error(w, "Invalid new path", http.StatusBadRequest)
+		return
+	}
+	// Moving onto a folder, or a path ending in a slash, moves into it.
+	if d, err := statShared(dest); strings.HasSuffix(newPath, "/") || err == nil && d.IsDir() {
+		dest = path.Join(dest, path.Base(name))
+	}
+	if dest == name {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if msg := checkNewPath(r, m, name, dest, info.IsDir()); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if sharedPathTaken(m, dest) {
+		http.Error(w, dest+" already exists", http.StatusConflict)
+		return
+	}
+
+	_, destRel, _ := resolve(dest)
+	if err := fsys.Rename(rel, destRel); err != nil {
+		log.Printf("Error moving %s to %s: %v", name, dest, err)
+		http.Error(w, "Error moving "+name, http.StatusInternalServerError)
+		return
+	}
+	versions.moved(name, dest)
+	tags.moved(name, dest)
+	pins.moved(name, dest)
+	notes.moved(name, dest)
+	log.Printf("Moved %s to %s, for %s", name, dest, clientIP(r))
+	shareChanged()
+	writeJSON(w, http.StatusOK, map[string]string{"path": dest})
+}
+
+// makeFolder makes the folder name for an uploader to send files to, in a
+// folder that takes uploads.
+func makeFolder(w http.ResponseWriter, r *http.Request, name string) {
+	if !uploadsEnabled || !hasRole(r, roleUploader) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if name == "" {
+		http.Error(w, "The top of the share already exists", http.StatusConflict)
+		return
+	}
+	parent, base := path.Dir(name), path.Base(name)
+	if parent == "." {
+		parent = ""
+	}
+	if n, ok := uploadName(base); !ok || n != base {
+		http.Error(w, fmt.Sprintf("Can't use the name %q", base), http.StatusBadRequest)
+		return
+	}
+	if _, err := statShared(parent); err != nil {
+		http.Error(w, "There's no folder "+parent, http.StatusConflict)
+		return
+	}
+	m, rel, ok := resolve(name)
+	if _, _, writable := uploadTarget(parent); !ok || rel == "" || !writable {
+		http.Error(w, "Folders can't be made there", http.StatusForbidden)
+		return
+	}
+	fsys, ok := m.fsys.(mkdirFS)
+	if !ok {
+		http.Error(w, "Folders can't be made there", http.StatusForbidden)
+		return
+	}
+	if !visible(name, true) {
+		http.Error(w, name+" wouldn't be shared", http.StatusBadRequest)
+		return
+	}
+	if _, locked := lockedBy(r, name); locked {
+		http.Error(w, "Unlock this folder first", http.StatusForbidden)
+		return
+	}
+	if sharedPathTaken(m, name) {
+		http.Error(w, name+" already exists", http.StatusConflict)
+		return
+	}
+	if err := fsys.Mkdir(rel); err != nil {
+		log.Printf("Error making folder %s: %v", name, err)
+		http.Error(w, "Error making "+name, http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Made folder %s, for %s", name, clientIP(r))
+	shareChanged()
+	writeJSON(w, http.StatusCreated, map[string]string{"path": name})
+}
+
+// entryFolders lists the folders holding the listed files, to suggest as
+// places to move things to.
+func entryFolders(files []fileEntry) []string {
+	seen := map[string]bool{}
+	for _, f := range files {
+		dir := f.Name
+		if !f.Folder {
+			dir = path.Dir(dir)
+		}
+		for ; dir != "." && !seen[dir]; dir = path.Dir(dir) {
+			seen[dir] = true
+		}
+	}
+	return slices.Sorted(maps.Keys(seen))
+}
+
+// checkNewPath explains what's wrong with dest as a new path for name, a
+// file or folder in m, or returns "" if nothing is. It has to be in the
+// same mount, in a folder that exists, and be a name that would still be
+// shared; a folder can't go inside itself.
+func checkNewPath(r *http.Request, m *mount, name, dest string, isDir bool) string {
+	dm, destRel, ok := resolve(dest)
+	if !ok || dm != m || destRel == "" {
+		return "Files can only be moved within the same shared folder"
+	}
+	if isDir && strings.HasPrefix(dest, name+"/") {
+		return "A folder can't be moved into itself"
+	}
+	if base, ok := uploadName(path.Base(dest)); !ok || base != path.Base(dest) {
+		return fmt.Sprintf("Can't use the name %q", path.Base(dest))
+	}
+	if parent, err := statShared(path.Dir(dest)); path.Dir(dest) != "." && (err != nil || !parent.IsDir()) {
+		return path.Dir(dest) + " isn't a folder"
+	}
+	if !visible(dest, isDir) {
+		return dest + " wouldn't be shared"
+	}
+	if _, locked := lockedBy(r, dest); locked {
+		return "Unlock the destination folder first"
+	}
+	return ""
+}
+
+// sharedPathTaken reports whether anything, even something hidden from the
+// share, is already at dest in m.
+func sharedPathTaken(m *mount, dest string) bool {
+	_, rel, _ := resolve(dest)
+	_, err := fs.Lstat(m.fsys, rel)
+	return !errors.Is(err, fs.ErrNotExist)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// showHidden lists and serves dotfiles and OS clutter too.
+var showHidden bool
+
+// systemFiles are left behind by file managers and never meant for sharing.
+var systemFiles = map[string]bool{
+	"thumbs.db":                 true,
+	"ehthumbs.db":               true,
+	"desktop.ini":               true,
+	"$recycle.bin":              true,
+	"system volume information": true,
+	"icon\r":                    true,
+}
+
+// isHiddenName reports whether a single file or folder name is a dotfile or
+// system file.
+func isHiddenName(name string) bool {
+	return strings.HasPrefix(name, ".") || systemFiles[strings.ToLower(name)]
+}
+
+// globsFlag collects --include or --exclude patterns, in .shareignore
+// syntax.
+type globsFlag []*regexp.Regexp
+
+func (g *globsFlag) String() string {
+	list := make([]string, len(*g))
+	for i, re := range *g {
+		list[i] = re.String()
+	}
+	return strings.Join(list, ",")
+}
+
+func (g *globsFlag) Set(value string) error {
+	re, err := compileGlob(value)
+	if err != nil {
+		return err
+	}
+	*g = append(*g, re)
+	return nil
+}
+
+func (g globsFlag) match(p string) bool {
+	for _, re := range g {
+		if re.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	includeGlobs globsFlag // When set, only matching files are shared
+	excludeGlobs globsFlag // Matching files and folders are left out
+
+	maxDepth int // Folder levels shared below the root, 0 is unlimited
+)
+
+// depth is the number of levels the clean share path p is below the root.
+func depth(p string) int {
+	if p == "" {
+		return 0
+	}
+	return strings.Count(p, "/") + 1
+}
+
+// reservedName reports whether name, at the top of a mount, is one of the
+// folders lanshare keeps its own things in.
+func reservedName(name string) bool {
+	return name == trashDir || name == versionsDir
+}
+
+// visible reports whether the clean share path p, a folder if isDir, may be
+// listed and served. Anything inside a hidden or excluded folder is hidden
+// too.
+func visible(p string, isDir bool) bool {
+	if p == "" {
+		return true
+	}
+	if _, rel, _ := resolve(p); reservedName(strings.Split(rel, "/")[0]) {
+		return false
+	}
+	if maxDepth > 0 && depth(p) > maxDepth {
+		return false
+	}
+	parts := strings.Split(p, "/")
+	for i, name := range parts {
+		if !showHidden && isHiddenName(name) {
+			return false
+		}
+		if excludeGlobs.match(strings.Join(parts[:i+1], "/")) {
+			return false
+		}
+	}
+	if !isDir && len(includeGlobs) > 0 && !includeGlobs.match(p) {
+		return false
+	}
+	return !ignored(p, isDir)
+}
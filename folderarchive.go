@@ -0,0 +1,287 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// zipLevel is how hard folder downloads are compressed, from 1, fastest,
+// to 9, smallest, or 0 to store files as they are, --zip-level.
+var zipLevel = flate.DefaultCompression
+
+// parseZipLevel reads --zip-level: a number from 0 to 9, or store.
+func parseZipLevel(s string) (int, error) {
+	if s == "store" {
+		return flate.NoCompression, nil
+	}
+	level, err := strconv.Atoi(s)
+	if err != nil || level < 0 || level > 9 {
+		return 0, fmt.Errorf("expected store or 0 to 9, got %q", s)
+	}
+	return level, nil
+}
+
+// compressedExtensions are files already compressed, which deflate would
+// spend time on for nothing, so folder zips store them as they are.
+var compressedExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".avif": true, ".heic": true,
+	".mp4": true, ".m4v": true, ".mkv": true, ".mov": true, ".webm": true, ".avi": true, ".wmv": true, ".ogv": true,
+	".mp3": true, ".aac": true, ".m4a": true, ".ogg": true, ".opus": true, ".flac": true, ".weba": true,
+	".zip": true, ".7z": true, ".rar": true, ".gz": true, ".tgz": true, ".xz": true, ".zst": true, ".bz2": true,
+	".apk": true, ".jar": true, ".deb": true, ".rpm": true, ".dmg": true,
+	".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".epub": true,
+}
+
+// maxArchiveDepth stops a folder download going round in circles when a
+// symlink leads back to a folder it's in.
+const maxArchiveDepth = 64
+
+// folderArchiveHandler streams a whole folder as one archive, made as it's
+// sent: /zip/DIR as a .zip, and /tar/DIR as a .tar.gz, which keeps file
+// permissions and symlinks within the folder, as Linux users expect.
+// ?format=zip or ?format=tar.gz picks the other one at either address.
+// Hidden files and password-protected folders that aren't unlocked are left
+// out, as they are from the list.
+func folderArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	kind, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	format := "zip"
+	if kind == "tar" {
+		format = "tar.gz"
+	}
+	switch f := r.URL.Query().Get("format"); f {
+	case "":
+	case "zip", "tar.gz":
+		format = f
+	case "tgz":
+		format = "tar.gz"
+	default:
+		http.Error(w, "The format can be zip or tar.gz", http.StatusBadRequest)
+		return
+	}
+	dir, ok := safeSharePath(rest)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if p, locked := lockedBy(r, dir); locked {
+		redirectToUnlock(w, r, p)
+		return
+	}
+	info, err := statShared(dir)
+	if err != nil || !info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	name := path.Base(dir)
+	if dir == "" {
+		name = "share"
+	}
+	ctype := "application/zip"
+	if format == "tar.gz" {
+		ctype = "application/gzip"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", name+"."+format))
+	setCachePolicy(w, "downloads")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	t := transfers.start(r.Context(), r, "download", strings.TrimPrefix(dir+"/", "/"), -1)
+	w.Header().Set("X-Transfer-ID", strconv.FormatInt(t.ID, 10))
+	out := &transferWriter{ResponseWriter: w, t: t}
+	a := folderArchive{r: r, dir: dir, top: name, t: t}
+	if format == "zip" {
+		err = a.writeZip(out)
+	} else {
+		err = a.writeTarGz(out)
+	}
+	if err != nil {
+		log.Printf("Error sending %s as a %s: %v", name, format, err)
+		// Expect more than was sent, which makes the transfer a failed one.
+		t.size.Store(t.bytes.Load() + 1)
+	}
+	if transfers.finish(t) == transferDone {
+		countDownload()
+	}
+}
+
+// folderArchive is one folder being sent as an archive.
+type folderArchive struct {
+	r   *http.Request
+	dir string
+	top string // The folder everything is in, in the archive
+	t   *transfer
+}
+
+// archivedFile is something in the folder, with its path in the archive.
+type archivedFile struct {
+	sharePath string
+	name      string
+	info      fs.FileInfo
+	link      string // Where a symlink points, when it's kept as one
+}
+
+// walk calls fn for each folder and file under a.dir that the client can
+// see, folders before what's in them. With links, symlinks to something
+// within a.dir are passed on as they are rather than followed.
+func (a *folderArchive) walk(links bool, fn func(archivedFile) error) error {
+	var visit func(p string, depth int) error
+	visit = func(p string, depth int) error {
+		if depth > maxArchiveDepth {
+			return nil
+		}
+		entries, err := readDirShared(p)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			child := path.Join(p, e.Name())
+			if _, locked := lockedBy(a.r, child); locked {
+				continue
+			}
+			name := path.Join(a.top, strings.TrimPrefix(child, a.dir))
+			if links && e.Type()&fs.ModeSymlink != 0 && visible(child, false) {
+				if target, ok := a.linkWithin(child); ok {
+					info, err := e.Info()
+					if err != nil {
+						continue
+					}
+					if err := fn(archivedFile{sharePath: child, name: name, info: info, link: target}); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			info, err := statShared(child)
+			if err != nil {
+				continue // Hidden, or a symlink that isn't followed
+			}
+			if info.IsDir() {
+				if err := fn(archivedFile{sharePath: child, name: name, info: info}); err != nil {
+					return err
+				}
+				if err := visit(child, depth+1); err != nil {
+					return err
+				}
+			} else if info.Mode().IsRegular() {
+				if err := fn(archivedFile{sharePath: child, name: name, info: info}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return visit(a.dir, 0)
+}
+
+// linkWithin returns where the symlink p points to, if that's relative and
+// somewhere inside the folder being sent.
+func (a *folderArchive) linkWithin(p string) (string, bool) {
+	m, rel, ok := resolve(p)
+	if !ok {
+		return "", false
+	}
+	target, err := fs.ReadLink(m.fsys, rel)
+	if err != nil || path.IsAbs(target) {
+		return "", false
+	}
+	dest := path.Join(path.Dir(p), target)
+	if a.dir != "" && !strings.HasPrefix(dest, a.dir+"/") || dest == ".." || strings.HasPrefix(dest, "../") {
+		return "", false
+	}
+	return target, true
+}
+
+// copyFile sends the content of f through the transfer, so it's throttled
+// and can be cancelled like any download.
+func (a *folderArchive) copyFile(dst io.Writer, f archivedFile) error {
+	src, err := openShared(f.sharePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	content := newThrottledReader(a.t.reader(&forwardSeeker{r: src, size: f.info.Size()}), globalLimiter, newByteLimiter(connRate))
+	_, err = io.Copy(dst, content)
+	return err
+}
+
+func (a *folderArchive) writeZip(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, zipLevel)
+	})
+	err := a.walk(false, func(f archivedFile) error {
+		h, err := zip.FileInfoHeader(f.info)
+		if err != nil {
+			return err
+		}
+		h.Name = f.name
+		if f.info.IsDir() {
+			h.Name += "/"
+			_, err := zw.CreateHeader(h)
+			return err
+		}
+		h.Method = zip.Deflate
+		if zipLevel == flate.NoCompression || compressedExtensions[strings.ToLower(path.Ext(f.name))] {
+			h.Method = zip.Store
+		}
+		dst, err := zw.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+		return a.copyFile(dst, f)
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func (a *folderArchive) writeTarGz(w io.Writer) error {
+	gz, err := gzip.NewWriterLevel(w, zipLevel)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(gz)
+	err = a.walk(true, func(f archivedFile) error {
+		h := &tar.Header{
+			Name:    f.name,
+			Mode:    int64(f.info.Mode().Perm()),
+			ModTime: f.info.ModTime().Truncate(time.Second),
+			Format:  tar.FormatPAX,
+		}
+		switch {
+		case f.link != "":
+			h.Typeflag, h.Linkname = tar.TypeSymlink, f.link
+		case f.info.IsDir():
+			h.Typeflag = tar.TypeDir
+			h.Name += "/"
+		default:
+			h.Typeflag, h.Size = tar.TypeReg, f.info.Size()
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg {
+			return nil
+		}
+		return a.copyFile(tw, f)
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Join(tw.Close(), gz.Close())
+}
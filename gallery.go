@@ -0,0 +1,104 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// galleryImage is a picture in a gallery, with where to get it at the size
+// of the screen.
+type galleryImage struct {
+	Name  string `json:"name"`
+	Thumb string `json:"-"`
+	Large string `json:"large"`
+	View  string `json:"view"`
+}
+
+// galleryFolders returns the folders in files that are mostly pictures,
+// "" being the top of the share, for the list to link to their galleries.
+func galleryFolders(files []fileEntry) []string {
+	images, all := make(map[string]int), make(map[string]int)
+	var folders []string
+	for _, f := range files {
+		if f.Folder {
+			continue
+		}
+		dir := folderOf(f.Name)
+		if all[dir] == 0 {
+			folders = append(folders, dir)
+		}
+		all[dir]++
+		if previewImage(f.Type) {
+			images[dir]++
+		}
+	}
+	var galleries []string
+	for _, dir := range folders {
+		if images[dir] >= 2 && images[dir]*2 >= all[dir] {
+			galleries = append(galleries, dir)
+		}
+	}
+	return galleries
+}
+
+func folderOf(name string) string {
+	if dir := path.Dir(name); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+// galleryHandler shows the pictures in the folder at /gallery/PATH as a
+// grid of thumbnails. Tapping one opens it across the whole screen, where
+// the arrow keys or a swipe go through the rest, and the slideshow button
+// does that by itself.
+func galleryHandler(w http.ResponseWriter, r *http.Request) {
+	dir := strings.Trim(strings.TrimPrefix(r.URL.Path, "/gallery"), "/")
+	if dir != "" {
+		var ok bool
+		if dir, ok = safeSharePath(dir); !ok {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	files, err := listEntries(r)
+	if err != nil {
+		http.Error(w, "Error listing files", http.StatusInternalServerError)
+		return
+	}
+	sortEntries(files, parseSort(r.URL.Query()))
+	var images []galleryImage
+	for _, f := range files {
+		if f.Folder || f.Locked || folderOf(f.Name) != dir || !previewImage(f.Type) {
+			continue
+		}
+		img := galleryImage{
+			Name:  f.Name,
+			Thumb: basePath + "/thumb/" + escapePath(f.Name) + "?w=300",
+			Large: basePath + "/download/" + escapePath(f.Name),
+			View:  basePath + "/view/" + escapePath(f.Name),
+		}
+		if canResize(f.Type) {
+			img.Large = basePath + "/img/" + escapePath(f.Name) + "?w=2048"
+		}
+		images = append(images, img)
+	}
+	if len(images) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	data := struct {
+		Folder string
+		Images []galleryImage
+	}{dir, images}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := galleryTemplate.Execute(w, data); err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	}
+}
+
+var galleryTemplate = newPage("gallery", template.FuncMap{
+	"base": path.Base,
+})
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// defaultCSP allows what the pages need, inline styles and scripts, and
+// images, video and audio from the share itself, and nothing else.
+const defaultCSP = "default-src 'self'; img-src 'self' data: blob:; media-src 'self' blob:; " +
+	"style-src 'self' 'unsafe-inline'; script-src 'self' 'unsafe-inline'; " +
+	"object-src 'none'; base-uri 'self'; frame-ancestors 'self'"
+
+// securityHeaders are sent with every response. --csp and --header change
+// them.
+var securityHeaders = map[string]string{
+	"Content-Security-Policy": defaultCSP,
+	"X-Content-Type-Options":  "nosniff",
+	"X-Frame-Options":         "SAMEORIGIN",
+	"Referrer-Policy":         "no-referrer", // Keeps signed URLs out of other sites' logs
+	"Permissions-Policy":      "camera=(), microphone=(), geolocation=()",
+}
+
+// headerFlag collects --header "Name: value" options. An empty value removes
+// a default header.
+type headerFlag struct{}
+
+func (headerFlag) String() string { return "" }
+
+func (headerFlag) Set(value string) error {
+	name, v, ok := strings.Cut(value, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return fmt.Errorf(`expected "Name: value", got %q`, value)
+	}
+	securityHeaders[textproto.CanonicalMIMEHeaderKey(name)] = strings.TrimSpace(v)
+	return nil
+}
+
+func securityHeadersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		for name, value := range securityHeaders {
+			if value != "" {
+				h.Set(name, value)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"path"
+	"strings"
+)
+
+// syntax is what the highlighter needs to know about a language: its
+// comments, string quotes and keywords. It doesn't parse anything, so it
+// gets unusual code wrong now and then, but it's right about nearly all
+// the code people share.
+type syntax struct {
+	lineComments []string
+	blockComment [2]string
+	quotes       string
+	tripleQuotes bool   // Python's """ strings
+	keywords     string // Separated by spaces
+}
+
+var (
+	cSyntax = syntax{lineComments: []string{"//"}, blockComment: [2]string{"/*", "*/"}, quotes: `"'`,
+		keywords: "auto break case char const continue default do double else enum extern float for goto if inline int long register return short signed sizeof static struct switch typedef union unsigned void volatile while bool true false NULL nullptr class public private protected virtual template typename namespace using new delete this throw try catch include define"}
+	goSyntax = syntax{lineComments: []string{"//"}, blockComment: [2]string{"/*", "*/"}, quotes: "\"'`",
+		keywords: "break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var true false nil iota any error string bool byte rune int int8 int16 int32 int64 uint uint8 uint16 uint32 uint64 uintptr float32 float64 complex64 complex128 append cap clear close copy delete len make max min new panic print println recover"}
+	jsSyntax = syntax{lineComments: []string{"//"}, blockComment: [2]string{"/*", "*/"}, quotes: "\"'`",
+		keywords: "async await break case catch class const continue debugger default delete do else export extends false finally for from function if import in instanceof let new null of return static super switch this throw true try typeof undefined var void while with yield interface type enum implements private public protected readonly as"}
+	javaSyntax = syntax{lineComments: []string{"//"}, blockComment: [2]string{"/*", "*/"}, quotes: `"'`,
+		keywords: "abstract boolean break byte case catch char class const continue default do double else enum extends final finally float for if implements import instanceof int interface long native new null package private protected public return short static super switch synchronized this throw throws transient true false try void volatile while var val fun object when is in override namespace using string bool"}
+	rustSyntax = syntax{lineComments: []string{"//"}, blockComment: [2]string{"/*", "*/"}, quotes: `"`,
+		keywords: "as async await break const continue crate dyn else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while Some None Ok Err"}
+	pythonSyntax = syntax{lineComments: []string{"#"}, quotes: `"'`, tripleQuotes: true,
+		keywords: "and as assert async await break class continue def del elif else except False finally for from global if import in is lambda None nonlocal not or pass raise return True try while with yield self print"}
+	shellSyntax = syntax{lineComments: []string{"#"}, quotes: `"'`,
+		keywords: "if then else elif fi case esac for select while until do done in function time return exit export local readonly set unset echo cd source"}
+	rubySyntax = syntax{lineComments: []string{"#"}, quotes: `"'`,
+		keywords: "alias and begin break case class def defined do else elsif end ensure false for if in module next nil not or redo rescue retry return self super then true undef unless until when while yield require"}
+	sqlSyntax = syntax{lineComments: []string{"--"}, blockComment: [2]string{"/*", "*/"}, quotes: `"'`,
+		keywords: "select from where and or not insert into values update set delete create table drop alter index primary key foreign references join left right inner outer on group by order having limit offset as distinct null is in like between union all case when then else end begin commit rollback SELECT FROM WHERE AND OR NOT INSERT INTO VALUES UPDATE SET DELETE CREATE TABLE DROP ALTER INDEX PRIMARY KEY FOREIGN REFERENCES JOIN LEFT RIGHT INNER OUTER ON GROUP BY ORDER HAVING LIMIT OFFSET AS DISTINCT NULL IS IN LIKE BETWEEN UNION ALL CASE WHEN THEN ELSE END BEGIN COMMIT ROLLBACK"}
+	luaSyntax = syntax{lineComments: []string{"--"}, quotes: `"'`,
+		keywords: "and break do else elseif end false for function goto if in local nil not or repeat return then true until while"}
+	confSyntax  = syntax{lineComments: []string{"#", ";"}, quotes: `"'`, keywords: "true false yes no on off null"}
+	jsonSyntax  = syntax{quotes: `"`, keywords: "true false null"}
+	cssSyntax   = syntax{blockComment: [2]string{"/*", "*/"}, quotes: `"'`, keywords: "important"}
+	htmlSyntax  = syntax{blockComment: [2]string{"<!--", "-->"}, quotes: `"'`}
+	plainSyntax = syntax{}
+)
+
+// syntaxes picks the syntax of a file by its extension, or for a few files
+// without one, its name.
+var syntaxes = map[string]*syntax{
+	".c": &cSyntax, ".h": &cSyntax, ".cc": &cSyntax, ".cpp": &cSyntax, ".hpp": &cSyntax, ".ino": &cSyntax,
+	".go": &goSyntax,
+	".js": &jsSyntax, ".mjs": &jsSyntax, ".cjs": &jsSyntax, ".jsx": &jsSyntax, ".ts": &jsSyntax, ".tsx": &jsSyntax,
+	".java": &javaSyntax, ".kt": &javaSyntax, ".kts": &javaSyntax, ".cs": &javaSyntax, ".scala": &javaSyntax, ".dart": &javaSyntax, ".swift": &javaSyntax, ".php": &javaSyntax,
+	".rs": &rustSyntax,
+	".py": &pythonSyntax, ".pyw": &pythonSyntax,
+	".sh": &shellSyntax, ".bash": &shellSyntax, ".zsh": &shellSyntax, "Makefile": &shellSyntax, "Dockerfile": &shellSyntax, ".mk": &shellSyntax,
+	".rb": &rubySyntax, ".pl": &rubySyntax,
+	".sql": &sqlSyntax,
+	".lua": &luaSyntax, ".hs": &luaSyntax,
+	".yaml": &confSyntax, ".yml": &confSyntax, ".toml": &confSyntax, ".ini": &confSyntax, ".conf": &confSyntax, ".cfg": &confSyntax, ".env": &confSyntax, ".properties": &confSyntax,
+	".json": &jsonSyntax, ".geojson": &jsonSyntax,
+	".css": &cssSyntax, ".scss": &cssSyntax, ".less": &cssSyntax,
+	".html": &htmlSyntax, ".htm": &htmlSyntax, ".xml": &htmlSyntax, ".vue": &htmlSyntax,
+}
+
+// syntaxFor returns the syntax of the file name, if it's one the viewer
+// knows.
+func syntaxFor(name string) (*syntax, bool) {
+	if s, ok := syntaxes[path.Base(name)]; ok {
+		return s, true
+	}
+	s, ok := syntaxes[strings.ToLower(path.Ext(name))]
+	return s, ok
+}
+
+// highlight splits src into lines of HTML, with comments, strings, numbers
+// and keywords marked by class: hl-c, hl-s, hl-n and hl-k.
+func highlight(src string, s *syntax) []template.HTML {
+	keywords := make(map[string]bool)
+	for _, k := range strings.Fields(s.keywords) {
+		keywords[k] = true
+	}
+
+	var lines []template.HTML
+	var line strings.Builder
+	emit := func(class, text string) {
+		for {
+			part, rest, more := strings.Cut(text, "\n")
+			if part != "" {
+				if class != "" {
+					line.WriteString(`<span class="` + class + `">` + html.EscapeString(part) + "</span>")
+				} else {
+					line.WriteString(html.EscapeString(part))
+				}
+			}
+			if !more {
+				return
+			}
+			lines = append(lines, template.HTML(line.String()))
+			line.Reset()
+			text = rest
+		}
+	}
+
+	for i := 0; i < len(src); {
+		rest := src[i:]
+		n, class := 1, ""
+		switch c := src[i]; {
+		case s.blockComment[0] != "" && strings.HasPrefix(rest, s.blockComment[0]):
+			n = len(rest)
+			if end := strings.Index(rest[len(s.blockComment[0]):], s.blockComment[1]); end >= 0 {
+				n = len(s.blockComment[0]) + end + len(s.blockComment[1])
+			}
+			class = "hl-c"
+
+		case startsLineComment(rest, s.lineComments):
+			n = strings.IndexByte(rest, '\n')
+			if n < 0 {
+				n = len(rest)
+			}
+			class = "hl-c"
+
+		case s.tripleQuotes && (strings.HasPrefix(rest, `"""`) || strings.HasPrefix(rest, "'''")):
+			n = len(rest)
+			if end := strings.Index(rest[3:], rest[:3]); end >= 0 {
+				n = 3 + end + 3
+			}
+			class = "hl-s"
+
+		case strings.IndexByte(s.quotes, c) >= 0:
+			n = stringLength(rest)
+			class = "hl-s"
+
+		case '0' <= c && c <= '9' && (i == 0 || !isWordByte(src[i-1])):
+			for n < len(rest) && (isWordByte(rest[n]) || rest[n] == '.') {
+				n++
+			}
+			class = "hl-n"
+
+		case isWordByte(c):
+			for n < len(rest) && isWordByte(rest[n]) {
+				n++
+			}
+			if keywords[rest[:n]] {
+				class = "hl-k"
+			}
+		}
+		emit(class, rest[:n])
+		i += n
+	}
+	return append(lines, template.HTML(line.String()))
+}
+
+func startsLineComment(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// stringLength returns the length of the quoted string at the start of s,
+// which ends at its closing quote, or at the end of the line for all but
+// backquoted strings.
+func stringLength(s string) int {
+	quote := s[0]
+	for j := 1; j < len(s); j++ {
+		switch {
+		case s[j] == '\\' && quote != '`':
+			j++
+		case s[j] == quote:
+			return j + 1
+		case s[j] == '\n' && quote != '`':
+			return j
+		}
+	}
+	return len(s)
+}
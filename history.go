@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// historyRecord is a completed transfer as stored in the history file.
+type historyRecord struct {
+	Kind     string    `json:"kind"`
+	File     string    `json:"file"`
+	Client   string    `json:"client"`
+	Bytes    int64     `json:"bytes"`
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration"` // Seconds
+}
+
+// historyStore appends transfer records to a JSON-lines file, one record
+// per line, so it survives restarts and can be inspected with any text tool.
+type historyStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// history is nil when the state directory isn't usable.
+var history *historyStore
+
+func openHistory(dir string) (*historyStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &historyStore{path: filepath.Join(dir, "history.jsonl")}, nil
+}
+
+func (h *historyStore) add(rec historyRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// recent returns up to limit records, newest first. A limit of 0 returns
+// everything.
+func (h *historyStore) recent(limit int) ([]historyRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []historyRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec historyRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) == nil {
+			records = append(records, rec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+// recordHistory saves a finished transfer, logging rather than failing when
+// the history file can't be written.
+func recordHistory(t *transfer) {
+	if history == nil {
+		return
+	}
+	err := history.add(historyRecord{
+		Kind:     t.Kind,
+		File:     t.File,
+		Client:   t.Client,
+		Bytes:    t.bytes.Load(),
+		Time:     t.ended,
+		Duration: t.ended.Sub(t.Started).Seconds(),
+	})
+	if err != nil {
+		log.Println("Error writing history:", err)
+	}
+}
+
+// defaultStateDir is where history and other persistent state live unless
+// --state-dir says otherwise.
+func defaultStateDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".lanshare"
+	}
+	return filepath.Join(dir, "lanshare")
+}
+
+func historyPageHandler(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = 200
+	}
+
+	var records []historyRecord
+	if history != nil {
+		var err error
+		records, err = history.recent(limit)
+		if err != nil {
+			http.Error(w, "Error reading history", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := historyTemplate.Execute(w, records)
+	if err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	}
+}
+
+var historyTemplate = newPage("history", template.FuncMap{
+	"seconds": func(s float64) string {
+		return time.Duration(s * float64(time.Second)).Round(time.Millisecond).String()
+	},
+})
+
+// historyCommand implements the "history" subcommand, printing recent
+// transfers from the history file.
+func historyCommand(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	dir := fs.String("state-dir", defaultStateDir(), "directory holding persistent state")
+	limit := fs.Int("n", 20, "number of transfers to show (0 shows all)")
+	fs.Parse(args)
+
+	h, err := openHistory(*dir)
+	if err != nil {
+		log.Fatal("Error opening history:", err)
+	}
+	records, err := h.recent(*limit)
+	if err != nil {
+		log.Fatal("Error reading history:", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tKIND\tFILE\tCLIENT\tBYTES\tDURATION")
+	for _, rec := range records {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n",
+			rec.Time.Format("2006-01-02 15:04:05"), rec.Kind, rec.File, rec.Client, rec.Bytes,
+			time.Duration(rec.Duration*float64(time.Second)).Round(time.Millisecond))
+	}
+	tw.Flush()
+}
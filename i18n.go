@@ -0,0 +1,107 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// language is one the pages can be shown in.
+type language struct {
+	Code string // As in Accept-Language and ?lang=
+	Name string // In itself, for the picker
+}
+
+// languages are the ones there are messages for, English first as what
+// the pages are written in.
+var languages = []language{
+	{"en", "English"},
+	{"bn", "বাংলা"},
+}
+
+// catalogs translate the English messages in the pages, by language.
+// Messages missing from one are shown in English.
+var catalogs = map[string]map[string]string{
+	"bn": bnMessages,
+}
+
+// langCookie remembers the language picked on the page.
+const langCookie = "lanshare_lang"
+
+// pageLanguage returns the code of the language to show r the pages in:
+// from ?lang= if given, which it remembers, or else the one last picked,
+// or else the first one the browser asks for in Accept-Language that there
+// are messages for, or else English.
+func pageLanguage(w http.ResponseWriter, r *http.Request) string {
+	if lang := r.URL.Query().Get("lang"); knownLanguage(lang) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     langCookie,
+			Value:    lang,
+			Path:     basePath + "/",
+			MaxAge:   365 * 24 * 60 * 60,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return lang
+	}
+	if c, err := r.Cookie(langCookie); err == nil && knownLanguage(c.Value) {
+		return c.Value
+	}
+	for _, lang := range acceptedLanguages(r.Header.Get("Accept-Language")) {
+		if knownLanguage(lang) {
+			return lang
+		}
+	}
+	return "en"
+}
+
+func knownLanguage(code string) bool {
+	return slices.ContainsFunc(languages, func(l language) bool { return l.Code == code })
+}
+
+// acceptedLanguages returns the primary language codes in an
+// Accept-Language header, lowercased, the most wanted first.
+func acceptedLanguages(header string) []string {
+	type choice struct {
+		code string
+		q    float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		c := choice{code: strings.ToLower(strings.TrimSpace(tag)), q: 1}
+		c.code, _, _ = strings.Cut(c.code, "-")
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if q, err := strconv.ParseFloat(v, 64); err == nil {
+				c.q = q
+			}
+		}
+		if c.code != "" && c.code != "*" && c.q > 0 {
+			choices = append(choices, c)
+		}
+	}
+	slices.SortStableFunc(choices, func(a, b choice) int { return cmp.Compare(b.q, a.q) })
+	codes := make([]string, len(choices))
+	for i, c := range choices {
+		codes[i] = c.code
+	}
+	return codes
+}
+
+// translator returns the "t" function the page templates use for their
+// text in lang: it looks msg up in the catalog and fills in args as
+// fmt.Sprintf does.
+func translator(lang string) func(msg string, args ...any) string {
+	messages := catalogs[lang]
+	return func(msg string, args ...any) string {
+		if m, ok := messages[msg]; ok {
+			msg = m
+		}
+		if len(args) == 0 {
+			return msg
+		}
+		return fmt.Sprintf(msg, args...)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// netsFlag collects CIDR ranges, or single addresses, from a repeatable
+// comma-separated option.
+type netsFlag []*net.IPNet
+
+func (f *netsFlag) String() string {
+	list := make([]string, len(*f))
+	for i, n := range *f {
+		list[i] = n.String()
+	}
+	return strings.Join(list, ",")
+}
+
+func (f *netsFlag) Set(value string) error {
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return fmt.Errorf("invalid address %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			*f = append(*f, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		*f = append(*f, n)
+	}
+	return nil
+}
+
+func (f netsFlag) contains(ip net.IP) bool {
+	for _, n := range f {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	allowNets      netsFlag // When set, only these clients get in
+	denyNets       netsFlag // Always turned away
+	trustedProxies netsFlag // Reverse proxies whose X-Forwarded-For we believe
+)
+
+// ipFilterMiddleware turns away clients outside --allow or inside --deny.
+// Loopback requests are let through unless denied explicitly, so the admin
+// pages stay reachable from the host, though not ones a proxy passed on.
+// Clients a trusted proxy didn't give the address of are turned away.
+func ipFilterMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(clientIP(r))
+		if ip == nil || denyNets.contains(ip) ||
+			(len(allowNets) > 0 && !allowNets.contains(ip) && (!ip.IsLoopback() || viaProxy(r))) {
+			log.Printf("Refused request from %s for %s", cmp.Or(clientIP(r), "an unknown client"), r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClientIP returns the client address a trusted proxy passed on in
+// X-Forwarded-For. The header is read right to left, skipping our own
+// proxies, since anything further left could have been made up by the
+// client. It's "" when the proxy didn't say, as the client is unknown
+// then, and not the proxy itself.
+func forwardedClientIP(r *http.Request) string {
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		parsed := net.ParseIP(strings.TrimSpace(hops[i]))
+		if parsed == nil {
+			break
+		}
+		if !trustedProxies.contains(parsed) {
+			return parsed.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNetsFlag(t *testing.T) {
+	tests := []struct {
+		value   string
+		ok      bool
+		in, out []string
+		nets    int
+	}{
+		{"192.168.1.0/24", true, []string{"192.168.1.1", "192.168.1.255"}, []string{"192.168.2.1", "10.0.0.1"}, 1},
+		{"10.0.0.5", true, []string{"10.0.0.5"}, []string{"10.0.0.6"}, 1},
+		{"10.0.0.5, fd00::/8 ,", true, []string{"10.0.0.5", "fd12::1"}, []string{"fe80::1"}, 2},
+		{"::1", true, []string{"::1"}, []string{"127.0.0.1"}, 1},
+		{"localhost", false, nil, nil, 0},
+		{"10.0.0.0/33", false, nil, nil, 0},
+		{"10.0.0.0/8,nope", false, nil, nil, 0},
+	}
+	for _, tt := range tests {
+		var f netsFlag
+		err := f.Set(tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("Set(%q) error = %v, want ok = %v", tt.value, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if len(f) != tt.nets {
+			t.Errorf("Set(%q) gave %d networks, want %d", tt.value, len(f), tt.nets)
+		}
+		for _, ip := range tt.in {
+			if !f.contains(net.ParseIP(ip)) {
+				t.Errorf("%q doesn't contain %s", tt.value, ip)
+			}
+		}
+		for _, ip := range tt.out {
+			if f.contains(net.ParseIP(ip)) {
+				t.Errorf("%q contains %s", tt.value, ip)
+			}
+		}
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	withNets(t, &allowNets, "192.168.1.0/24")
+	withNets(t, &denyNets, "192.168.1.66,127.0.0.2")
+	h := ipFilterMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		remote string
+		header string // A forwarding header the client sent itself
+		status int
+	}{
+		{"192.168.1.20:4000", "", http.StatusOK},
+		{"192.168.1.66:4000", "", http.StatusForbidden},
+		{"10.0.0.1:4000", "", http.StatusForbidden},
+		{"10.0.0.1:4000", "192.168.1.20", http.StatusForbidden},
+		{"127.0.0.1:4000", "", http.StatusOK},
+		{"127.0.0.2:4000", "", http.StatusForbidden},
+		{"127.0.0.1:4000", "10.0.0.1", http.StatusForbidden}, // An untrusted proxy on the host
+		{"not an address", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.header != "" {
+			r.Header.Set("X-Forwarded-For", tt.header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("from %s, X-Forwarded-For %q: status %d, want %d", tt.remote, tt.header, w.Code, tt.status)
+		}
+	}
+}
+
+func TestForwardedClientIP(t *testing.T) {
+	withNets(t, &trustedProxies, "10.0.0.1,10.0.0.2")
+	tests := []struct {
+		remote string
+		hops   []string // X-Forwarded-For headers, in order
+		want   string
+	}{
+		{"192.168.1.20:4000", []string{"203.0.113.7"}, "192.168.1.20"}, // Not a proxy, the header is ignored
+		{"10.0.0.1:4000", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"10.0.0.1:4000", []string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7"}, // The client made up the first
+		{"10.0.0.1:4000", []string{"203.0.113.7, 10.0.0.2"}, "203.0.113.7"},     // Through both proxies
+		{"10.0.0.1:4000", []string{"198.51.100.1", "203.0.113.7"}, "203.0.113.7"},
+		{"10.0.0.1:4000", []string{"203.0.113.7 , junk"}, ""},
+		{"10.0.0.1:4000", nil, ""},
+		{"[::1]:4000", nil, "::1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remote
+		for _, h := range tt.hops {
+			r.Header.Add("X-Forwarded-For", h)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("from %s, X-Forwarded-For %q: clientIP = %q, want %q", tt.remote, tt.hops, got, tt.want)
+		}
+	}
+}
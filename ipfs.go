@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ipfsAPI     string // The local IPFS node's HTTP API, --ipfs-api, "" for none
+	ipfsGateway string // Where CIDs are linked to, --ipfs-gateway
+)
+
+// ipfsRecord is what a file was published to IPFS as.
+type ipfsRecord struct {
+	CID      string    `json:"cid"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	At       time.Time `json:"at"`
+}
+
+// ipfsStore remembers the files published to IPFS, by share path, saved to
+// the state directory, so their CIDs stay on the page.
+type ipfsStore struct {
+	mu      sync.Mutex
+	path    string
+	records map[string]ipfsRecord
+}
+
+var published *ipfsStore
+
+func openIPFS(dir string) (*ipfsStore, error) {
+	s := &ipfsStore{path: filepath.Join(dir, "ipfs.json"), records: map[string]ipfsRecord{}}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.records); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// save must be called with s.mu held.
+func (s *ipfsStore) save() {
+	data, err := json.Marshal(s.records)
+	if err == nil {
+		err = writeFileAtomic(s.path, data)
+	}
+	if err != nil {
+		log.Println("Error saving IPFS records:", err)
+	}
+}
+
+// cid returns the CID p was published as, if it hasn't changed since.
+func (s *ipfsStore) cid(p string, info fs.FileInfo) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.records[p]
+	if !ok || rec.Size != info.Size() || !rec.Modified.Equal(info.ModTime()) {
+		return ""
+	}
+	return rec.CID
+}
+
+func (s *ipfsStore) set(p string, rec ipfsRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[p] = rec
+	s.save()
+}
+
+// ipfsLink is where the file name with the given CID can be fetched from
+// anywhere.
+func ipfsLink(cid, name string) string {
+	return strings.TrimSuffix(ipfsGateway, "/") + "/ipfs/" + cid + "?filename=" + url.QueryEscape(path.Base(name))
+}
+
+// apiIPFSHandler publishes files to IPFS, through the local node at
+// --ipfs-api, which adds and pins them:
+//
+//	GET  /api/ipfs/PATH  what the file was published as, or 404
+//	POST /api/ipfs/PATH  publishes it, for the host
+//
+// Both answer {"cid": "...", "url": "..."}, the url being the file on the
+// --ipfs-gateway.
+func apiIPFSHandler(w http.ResponseWriter, r *http.Request) {
+	if ipfsAPI == "" {
+		http.NotFound(w, r)
+		return
+	}
+	name, ok := safeSharePath(strings.TrimPrefix(r.URL.Path, "/api/ipfs/"))
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if _, locked := lockedBy(r, name); locked {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	info, err := statShared(name)
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		cid := published.cid(name, info)
+		if cid == "" {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"cid": cid, "url": ipfsLink(cid, name)})
+	case http.MethodPost:
+		if !isAdmin(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		cid, err := addToIPFS(r, name)
+		if err != nil {
+			log.Printf("Error publishing %s to IPFS: %v", name, err)
+			http.Error(w, "Error publishing to IPFS: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		published.set(name, ipfsRecord{CID: cid, Size: info.Size(), Modified: info.ModTime(), At: time.Now()})
+		log.Printf("Published %s to IPFS as %s, for %s", name, cid, clientIP(r))
+		writeJSON(w, http.StatusOK, map[string]string{"cid": cid, "url": ipfsLink(cid, name)})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// addToIPFS streams the shared file name to the node's /api/v0/add, pinned,
+// and returns its CID.
+func addToIPFS(r *http.Request, name string) (string, error) {
+	f, err := openShared(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	body, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		part, err := form.CreateFormFile("file", path.Base(name))
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	q := url.Values{"pin": {"true"}, "cid-version": {"1"}, "quieter": {"true"}}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, strings.TrimSuffix(ipfsAPI, "/")+"/api/v0/add?"+q.Encode(), body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		body.CloseWithError(err)
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return "", fmt.Errorf("the node answered %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var added struct{ Hash string }
+	if err := json.NewDecoder(resp.Body).Decode(&added); err != nil || added.Hash == "" {
+		return "", fmt.Errorf("the node didn't say what it added it as")
+	}
+	return added.Hash, nil
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ldapBackend checks passwords against an LDAP directory or Active
+// Directory: it looks the user up with a service account, binds as the
+// user to verify the password, and maps their groups to a role. It speaks
+// just enough of the LDAPv3 protocol for that.
+type ldapBackend struct {
+	URL          string // ldap://host:389 or ldaps://host:636
+	BindDN       string // Service account used for the search, anonymous if empty
+	BindPassword string
+	BaseDN       string
+	UserFilter   string // %s is replaced with the escaped username
+	GroupAttr    string // Attribute listing the user's groups
+	RoleMap      map[string]string
+	DefaultRole  string // Role for users matching nothing, "" denies them
+}
+
+// ldap is nil unless --ldap-url is set.
+var ldap *ldapBackend
+
+// ldapRoleFlag collects --ldap-role role=group options.
+type ldapRoleFlag map[string]string
+
+func (f ldapRoleFlag) String() string { return fmt.Sprint(map[string]string(f)) }
+
+func (f ldapRoleFlag) Set(value string) error {
+	role, group, ok := strings.Cut(value, "=")
+	if _, known := roleRank[role]; !ok || !known || group == "" {
+		return fmt.Errorf("expected role=group, got %q", value)
+	}
+	f[strings.ToLower(group)] = role
+	return nil
+}
+
+var ldapRoles = ldapRoleFlag{}
+
+// authenticate returns the directory user matching name and password, or
+// nil if the credentials are wrong or the user has no role.
+func (l *ldapBackend) authenticate(name, password string) (*user, error) {
+	// An empty password would be an "unauthenticated bind", which many
+	// servers accept for any DN.
+	if name == "" || password == "" {
+		return nil, nil
+	}
+
+	conn, err := l.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+
+	if err := conn.bind(l.BindDN, l.BindPassword); err != nil {
+		return nil, fmt.Errorf("service bind: %w", err)
+	}
+	filter := strings.ReplaceAll(l.UserFilter, "%s", ldapEscape(name))
+	entries, err := conn.search(l.BaseDN, filter, []string{l.GroupAttr})
+	if err != nil {
+		return nil, fmt.Errorf("user search: %w", err)
+	}
+	if len(entries) != 1 {
+		return nil, nil
+	}
+	entry := entries[0]
+
+	err = conn.bind(entry.dn, password)
+	if errors.Is(err, errLDAPInvalidCredentials) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	role := l.DefaultRole
+	for _, group := range entry.attrs[strings.ToLower(l.GroupAttr)] {
+		for _, key := range []string{strings.ToLower(group), strings.ToLower(groupCN(group))} {
+			if mapped, ok := l.RoleMap[key]; ok && roleRank[mapped] > roleRank[role] {
+				role = mapped
+			}
+		}
+	}
+	if role == "" {
+		return nil, nil
+	}
+	return &user{Name: name, Role: role, external: true}, nil
+}
+
+// groupCN returns the CN of a group DN, so roles can be mapped by plain
+// group name as well as by full DN.
+func groupCN(dn string) string {
+	first, _, _ := strings.Cut(dn, ",")
+	if attr, value, ok := strings.Cut(first, "="); ok && strings.EqualFold(strings.TrimSpace(attr), "cn") {
+		return strings.TrimSpace(value)
+	}
+	return dn
+}
+
+// ldapEscape escapes a value for use inside a search filter (RFC 4515).
+func ldapEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ldapError is a non-success LDAP result code.
+type ldapError struct {
+	Code    int
+	Message string
+}
+
+func (e *ldapError) Error() string {
+	return fmt.Sprintf("LDAP error %d: %s", e.Code, e.Message)
+}
+
+// LDAP result codes we care about.
+const (
+	ldapSizeLimitExceeded  = 4
+	ldapInvalidCredentials = 49
+)
+
+var errLDAPInvalidCredentials = &ldapError{Code: ldapInvalidCredentials, Message: "invalid credentials"}
+
+type ldapConn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	msgID int
+}
+
+type ldapEntry struct {
+	dn    string
+	attrs map[string][]string // Lowercase attribute name to values
+}
+
+func (l *ldapBackend) dial() (*ldapConn, error) {
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		conn, err = dialer.Dial("tcp", host)
+	case "ldaps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("unsupported LDAP URL scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	return &ldapConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (c *ldapConn) close() {
+	c.msgID++
+	c.conn.Write(berTLV(0x30, berInt(c.msgID), berTLV(0x42)))
+	c.conn.Close()
+}
+
+// send writes one LDAPMessage and returns its message ID.
+func (c *ldapConn) send(op []byte) (int, error) {
+	c.msgID++
+	_, err := c.conn.Write(berTLV(0x30, berInt(c.msgID), op))
+	return c.msgID, err
+}
+
+// receive reads the next LDAPMessage and returns its operation.
+func (c *ldapConn) receive(id int) (berValue, error) {
+	msg, err := readBER(c.r)
+	if err != nil {
+		return berValue{}, err
+	}
+	children, err := msg.children()
+	if err != nil || len(children) < 2 {
+		return berValue{}, errors.New("malformed LDAP message")
+	}
+	if children[0].int() != id {
+		return berValue{}, errors.New("unexpected LDAP message ID")
+	}
+	return children[1], nil
+}
+
+// result checks an LDAPResult such as a BindResponse.
+func ldapResult(op berValue) error {
+	fields, err := op.children()
+	if err != nil || len(fields) < 3 {
+		return errors.New("malformed LDAP result")
+	}
+	switch code := fields[0].int(); code {
+	case 0:
+		return nil
+	case ldapInvalidCredentials:
+		return errLDAPInvalidCredentials
+	default:
+		return &ldapError{Code: code, Message: string(fields[2].content)}
+	}
+}
+
+func (c *ldapConn) bind(dn, password string) error {
+	id, err := c.send(berTLV(0x60, berInt(3), berTLV(0x04, []byte(dn)), berTLV(0x80, []byte(password))))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != 0x61 {
+		return errors.New("unexpected reply to bind")
+	}
+	return ldapResult(op)
+}
+
+func (c *ldapConn) search(base, filter string, attrs []string) ([]ldapEntry, error) {
+	encodedFilter, err := encodeLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var attrList [][]byte
+	for _, a := range attrs {
+		attrList = append(attrList, berTLV(0x04, []byte(a)))
+	}
+	id, err := c.send(berTLV(0x63,
+		berTLV(0x04, []byte(base)),
+		berTLV(0x0a, []byte{2}), // Scope: whole subtree
+		berTLV(0x0a, []byte{0}), // Never dereference aliases
+		berInt(2),               // Size limit: we only need to know if there's more than one
+		berInt(10),              // Time limit in seconds
+		berTLV(0x01, []byte{0}), // Types only: false
+		encodedFilter,
+		berTLV(0x30, attrList...),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []ldapEntry
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case 0x64: // SearchResultEntry
+			entry, err := parseLDAPEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case 0x65: // SearchResultDone
+			// Hitting the size limit just means the filter matched more
+			// than one user, which the caller treats as no match.
+			var lerr *ldapError
+			if err := ldapResult(op); err != nil && !(errors.As(err, &lerr) && lerr.Code == ldapSizeLimitExceeded) {
+				return nil, err
+			}
+			return entries, nil
+		case 0x73: // SearchResultReference, ignored
+		default:
+			return nil, errors.New("unexpected reply to search")
+		}
+	}
+}
+
+func parseLDAPEntry(op berValue) (ldapEntry, error) {
+	fields, err := op.children()
+	if err != nil || len(fields) != 2 {
+		return ldapEntry{}, errors.New("malformed search entry")
+	}
+	entry := ldapEntry{dn: string(fields[0].content), attrs: make(map[string][]string)}
+	attrs, err := fields[1].children()
+	if err != nil {
+		return entry, err
+	}
+	for _, attr := range attrs {
+		parts, err := attr.children()
+		if err != nil || len(parts) != 2 {
+			return entry, errors.New("malformed attribute")
+		}
+		values, err := parts[1].children()
+		if err != nil {
+			return entry, err
+		}
+		name := strings.ToLower(string(parts[0].content))
+		for _, v := range values {
+			entry.attrs[name] = append(entry.attrs[name], string(v.content))
+		}
+	}
+	return entry, nil
+}
+
+// encodeLDAPFilter turns a string filter such as "(&(objectClass=user)
+// (sAMAccountName=bob))" into its BER form. It supports and, or, not,
+// equality, presence, substring, >=, <= and ~= items.
+func encodeLDAPFilter(filter string) ([]byte, error) {
+	filter = strings.TrimSpace(filter)
+	if !strings.HasPrefix(filter, "(") {
+		filter = "(" + filter + ")"
+	}
+	enc, rest, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return nil, fmt.Errorf("trailing characters in filter: %q", rest)
+	}
+	return enc, nil
+}
+
+func parseFilter(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, s, errors.New("filter must start with '('")
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, s, errors.New("unterminated filter")
+	}
+
+	switch s[0] {
+	case '&', '|':
+		tag := byte(0xa0)
+		if s[0] == '|' {
+			tag = 0xa1
+		}
+		s = s[1:]
+		var items [][]byte
+		for strings.HasPrefix(s, "(") {
+			item, rest, err := parseFilter(s)
+			if err != nil {
+				return nil, rest, err
+			}
+			items = append(items, item)
+			s = rest
+		}
+		if !strings.HasPrefix(s, ")") {
+			return nil, s, errors.New("unterminated filter list")
+		}
+		return berTLV(tag, items...), s[1:], nil
+	case '!':
+		item, rest, err := parseFilter(s[1:])
+		if err != nil {
+			return nil, rest, err
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, rest, errors.New("unterminated not filter")
+		}
+		return berTLV(0xa2, item), rest[1:], nil
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, s, errors.New("unterminated filter item")
+	}
+	item, rest := s[:end], s[end+1:]
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, rest, fmt.Errorf("invalid filter item %q", item)
+	}
+	attr, value := item[:eq], item[eq+1:]
+
+	tag := byte(0xa3)
+	switch attr[len(attr)-1] {
+	case '>':
+		tag, attr = 0xa5, attr[:len(attr)-1]
+	case '<':
+		tag, attr = 0xa6, attr[:len(attr)-1]
+	case '~':
+		tag, attr = 0xa8, attr[:len(attr)-1]
+	}
+
+	if tag == 0xa3 && value == "*" {
+		return berTLV(0x87, []byte(attr)), rest, nil
+	}
+	if tag == 0xa3 && strings.Contains(value, "*") {
+		pieces := strings.Split(value, "*")
+		var subs [][]byte
+		for i, p := range pieces {
+			if p == "" {
+				continue
+			}
+			v, err := unescapeFilterValue(p)
+			if err != nil {
+				return nil, rest, err
+			}
+			subTag := byte(0x81) // any
+			if i == 0 {
+				subTag = 0x80 // initial
+			} else if i == len(pieces)-1 {
+				subTag = 0x82 // final
+			}
+			subs = append(subs, berTLV(subTag, v))
+		}
+		return berTLV(0xa4, berTLV(0x04, []byte(attr)), berTLV(0x30, subs...)), rest, nil
+	}
+
+	v, err := unescapeFilterValue(value)
+	if err != nil {
+		return nil, rest, err
+	}
+	return berTLV(tag, berTLV(0x04, []byte(attr)), berTLV(0x04, v)), rest, nil
+}
+
+func unescapeFilterValue(s string) ([]byte, error) {
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			out = append(out, s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return nil, fmt.Errorf("bad escape in filter value %q", s)
+		}
+		b, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return nil, fmt.Errorf("bad escape in filter value %q", s)
+		}
+		out = append(out, b...)
+		i += 2
+	}
+	return out, nil
+}
+
+// berValue is a decoded BER element.
+type berValue struct {
+	tag     byte
+	content []byte
+}
+
+// berTLV encodes a BER element whose content is the concatenation of parts.
+func berTLV(tag byte, parts ...[]byte) []byte {
+	var body []byte
+	for _, c := range parts {
+		body = append(body, c...)
+	}
+	out := []byte{tag}
+	n := len(body)
+	switch {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x100:
+		out = append(out, 0x81, byte(n))
+	case n < 0x10000:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, body...)
+}
+
+func berInt(n int) []byte {
+	b := []byte{byte(n)}
+	for n > 0x7f || n < -0x80 {
+		n >>= 8
+		b = append([]byte{byte(n)}, b...)
+	}
+	return berTLV(0x02, b)
+}
+
+func readBER(r *bufio.Reader) (berValue, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return berValue{}, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return berValue{}, err
+	}
+	n := int(first)
+	if first&0x80 != 0 {
+		count := int(first & 0x7f)
+		if count == 0 || count > 4 {
+			return berValue{}, errors.New("unsupported BER length")
+		}
+		n = 0
+		for i := 0; i < count; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return berValue{}, err
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	if n > 16<<20 {
+		return berValue{}, errors.New("LDAP message too large")
+	}
+	content := make([]byte, n)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return berValue{}, err
+	}
+	return berValue{tag: tag, content: content}, nil
+}
+
+// children decodes the elements of a constructed value.
+func (v berValue) children() ([]berValue, error) {
+	r := bufio.NewReader(strings.NewReader(string(v.content)))
+	var list []berValue
+	for {
+		child, err := readBER(r)
+		if err == io.EOF {
+			return list, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, child)
+	}
+}
+
+func (v berValue) int() int {
+	n := 0
+	for i, b := range v.content {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int(b)
+	}
+	return n
+}
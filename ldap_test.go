@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func readBERBytes(b []byte) (berValue, error) {
+	return readBER(bufio.NewReader(bytes.NewReader(b)))
+}
+
+func TestBERLengths(t *testing.T) {
+	tests := []struct {
+		size   int
+		header string // Tag and length, in hex
+	}{
+		{0, "0400"},
+		{127, "047f"},
+		{128, "048180"},
+		{255, "0481ff"},
+		{256, "04820100"},
+		{65535, "0482ffff"},
+		{65536, "048400010000"},
+	}
+	for _, tt := range tests {
+		content := bytes.Repeat([]byte{'x'}, tt.size)
+		enc := berTLV(0x04, content)
+		if got := hex.EncodeToString(enc[:len(enc)-tt.size]); got != tt.header {
+			t.Errorf("%d bytes: header %s, want %s", tt.size, got, tt.header)
+		}
+		v, err := readBERBytes(enc)
+		if err != nil || v.tag != 0x04 || !bytes.Equal(v.content, content) {
+			t.Errorf("%d bytes: read back tag %#x, %d bytes, %v", tt.size, v.tag, len(v.content), err)
+		}
+	}
+}
+
+func TestBERInt(t *testing.T) {
+	tests := []struct {
+		n   int
+		enc string
+	}{
+		{0, "020100"},
+		{1, "020101"},
+		{127, "02017f"},
+		{128, "02020080"},
+		{255, "020200ff"},
+		{256, "02020100"},
+		{-1, "0201ff"},
+		{-128, "020180"},
+		{-129, "0202ff7f"},
+		{1 << 24, "020401000000"},
+	}
+	for _, tt := range tests {
+		enc := berInt(tt.n)
+		if got := hex.EncodeToString(enc); got != tt.enc {
+			t.Errorf("berInt(%d) = %s, want %s", tt.n, got, tt.enc)
+		}
+		v, err := readBERBytes(enc)
+		if err != nil || v.int() != tt.n {
+			t.Errorf("berInt(%d) read back as %d, %v", tt.n, v.int(), err)
+		}
+	}
+}
+
+func TestReadBERRejects(t *testing.T) {
+	tests := []struct{ name, hex string }{
+		{"empty", ""},
+		{"no length", "04"},
+		{"short content", "0405616263"},
+		{"indefinite length", "0480616263"},
+		{"length of 5 bytes", "04850000000001"},
+		{"over 16 MiB", "048401000001"},
+		{"short length", "048201"},
+	}
+	for _, tt := range tests {
+		b, _ := hex.DecodeString(tt.hex)
+		if v, err := readBERBytes(b); err == nil {
+			t.Errorf("%s: read %#x with %d bytes, want an error", tt.name, v.tag, len(v.content))
+		}
+	}
+
+	// A truncated child makes children fail rather than drop it.
+	v := berValue{tag: 0x30, content: append(berTLV(0x04, []byte("ok")), 0x04, 0x05, 'a')}
+	if list, err := v.children(); err == nil {
+		t.Errorf("children of a truncated sequence = %d values, want an error", len(list))
+	}
+}
+
+func TestEncodeLDAPFilter(t *testing.T) {
+	str := func(s string) []byte { return berTLV(0x04, []byte(s)) }
+	eq := func(attr, value string) []byte { return berTLV(0xa3, str(attr), str(value)) }
+	tests := []struct {
+		filter string
+		want   []byte
+	}{
+		{"(uid=bob)", eq("uid", "bob")},
+		{"uid=bob", eq("uid", "bob")},
+		{"(&(objectClass=user)(sAMAccountName=bob))", berTLV(0xa0, eq("objectClass", "user"), eq("sAMAccountName", "bob"))},
+		{"(|(uid=a)(uid=b))", berTLV(0xa1, eq("uid", "a"), eq("uid", "b"))},
+		{"(!(uid=bob))", berTLV(0xa2, eq("uid", "bob"))},
+		{"(mail=*)", berTLV(0x87, []byte("mail"))},
+		{"(cn=ab*cd*ef)", berTLV(0xa4, str("cn"), berTLV(0x30, berTLV(0x80, []byte("ab")), berTLV(0x81, []byte("cd")), berTLV(0x82, []byte("ef"))))},
+		{"(cn=*cd*)", berTLV(0xa4, str("cn"), berTLV(0x30, berTLV(0x81, []byte("cd"))))},
+		{"(uidNumber>=1000)", berTLV(0xa5, str("uidNumber"), str("1000"))},
+		{"(uidNumber<=1000)", berTLV(0xa6, str("uidNumber"), str("1000"))},
+		{"(cn~=bob)", berTLV(0xa8, str("cn"), str("bob"))},
+		{`(cn=a\2ab\28\29\5c\00)`, eq("cn", "a*b()\\\x00")},
+	}
+	for _, tt := range tests {
+		got, err := encodeLDAPFilter(tt.filter)
+		if err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("encodeLDAPFilter(%q) = %x, %v; want %x", tt.filter, got, err, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", "(", "(uid=bob", "(uid=bob))", "(&(uid=a)", "(!(uid=a)", "(=bob)", "(uid)", `(cn=\zz)`, `(cn=\2)`, "(uid=a)(uid=b)"} {
+		if got, err := encodeLDAPFilter(bad); err == nil {
+			t.Errorf("encodeLDAPFilter(%q) = %x, want an error", bad, got)
+		}
+	}
+}
+
+func TestLDAPEscape(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"bob", "bob"},
+		{"*", `\2a`},
+		{"bob)(uid=*", `bob\29\28uid=\2a`},
+		{`a\b`, `a\5cb`},
+		{"a\x00b", `a\00b`},
+		{"Zoë", "Zoë"},
+	}
+	for _, tt := range tests {
+		got := ldapEscape(tt.in)
+		if got != tt.want {
+			t.Errorf("ldapEscape(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		// Escaped, a name can only ever be one equality item.
+		enc, err := encodeLDAPFilter("(uid=" + got + ")")
+		want := berTLV(0xa3, berTLV(0x04, []byte("uid")), berTLV(0x04, []byte(tt.in)))
+		if err != nil || !bytes.Equal(enc, want) {
+			t.Errorf("filter for %q = %x, %v; want %x", tt.in, enc, err, want)
+		}
+	}
+}
+
+func TestGroupCN(t *testing.T) {
+	tests := []struct{ dn, want string }{
+		{"CN=Admins,OU=Groups,DC=corp,DC=example", "Admins"},
+		{"cn = staff , ou=groups", "staff"},
+		{"ou=groups,dc=example", "ou=groups,dc=example"},
+		{"admins", "admins"},
+	}
+	for _, tt := range tests {
+		if got := groupCN(tt.dn); got != tt.want {
+			t.Errorf("groupCN(%q) = %q, want %q", tt.dn, got, tt.want)
+		}
+	}
+}
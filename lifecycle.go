@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// shutdownRequests receives the reason the server should stop. Only the first
+// request matters; later ones are dropped.
+var shutdownRequests = make(chan string, 1)
+
+// requestShutdown asks the server to stop gracefully, letting in-flight
+// requests finish.
+func requestShutdown(reason string) {
+	select {
+	case shutdownRequests <- reason:
+	default:
+	}
+}
+
+var (
+	activeRequests atomic.Int64
+	lastActivity   atomic.Int64 // Unix nanoseconds of the last finished request
+)
+
+// activityMiddleware keeps track of when the server last did something so
+// the idle timeout knows when to fire.
+func activityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		activeRequests.Add(1)
+		defer func() {
+			lastActivity.Store(time.Now().UnixNano())
+			activeRequests.Add(-1)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// watchIdle shuts the server down once no request has been served for
+// timeout. Requests still running, such as long downloads, keep it alive.
+func watchIdle(timeout time.Duration) {
+	lastActivity.Store(time.Now().UnixNano())
+
+	interval := timeout / 10
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	for range time.Tick(interval) {
+		if activeRequests.Load() > 0 {
+			continue
+		}
+		if time.Since(time.Unix(0, lastActivity.Load())) >= timeout {
+			requestShutdown("idle for " + timeout.String())
+			return
+		}
+	}
+}
+
+var completedDownloads atomic.Int64
+
+// countDownload counts a completed download and stops the server once
+// --max-downloads is reached.
+func countDownload() {
+	n := completedDownloads.Add(1)
+	if downloadLimit > 0 && n >= downloadLimit {
+		requestShutdown(fmt.Sprintf("%d of %d downloads completed", n, downloadLimit))
+	}
+}
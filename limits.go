@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// retryAfter is the hint sent to clients when the server is saturated.
+const retryAfter = 5 * time.Second
+
+// limitListener caps the number of open connections. Connections beyond the
+// limit get a bare 503 response and are closed right away.
+type limitListener struct {
+	net.Listener
+	mu     sync.Mutex
+	active int
+	max    int
+}
+
+func newLimitListener(l net.Listener, max int) net.Listener {
+	return &limitListener{Listener: l, max: max}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		l.mu.Lock()
+		if l.active >= l.max {
+			l.mu.Unlock()
+			go rejectConn(c)
+			continue
+		}
+		l.active++
+		l.mu.Unlock()
+
+		return &limitConn{Conn: c, release: l.release}, nil
+	}
+}
+
+func (l *limitListener) release() {
+	l.mu.Lock()
+	l.active--
+	l.mu.Unlock()
+}
+
+func rejectConn(c net.Conn) {
+	defer c.Close()
+	c.SetWriteDeadline(time.Now().Add(time.Second))
+	c.Write([]byte("HTTP/1.1 503 Service Unavailable\r\n" +
+		"Retry-After: " + strconv.Itoa(int(retryAfter.Seconds())) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Length: 20\r\n" +
+		"Connection: close\r\n\r\n" +
+		"Too many connections"))
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// downloadQueue limits concurrent downloads. Waiters are queued per client
+// and served round-robin, so one client queueing many files can't starve
+// the others.
+type downloadQueue struct {
+	mu      sync.Mutex
+	free    int
+	waiting map[string][]chan struct{}
+	order   []string // Clients with waiters, in round-robin order
+}
+
+func newDownloadQueue(slots int) *downloadQueue {
+	return &downloadQueue{free: slots, waiting: make(map[string][]chan struct{})}
+}
+
+// acquire waits up to timeout for a download slot for client, giving up early
+// if ctx is cancelled. It reports whether a slot was obtained; the caller must
+// release it when done.
+func (q *downloadQueue) acquire(ctx context.Context, client string, timeout time.Duration) bool {
+	q.mu.Lock()
+	if q.free > 0 && len(q.order) == 0 {
+		q.free--
+		q.mu.Unlock()
+		return true
+	}
+
+	ch := make(chan struct{})
+	if len(q.waiting[client]) == 0 {
+		q.order = append(q.order, client)
+	}
+	q.waiting[client] = append(q.waiting[client], ch)
+	q.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ch:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	queued := q.remove(client, ch)
+	q.mu.Unlock()
+	if !queued {
+		// The slot was handed over just as we gave up; pass it on.
+		q.release()
+	}
+	return false
+}
+
+// release frees a slot, handing it to the next client in line if any.
+func (q *downloadQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.order) == 0 {
+		q.free++
+		return
+	}
+
+	client := q.order[0]
+	q.order = q.order[1:]
+	waiters := q.waiting[client]
+	ch := waiters[0]
+	if len(waiters) > 1 {
+		q.waiting[client] = waiters[1:]
+		q.order = append(q.order, client)
+	} else {
+		delete(q.waiting, client)
+	}
+	close(ch)
+}
+
+// remove drops ch from client's waiters. It must be called with q.mu held and
+// reports whether ch was still queued.
+func (q *downloadQueue) remove(client string, ch chan struct{}) bool {
+	waiters := q.waiting[client]
+	for i, w := range waiters {
+		if w != ch {
+			continue
+		}
+		waiters = append(waiters[:i], waiters[i+1:]...)
+		if len(waiters) > 0 {
+			q.waiting[client] = waiters
+			return true
+		}
+		delete(q.waiting, client)
+		for j, c := range q.order {
+			if c == client {
+				q.order = append(q.order[:j], q.order[j+1:]...)
+				break
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// queueTimeout is how long a download waits for a free slot before giving up.
+const queueTimeout = 30 * time.Second
+
+func downloadLimitMiddleware(q *downloadQueue, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !q.acquire(r.Context(), clientIP(r), queueTimeout) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+			http.Error(w, "Server busy, try again shortly", http.StatusServiceUnavailable)
+			return
+		}
+		defer q.release()
+		next.ServeHTTP(w, r)
+	})
+}
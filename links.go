@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// secretKey signs share links. It is kept in the state directory so links
+// keep working across restarts.
+var secretKey []byte
+
+var (
+	errBadToken     = errors.New("invalid link")
+	errTokenExpired = errors.New("link has expired")
+)
+
+// loadSecret reads the signing key from dir, creating it on first use.
+func loadSecret(dir string) ([]byte, error) {
+	keyPath := filepath.Join(dir, "secret.key")
+	key, err := os.ReadFile(keyPath)
+	if err == nil && len(key) >= 32 {
+		return key, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyPath, key, 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// sign returns the HMAC-SHA256 of data under secretKey.
+func sign(data []byte) []byte {
+	mac := hmac.New(sha256.New, secretKey)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// linkClaims is what a share link grants: access to Path, a file or a
+// folder relative to the share root, until Expires. Links with a Nonce are
+// one-time links and stop working after the first complete download.
+type linkClaims struct {
+	Path    string `json:"p"`
+	Expires int64  `json:"e"` // Unix seconds
+	Nonce   string `json:"n,omitempty"`
+}
+
+// makeLinkToken encodes and signs claims for use in a /s/ URL.
+func makeLinkToken(c linkClaims) string {
+	payload, _ := json.Marshal(c)
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(sign(payload))
+}
+
+// parseLinkToken verifies a token made by makeLinkToken and returns its
+// claims if it is still valid.
+func parseLinkToken(token string) (linkClaims, error) {
+	var c linkClaims
+	enc := base64.RawURLEncoding
+
+	payloadPart, sigPart, ok := strings.Cut(token, ".")
+	if !ok {
+		return c, errBadToken
+	}
+	payload, err := enc.DecodeString(payloadPart)
+	if err != nil {
+		return c, errBadToken
+	}
+	sig, err := enc.DecodeString(sigPart)
+	if err != nil || !hmac.Equal(sig, sign(payload)) {
+		return c, errBadToken
+	}
+	if json.Unmarshal(payload, &c) != nil {
+		return c, errBadToken
+	}
+	if time.Now().Unix() > c.Expires {
+		return c, errTokenExpired
+	}
+	return c, nil
+}
+
+// cleanSharePath normalizes a user-supplied share-relative path, returning
+// "" for the share root.
+func cleanSharePath(p string) string {
+	p = path.Clean("/" + filepath.ToSlash(p))
+	return strings.TrimPrefix(p, "/")
+}
+
+// shareLinkHandler serves /s/<token> for a file, and /s/<token>/ plus
+// /s/<token>/<file> for a folder.
+func shareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	token, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/s/"), "/")
+	claims, err := parseLinkToken(token)
+	switch {
+	case errors.Is(err, errTokenExpired):
+		http.Error(w, "This link has expired", http.StatusGone)
+		return
+	case err != nil:
+		http.NotFound(w, r)
+		return
+	}
+
+	info, err := statShared(claims.Path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !info.IsDir() {
+		if rest != "" {
+			http.NotFound(w, r)
+			return
+		}
+		if claims.Nonce == "" {
+			serveFile(w, r, claims.Path)
+			return
+		}
+		serveOnce(w, r, claims)
+		return
+	}
+
+	if rest != "" {
+		serveFile(w, r, path.Join(claims.Path, cleanSharePath(rest)))
+		return
+	}
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	files, err := listFiles(claims.Path)
+	if err != nil {
+		http.Error(w, "Error listing files", http.StatusInternalServerError)
+		return
+	}
+	for i, f := range files {
+		files[i] = filepath.ToSlash(f)
+	}
+
+	data := struct {
+		Folder  string
+		Files   []string
+		Expires time.Time
+	}{
+		Folder:  path.Base("/" + claims.Path),
+		Files:   files,
+		Expires: time.Unix(claims.Expires, 0),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = sharedFolderTemplate.Execute(w, data)
+	if err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	}
+}
+
+var sharedFolderTemplate = newPage("shared", template.FuncMap{
+	"until": func(t time.Time) string {
+		return time.Until(t).Round(time.Second).String()
+	},
+	"isFolder":   func(name string) bool { return strings.HasSuffix(name, "/") },
+	"escapePath": escapePath,
+})
+
+// linksPageHandler lets the host mint expiring links from the browser.
+func linksPageHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Path   string
+		Expire string
+		Once   bool
+		Link   string
+		Error  string
+		CSRF   string
+	}{
+		Path:   r.FormValue("path"),
+		Expire: r.FormValue("expire"),
+		Once:   r.FormValue("once") != "",
+		CSRF:   csrfToken(w, r),
+	}
+	if data.Expire == "" {
+		data.Expire = "1h"
+	}
+
+	if r.Method == http.MethodPost {
+		link, err := mintLink(externalBaseURL(r), data.Path, data.Expire, data.Once)
+		if err != nil {
+			data.Error = err.Error()
+		} else {
+			data.Link = link
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := linksTemplate.Execute(w, data)
+	if err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	}
+}
+
+// mintLink creates a link under base granting access to the share-relative
+// path p for the given duration. One-time links only work for files.
+func mintLink(base, p, expire string, once bool) (string, error) {
+	d, err := time.ParseDuration(expire)
+	if err != nil || d <= 0 {
+		return "", fmt.Errorf("invalid expiry %q", expire)
+	}
+	sharePath, ok := safeSharePath(p)
+	if !ok {
+		return "", fmt.Errorf("%q is not in the share", p)
+	}
+	info, err := statShared(sharePath)
+	if err != nil {
+		return "", fmt.Errorf("%q is not in the share", p)
+	}
+
+	claims := linkClaims{Path: sharePath, Expires: time.Now().Add(d).Unix()}
+	if once {
+		if info.IsDir() {
+			return "", fmt.Errorf("one-time links only work for files, %q is a folder", p)
+		}
+		nonce := make([]byte, 12)
+		rand.Read(nonce)
+		claims.Nonce = base64.RawURLEncoding.EncodeToString(nonce)
+	}
+	return strings.TrimSuffix(base, "/") + "/s/" + makeLinkToken(claims), nil
+}
+
+var linksTemplate = newPage("links", nil)
+
+// linkCommand implements the "link" subcommand, printing an expiring link
+// for a file or folder in the share.
+func linkCommand(args []string) {
+	fs := flag.NewFlagSet("link", flag.ExitOnError)
+	dir := fs.String("state-dir", defaultStateDir(), "directory holding persistent state")
+	var dirs []*mount
+	fs.Var(mountFlag{&dirs}, "dir", "directory being shared, or alias=path for each of several (default "+shareDir+")")
+	port := fs.String("port", port, "port the server listens on")
+	expire := fs.String("expire", "1h", "how long the link stays valid")
+	once := fs.Bool("once", false, "make a one-time link that stops working after the first complete download")
+	signed := fs.Bool("signed", false, "print a signed /download/ URL for a file instead of a /s/ link")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(fs.Output(), "Usage: link [options] path")
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+
+	var err error
+	secretKey, err = loadSecret(*dir)
+	if err != nil {
+		log.Fatal("Error loading secret key:", err)
+	}
+	if len(dirs) == 0 {
+		dirs = []*mount{{Dir: shareDir}}
+	}
+	if err := openMounts(dirs); err != nil {
+		log.Fatal("Error opening share directory:", err)
+	}
+
+	base := fmt.Sprintf("http://%s:%s/", getLocalIP(), *port)
+	if *signed {
+		d, err := time.ParseDuration(*expire)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid expiry %q", *expire)
+		}
+		if !sharedFileExists(fs.Arg(0)) {
+			log.Fatalf("%q is not a file in the share", fs.Arg(0))
+		}
+		fmt.Println(signedDownloadURL(base, fs.Arg(0), d))
+		return
+	}
+	link, err := mintLink(base, fs.Arg(0), *expire, *once)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(link)
+}
+
+// serveOnce sends the file a one-time link is for. The link is used up by
+// one whole download, which can be resumed from where an earlier try got
+// to. Any other range, like the last byte a media player asks for first,
+// is answered with the whole file, so a probe can't use the link up, and
+// only one download of it runs at a time.
+func serveOnce(w http.ResponseWriter, r *http.Request, claims linkClaims) {
+	delivered, ok := usedLinks.reserve(claims.Nonce)
+	if !ok {
+		if usedLinks.used(claims.Nonce) {
+			http.Error(w, "This link has already been used", http.StatusGone)
+		} else {
+			http.Error(w, "This link is being downloaded already", http.StatusConflict)
+		}
+		return
+	}
+	start, ok := rangeStart(r.Header.Get("Range"))
+	if !ok || start > delivered {
+		r.Header.Del("Range")
+		r.Header.Del("If-Range")
+	}
+	cw := &countingWriter{ResponseWriter: w}
+	if !serveFile(cw, r, claims.Path) {
+		if cw.code != http.StatusPartialContent {
+			start = 0
+		}
+		usedLinks.release(claims.Nonce, start+cw.n)
+		return
+	}
+	if err := usedLinks.markUsed(claims.Nonce, time.Unix(claims.Expires, 0)); err != nil {
+		log.Println("Error saving one-time link state:", err)
+	}
+}
+
+// rangeStart is where a Range header of a single range, like "bytes=500-",
+// starts.
+func rangeStart(h string) (int64, bool) {
+	spec, ok := strings.CutPrefix(h, "bytes=")
+	first, _, found := strings.Cut(spec, "-")
+	if !ok || !found || strings.Contains(spec, ",") {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(first), 10, 64)
+	return n, err == nil && n >= 0
+}
+
+// countingWriter notes the status of a response and how much of its body
+// was sent.
+type countingWriter struct {
+	http.ResponseWriter
+	code int
+	n    int64
+}
+
+func (w *countingWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// secretForTest signs links and tokens with a fixed key for the length of
+// the test.
+func secretForTest(t *testing.T) {
+	t.Helper()
+	old := secretKey
+	t.Cleanup(func() { secretKey = old })
+	secretKey = bytes.Repeat([]byte{7}, 32)
+}
+
+func TestParseLinkToken(t *testing.T) {
+	secretForTest(t)
+	enc := base64.RawURLEncoding
+	valid := linkClaims{Path: "docs/a.txt", Expires: time.Now().Add(time.Hour).Unix()}
+	token := makeLinkToken(valid)
+	payloadPart, sigPart, _ := strings.Cut(token, ".")
+
+	// A payload for another file, signed with the right key, spliced onto
+	// the signature of the first.
+	other, _ := json.Marshal(linkClaims{Path: "private/b.txt", Expires: valid.Expires})
+	expired := makeLinkToken(linkClaims{Path: "docs/a.txt", Expires: time.Now().Add(-time.Minute).Unix()})
+	secretKey = bytes.Repeat([]byte{8}, 32)
+	otherKey := makeLinkToken(valid)
+	secretForTest(t)
+
+	tests := []struct {
+		name, token string
+		err         error
+	}{
+		{"valid", token, nil},
+		{"expired", expired, errTokenExpired},
+		{"other payload", enc.EncodeToString(other) + "." + sigPart, errBadToken},
+		{"truncated signature", payloadPart + "." + sigPart[:len(sigPart)-2], errBadToken},
+		{"no signature", payloadPart + ".", errBadToken},
+		{"no dot", payloadPart, errBadToken},
+		{"bad base64", payloadPart + ".!!!", errBadToken},
+		{"signed with another key", otherKey, errBadToken},
+		{"empty", "", errBadToken},
+	}
+	for _, tt := range tests {
+		claims, err := parseLinkToken(tt.token)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && claims != valid {
+			t.Errorf("%s: claims = %+v, want %+v", tt.name, claims, valid)
+		}
+	}
+}
+
+func TestMintLink(t *testing.T) {
+	secretForTest(t)
+	shareForTest(t, symlinksWithinRoot)
+	tests := []struct {
+		path, expire string
+		once         bool
+		err          string // What the error mentions, "" for none
+	}{
+		{"docs/a.txt", "1h", false, ""},
+		{"/docs/a.txt", "10m", true, ""},
+		{"docs", "1h", false, ""},
+		{"docs", "1h", true, `"docs" is a folder`},
+		{"missing.txt", "1h", false, `"missing.txt" is not in the share`},
+		{"docs/a.txt", "soon", false, `invalid expiry "soon"`},
+		{"docs/a.txt", "-1h", false, "invalid expiry"},
+	}
+	for _, tt := range tests {
+		link, err := mintLink("http://192.0.2.1:8080/", tt.path, tt.expire, tt.once)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("mintLink(%q, %q): error = %v, want one saying %s", tt.path, tt.expire, err, tt.err)
+			}
+			continue
+		}
+		token, ok := strings.CutPrefix(link, "http://192.0.2.1:8080/s/")
+		if err != nil || !ok {
+			t.Errorf("mintLink(%q, %q) = %q, %v", tt.path, tt.expire, link, err)
+			continue
+		}
+		claims, err := parseLinkToken(token)
+		if err != nil || claims.Path != cleanSharePath(tt.path) || (claims.Nonce != "") != tt.once {
+			t.Errorf("mintLink(%q, %q) made a link for %+v, %v", tt.path, tt.expire, claims, err)
+		}
+	}
+}
+
+func TestShareLinkStaysInItsFolder(t *testing.T) {
+	secretForTest(t)
+	shareForTest(t, symlinksWithinRoot)
+	writeTestFile(t, filepath.Join(mounts[0].Dir, "top.txt"), "top")
+	token := makeLinkToken(linkClaims{Path: "docs", Expires: time.Now().Add(time.Hour).Unix()})
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/s/" + token + "/a.txt", http.StatusOK},
+		{"/s/" + token + "/", http.StatusOK},
+		{"/s/" + token + "/../top.txt", http.StatusNotFound},
+		{"/s/" + token + "/..%2ftop.txt", http.StatusNotFound},
+		{"/s/" + token[:len(token)-1] + "/a.txt", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		shareLinkHandler(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("GET %s: status %d, want %d", tt.path, w.Code, tt.status)
+		}
+		if w.Body.String() == "top" {
+			t.Errorf("GET %s served a file outside the linked folder", tt.path)
+		}
+	}
+}
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"flag"
 	"fmt"
 	"html/template"
+	"io"
+	"io/fs"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,18 +26,304 @@ var (
 	shareDir  = "./file" // Default sharing directory
 	baseURL   string
 	startTime time.Time
-	fileList  []string
-	mu        sync.Mutex
+	fileList  []string   // What searches look through, see indexedFiles
+	mu        sync.Mutex // Guards fileList
+
+	rateLimit float64 // Requests per second per client IP, 0 disables
+	rateBurst int
+
+	globalLimiter *byteLimiter // Shared by all downloads, nil when unlimited
+	connRate      int64        // Bytes per second for each download, 0 is unlimited
+
+	maxConnections         int // 0 is unlimited
+	maxConcurrentDownloads int // 0 is unlimited
+	http1Only              bool
+
+	stateDir string // Persistent state such as transfer history
+
+	idleTimeout   time.Duration // Exit after this long without requests, 0 disables
+	downloadLimit int64         // Exit after this many completed downloads, 0 disables
+	expiresAt     time.Time     // When the share shuts down, zero if never
 )
 
 func main() {
 	startTime = time.Now()
 
+	sending := false
 	if len(os.Args) > 1 {
-		port = os.Args[1]
+		switch os.Args[1] {
+		case "send":
+			// Same options as serving a folder, with a file to share first.
+			sending = true
+			os.Args = append(os.Args[:1:1], os.Args[2:]...)
+		case "history":
+			historyCommand(os.Args[2:])
+			return
+		case "link":
+			linkCommand(os.Args[2:])
+			return
+		case "user":
+			userCommand(os.Args[2:])
+			return
+		case "token":
+			tokenCommand(os.Args[2:])
+			return
+		case "upload":
+			uploadCommand(os.Args[2:])
+			return
+		case "templates":
+			templatesCommand(os.Args[2:])
+			return
+		}
+	}
+
+	flag.Float64Var(&rateLimit, "rps", 0, "max requests per second per client IP (0 disables)")
+	flag.IntVar(&rateBurst, "burst", 20, "number of requests a client may make at once before --rps applies")
+	limitRate := flag.String("limit-rate", "", "max total download bandwidth, e.g. 10MB/s (empty is unlimited)")
+	limitRateConn := flag.String("limit-rate-per-conn", "", "max bandwidth for each download, e.g. 2MB/s (empty is unlimited)")
+	flag.IntVar(&maxConnections, "max-connections", 0, "max simultaneous client connections (0 is unlimited)")
+	flag.BoolVar(&compressResponses, "compress", true, "gzip pages, JSON and text for clients that accept it")
+	flag.BoolVar(&http1Only, "http1-only", false, "serve HTTP/1.1 only, for clients and proxies that have trouble with HTTP/2")
+	flag.IntVar(&maxConcurrentDownloads, "max-concurrent-downloads", 0, "max downloads served at once, others wait in a queue (0 is unlimited)")
+	flag.StringVar(&stateDir, "state-dir", defaultStateDir(), "directory holding persistent state such as transfer history")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 0, "stop the server after this long without requests, e.g. 30m (0 disables)")
+	flag.Int64Var(&downloadLimit, "max-downloads", 0, "stop the server after this many completed downloads (0 disables)")
+	expire := flag.Duration("expire", 0, "stop the server after this long, e.g. 2h (0 disables)")
+	auth := flag.String("auth", os.Getenv("LANSHARE_AUTH"), "add an admin account user:password, requiring sign-in (also read from $LANSHARE_AUTH)")
+	flag.Var(protected, "protect", "password-protect a file or folder in the share, as path=password (repeatable)")
+	oidcIssuer := flag.String("oidc-issuer", "", "sign users in with this OpenID Connect provider, e.g. https://accounts.google.com")
+	oidcClientID := flag.String("oidc-client-id", "", "OIDC client ID")
+	oidcClientSecret := flag.String("oidc-client-secret", os.Getenv("LANSHARE_OIDC_SECRET"), "OIDC client secret (also read from $LANSHARE_OIDC_SECRET)")
+	oidcRedirect := flag.String("oidc-redirect-url", "", "OIDC redirect URL (default <server URL>/oidc/callback)")
+	oidcRoleClaim := flag.String("oidc-role-claim", "groups", "ID token claim mapped to roles")
+	oidcRoles := flag.String("oidc-roles", "", "map claim values to roles, e.g. admins=admin,staff=uploader")
+	oidcDefaultRole := flag.String("oidc-default-role", roleViewer, "role for OIDC users matching no mapping (empty denies them)")
+	ldapURL := flag.String("ldap-url", "", "check passwords against this LDAP/AD server, e.g. ldaps://dc.corp.example")
+	ldapBindDN := flag.String("ldap-bind-dn", "", "service account DN used to look users up (anonymous if empty)")
+	ldapBindPassword := flag.String("ldap-bind-password", os.Getenv("LANSHARE_LDAP_PASSWORD"), "password for --ldap-bind-dn (also read from $LANSHARE_LDAP_PASSWORD)")
+	ldapBaseDN := flag.String("ldap-base-dn", "", "where to search for users, e.g. dc=corp,dc=example")
+	ldapFilter := flag.String("ldap-user-filter", "(uid=%s)", "filter finding a user, %s is the username; use (sAMAccountName=%s) for AD")
+	ldapGroupAttr := flag.String("ldap-group-attr", "memberOf", "user attribute listing their groups")
+	flag.Var(ldapRoles, "ldap-role", "give members of an LDAP group a role, as role=group DN or CN (repeatable)")
+	ldapDefaultRole := flag.String("ldap-default-role", roleViewer, "role for LDAP users in no mapped group (empty denies them)")
+	flag.Var(&allowNets, "allow", "only let in clients from these networks, e.g. 192.168.1.0/24 (repeatable)")
+	flag.Var(&denyNets, "deny", "turn away clients from these networks (repeatable)")
+	flag.Var(&trustedProxies, "trusted-proxy", "reverse proxy addresses whose X-Forwarded-For, -Proto and -Host headers are trusted (repeatable)")
+	basePathFlag := flag.String("base-path", "", "serve the share below this path, like /share, for a reverse proxy that puts it there")
+	flag.Var(&corsOrigins, "cors-origins", "let pages on these sites call the JSON API and uploads, e.g. https://tools.corp.example, or * for any site without credentials (repeatable)")
+	csp := flag.String("csp", defaultCSP, "Content-Security-Policy header (empty disables it)")
+	flag.Var(cachePolicyFlag{}, "cache-policy", `set the Cache-Control of pages, thumbnails, previews or downloads, as "thumbnails=max-age=604800, immutable" (repeatable, none sends none)`)
+	flag.Var(headerFlag{}, "header", `add or override a response header, as "Name: value" (repeatable, empty value removes it)`)
+	flag.BoolVar(&showHidden, "show-hidden", false, "list and serve dotfiles and system files such as Thumbs.db")
+	flag.Var(&includeGlobs, "include", "only share files matching this pattern, e.g. '*.pdf' (repeatable)")
+	flag.Var(&excludeGlobs, "exclude", "leave out files and folders matching this pattern, e.g. 'drafts/**' (repeatable)")
+	flag.IntVar(&maxDepth, "max-depth", 0, "share at most this many folder levels, deeper folders are listed but not opened (0 is unlimited)")
+	var dirs []*mount
+	flag.Var(mountFlag{&dirs}, "dir", "share a folder or archive under an alias, as alias=path, with ,ro appended to make it read-only (repeatable, instead of [directory])")
+	flag.Var(mountFlag{&dirs}, "backend", "share a storage backend instead of a folder: s3://bucket/prefix (also alias=URL, like --dir)")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "", "S3-compatible server for s3:// backends, e.g. http://nas:9000 for MinIO (default AWS, or $AWS_ENDPOINT_URL)")
+	flag.StringVar(&s3Region, "s3-region", os.Getenv("AWS_REGION"), "region for s3:// backends (default us-east-1, or $AWS_REGION)")
+	flag.BoolVar(&uploadsEnabled, "upload", false, "let visitors (with the uploader role, when signing in) add files")
+	flag.BoolVar(&receiveOnly, "receive-only", false, "only take uploads: no file listing and no downloads")
+	maxUpload := flag.String("max-upload-size", "", "largest file that can be uploaded, e.g. 2GB (empty is unlimited)")
+	quota := flag.String("upload-quota", "", "how much each client (or signed-in user) can upload a day, e.g. 5GB (empty is unlimited)")
+	minFree := flag.String("min-free-space", "1GB", "disk space uploads must leave free")
+	zipCompression := flag.String("zip-level", "6", "how hard folder downloads are compressed, from 1 (fastest) to 9 (smallest), or store")
+	flag.StringVar(&ipfsAPI, "ipfs-api", "", "let the host publish files to IPFS through this node's HTTP API, e.g. http://127.0.0.1:5001")
+	flag.StringVar(&ipfsGateway, "ipfs-gateway", "https://ipfs.io", "gateway to link files published to IPFS on")
+	flag.BoolVar(&dlnaEnabled, "dlna", false, "serve videos, music and photos to smart TVs on the LAN as a DLNA media server")
+	flag.IntVar(&seedPort, "seed-port", 0, "seed the torrents made for big files over BitTorrent on this port (0 leaves it to the web seed)")
+	maxExtract := flag.String("max-extract-size", "10GB", "most an uploaded archive may unpack to with Extract here (0 is unlimited)")
+	flag.StringVar(&scanCommand, "scan-command", "", "check each upload with this command before it's shared, e.g. 'clamdscan --fdpass --no-summary {}'; exit status 1 rejects it")
+	flag.StringVar(&scanSocket, "scan-socket", "", "check each upload with clamd at this Unix socket or host:port, e.g. /run/clamav/clamd.ctl")
+	flag.Var(&dedupe, "dedupe", "what to do with uploads identical to a file already shared: off, link (hard link to it) or skip")
+	flag.Var(&onScanFailure, "scan-action", "what to do with uploads the scan rejects: quarantine or delete")
+	flag.StringVar(&quarantineDir, "quarantine-dir", "", "where rejected uploads are kept (default <state dir>/quarantine)")
+	flag.BoolVar(&allowRename, "allow-rename", false, "let admins, or anyone on the host machine, rename files and folders and move them around")
+	flag.BoolVar(&allowDelete, "allow-delete", false, "let admins, or anyone on the host machine, delete files and folders")
+	flag.StringVar(&siteTitle, "title", "", "name to show at the top of the page instead of Shared Files, like an event or company")
+	flag.StringVar(&logoFile, "logo", "", "image file to show above the title")
+	flag.BoolVar(&chatEnabled, "chat", false, "add a chat panel to the file list for everyone on the share")
+	flag.BoolVar(&clipboardEnabled, "clipboard", false, "share a clipboard between devices at /clipboard")
+	flag.StringVar(&templatesDir, "templates", "", "folder of templates to use instead of the built-in pages, from lanshare templates DIR")
+	flag.StringVar(&themeCSS, "theme-css", "", "stylesheet to load into every page, setting colors with variables like --background and --accent")
+	flag.BoolVar(&siSizes, "si", false, "show sizes in powers of 1000 (KB, MB) rather than 1024 (KiB, MiB)")
+	flag.StringVar(&cacheDir, "cache-dir", "", "where thumbnails are kept between restarts (default <state dir>/cache)")
+	cacheSize := flag.String("cache-max-size", "500MB", "how much space thumbnails may take, the least recently used are deleted past it (empty is unlimited)")
+	flag.BoolVar(&indexContents, "index-contents", false, "index the words in text files, code and PDFs, so searches can find files by what's in them")
+	flag.BoolVar(&transcode, "transcode", false, "convert videos browsers can't play to HLS with ffmpeg while they're watched")
+	flag.IntVar(&keepVersions, "keep-versions", 0, "let uploads replace files with the same name, keeping this many earlier versions of each")
+	flag.DurationVar(&trashRetention, "trash-retention", trashRetention, "how long deleted files stay in the trash before they're gone for good, 0 to delete them straight away")
+	sendName := flag.String("name", "stdin", "with lanshare send -, the file name to share stdin under")
+	flag.Var(&followSymlinks, "follow-symlinks", "which symlinks to follow: never, within-root (the default) or always")
+	flag.Usage = func() {
+		name := filepath.Base(os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [port] [directory]\n", name)
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s send [options] file|- [port]\n", name)
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s history [-n N] [--state-dir DIR]\n", name)
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s user add|remove|list [--state-dir DIR]\n", name)
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s token create --user NAME [--expire D] [--state-dir DIR]\n", name)
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s upload [--dir D] [--token T|--auth user:password] URL file...\n", name)
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s link [--expire D] [--once|--signed] [--port PORT] [--state-dir DIR] path\n\nOptions:\n", name)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if receiveOnly {
+		uploadsEnabled = true
+	}
+	if *csp != defaultCSP {
+		securityHeaders["Content-Security-Policy"] = *csp
+	}
+
+	args := flag.Args()
+	if sending {
+		if len(args) == 0 {
+			log.Fatal("Give the file to send: lanshare send [options] file [port]")
+		}
+		if len(dirs) > 0 {
+			log.Fatal("lanshare send shares one file, --dir and --backend can't be used with it")
+		}
+		var m *mount
+		var err error
+		if args[0] == "-" {
+			m, err = stdinMount(os.Stdin, *sendName)
+		} else {
+			m, err = sendMount(args[0])
+		}
+		if err != nil {
+			log.Fatal("Error opening file to send:", err)
+		}
+		dirs = []*mount{m}
+		args = args[1:]
+		showHidden = true // Picked by name, even if it's a dotfile
+	}
+	if len(args) > 0 {
+		port = args[0]
+	}
+	if len(args) > 1 {
+		if len(dirs) > 0 {
+			log.Fatal("Give either a directory or --dir/--backend options, not both")
+		}
+		shareDir = args[1]
+	}
+
+	rate, err := parseRate(*limitRate)
+	if err != nil {
+		log.Fatal("Invalid --limit-rate:", err)
+	}
+	globalLimiter = newByteLimiter(rate)
+	connRate, err = parseRate(*limitRateConn)
+	if err != nil {
+		log.Fatal("Invalid --limit-rate-per-conn:", err)
+	}
+	// Sizes take the same units as rates.
+	if maxUploadSize, err = parseRate(*maxUpload); err != nil {
+		log.Fatal("Invalid --max-upload-size:", err)
+	}
+	if uploadQuota, err = parseRate(*quota); err != nil {
+		log.Fatal("Invalid --upload-quota:", err)
+	}
+	if minFreeSpace, err = parseRate(*minFree); err != nil {
+		log.Fatal("Invalid --min-free-space:", err)
+	}
+	if basePath, err = parseBasePath(*basePathFlag); err != nil {
+		log.Fatal("Invalid --base-path:", err)
+	}
+	if basePath != "" && len(trustedProxies) == 0 {
+		log.Fatal("--base-path needs --trusted-proxy with the reverse proxy's address, or everyone coming through it would count as the host")
+	}
+	if zipLevel, err = parseZipLevel(*zipCompression); err != nil {
+		log.Fatal("Invalid --zip-level:", err)
+	}
+	if maxExtractSize, err = parseRate(*maxExtract); err != nil {
+		log.Fatal("Invalid --max-extract-size:", err)
+	}
+	if cacheMaxSize, err = parseRate(*cacheSize); err != nil {
+		log.Fatal("Invalid --cache-max-size:", err)
+	}
+
+	if err := checkBranding(); err != nil {
+		log.Fatal("Error loading the logo or theme:", err)
+	}
+	if err := loadTemplates(); err != nil {
+		log.Fatal("Error loading templates:", err)
+	}
+	history, err = openHistory(stateDir)
+	if err != nil {
+		log.Println("Transfer history disabled:", err)
+	}
+	secretKey, err = loadSecret(stateDir)
+	if err != nil {
+		log.Fatal("Error loading secret key:", err)
+	}
+	usedLinks, err = openUsedLinks(stateDir)
+	if err != nil {
+		log.Fatal("Error loading one-time links:", err)
+	}
+	if quarantineDir == "" {
+		quarantineDir = filepath.Join(stateDir, "quarantine")
+	}
+	checksums, err = openChecksums(stateDir)
+	if err != nil {
+		log.Fatal("Error loading checksums:", err)
+	}
+	versions, err = openVersions(stateDir)
+	if err != nil {
+		log.Fatal("Error loading file versions:", err)
 	}
-	if len(os.Args) > 2 {
-		shareDir = os.Args[2]
+	tags, err = openTags(stateDir)
+	if err != nil {
+		log.Fatal("Error loading tags:", err)
+	}
+	pins, err = openPins(stateDir)
+	if err != nil {
+		log.Fatal("Error loading pinned files:", err)
+	}
+	published, err = openIPFS(stateDir)
+	if err != nil {
+		log.Fatal("Error loading IPFS records:", err)
+	}
+	notes, err = openNotes(stateDir)
+	if err != nil {
+		log.Fatal("Error loading notes:", err)
+	}
+	pastes, err = openPastes(stateDir)
+	if err != nil {
+		log.Fatal("Error loading shared text:", err)
+	}
+	trash, err = openTrash(stateDir)
+	if err != nil {
+		log.Fatal("Error loading the trash:", err)
+	}
+	go expireTrash()
+	if cacheDir == "" {
+		cacheDir = filepath.Join(stateDir, "cache")
+	}
+	previews, err = openPreviewCache(cacheDir, cacheMaxSize)
+	if err != nil {
+		log.Fatal("Error opening the thumbnail cache:", err)
+	}
+	if err := checkTranscode(); err != nil {
+		log.Fatal(err)
+	}
+	quotas, err = openQuotas(stateDir)
+	if err != nil {
+		log.Fatal("Error loading upload quotas:", err)
+	}
+	users, err = openUsers(stateDir)
+	if err != nil {
+		log.Fatal("Error loading users:", err)
+	}
+	if *auth != "" {
+		name, password, ok := strings.Cut(*auth, ":")
+		if !ok || name == "" {
+			log.Fatal("Invalid --auth, expected user:password")
+		}
+		hash, err := hashPassword(password)
+		if err != nil {
+			log.Fatal("Error hashing password:", err)
+		}
+		users.builtin = &user{Name: name, Role: roleAdmin, Hash: hash}
 	}
 
 	absPath, err := filepath.Abs(shareDir)
@@ -37,156 +331,654 @@ func main() {
 		log.Fatal("Error getting absolute path:", err)
 	}
 	shareDir = absPath
+	if len(dirs) == 0 {
+		dirs = []*mount{{Dir: shareDir}}
+	}
+	if err := openMounts(dirs); err != nil {
+		log.Fatal("Error opening share directory:", err)
+	}
 
-	fileList, err = listFiles(shareDir)
+	_, err = indexedFiles()
 	if err != nil {
 		log.Fatal("Error listing files:", err)
 	}
+	if indexContents {
+		startContentIndex()
+	}
+
+	baseURL = fmt.Sprintf("http://%s:%s%s/", getLocalIP(), port, basePath)
 
-	baseURL = fmt.Sprintf("http://%s:%s/", getLocalIP(), port)
+	if *ldapURL != "" {
+		if _, ok := roleRank[*ldapDefaultRole]; !ok && *ldapDefaultRole != "" {
+			log.Fatalf("Invalid --ldap-default-role %q", *ldapDefaultRole)
+		}
+		ldap = &ldapBackend{
+			URL:          *ldapURL,
+			BindDN:       *ldapBindDN,
+			BindPassword: *ldapBindPassword,
+			BaseDN:       *ldapBaseDN,
+			UserFilter:   *ldapFilter,
+			GroupAttr:    *ldapGroupAttr,
+			RoleMap:      ldapRoles,
+			DefaultRole:  *ldapDefaultRole,
+		}
+		if _, err := encodeLDAPFilter(strings.ReplaceAll(ldap.UserFilter, "%s", "x")); err != nil {
+			log.Fatal("Invalid --ldap-user-filter:", err)
+		}
+	}
 
-	fmt.Println("Sharing files from:", shareDir)
+	if *oidcIssuer != "" {
+		roleMap, err := parseRoleMap(*oidcRoles)
+		if err != nil {
+			log.Fatal("Invalid --oidc-roles:", err)
+		}
+		if _, ok := roleRank[*oidcDefaultRole]; !ok && *oidcDefaultRole != "" {
+			log.Fatalf("Invalid --oidc-default-role %q", *oidcDefaultRole)
+		}
+		oidc = &oidcProvider{
+			Issuer:       *oidcIssuer,
+			ClientID:     *oidcClientID,
+			ClientSecret: *oidcClientSecret,
+			RedirectURL:  *oidcRedirect,
+			RoleClaim:    *oidcRoleClaim,
+			RoleMap:      roleMap,
+			DefaultRole:  *oidcDefaultRole,
+		}
+		if oidc.RedirectURL == "" {
+			oidc.RedirectURL = baseURL + "oidc/callback"
+		}
+		if err := oidc.discover(); err != nil {
+			log.Fatal("OIDC discovery failed:", err)
+		}
+	}
+
+	for _, m := range mounts {
+		if sendFile != "" {
+			fmt.Println("Sending file:", m.Dir)
+		} else if receiveOnly {
+			fmt.Println("Receiving files into:", m.Dir)
+		} else if m.Name == "" {
+			fmt.Println("Sharing files from:", m.Dir)
+		} else {
+			fmt.Printf("Sharing files from: %s as /%s\n", m.Dir, m.Name)
+		}
+	}
 	fmt.Println("Server started at:", baseURL)
 	fmt.Println("Use Ctrl+C to stop.")
 
+	limitDownloads := func(h http.HandlerFunc) http.Handler { return h }
+	if maxConcurrentDownloads > 0 {
+		queue := newDownloadQueue(maxConcurrentDownloads)
+		limitDownloads = func(h http.HandlerFunc) http.Handler { return downloadLimitMiddleware(queue, h) }
+	}
+
+	downloads := func(h http.Handler) http.Handler { return h }
+	if receiveOnly {
+		downloads = func(http.Handler) http.Handler { return http.NotFoundHandler() }
+	}
 	http.HandleFunc("/", fileListHandler)
-	http.HandleFunc("/download/", downloadHandler)
+	http.Handle("/download/", downloads(limitDownloads(downloadHandler)))
+	http.Handle("/s/", downloads(limitDownloads(shareLinkHandler)))
+	http.Handle("/zip/", downloads(limitDownloads(folderArchiveHandler)))
+	http.Handle("/tar/", downloads(limitDownloads(folderArchiveHandler)))
+	http.Handle("/torrent/", downloads(http.HandlerFunc(torrentHandler)))
+	http.HandleFunc("/announce", announceHandler)
+	http.Handle("/dlna/", downloads(http.HandlerFunc(dlnaHandler)))
+	http.Handle("/api/cast", downloads(http.HandlerFunc(apiCastHandler)))
+	http.Handle("/api/cast/", downloads(http.HandlerFunc(apiCastHandler)))
+	http.Handle("/api/ipfs/", downloads(http.HandlerFunc(apiIPFSHandler)))
+	http.Handle("/api/files", downloads(http.HandlerFunc(apiFilesHandler)))
+	http.Handle("/api/sign", downloads(http.HandlerFunc(apiSignHandler)))
+	http.HandleFunc("/api/status", apiStatusHandler)
+	http.HandleFunc("/api/files/", apiFileHandler)
+	http.HandleFunc("/api/extract/", apiExtractHandler)
+	http.Handle("/api/folders", downloads(http.HandlerFunc(apiFoldersHandler)))
+	http.Handle("/api/notes/", downloads(http.HandlerFunc(notesHandler)))
+	http.Handle("/api/pastes", downloads(http.HandlerFunc(pastesHandler)))
+	http.Handle("/paste/", downloads(http.HandlerFunc(pastePageHandler)))
+	http.Handle("/raw/", downloads(http.HandlerFunc(rawPasteHandler)))
+	http.Handle("/clipboard", downloads(http.HandlerFunc(clipboardPageHandler)))
+	http.Handle("/clipboard/ws", downloads(http.HandlerFunc(clipboardSocketHandler)))
+	http.Handle("/api/clipboard", downloads(http.HandlerFunc(apiClipboardHandler)))
+	http.Handle("/chat/ws", downloads(http.HandlerFunc(chatSocketHandler)))
+	http.Handle("/checksums", downloads(http.HandlerFunc(checksumsHandler)))
+	http.Handle("/checksums/", downloads(http.HandlerFunc(checksumsHandler)))
+	http.Handle("/api/versions/", downloads(http.HandlerFunc(apiVersionsHandler)))
+	http.Handle("/versions/", downloads(http.HandlerFunc(versionsHandler)))
+	http.Handle("/view/", downloads(http.HandlerFunc(viewHandler)))
+	http.Handle("/watch/", downloads(http.HandlerFunc(watchHandler)))
+	http.Handle("/thumb/", downloads(http.HandlerFunc(thumbHandler)))
+	http.Handle("/img/", downloads(http.HandlerFunc(imgHandler)))
+	http.Handle("/gallery/", downloads(http.HandlerFunc(galleryHandler)))
+	http.Handle("/search", downloads(http.HandlerFunc(searchHandler)))
+	http.Handle("/hls/", downloads(http.HandlerFunc(hlsHandler)))
+	http.HandleFunc("/player.js", playerJSHandler)
+	http.HandleFunc("/theme.css", themeHandler)
+	http.HandleFunc("/logo", logoHandler)
+	http.HandleFunc("/manifest.webmanifest", manifestHandler)
+	http.HandleFunc("/sw.js", serviceWorkerHandler)
+	http.HandleFunc("/icon-192.png", iconHandler(192))
+	http.HandleFunc("/icon-512.png", iconHandler(512))
+	http.HandleFunc("/offline", offlineHandler)
+	http.HandleFunc("/api/trash", adminOnly(trashHandler))
+	http.HandleFunc("/api/trash/", adminOnly(trashHandler))
+	http.HandleFunc("/admin/trash", adminOnly(trashHandler))
+	http.HandleFunc("/upload", uploadHandler)
+	http.HandleFunc("/upload/chunked/", chunkedUploadHandler)
+	http.HandleFunc("/upload/chunked", chunkedUploadHandler)
+	http.HandleFunc("/unlock", unlockHandler)
+	http.HandleFunc("/login", loginHandler)
+	http.HandleFunc("/logout", logoutHandler)
+	if oidc != nil {
+		http.HandleFunc("/oidc/login", oidcLoginHandler)
+		http.HandleFunc("/oidc/callback", oidcCallbackHandler)
+	} else {
+		http.Handle("/oidc/", http.NotFoundHandler())
+	}
+	http.HandleFunc("/history", adminOnly(historyPageHandler))
+	http.HandleFunc("/admin/links", adminOnly(linksPageHandler))
+	http.HandleFunc("/admin/transfers", adminOnly(transfersPageHandler))
+	http.HandleFunc("/admin/transfers/events", adminOnly(transfersEventsHandler))
+	http.HandleFunc("/progress/", progressHandler)
+	http.HandleFunc("/admin/transfers/cancel", adminOnly(transferCancelHandler))
+	http.HandleFunc("/api/fetch", adminOnly(apiFetchHandler))
+
+	var handler http.Handler = http.DefaultServeMux
+	handler = authMiddleware(handler)
+	handler = csrfMiddleware(handler)
+	handler = corsMiddleware(handler)
+	if compressResponses {
+		handler = compressMiddleware(handler)
+	}
+	handler = securityHeadersMiddleware(handler)
+	if rateLimit > 0 {
+		handler = rateLimitMiddleware(newRateLimiter(rateLimit, rateBurst), handler)
+	}
+	handler = activityMiddleware(handler)
+	if len(allowNets) > 0 || len(denyNets) > 0 {
+		handler = ipFilterMiddleware(handler)
+	}
+	handler = basePathMiddleware(handler)
 
-	err = http.ListenAndServe(":"+port, nil)
+	ln, err := net.Listen("tcp", ":"+port)
 	if err != nil {
-		log.Fatal("ListenAndServe:", err)
+		log.Fatal("Listen:", err)
+	}
+	if maxConnections > 0 {
+		ln = newLimitListener(ln, maxConnections)
+	}
+	if seedPort > 0 {
+		seeds, err := net.Listen("tcp", fmt.Sprintf(":%d", seedPort))
+		if err != nil {
+			log.Fatal("Listen for BitTorrent peers:", err)
+		}
+		go serveSeeds(seeds)
+	}
+	if dlnaEnabled {
+		go serveSSDP()
+	}
+
+	if idleTimeout > 0 {
+		go watchIdle(idleTimeout)
+	}
+	if *expire > 0 {
+		expiresAt = startTime.Add(*expire)
+		fmt.Println("Share closes at:", expiresAt.Format("15:04:05"))
+		time.AfterFunc(*expire, func() { requestShutdown("share expired after " + expire.String()) })
+	}
+
+	server := &http.Server{Handler: handler, Protocols: serverProtocols()}
+	stopped := make(chan struct{})
+	go func() {
+		reason := <-shutdownRequests
+		fmt.Println("Shutting down:", reason)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+		close(stopped)
+	}()
+
+	err = server.Serve(ln)
+	if err != http.ErrServerClosed {
+		log.Fatal("Serve:", err)
+	}
+	<-stopped
+	if stdinSpool != nil {
+		stdinSpool.remove()
+	}
+	stopTranscodes()
+	checksums.flush()
+}
+
+// serverProtocols is HTTP/1.1 and HTTP/2, which carries every download,
+// upload and live update from a page over one connection. There's no TLS
+// listener, so HTTP/2 is spoken in the clear, h2c, to clients that start
+// with it, like a reverse proxy in front of the share; browsers only use
+// it over TLS. --http1-only turns it off.
+func serverProtocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	if !http1Only {
+		p.SetHTTP2(true)
+		p.SetUnencryptedHTTP2(true)
+	}
+	return p
+}
+
+// fileEntry is a file shown in the listing.
+type fileEntry struct {
+	Name         string     `json:"name"`
+	Downloads    int        `json:"downloads"`
+	LastDownload time.Time  `json:"last_download,omitzero"`
+	Locked       bool       `json:"locked,omitempty"` // Password protected and not unlocked yet
+	Folder       bool       `json:"folder,omitempty"` // A folder past --max-depth, not expanded
+	Versions     int        `json:"versions,omitempty"`
+	SHA256       string     `json:"sha256,omitempty"`
+	Type         string     `json:"type,omitempty"`
+	Photo        *photoInfo `json:"photo,omitempty"` // With ?sort=taken, or ?photos for the API
+	Size         int64      `json:"size"`
+	HumanSize    string     `json:"size_human,omitempty"`
+	Modified     time.Time  `json:"modified,omitzero"`
+	Tags         []string   `json:"tags,omitempty"`
+	Pinned       bool       `json:"pinned,omitempty"`
+	Notes        []fileNote `json:"notes,omitempty"`
+	CID          string     `json:"cid,omitempty"` // What it was published to IPFS as
+}
+
+// listEntries lists the shared files along with their download statistics,
+// as seen by the client making r.
+func listEntries(r *http.Request) ([]fileEntry, error) {
+	files, err := listFileInfos("")
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fileEntry, len(files))
+	for i, f := range files {
+		name := filepath.ToSlash(f.name)
+		if folder, ok := strings.CutSuffix(name, "/"); ok {
+			entries[i] = fileEntry{Name: folder, Folder: true}
+			continue
+		}
+		stats := downloadStats.get(name)
+		_, locked := lockedBy(r, name)
+		entries[i] = fileEntry{
+			Name:         name,
+			Downloads:    stats.Downloads,
+			LastDownload: stats.LastDownload,
+			Locked:       locked,
+			Versions:     versions.count(name),
+			Type:         sharedFileType(name),
+			Size:         f.info.Size(),
+			HumanSize:    humanSize(f.info.Size()),
+			Modified:     f.info.ModTime(),
+			Tags:         tags.get(name),
+			Pinned:       pins.pinned(name),
+			Notes:        notes.list(name),
+		}
+		if ipfsAPI != "" && !locked {
+			entries[i].CID = published.cid(name, f.info)
+		}
+	}
+	return entries, nil
+}
+
+// layoutCookie remembers whether someone likes the file list as a list or
+// as a grid of cards.
+const layoutCookie = "lanshare_layout"
+
+// listLayout returns "grid" or "list", from ?layout= if given, which it
+// remembers, or else from what was last picked.
+func listLayout(w http.ResponseWriter, r *http.Request) string {
+	layout := r.URL.Query().Get("layout")
+	if layout == "grid" || layout == "list" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     layoutCookie,
+			Value:    layout,
+			Path:     basePath + "/",
+			MaxAge:   365 * 24 * 60 * 60,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return layout
 	}
+	if c, err := r.Cookie(layoutCookie); err == nil && c.Value == "grid" {
+		return "grid"
+	}
+	return "list"
 }
 
 func fileListHandler(w http.ResponseWriter, r *http.Request) {
-	files, err := listFiles(shareDir)
+	if sendFile != "" {
+		sendPageHandler(w, r)
+		return
+	}
+	if receiveOnly {
+		uploadHandler(w, r)
+		return
+	}
+	all, err := listEntries(r)
 	if err != nil {
 		http.Error(w, "Error listing files", http.StatusInternalServerError)
 		return
 	}
+	tag := r.URL.Query().Get("tag")
+	all = filterByTag(all, tag)
+	sort := parseSort(r.URL.Query())
+	sortEntries(all, sort)
+	page, err := parsePage(r.URL.Query(), defaultPerPage)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	files := page.slice(all)
+	for i, f := range files {
+		if !f.Folder && !f.Locked {
+			files[i].SHA256 = checksums.known(f.Name)
+		}
+	}
 
 	data := struct {
-		Files  []string
-		Uptime string
+		Files          []fileEntry
+		Uptime         string
+		ExpiresAt      time.Time
+		AuthEnabled    bool
+		CanUpload      bool
+		CanDelete      bool
+		Trash          bool // Deleted files can be restored for a while
+		CanRename      bool
+		CanExtract     bool
+		CanIPFS        bool     // The host can publish files to IPFS
+		Folders        []string // Where files can be moved to
+		CSRF           string
+		Free           string // Room left for uploads, "" if not known
+		User           *user
+		VideoThumbs    bool // ffmpeg can make them
+		Sort           []sortLink
+		GridURL        string // Keep the sort order
+		ListURL        string
+		Galleries      []string // Folders that are mostly pictures
+		Layout         string   // list or grid
+		Page           listPage
+		PrevURL        string // "" on the first page
+		NextURL        string // And on the last
+		FolderSizes    []folderSize
+		Tag            string   // What the list is filtered by
+		Tags           []string // Every tag in use, to filter by
+		CanTag         bool
+		Pinned         []fileEntry // At the top of the first page
+		CanPin         bool
+		Me             string  // Who's signed in, to take their own notes off
+		Pastes         []paste // Shared text, on the first page
+		Expiries       []struct{ Label, After string }
+		PasteLanguages []struct{ Label, Language string }
+		Clipboard      bool
+		Chat           bool
+		CanFetch       bool
+		FetchDir       string // Where fetched files go
+		Lang           string
+		Languages      []language
+		Title          string // --title, or "" for the usual one
+		Logo           bool
+		Calculating    bool // The folder sizes aren't worked out yet
 	}{
-		Files:  files,
-		Uptime: time.Since(startTime).String(),
-	}
-
-	// Template with modern UI
-	tmpl := template.Must(template.New("index").Funcs(template.FuncMap{
-		"isImage": func(fileName string) bool {
-			ext := strings.ToLower(filepath.Ext(fileName))
-			return ext == ".jpg" || ext == ".jpeg" || ext == ".png" || ext == ".gif" || ext == ".webp"
-		},
-		"isVideo": func(fileName string) bool {
-			ext := strings.ToLower(filepath.Ext(fileName))
-			return ext == ".mp4" || ext == ".webm" || ext == ".ogg"
-		},
-		"fileIcon": func(fileName string) string {
-			ext := strings.ToLower(filepath.Ext(fileName))
-			icons := map[string]string{
-				".pdf":  "📄",
-				".txt":  "📝",
-				".zip":  "📦",
-				".rar":  "📦",
-				".docx": "📃",
-				".xlsx": "📊",
-				".pptx": "📽",
-				".mp3":  "🎵",
-				".wav":  "🎶",
-			}
-			if icon, found := icons[ext]; found {
-				return icon
-			}
-			return "📁" // Default icon
-		},
-	}).Parse(`
-<!DOCTYPE html>
-<html lang="en">
-<head>
-  <meta charset="UTF-8">
-  <meta name="viewport" content="width=device-width, initial-scale=1.0">
-  <title>File Sharing</title>
-  <style>
-    body { font-family: Arial, sans-serif; background-color: #0a192f; color: #ffffff; margin: 0; padding: 20px; }
-    .container { max-width: 800px; margin: 0 auto; }
-    h1 { color: #64ffda; text-align: center; }
-    .file-list { list-style: none; padding: 0; }
-    .file-item { background-color: #112240; padding: 15px; border-radius: 8px; margin-bottom: 10px; display: flex; align-items: center; gap: 15px; }
-    .file-item img, .file-item video { max-width: 100px; max-height: 100px; border-radius: 5px; }
-    .file-icon { width: 50px; height: 50px; display: flex; align-items: center; justify-content: center; background-color: #233554; border-radius: 5px; font-size: 20px; }
-    .file-name { flex-grow: 1; color: #ffffff; text-decoration: none; }
-    .file-name:hover { text-decoration: underline; }
-    .download-btn { background-color: #64ffda; color: #0a192f; border: none; padding: 8px 12px; border-radius: 5px; cursor: pointer; text-decoration: none; }
-    .download-btn:hover { background-color: #52e3c2; }
-    .uptime { text-align: center; margin-top: 20px; color: #8892b0; }
-  </style>
-</head>
-<body>
-  <div class="container">
-    <h1>Shared Files</h1>
-    <ul class="file-list">
-      {{range .Files}}
-      <li class="file-item">
-        {{if isImage .}}
-        <img src="/download/{{.}}" alt="{{.}}">
-        {{else if isVideo .}}
-        <video controls muted>
-          <source src="/download/{{.}}" type="video/mp4">
-          Your browser does not support the video tag.
-        </video>
-        {{else}}
-        <div class="file-icon">{{fileIcon .}}</div>
-        {{end}}
-        <span class="file-name">{{.}}</span>
-        <a href="/download/{{.}}" class="download-btn" download>Download</a>
-      </li>
-      {{end}}
-    </ul>
-    <div class="uptime">Server started {{.Uptime}} ago</div>
-  </div>
-</body>
-</html>
-`))
-
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	err = tmpl.Execute(w, data)
-	if err != nil {
+		Files:          files,
+		Uptime:         roughUptime(),
+		ExpiresAt:      expiresAt,
+		AuthEnabled:    authEnabled(),
+		CanUpload:      uploadsEnabled && hasRole(r, roleUploader) && len(uploadDirs()) > 0,
+		CanDelete:      canDelete(r),
+		Trash:          trashRetention > 0,
+		CanRename:      canRename(r),
+		CanExtract:     canExtract(r),
+		CanIPFS:        ipfsAPI != "" && isAdmin(r),
+		CSRF:           csrfToken(w, r),
+		User:           currentUser(r),
+		VideoThumbs:    ffmpegPath != "",
+		Sort:           sortLinks(basePath+"/", sort, withTag(url.Values{}, tag)),
+		GridURL:        sort.url(basePath+"/", withTag(url.Values{"layout": {"grid"}}, tag)),
+		ListURL:        sort.url(basePath+"/", withTag(url.Values{"layout": {"list"}}, tag)),
+		Galleries:      galleryFolders(all),
+		Layout:         listLayout(w, r),
+		Page:           page,
+		Tag:            strings.ToLower(tag),
+		Tags:           tags.all(),
+		CanTag:         canTag(r),
+		CanPin:         isAdmin(r),
+		Me:             uploaderName(r),
+		Lang:           pageLanguage(w, r),
+		Languages:      languages,
+		Title:          siteTitle,
+		Logo:           logoFile != "",
+		Expiries:       pasteExpiries,
+		PasteLanguages: pasteLanguages,
+		Clipboard:      clipboardEnabled,
+		Chat:           chatEnabled,
+	}
+	if page.Page == 1 {
+		data.Pinned = pinnedEntries(all)
+		data.Pastes = pastes.list()
+	}
+	if page.Page > 1 {
+		data.PrevURL = sort.url(basePath+"/", withTag(page.query(page.Page-1), tag))
+	}
+	if page.Page < page.Pages() {
+		data.NextURL = sort.url(basePath+"/", withTag(page.query(page.Page+1), tag))
+	}
+	sizes, ready := folderSizeList(sharedFolders(all))
+	data.FolderSizes, data.Calculating = sizes, !ready
+	if data.CanUpload {
+		data.Free = uploadSpaceSummary()
+	}
+	if dirs := uploadDirs(); isAdmin(r) && len(dirs) > 0 {
+		data.CanFetch, data.FetchDir = true, dirs[0]
+	}
+	if data.CanRename {
+		data.Folders = entryFolders(all)
+	}
+
+	tmpl := indexTemplate.withFuncs(template.FuncMap{"t": translator(data.Lang)})
+	var html bytes.Buffer
+	if err := tmpl.Execute(&html, data); err != nil {
 		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+		return
 	}
+	writeTagged(w, r, "text/html; charset=utf-8", html.Bytes())
+}
+
+// roughUptime is how long the server has been up, to the minute, so the
+// file list stays the same from one refresh to the next and can be
+// answered with a 304.
+func roughUptime() string {
+	d := max(time.Since(startTime).Truncate(time.Minute), time.Minute)
+	return strings.TrimSuffix(d.String(), "0s")
 }
 
+var indexTemplate = newPage("index", template.FuncMap{
+	"isImage":      previewImage,
+	"isVideo":      previewVideo,
+	"anyVideo":     isVideo,
+	"isAudio":      isAudio,
+	"isArchive":    extractable,
+	"ipfsLink":     ipfsLink,
+	"torrentable":  func(size int64) bool { return size >= minTorrentSize },
+	"fileIcon":     typeIcon,
+	"mediaType":    mediaType,
+	"escapePath":   escapePath,
+	"humanSize":    humanSize,
+	"join":         strings.Join,
+	"t":            translator("en"),
+	"layoutCookie": func() string { return layoutCookie },
+	"themeChoices": func() []string { return []string{"automatic", "light", "dark"} },
+	"since": func(t time.Time) string {
+		return time.Since(t).Round(time.Second).String()
+	},
+	"until": func(t time.Time) string {
+		return time.Until(t).Round(time.Second).String()
+	},
+})
+
 func downloadHandler(w http.ResponseWriter, r *http.Request) {
-	filename := strings.TrimPrefix(r.URL.Path, "/download/")
-	filepath := filepath.Join(shareDir, filename)
+	name := strings.TrimPrefix(r.URL.Path, "/download/")
+	// Signed URLs can only be made by someone who could read the file, so
+	// they skip the password prompt along with global auth.
+	if p, locked := lockedBy(r, name); locked && !validSignedURL(r) {
+		redirectToUnlock(w, r, p)
+		return
+	}
+	serveFile(w, r, name)
+}
 
-	mu.Lock()
-	defer mu.Unlock()
+// serveFile sends the shared file filename, a path relative to the share,
+// keeping track of the transfer along the way. It reports whether the file
+// was downloaded to the end.
+func serveFile(w http.ResponseWriter, r *http.Request, filename string) bool {
+	filename, ok := safeSharePath(filename)
+	if !ok {
+		http.NotFound(w, r)
+		return false
+	}
+	f, err := openShared(filename)
+	if err != nil {
+		http.NotFound(w, r)
+		return false
+	}
+	defer f.Close()
 
-	if !fileExists(filepath) {
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
 		http.NotFound(w, r)
-		return
+		return false
+	}
+
+	if g, ok := f.(growingFile); ok && g.growing() {
+		return streamFile(w, r, filename, f, info)
+	}
+	rs := seekable(w, f, info)
+	setDisposition(w, r, info.Name())
+	if r.Method == http.MethodHead {
+		http.ServeContent(w, r, info.Name(), info.ModTime(), rs)
+		return false
+	}
+
+	if strings.HasPrefix(w.Header().Get("Content-Disposition"), "attachment") {
+		setCachePolicy(w, "downloads")
+	} else {
+		setCachePolicy(w, "previews")
+	}
+	// Answered here rather than by ServeContent, so a 304 doesn't show up
+	// as a download that went nowhere.
+	if r.Header.Get("Range") == "" && notModified(w, r, fileETag(info), info.ModTime()) {
+		return false
+	}
+	t := transfers.start(r.Context(), r, "download", filename, info.Size())
+	w.Header().Set("X-Transfer-ID", strconv.FormatInt(t.ID, 10))
+	content := newThrottledReader(t.reader(rs), globalLimiter, newByteLimiter(connRate))
+	http.ServeContent(&transferWriter{ResponseWriter: w, t: t}, r, info.Name(), info.ModTime(), content)
+	if transfers.finish(t) != transferDone || !t.reachedEnd.Load() {
+		return false
+	}
+	downloadStats.record(filename)
+	countDownload()
+	return true
+}
+
+// streamFile sends a file that is still growing, without a size and so
+// without support for ranges, until its writer is done.
+func streamFile(w http.ResponseWriter, r *http.Request, filename string, f fs.File, info fs.FileInfo) bool {
+	w.Header().Set("Content-Type", cmp.Or(typeByName(info.Name()), "application/octet-stream"))
+	setDisposition(w, r, info.Name())
+	if r.Method == http.MethodHead {
+		return false
 	}
 
-	http.ServeFile(w, r, filepath)
+	t := transfers.start(r.Context(), r, "download", filename, -1)
+	w.Header().Set("X-Transfer-ID", strconv.FormatInt(t.ID, 10))
+	content := newThrottledReader(t.reader(f.(io.ReadSeeker)), globalLimiter, newByteLimiter(connRate))
+	_, err := io.Copy(&transferWriter{ResponseWriter: w, t: t}, content)
+	if err != nil {
+		// Expect more than was sent, which makes the transfer a failed one.
+		t.size.Store(t.bytes.Load() + 1)
+	}
+	if transfers.finish(t) != transferDone {
+		return false
+	}
+	downloadStats.record(filename)
+	countDownload()
+	return true
 }
 
-func listFiles(dir string) ([]string, error) {
-	var files []string
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
-			relPath, _ := filepath.Rel(dir, path)
-			files = append(files, relPath)
+// setDisposition says how to show a download of name, whose Content-Type is
+// already set on w. With ?dl it's always saved; with ?view it's shown
+// in the browser where it can be, text as plain text and SVG images without
+// running their scripts. Without either the browser decides.
+func setDisposition(w http.ResponseWriter, r *http.Request, name string) {
+	q := r.URL.Query()
+	if q.Has("dl") {
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", name))
+		return
+	}
+	if q.Has("view") {
+		ctype := w.Header().Get("Content-Type")
+		if showAsText(ctype) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		}
-		return nil
-	})
-	return files, err
+		if mediaType(ctype) == "image/svg+xml" {
+			w.Header().Set("Content-Security-Policy", strings.TrimPrefix(w.Header().Get("Content-Security-Policy")+"; sandbox", "; "))
+		}
+	}
+	w.Header().Set("Content-Disposition", contentDisposition("inline", name))
 }
 
-func fileExists(filename string) bool {
-	info, err := os.Stat(filename)
-	return err == nil && !info.IsDir()
+// contentDisposition returns a Content-Disposition header of the given kind,
+// inline or attachment, saving as name. Names that aren't plain ASCII get an
+// RFC 5987 filename* for browsers along with a rough ASCII filename for
+// anything older.
+func contentDisposition(kind, name string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' || r == '"' || r == '\\' || r == '%' {
+			return '_'
+		}
+		return r
+	}, name)
+	if fallback == name {
+		return kind + `; filename="` + name + `"`
+	}
+	var enc strings.Builder
+	for _, b := range []byte(name) {
+		if 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+			enc.WriteByte(b)
+		} else {
+			fmt.Fprintf(&enc, "%%%02X", b)
+		}
+	}
+	return kind + `; filename="` + fallback + `"; filename*=UTF-8''` + enc.String()
+}
+
+// escapePath percent-encodes each part of the share path p for a URL, so
+// links to names with spaces, # or ? in them, or in Bangla or Chinese, work.
+func escapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// safeSharePath cleans a user-supplied path relative to the share root and
+// reports whether it stays inside it. Beyond the ".." that cleanSharePath
+// collapses, it turns away NUL bytes and, on Windows, drive letters,
+// backslash tricks and reserved device names like NUL or COM1.
+func safeSharePath(p string) (string, bool) {
+	if strings.ContainsRune(p, 0) {
+		return "", false
+	}
+	p = cleanSharePath(p)
+	if p == "" {
+		return "", true
+	}
+	if !filepath.IsLocal(filepath.FromSlash(p)) {
+		return "", false
+	}
+	return p, true
 }
 
 func getLocalIP() string {
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestMain parses the pages' templates, as main does, for the handlers that
+// show one.
+func TestMain(m *testing.M) {
+	if err := loadTemplates(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// h2cServer serves handler with the server's own protocols, wrapped the way
+// main wraps it, and returns a client that speaks HTTP/2 in the clear to it
+// along with a count of the connections it was sent.
+func h2cServer(t *testing.T, handler http.Handler) (*httptest.Server, *http.Client, *atomic.Int32) {
+	t.Helper()
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(securityHeadersMiddleware(compressMiddleware(handler)))
+	srv.Config.Protocols = serverProtocols()
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	p := new(http.Protocols)
+	p.SetUnencryptedHTTP2(true)
+	tr := &http.Transport{Protocols: p}
+	t.Cleanup(tr.CloseIdleConnections)
+	return srv, &http.Client{Transport: tr, Timeout: 10 * time.Second}, &conns
+}
+
+func TestHTTP2ParallelRanges(t *testing.T) {
+	share, _ := shareForTest(t, symlinksWithinRoot)
+	content := make([]byte, 1<<20)
+	rand.Read(content)
+	if err := os.WriteFile(filepath.Join(share, "big.bin"), content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/download/", downloadHandler)
+	srv, client, conns := h2cServer(t, mux)
+
+	get := func(from, to int) ([]byte, error) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/download/big.bin", nil)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, to))
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.ProtoMajor != 2 {
+			return nil, fmt.Errorf("served over %s, want HTTP/2", resp.Proto)
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			return nil, fmt.Errorf("status %d, want 206", resp.StatusCode)
+		}
+		return io.ReadAll(resp.Body)
+	}
+	// The first request sets up the connection the rest share.
+	if _, err := get(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	const parts = 8
+	size := len(content) / parts
+	var wg sync.WaitGroup
+	errs := make([]error, parts)
+	for i := range parts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			from := i * size
+			got, err := get(from, from+size-1)
+			if err == nil && !bytes.Equal(got, content[from:from+size]) {
+				err = fmt.Errorf("got %d bytes that don't match the file", len(got))
+			}
+			errs[i] = err
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("part %d: %v", i, err)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("the downloads used %d connections, want them all on one", n)
+	}
+}
+
+func TestHTTP2EventStreamFlushes(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/transfers/events", transfersEventsHandler)
+	srv, client, _ := h2cServer(t, mux)
+
+	resp, err := client.Get(srv.URL + "/admin/transfers/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("served over %s, want HTTP/2", resp.Proto)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q, want text/event-stream", ct)
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" {
+		t.Fatalf("event stream sent with Content-Encoding %q", ce)
+	}
+
+	// The handler never returns by itself, so each event only arrives if it
+	// was flushed; two show it keeps flushing as it goes.
+	events := make(chan string)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if line, ok := strings.CutPrefix(sc.Text(), "data: "); ok {
+				events <- line
+			}
+		}
+		close(events)
+	}()
+	for i := range 2 {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				t.Fatalf("stream ended after %d events", i)
+			}
+			if !strings.HasPrefix(ev, "[") && ev != "null" {
+				t.Errorf("event %d is %q, want a JSON list of transfers", i, ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event %d didn't arrive, the stream isn't being flushed", i)
+		}
+	}
+}
+
+// withNets sets a --allow/--deny/--trusted-proxy style option for the
+// length of the test.
+func withNets(t *testing.T, nets *netsFlag, value string) {
+	t.Helper()
+	old := *nets
+	t.Cleanup(func() { *nets = old })
+	*nets = nil
+	if err := nets.Set(value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrustedProxyIsNeverLocal(t *testing.T) {
+	withNets(t, &trustedProxies, "127.0.0.1")
+	tests := []struct {
+		remote, forwardedFor string
+		client               string
+	}{
+		{"127.0.0.1:4000", "", ""},
+		{"127.0.0.1:4000", "127.0.0.1", ""},
+		{"127.0.0.1:4000", "203.0.113.7", "203.0.113.7"},
+		{"127.0.0.1:4000", "127.0.0.1, 203.0.113.7", "203.0.113.7"},
+		{"127.0.0.1:4000", "junk", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/admin", nil)
+		r.RemoteAddr = tt.remote
+		if tt.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		if got := clientIP(r); got != tt.client {
+			t.Errorf("X-Forwarded-For %q: clientIP = %q, want %q", tt.forwardedFor, got, tt.client)
+		}
+		if isLocalRequest(r) {
+			t.Errorf("X-Forwarded-For %q: a request from the trusted proxy counted as local", tt.forwardedFor)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	r.RemoteAddr = "[::1]:4000"
+	if !isLocalRequest(r) {
+		t.Error("a direct request over loopback didn't count as local")
+	}
+}
+
+func TestAllowTurnsAwayUnknownProxiedClients(t *testing.T) {
+	withNets(t, &trustedProxies, "127.0.0.1")
+	withNets(t, &allowNets, "192.168.1.0/24")
+	h := ipFilterMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		remote, forwardedFor string
+		status               int
+	}{
+		{"127.0.0.1:4000", "", http.StatusForbidden},
+		{"127.0.0.1:4000", "127.0.0.1", http.StatusForbidden},
+		{"127.0.0.1:4000", "203.0.113.7", http.StatusForbidden},
+		{"127.0.0.1:4000", "192.168.1.20", http.StatusOK},
+		{"192.168.1.20:4000", "", http.StatusOK},
+		{"[::1]:4000", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("from %s, X-Forwarded-For %q: status %d, want %d", tt.remote, tt.forwardedFor, w.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// renderMarkdown turns Markdown into HTML: headings, paragraphs, emphasis,
+// links and images, code, quotes, lists and tables, which covers what READMEs
+// and notes use. It's safe to show as is, as all text is escaped and only
+// http, https and mailto links are kept, besides relative ones.
+func renderMarkdown(src string) string {
+	lines := strings.Split(strings.ReplaceAll(strings.ReplaceAll(src, "\r\n", "\n"), "\t", "    "), "\n")
+	var b strings.Builder
+	renderBlocks(&b, lines)
+	return b.String()
+}
+
+var (
+	mdHeading   = regexp.MustCompile(`^ {0,3}(#{1,6})(?:\s+(.*?))?(?:\s+#+)?\s*$`)
+	mdRule      = regexp.MustCompile(`^ {0,3}(?:(?:\*\s*){3,}|(?:-\s*){3,}|(?:_\s*){3,})$`)
+	mdFence     = regexp.MustCompile("^( {0,3})(```+|~~~+)\\s*([^`\\s]*)")
+	mdQuote     = regexp.MustCompile(`^ {0,3}> ?(.*)$`)
+	mdItem      = regexp.MustCompile(`^( *)([-*+]|\d{1,9}[.)])(?:\s+(.*))?$`)
+	mdTableRule = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(?:\|\s*:?-+:?\s*)*\|?\s*$`)
+	mdTag       = regexp.MustCompile(`<[^>]*>`)
+)
+
+func blank(line string) bool { return strings.TrimSpace(line) == "" }
+
+func indentOf(line string) int { return len(line) - len(strings.TrimLeft(line, " ")) }
+
+// startsBlock reports whether line begins something other than a paragraph,
+// ending a paragraph before it.
+func startsBlock(line string) bool {
+	return mdHeading.MatchString(line) || mdRule.MatchString(line) || mdFence.MatchString(line) ||
+		mdQuote.MatchString(line) || mdItem.MatchString(line)
+}
+
+func renderBlocks(b *strings.Builder, lines []string) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case blank(line):
+			i++
+
+		case mdFence.MatchString(line):
+			m := mdFence.FindStringSubmatch(line)
+			var code []string
+			for i++; i < len(lines); i++ {
+				if strings.HasPrefix(strings.TrimSpace(lines[i]), m[2]) && strings.Trim(strings.TrimSpace(lines[i]), m[2][:1]) == "" {
+					i++
+					break
+				}
+				code = append(code, strings.TrimPrefix(lines[i], m[1]))
+			}
+			b.WriteString("<pre><code")
+			if m[3] != "" {
+				fmt.Fprintf(b, ` class="language-%s"`, html.EscapeString(m[3]))
+			}
+			b.WriteString(">" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+
+		case mdHeading.MatchString(line):
+			m := mdHeading.FindStringSubmatch(line)
+			fmt.Fprintf(b, "<h%d id=\"%s\">%s</h%d>\n", len(m[1]), headingID(m[2]), renderInline(m[2]), len(m[1]))
+			i++
+
+		case mdRule.MatchString(line):
+			b.WriteString("<hr>\n")
+			i++
+
+		case mdQuote.MatchString(line):
+			var quoted []string
+			for ; i < len(lines) && !blank(lines[i]); i++ {
+				if m := mdQuote.FindStringSubmatch(lines[i]); m != nil {
+					quoted = append(quoted, m[1])
+				} else {
+					quoted = append(quoted, lines[i]) // A lazy continuation
+				}
+			}
+			b.WriteString("<blockquote>\n")
+			renderBlocks(b, quoted)
+			b.WriteString("</blockquote>\n")
+
+		case mdItem.MatchString(line):
+			i = renderList(b, lines, i)
+
+		case i+1 < len(lines) && strings.Contains(line, "|") && mdTableRule.MatchString(lines[i+1]):
+			i = renderTable(b, lines, i)
+
+		default:
+			var para []string
+			for ; i < len(lines) && !blank(lines[i]) && (len(para) == 0 || !startsBlock(lines[i])); i++ {
+				para = append(para, strings.TrimSpace(lines[i]))
+			}
+			b.WriteString("<p>" + renderInline(strings.Join(para, "\n")) + "</p>\n")
+		}
+	}
+}
+
+// renderList writes the list starting at lines[i] and returns where it
+// ends. Each item's lines are rendered as blocks of their own, so lists can
+// nest; items of a list without blank lines in it aren't wrapped in <p>.
+func renderList(b *strings.Builder, lines []string, i int) int {
+	first := mdItem.FindStringSubmatch(lines[i])
+	indent := len(first[1])
+	ordered := first[2][0] >= '0' && first[2][0] <= '9'
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+		if start := strings.TrimRight(first[2], ".)"); start != "1" {
+			fmt.Fprintf(b, "<ol start=\"%s\">\n", strings.TrimLeft(start, "0"))
+			tag = ""
+		}
+	}
+	if tag != "" {
+		b.WriteString("<" + tag + ">\n")
+	}
+
+	var items [][]string
+	loose := false
+	for i < len(lines) {
+		m := mdItem.FindStringSubmatch(lines[i])
+		if m == nil || len(m[1]) > indent+1 || (m[2][0] >= '0' && m[2][0] <= '9') != ordered {
+			break
+		}
+		item := []string{m[3]}
+		contentIndent := len(m[1]) + len(m[2]) + 1
+		for i++; i < len(lines); i++ {
+			line := lines[i]
+			if blank(line) {
+				// A blank line is part of the item if more of it follows.
+				j := i
+				for j < len(lines) && blank(lines[j]) {
+					j++
+				}
+				if j < len(lines) && indentOf(lines[j]) >= contentIndent {
+					item = append(item, "")
+					loose = true
+					continue
+				}
+				if next := mdItem.FindStringSubmatch(lines[min(j, len(lines)-1)]); j < len(lines) && next != nil &&
+					len(next[1]) <= indent+1 && (next[2][0] >= '0' && next[2][0] <= '9') == ordered {
+					loose = true
+				}
+				i = j
+				break
+			}
+			if indentOf(line) >= contentIndent {
+				item = append(item, line[min(contentIndent, indentOf(line)):])
+				continue
+			}
+			if mdItem.MatchString(line) || startsBlock(line) {
+				break
+			}
+			item = append(item, strings.TrimSpace(line)) // A lazy continuation
+		}
+		items = append(items, item)
+		if i < len(lines) && blank(lines[i]) {
+			break
+		}
+	}
+
+	for _, item := range items {
+		var inner strings.Builder
+		renderBlocks(&inner, item)
+		s := strings.TrimSuffix(inner.String(), "\n")
+		if !loose {
+			// Tight lists keep their text bare, though a nested list or
+			// code after it still gets its own lines.
+			if rest, ok := strings.CutPrefix(s, "<p>"); ok {
+				if end := strings.Index(rest, "</p>"); end >= 0 {
+					s = rest[:end] + rest[end+len("</p>"):]
+				}
+			}
+		}
+		b.WriteString("<li>" + s + "</li>\n")
+	}
+	if tag == "" {
+		tag = "ol"
+	}
+	b.WriteString("</" + tag + ">\n")
+	return i
+}
+
+// renderTable writes the GitHub-style table starting at lines[i], a header
+// row followed by a row of dashes, and returns where it ends.
+func renderTable(b *strings.Builder, lines []string, i int) int {
+	var align []string
+	for _, cell := range tableCells(lines[i+1]) {
+		switch left, right := strings.HasPrefix(cell, ":"), strings.HasSuffix(cell, ":"); {
+		case left && right:
+			align = append(align, ` style="text-align: center"`)
+		case right:
+			align = append(align, ` style="text-align: right"`)
+		default:
+			align = append(align, "")
+		}
+	}
+	row := func(line, cell string) {
+		b.WriteString("<tr>")
+		cells := tableCells(line)
+		for j := range align {
+			text := ""
+			if j < len(cells) {
+				text = cells[j]
+			}
+			fmt.Fprintf(b, "<%s%s>%s</%s>", cell, align[j], renderInline(text), cell)
+		}
+		b.WriteString("</tr>\n")
+	}
+
+	b.WriteString("<table>\n<thead>\n")
+	row(lines[i], "th")
+	b.WriteString("</thead>\n<tbody>\n")
+	for i += 2; i < len(lines) && !blank(lines[i]) && strings.Contains(lines[i], "|"); i++ {
+		row(lines[i], "td")
+	}
+	b.WriteString("</tbody>\n</table>\n")
+	return i
+}
+
+// tableCells splits a table row at the pipes that aren't escaped.
+func tableCells(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+	var cells []string
+	var cell strings.Builder
+	for j := 0; j < len(line); j++ {
+		switch {
+		case line[j] == '\\' && j+1 < len(line) && line[j+1] == '|':
+			cell.WriteByte('|')
+			j++
+		case line[j] == '|':
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(line[j])
+		}
+	}
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+// headingID makes the anchor for a heading the way GitHub does, so links to
+// sections of a README work here too.
+func headingID(text string) string {
+	var id strings.Builder
+	for _, r := range strings.ToLower(renderPlain(text)) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) || r == '-' || r == '_':
+			id.WriteRune(r)
+		case r == ' ':
+			id.WriteByte('-')
+		}
+	}
+	return html.EscapeString(id.String())
+}
+
+// renderPlain strips the Markdown from inline text, leaving what it says.
+func renderPlain(text string) string {
+	return html.UnescapeString(mdTag.ReplaceAllString(renderInline(text), ""))
+}
+
+// renderInline renders the Markdown of a paragraph or other bit of text.
+func renderInline(text string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		c := text[i]
+		rest := text[i:]
+		switch {
+		case c == '\\' && i+1 < len(text) && strings.IndexByte("\\`*_{}[]()#+-.!|~<>\"'", text[i+1]) >= 0:
+			b.WriteString(html.EscapeString(text[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '\\' && i+1 < len(text) && text[i+1] == '\n', strings.HasPrefix(rest, "  \n"):
+			b.WriteString("<br>\n")
+			i += strings.IndexByte(rest, '\n') + 1
+			continue
+
+		case c == '`':
+			ticks := len(rest) - len(strings.TrimLeft(rest, "`"))
+			if end := strings.Index(rest[ticks:], rest[:ticks]); end >= 0 {
+				code := strings.ReplaceAll(rest[ticks:ticks+end], "\n", " ")
+				if strings.TrimSpace(code) != "" {
+					code = strings.TrimPrefix(strings.TrimSuffix(code, " "), " ")
+				}
+				b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i += 2*ticks + end
+				continue
+			}
+			b.WriteString(rest[:ticks])
+			i += ticks
+			continue
+
+		case c == '!' && strings.HasPrefix(rest, "!["):
+			if alt, url, title, n, ok := parseLink(rest[1:]); ok {
+				if u, ok := safeURL(url); ok {
+					fmt.Fprintf(&b, `<img src="%s" alt="%s"%s>`, u, html.EscapeString(renderPlain(alt)), titleAttr(title))
+				} else {
+					b.WriteString(html.EscapeString(renderPlain(alt)))
+				}
+				i += 1 + n
+				continue
+			}
+
+		case c == '[':
+			if label, url, title, n, ok := parseLink(rest); ok {
+				if u, ok := safeURL(url); ok {
+					fmt.Fprintf(&b, `<a href="%s"%s>%s</a>`, u, titleAttr(title), renderInline(label))
+				} else {
+					b.WriteString(renderInline(label))
+				}
+				i += n
+				continue
+			}
+
+		case c == '<':
+			if end := strings.IndexByte(rest, '>'); end > 0 {
+				target := rest[1:end]
+				if !strings.ContainsAny(target, " <\n") {
+					if strings.Contains(target, "@") && !strings.Contains(target, ":") {
+						target = "mailto:" + target
+					}
+					if u, ok := safeURL(target); ok && strings.Contains(target, ":") {
+						fmt.Fprintf(&b, `<a href="%s">%s</a>`, u, html.EscapeString(strings.TrimPrefix(target, "mailto:")))
+						i += end + 1
+						continue
+					}
+				}
+			}
+
+		case c == '*' || c == '_' || c == '~':
+			if n, ok := renderEmphasis(&b, text, i); ok {
+				i = n
+				continue
+			}
+		}
+		b.WriteString(html.EscapeString(text[i : i+1]))
+		i++
+	}
+	return b.String()
+}
+
+// renderEmphasis writes the strong, emphasised or struck text starting at
+// text[i], if it's closed, and returns where it ends.
+func renderEmphasis(b *strings.Builder, text string, i int) (int, bool) {
+	c := text[i]
+	for _, d := range []struct{ delim, tag string }{
+		{strings.Repeat(string(c), 2), "strong"},
+		{string(c), "em"},
+	} {
+		if c == '~' {
+			if d.tag != "strong" {
+				continue
+			}
+			d.tag = "del"
+		}
+		if !strings.HasPrefix(text[i:], d.delim) {
+			continue
+		}
+		start := i + len(d.delim)
+		if start >= len(text) || text[start] == ' ' || text[start] == '\n' {
+			continue
+		}
+		// Underscores inside words, as in snake_case, aren't emphasis.
+		if c == '_' && i > 0 && isWordByte(text[i-1]) {
+			continue
+		}
+		for j := start + 1; j+len(d.delim) <= len(text); j++ {
+			if text[j:j+len(d.delim)] != d.delim || text[j-1] == ' ' || text[j-1] == '\\' {
+				continue
+			}
+			if len(d.delim) == 1 && j+1 < len(text) && text[j+1] == c {
+				j++ // Part of a longer run, like the end of **
+				continue
+			}
+			if c == '_' && j+1 < len(text) && isWordByte(text[j+1]) {
+				continue
+			}
+			b.WriteString("<" + d.tag + ">" + renderInline(text[start:j]) + "</" + d.tag + ">")
+			return j + len(d.delim), true
+		}
+	}
+	return i, false
+}
+
+func isWordByte(c byte) bool {
+	return c >= 0x80 || c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// parseLink reads [label](url "title") at the start of s and returns its
+// parts and length.
+func parseLink(s string) (label, url, title string, n int, ok bool) {
+	depth := 0
+	end := -1
+	for j := 0; j < len(s) && end < 0; j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '[':
+			depth++
+		case ']':
+			if depth--; depth == 0 {
+				end = j
+			}
+		}
+	}
+	if end < 0 || end+1 >= len(s) || s[end+1] != '(' {
+		return "", "", "", 0, false
+	}
+	// The URL can have parentheses of its own, as long as they pair up.
+	closing, depth := -1, 0
+	for j := end + 2; j < len(s) && closing < 0; j++ {
+		switch s[j] {
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth < 0 {
+				closing = j - (end + 2)
+			}
+		case '\n':
+			return "", "", "", 0, false
+		}
+	}
+	if closing < 0 {
+		return "", "", "", 0, false
+	}
+	dest := strings.TrimSpace(s[end+2 : end+2+closing])
+	url, title, _ = strings.Cut(dest, " ")
+	title = strings.Trim(strings.TrimSpace(title), `"'`)
+	url = strings.TrimSuffix(strings.TrimPrefix(url, "<"), ">")
+	return s[1:end], url, title, end + 3 + closing, true
+}
+
+func titleAttr(title string) string {
+	if title == "" {
+		return ""
+	}
+	return ` title="` + html.EscapeString(title) + `"`
+}
+
+// safeURL escapes url for an attribute, unless it uses a scheme other than
+// http, https or mailto, like javascript:.
+func safeURL(url string) (string, bool) {
+	if i := strings.IndexAny(url, ":/?#"); i >= 0 && url[i] == ':' {
+		switch strings.ToLower(url[:i]) {
+		case "http", "https", "mailto":
+		default:
+			return "", false
+		}
+	}
+	return html.EscapeString(url), true
+}
@@ -0,0 +1,149 @@
+package main
+
+// bnMessages are the pages' messages in Bangla.
+var bnMessages = map[string]string{
+	// The file list
+	"File Sharing":      "ফাইল শেয়ারিং",
+	"Shared Files":      "শেয়ার করা ফাইল",
+	"Upload files":      "ফাইল আপলোড করুন",
+	"Search file names": "ফাইলের নাম দিয়ে খুঁজুন",
+	"Gallery of":        "গ্যালারি:",
+	"the top folder":    "মূল ফোল্ডার",
+	"Tags":              "ট্যাগ:",
+	"Sort by":           "সাজান:",
+	"name":              "নাম",
+	"size":              "আকার",
+	"modified":          "পরিবর্তিত",
+	"type":              "ধরন",
+	"date taken":        "ছবি তোলার তারিখ",
+	"Show as":           "দেখান:",
+	"a list":            "তালিকা",
+	"a grid":            "গ্রিড",
+	"Files tagged":      "যে ফাইলে ট্যাগ আছে",
+	"show all files":    "সব ফাইল দেখান",
+	"Pinned":            "পিন করা",
+	"Theme":             "থিম:",
+	"automatic":         "স্বয়ংক্রিয়",
+	"light":             "হালকা",
+	"dark":              "গাঢ়",
+
+	"%d folder and its size":     "%d টি ফোল্ডার ও তার আকার",
+	"%d folders and their sizes": "%d টি ফোল্ডার ও সেগুলোর আকার",
+	"calculating…":               "হিসাব করা হচ্ছে…",
+	"%s in %d file":              "%s, %d টি ফাইল",
+	"%s in %d files":             "%s, %d টি ফাইল",
+
+	"Open in the browser": "ব্রাউজারে খুলুন",
+	"Password protected":  "পাসওয়ার্ড দিয়ে সুরক্ষিত",
+	"Watch":               "দেখুন",
+	"Contents not shared, the folder is past the maximum depth": "ভেতরের ফাইলগুলো শেয়ার করা হয়নি, ফোল্ডারটি সর্বোচ্চ গভীরতার বাইরে",
+	"Taken %s":                           "তোলা হয়েছে %s",
+	"with %s":                            "(%s দিয়ে)",
+	"Take this note off":                 "নোটটি সরান",
+	"edit tags":                          "ট্যাগ বদলান",
+	"add tags":                           "ট্যাগ দিন",
+	"add a note":                         "নোট লিখুন",
+	"%d earlier version":                 "আগের %d টি সংস্করণ",
+	"%d earlier versions":                "আগের %d টি সংস্করণ",
+	"copy":                               "কপি",
+	"show":                               "দেখান",
+	"Play":                               "চালান",
+	"Copy link":                          "লিংক কপি করুন",
+	"Download":                           "ডাউনলোড",
+	"Pin":                                "পিন করুন",
+	"Unpin":                              "পিন সরান",
+	"Rename":                             "নাম বদলান",
+	"Fetch a URL":                        "URL থেকে আনুন",
+	"Extract here":                       "এখানে খুলুন",
+	"Unpack it into a folder next to it": "পাশের একটি ফোল্ডারে এটি খুলুন",
+	"Extracting…":                        "খোলা হচ্ছে…",
+	"Could not extract %s":               "%s খোলা যায়নি",
+	"Download a file from the web into the share":          "ওয়েব থেকে একটি ফাইল শেয়ারে ডাউনলোড করুন",
+	"URL of the file to download into the share":           "শেয়ারে ডাউনলোড করার ফাইলের URL",
+	"Could not fetch %s":                                   "%s আনা যায়নি",
+	"Download the folder as one file":                      "ফোল্ডারটি একটি ফাইল হিসেবে ডাউনলোড করুন",
+	"Get torrent":                                          "টরেন্ট নিন",
+	"Publish to IPFS":                                      "IPFS এ প্রকাশ করুন",
+	"Add it to IPFS, for a link that works beyond the LAN": "LAN এর বাইরেও কাজ করে এমন লিংকের জন্য এটি IPFS এ যোগ করুন",
+	"Publishing…":                                          "প্রকাশ করা হচ্ছে…",
+	"Could not publish %s":                                 "%s প্রকাশ করা যায়নি",
+	"Published %s; its link on the IPFS gateway is":        "%s প্রকাশ করা হয়েছে; IPFS গেটওয়েতে এর লিংক",
+	"Download it over BitTorrent, sharing the work with everyone else downloading it": "BitTorrent দিয়ে ডাউনলোড করুন, যারা এটি ডাউনলোড করছেন সবার সাথে ভাগ করে",
+	"Delete":                "মুছে ফেলুন",
+	"Previous":              "আগের পাতা",
+	"Next":                  "পরের পাতা",
+	"Trash":                 "ট্র্যাশ",
+	"Sign out":              "সাইন আউট",
+	"For sha256sum -c":      "sha256sum -c দিয়ে মেলানোর জন্য",
+	"Cancel":                "বাতিল",
+	"closes in %s":          "%s পরে বন্ধ হবে",
+	"share has closed":      "শেয়ার বন্ধ হয়ে গেছে",
+	"working it out…":       "হিসাব করা হচ্ছে…",
+	"unavailable":           "পাওয়া যায়নি",
+	"copied":                "কপি হয়েছে",
+	"Copied!":               "কপি হয়েছে!",
+	"Copy this link":        "এই লিংকটি কপি করুন",
+	"Could not create link": "লিংক তৈরি করা যায়নি",
+
+	"Downloaded %d time, last %s ago":                        "%d বার ডাউনলোড হয়েছে, শেষবার %s আগে",
+	"Downloaded %d times, last %s ago":                       "%d বার ডাউনলোড হয়েছে, শেষবার %s আগে",
+	"Play this and the rest of its folder":                   "এটি আর এর ফোল্ডারের বাকিগুলো চালান",
+	"Copy a link that works without a password for 24 hours": "২৪ ঘণ্টা পাসওয়ার্ড ছাড়াই খোলা যাবে এমন একটি লিংক কপি করুন",
+	"Take it off the top of the page":                        "পাতার ওপর থেকে সরান",
+	"Show it at the top of the page for everyone":            "সবার জন্য পাতার ওপরে দেখান",
+	"Page %d of %d · %d files":                               "পাতা %d / %d · মোট %d টি ফাইল",
+	"Server started %s ago":                                  "সার্ভার চালু হয়েছে %s আগে",
+	"%s free for uploads":                                    "আপলোডের জন্য %s জায়গা খালি",
+	"Signed in as %s (%s)":                                   "%s (%s) হিসেবে সাইন ইন করা আছে",
+	"New name, or path to move it to":                        "নতুন নাম, বা যেখানে সরাতে চান সেই পাথ",
+	"Could not rename %s":                                    "%s এর নাম বদলানো যায়নি",
+	"Move %s to the trash?":                                  "%s ট্র্যাশে সরাবেন?",
+	"Delete %s? This can't be undone.":                       "%s মুছে ফেলবেন? এটি আর ফেরানো যাবে না।",
+	"Could not delete %s":                                    "%s মুছে ফেলা যায়নি",
+	"Tags for %s, separated by commas":                       "%s এর ট্যাগ, কমা দিয়ে আলাদা করে",
+	"Could not tag %s":                                       "%s এ ট্যাগ দেওয়া যায়নি",
+	`Note on %s, like "this is the corrected version"`:       `%s নিয়ে একটি নোট, যেমন "এটাই সংশোধিত সংস্করণ"`,
+	"Could not leave a note on %s":                           "%s এ নোট রাখা যায়নি",
+	"Could not take the note off %s":                         "%s থেকে নোট সরানো যায়নি",
+	"Could not pin %s":                                       "%s পিন করা যায়নি",
+
+	// Shared text
+	"Shared text":              "শেয়ার করা লেখা",
+	"Clipboard":                "ক্লিপবোর্ড",
+	"Language":                 "ভাষা",
+	"Plain text":               "সাধারণ লেখা",
+	"open":                     "খুলুন",
+	"raw":                      "শুধু লেখা",
+	"Chat":                     "চ্যাট",
+	"Your name":                "আপনার নাম",
+	"Say something":            "কিছু লিখুন",
+	"Message":                  "বার্তা",
+	"Send":                     "পাঠান",
+	"Text to share":            "শেয়ার করার লেখা",
+	"How long to keep it":      "কতক্ষণ রাখা হবে",
+	"Share text":               "লেখা শেয়ার করুন",
+	"Copy":                     "কপি করুন",
+	"Shared by %s %s ago":      "%s শেয়ার করেছেন %s আগে",
+	"Shared %s ago":            "শেয়ার করা হয়েছে %s আগে",
+	"gone in %s":               "%s পরে মুছে যাবে",
+	"keep it":                  "রেখে দিন",
+	"for 10 minutes":           "১০ মিনিটের জন্য",
+	"for an hour":              "এক ঘণ্টার জন্য",
+	"for a day":                "এক দিনের জন্য",
+	"for a week":               "এক সপ্তাহের জন্য",
+	"Could not share the text": "লেখাটি শেয়ার করা যায়নি",
+	"Paste a link, a Wi-Fi password or a command": "একটি লিংক, Wi-Fi পাসওয়ার্ড বা কমান্ড পেস্ট করুন",
+
+	// Searching
+	"Search":                      "খুঁজুন",
+	"Back to the files":           "ফাইলের তালিকায় ফিরে যান",
+	"Search inside documents too": "ডকুমেন্টের ভেতরেও খুঁজুন",
+	"The best %d files":           "সবচেয়ে মেলে এমন %d টি ফাইল",
+	"%d file":                     "%d টি ফাইল",
+	"%d files":                    "%d টি ফাইল",
+	"No file names match “%s”.":   "“%s” এর সাথে কোনো ফাইলের নাম মেলেনি।",
+	"Top folder":                  "মূল ফোল্ডার",
+	"Inside documents":            "ডকুমেন্টের ভেতরে",
+	"Still indexing the share, %s files done.": "শেয়ারের ফাইলগুলো এখনো পড়া হচ্ছে, %s টি হয়েছে।",
+	"No documents have all of “%s” in them.":   "কোনো ডকুমেন্টে “%s” এর সবগুলো শব্দ নেই।",
+}
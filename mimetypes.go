@@ -0,0 +1,195 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// extraTypes fills in types that Go's built-in table and the system's
+// mime.types often lack or get wrong, so a server on a bare machine gives
+// the same answers as one on a desktop.
+var extraTypes = map[string]string{
+	".7z":   "application/x-7z-compressed",
+	".aac":  "audio/aac",
+	".apk":  "application/vnd.android.package-archive",
+	".avi":  "video/x-msvideo",
+	".avif": "image/avif",
+	".bmp":  "image/bmp",
+	".csv":  "text/csv; charset=utf-8",
+	".deb":  "application/vnd.debian.binary-package",
+	".dmg":  "application/x-apple-diskimage",
+	".doc":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".epub": "application/epub+zip",
+	".exe":  "application/vnd.microsoft.portable-executable",
+	".flac": "audio/flac",
+	".gz":   "application/gzip",
+	".heic": "image/heic",
+	".ico":  "image/vnd.microsoft.icon",
+	".iso":  "application/x-iso9660-image",
+	".m4a":  "audio/mp4",
+	".m4v":  "video/mp4",
+	".md":   "text/markdown; charset=utf-8",
+	".mkv":  "video/x-matroska",
+	".mov":  "video/quicktime",
+	".mp3":  "audio/mpeg",
+	".mp4":  "video/mp4",
+	".msi":  "application/x-msi",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ogg":  "audio/ogg",
+	".ogv":  "video/ogg",
+	".opus": "audio/ogg",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".rar":  "application/vnd.rar",
+	".rpm":  "application/x-rpm",
+	".srt":  "application/x-subrip",
+	".svg":  "image/svg+xml",
+	".tar":  "application/x-tar",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".vtt":  "text/vtt; charset=utf-8",
+	".wav":  "audio/wav",
+	".weba": "audio/webm",
+	".webm": "video/webm",
+	".webp": "image/webp",
+	".wmv":  "video/x-ms-wmv",
+	".xls":  "application/vnd.ms-excel",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".xz":   "application/x-xz",
+	".yaml": "text/yaml; charset=utf-8",
+	".yml":  "text/yaml; charset=utf-8",
+	".zip":  "application/zip",
+	".zst":  "application/zstd",
+}
+
+// typeByName returns the type of a file going by its extension alone, or ""
+// if the extension says nothing.
+func typeByName(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if ctype, ok := extraTypes[ext]; ok {
+		return ctype
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// detectType returns the type of the file name, by its extension or, if that
+// says nothing, by sniffing its first bytes from content, which is left
+// where it was. Without either it's application/octet-stream.
+func detectType(name string, content io.ReadSeeker) string {
+	if ctype := typeByName(name); ctype != "" {
+		return ctype
+	}
+	if content == nil {
+		return "application/octet-stream"
+	}
+	pos, err := content.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	var buf [512]byte
+	n, _ := io.ReadFull(content, buf[:])
+	if _, err := content.Seek(pos, io.SeekStart); err != nil {
+		return "application/octet-stream"
+	}
+	return http.DetectContentType(buf[:n])
+}
+
+// sharedFileType returns the type of the shared file p, opening it to sniff
+// only if its extension says nothing.
+func sharedFileType(p string) string {
+	if ctype := typeByName(p); ctype != "" {
+		return ctype
+	}
+	f, err := openShared(p)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	rs, _ := f.(io.ReadSeeker)
+	return detectType(p, rs)
+}
+
+// mediaType is ctype without its parameters, like a charset.
+func mediaType(ctype string) string {
+	t, _, _ := strings.Cut(ctype, ";")
+	return strings.TrimSpace(t)
+}
+
+// previewImage reports whether browsers show images of type ctype inline.
+func previewImage(ctype string) bool {
+	switch mediaType(ctype) {
+	case "image/jpeg", "image/png", "image/gif", "image/webp", "image/avif", "image/svg+xml", "image/bmp":
+		return true
+	}
+	return false
+}
+
+// isVideo reports whether ctype is any kind of video, whether browsers play
+// it or not.
+func isVideo(ctype string) bool {
+	return strings.HasPrefix(mediaType(ctype), "video/")
+}
+
+// previewVideo reports whether browsers can generally play videos of type
+// ctype. Matroska often plays too, but not everywhere, so it isn't counted.
+func previewVideo(ctype string) bool {
+	switch mediaType(ctype) {
+	case "video/mp4", "video/webm", "video/ogg":
+		return true
+	}
+	return false
+}
+
+// showAsText reports whether a file of type ctype is text a browser would
+// rather download or run than show, like Markdown, CSV, JSON or HTML, and so
+// is better viewed as plain text.
+func showAsText(ctype string) bool {
+	switch t := mediaType(ctype); t {
+	case "text/plain":
+		return false
+	case "application/json", "application/xml", "application/javascript", "application/x-sh",
+		"application/yaml", "application/toml", "application/x-subrip", "application/xhtml+xml":
+		return true
+	default:
+		return strings.HasPrefix(t, "text/")
+	}
+}
+
+// typeIcon picks an icon for a file of type ctype.
+func typeIcon(ctype string) string {
+	t := mediaType(ctype)
+	switch t {
+	case "application/pdf", "application/epub+zip":
+		return "📄"
+	case "application/zip", "application/x-7z-compressed", "application/vnd.rar", "application/x-tar",
+		"application/gzip", "application/x-xz", "application/zstd":
+		return "📦"
+	case "application/vnd.android.package-archive", "application/vnd.microsoft.portable-executable",
+		"application/x-msi", "application/vnd.debian.binary-package", "application/x-rpm":
+		return "⚙️"
+	case "application/x-iso9660-image", "application/x-apple-diskimage":
+		return "💿"
+	case "application/msword", "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		"application/vnd.oasis.opendocument.text":
+		return "📃"
+	case "application/vnd.ms-excel", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "text/csv":
+		return "📊"
+	case "application/vnd.ms-powerpoint", "application/vnd.openxmlformats-officedocument.presentationml.presentation":
+		return "📽"
+	}
+	switch kind, _, _ := strings.Cut(t, "/"); kind {
+	case "audio":
+		return "🎵"
+	case "video":
+		return "🎬"
+	case "image":
+		return "🖼"
+	case "text":
+		return "📝"
+	}
+	return "📁" // Default icon
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// mount is a folder or archive that is part of the share. A single one is
+// the share itself; with --dir, each appears at the top level under its
+// alias.
+type mount struct {
+	Name     string // Alias, "" for a single shared folder
+	Dir      string // Absolute path of the folder or archive, or backend URL
+	ReadOnly bool   // Never accepts changes, even when uploads are on
+
+	fsys   fs.FS // See storage.go
+	folder bool  // fsys is the folder Dir on disk
+	ignore ignoreList
+}
+
+var mounts []*mount
+
+// mountFlag collects --dir alias=path[,ro] options. A plain --dir path
+// shares just that folder or archive.
+type mountFlag struct{ list *[]*mount }
+
+func (f mountFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	var names []string
+	for _, m := range *f.list {
+		names = append(names, m.Name+"="+m.Dir)
+	}
+	return strings.Join(names, " ")
+}
+
+func (f mountFlag) Set(value string) error {
+	name, dir, ok := strings.Cut(value, "=")
+	if !ok {
+		name, dir = "", value
+	}
+	if dir == "" || (ok && name == "") {
+		return fmt.Errorf("expected alias=path, got %q", value)
+	}
+	if strings.ContainsAny(name, `/\`) || isHiddenName(name) {
+		return fmt.Errorf("invalid alias %q", name)
+	}
+	if len(*f.list) > 0 && (name == "" || (*f.list)[0].Name == "") {
+		return fmt.Errorf("a --dir without alias can't be combined with others")
+	}
+	m := &mount{Name: name, Dir: dir}
+	switch {
+	case strings.HasSuffix(dir, ",ro"):
+		m.Dir, m.ReadOnly = strings.TrimSuffix(dir, ",ro"), true
+	case strings.HasSuffix(dir, ",rw"):
+		m.Dir = strings.TrimSuffix(dir, ",rw")
+	}
+	for _, other := range *f.list {
+		if other.Name == name {
+			return fmt.Errorf("alias %q used twice", name)
+		}
+	}
+	*f.list = append(*f.list, m)
+	return nil
+}
+
+// openMounts resolves and opens the shared folders, archives and backends.
+func openMounts(list []*mount) error {
+	for _, m := range list {
+		if m.fsys != nil {
+			continue // Opened already, like the file lanshare send shares
+		}
+		if strings.HasPrefix(m.Dir, "s3://") {
+			s, err := openS3(m.Dir)
+			if err != nil {
+				return err
+			}
+			m.fsys = s
+			continue
+		}
+		dir, err := filepath.Abs(m.Dir)
+		if err != nil {
+			return err
+		}
+		m.Dir = dir
+		if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+			m.fsys, err = archiveFS(dir)
+			if err != nil {
+				return err
+			}
+			m.ReadOnly = true
+			continue
+		}
+		m.fsys, err = diskFS(dir)
+		if err != nil {
+			return err
+		}
+		m.folder = true
+	}
+	mounts = list
+	return nil
+}
+
+// virtualRoot reports whether the top of the share is made up of the
+// mounts' aliases rather than a single folder or archive.
+func virtualRoot() bool {
+	return len(mounts) != 1 || mounts[0].Name != ""
+}
+
+// resolve splits the clean share path p into the mount it lies in and the
+// path inside that mount. ok is false for the virtual root and for paths
+// under no mount.
+func resolve(p string) (m *mount, rel string, ok bool) {
+	if !virtualRoot() {
+		return mounts[0], p, true
+	}
+	name, rel, _ := strings.Cut(p, "/")
+	for _, m := range mounts {
+		if m.Name == name {
+			return m, rel, true
+		}
+	}
+	return nil, "", false
+}
+
+// rootInfo describes the virtual folder holding the mounts.
+type rootInfo struct{}
+
+func (rootInfo) Name() string       { return "/" }
+func (rootInfo) Size() int64        { return 0 }
+func (rootInfo) Mode() os.FileMode  { return os.ModeDir | 0o555 }
+func (rootInfo) ModTime() time.Time { return startTime }
+func (rootInfo) IsDir() bool        { return true }
+func (rootInfo) Sys() any           { return nil }
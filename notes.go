@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxNoteLength = 500 // Runes
+	maxNotes      = 50  // On one file
+)
+
+// fileNote is a short note left on a file, like "this is the corrected
+// version".
+type fileNote struct {
+	ID   string    `json:"id"`
+	Text string    `json:"text"`
+	By   string    `json:"by,omitempty"` // Who left it, when there are accounts
+	At   time.Time `json:"at"`
+}
+
+// noteStore keeps the notes on each file by share path, oldest first,
+// saved to the state directory.
+type noteStore struct {
+	mu    sync.Mutex
+	path  string
+	files map[string][]fileNote
+}
+
+var notes *noteStore
+
+func openNotes(dir string) (*noteStore, error) {
+	s := &noteStore{
+		path:  filepath.Join(dir, "notes.json"),
+		files: make(map[string][]fileNote),
+	}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.files); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// save must be called with s.mu held.
+func (s *noteStore) save() {
+	data, err := json.Marshal(s.files)
+	if err == nil {
+		err = writeFileAtomic(s.path, data)
+	}
+	if err != nil {
+		log.Println("Error saving notes:", err)
+	}
+}
+
+func (s *noteStore) list(p string) []fileNote {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.files[p])
+}
+
+// add leaves n on p, unless it already has as many notes as it can.
+func (s *noteStore) add(p string, n fileNote) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.files[p]) >= maxNotes {
+		return false
+	}
+	s.files[p] = append(s.files[p], n)
+	s.save()
+	return true
+}
+
+func (s *noteStore) get(p, id string) (fileNote, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.files[p], func(n fileNote) bool { return n.ID == id })
+	if i < 0 {
+		return fileNote{}, false
+	}
+	return s.files[p][i], true
+}
+
+func (s *noteStore) remove(p, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[p] = slices.DeleteFunc(s.files[p], func(n fileNote) bool { return n.ID == id })
+	if len(s.files[p]) == 0 {
+		delete(s.files, p)
+	}
+	s.save()
+}
+
+// moved carries the notes on everything at oldname over to newname, after
+// a file or folder is renamed.
+func (s *noteStore) moved(oldname, newname string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for p, list := range s.files {
+		rest, ok := strings.CutPrefix(p, oldname)
+		if !ok || rest != "" && rest[0] != '/' {
+			continue
+		}
+		delete(s.files, p)
+		s.files[newname+rest] = list
+		changed = true
+	}
+	if changed {
+		s.save()
+	}
+}
+
+// canDeleteNote reports whether r may take n off its file: whoever left
+// it, when there are accounts, or the host.
+func canDeleteNote(r *http.Request, n fileNote) bool {
+	return n.By != "" && n.By == uploaderName(r) || isAdmin(r)
+}
+
+// notesHandler serves the notes on the shared file at /api/notes/PATH:
+//
+//	GET                      lists them
+//	POST   {"text": "..."}   leaves one, for anyone who can tag files
+//	DELETE ?id=ID            takes one off, for whoever left it or the host
+func notesHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := safeSharePath(strings.TrimPrefix(r.URL.Path, "/api/notes/"))
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if info, err := statShared(name); err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	if _, locked := lockedBy(r, name); locked {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		list := notes.list(name)
+		if list == nil {
+			list = []fileNote{}
+		}
+		writeJSON(w, http.StatusOK, list)
+	case http.MethodPost:
+		if !canTag(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Text string `json:"text"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "Expected JSON with the note's text", http.StatusBadRequest)
+			return
+		}
+		text := strings.TrimSpace(req.Text)
+		if text == "" || len([]rune(text)) > maxNoteLength {
+			http.Error(w, fmt.Sprintf("A note has to be from 1 to %d letters long", maxNoteLength), http.StatusBadRequest)
+			return
+		}
+		n := fileNote{ID: rand.Text(), Text: text, By: uploaderName(r), At: time.Now()}
+		if !notes.add(name, n) {
+			http.Error(w, fmt.Sprintf("%s already has %d notes", name, maxNotes), http.StatusConflict)
+			return
+		}
+		log.Printf("Left a note on %s, for %s", name, clientIP(r))
+		writeJSON(w, http.StatusCreated, n)
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		n, ok := notes.get(name, id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if !canDeleteNote(r, n) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		notes.remove(name, id)
+		log.Printf("Took a note off %s, for %s", name, clientIP(r))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
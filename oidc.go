@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcProvider signs users in against an external OpenID Connect identity
+// provider using the authorization code flow with PKCE.
+type oidcProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	RoleClaim    string            // Claim holding the user's groups or roles
+	RoleMap      map[string]string // Claim value to role
+	DefaultRole  string            // Role for users matching nothing, "" denies them
+
+	authURL  string
+	tokenURL string
+	jwksURL  string
+
+	mu   sync.Mutex
+	keys map[string]crypto.PublicKey // By key ID
+}
+
+// oidc is nil unless --oidc-issuer is set.
+var oidc *oidcProvider
+
+var oidcClient = &http.Client{Timeout: 15 * time.Second}
+
+// discover loads the provider's endpoints from its discovery document.
+func (p *oidcProvider) discover() error {
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	err := getJSON(strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &doc)
+	if err != nil {
+		return err
+	}
+	if doc.Issuer != p.Issuer {
+		return fmt.Errorf("issuer mismatch: discovery document says %q", doc.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return errors.New("discovery document is missing endpoints")
+	}
+	p.authURL, p.tokenURL, p.jwksURL = doc.AuthorizationEndpoint, doc.TokenEndpoint, doc.JWKSURI
+	return nil
+}
+
+func getJSON(u string, v any) error {
+	resp, err := oidcClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// key returns the provider's signing key with the given ID, refreshing the
+// key set when the ID is unknown so key rotation just works.
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := getJSON(p.jwksURL, &set); err != nil {
+		return nil, err
+	}
+
+	dec := base64.RawURLEncoding
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := dec.DecodeString(k.N)
+			e, err2 := dec.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			x, err1 := dec.DecodeString(k.X)
+			y, err2 := dec.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			p.keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// verifyIDToken checks an ID token's signature, issuer, audience, expiry
+// and nonce, and returns its claims.
+func (p *oidcProvider) verifyIDToken(token, nonce string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	dec := base64.RawURLEncoding
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerJSON, err := dec.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil {
+		return nil, errors.New("malformed ID token header")
+	}
+	sig, err := dec.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ID token signature")
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errors.New("bad ID token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("bad ID token signature")
+		}
+	default:
+		return nil, errors.New("unsupported ID token key")
+	}
+
+	payload, err := dec.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed ID token payload")
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("malformed ID token payload")
+	}
+
+	if claims["iss"] != p.Issuer {
+		return nil, errors.New("ID token from the wrong issuer")
+	}
+	if !claimContains(claims["aud"], p.ClientID) {
+		return nil, errors.New("ID token for a different client")
+	}
+	if exp, _ := claims["exp"].(float64); time.Now().Unix() > int64(exp) {
+		return nil, errors.New("ID token has expired")
+	}
+	if claims["nonce"] != nonce {
+		return nil, errors.New("ID token nonce mismatch")
+	}
+	return claims, nil
+}
+
+// claimContains reports whether a string or string-array claim holds want.
+func claimContains(claim any, want string) bool {
+	for _, v := range claimStrings(claim) {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
+
+func claimStrings(claim any) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// roleFor picks the most privileged role mapped from the user's claims.
+func (p *oidcProvider) roleFor(claims map[string]any) string {
+	role := p.DefaultRole
+	for _, v := range claimStrings(claims[p.RoleClaim]) {
+		if mapped, ok := p.RoleMap[v]; ok && roleRank[mapped] > roleRank[role] {
+			role = mapped
+		}
+	}
+	return role
+}
+
+// userName picks a readable name for the signed-in user.
+func userName(claims map[string]any) string {
+	for _, c := range []string{"preferred_username", "email", "name", "sub"} {
+		if s, ok := claims[c].(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// The login round trip keeps its state, nonce and PKCE verifier in a short
+// lived signed cookie rather than server memory.
+const (
+	oidcStateCookie = "oidc_state"
+	oidcStateTTL    = 10 * time.Minute
+)
+
+type oidcState struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	Next     string `json:"r"`
+	Expires  int64  `json:"e"`
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	next := safeNext(r.FormValue("next"))
+	st := oidcState{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Verifier: randomString() + randomString(),
+		Next:     next,
+		Expires:  time.Now().Add(oidcStateTTL).Unix(),
+	}
+	payload, _ := json.Marshal(st)
+	enc := base64.RawURLEncoding
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    enc.EncodeToString(payload) + "." + enc.EncodeToString(sign(append([]byte("oidc\n"), payload...))),
+		Path:     basePath + "/oidc/",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidc.ClientID},
+		"redirect_uri":          {oidc.RedirectURL},
+		"scope":                 {"openid profile email"},
+		"state":                 {st.State},
+		"nonce":                 {st.Nonce},
+		"code_challenge":        {enc.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(oidc.authURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, oidc.authURL+sep+q.Encode(), http.StatusFound)
+}
+
+func readOIDCState(r *http.Request) (oidcState, error) {
+	var st oidcState
+	c, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		return st, errors.New("login session missing, please try again")
+	}
+	enc := base64.RawURLEncoding
+	payloadPart, sigPart, _ := strings.Cut(c.Value, ".")
+	payload, err1 := enc.DecodeString(payloadPart)
+	sig, err2 := enc.DecodeString(sigPart)
+	if err1 != nil || err2 != nil || !hmac.Equal(sig, sign(append([]byte("oidc\n"), payload...))) {
+		return st, errors.New("invalid login session")
+	}
+	if json.Unmarshal(payload, &st) != nil || time.Now().Unix() > st.Expires {
+		return st, errors.New("login session expired, please try again")
+	}
+	return st, nil
+}
+
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: basePath + "/oidc/", MaxAge: -1})
+
+	st, err := readOIDCState(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "Sign-in failed: "+e+" "+q.Get("error_description"), http.StatusUnauthorized)
+		return
+	}
+	if !hmac.Equal([]byte(q.Get("state")), []byte(st.State)) {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := oidc.exchange(r.Context(), q.Get("code"), st)
+	if err != nil {
+		log.Println("OIDC sign-in failed:", err)
+		http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+		return
+	}
+
+	role := oidc.roleFor(claims)
+	name := userName(claims)
+	if role == "" || name == "" {
+		http.Error(w, "Your account has no access to this share", http.StatusForbidden)
+		return
+	}
+	setExternalSession(w, &user{Name: name, Role: role, external: true})
+	http.Redirect(w, r, st.Next, http.StatusSeeOther)
+}
+
+// exchange trades an authorization code for tokens and returns the verified
+// ID token claims.
+func (p *oidcProvider) exchange(ctx context.Context, code string, st oidcState) (map[string]any, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"client_id":     {p.ClientID},
+		"code_verifier": {st.Verifier},
+	}
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+		return nil, fmt.Errorf("token endpoint: %s %s", resp.Status, tok.Error)
+	}
+	return p.verifyIDToken(tok.IDToken, st.Nonce)
+}
+
+// parseRoleMap parses "group=role,other=role".
+func parseRoleMap(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		value, role, ok := strings.Cut(pair, "=")
+		if _, known := roleRank[role]; !ok || !known {
+			return nil, fmt.Errorf("invalid role mapping %q", pair)
+		}
+		m[value] = role
+	}
+	return m, nil
+}
+
+// External sessions belong to users who don't exist in the user store, so
+// the cookie carries the role itself: "ext.<name>.<role>.<exp>.<sig>".
+func externalSessionSignature(u *user, exp int64) string {
+	return base64.RawURLEncoding.EncodeToString(sign([]byte("session-ext\n" + u.Name + "\n" + u.Role + "\n" + strconv.FormatInt(exp, 10))))
+}
+
+func setExternalSession(w http.ResponseWriter, u *user) {
+	exp := time.Now().Add(sessionTTL)
+	value := "ext." + base64.RawURLEncoding.EncodeToString([]byte(u.Name)) + "." + u.Role + "." +
+		strconv.FormatInt(exp.Unix(), 10) + "." + externalSessionSignature(u, exp.Unix())
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     basePath + "/",
+		Expires:  exp,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func externalSessionUser(value string) *user {
+	parts := strings.Split(value, ".")
+	if len(parts) != 5 || parts[0] != "ext" {
+		return nil
+	}
+	name, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil
+	}
+	exp, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return nil
+	}
+	u := &user{Name: string(name), Role: parts[2], external: true}
+	if _, ok := roleRank[u.Role]; !ok || !hmac.Equal([]byte(parts[4]), []byte(externalSessionSignature(u, exp))) {
+		return nil
+	}
+	return u
+}
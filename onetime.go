@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// usedLinkStore remembers which one-time links have been used up. Entries are
+// kept until the link would have expired anyway, and the set is saved to
+// the state directory so a restart doesn't bring used links back to life.
+type usedLinkStore struct {
+	mu        sync.Mutex
+	path      string
+	links     map[string]time.Time // Nonce to link expiry
+	serving   map[string]bool      // Links being downloaded right now
+	delivered map[string]int64     // How far unfinished downloads got
+}
+
+var usedLinks *usedLinkStore
+
+func openUsedLinks(dir string) (*usedLinkStore, error) {
+	s := &usedLinkStore{
+		path:      filepath.Join(dir, "used-links.json"),
+		links:     make(map[string]time.Time),
+		serving:   make(map[string]bool),
+		delivered: make(map[string]int64),
+	}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.links); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *usedLinkStore) used(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.links[nonce]
+	return ok
+}
+
+// reserve claims the link with the given nonce for one download, reporting
+// false if it's used up or being downloaded already, and otherwise how much
+// of the file earlier tries sent, from the start. The claim ends with
+// markUsed, or with release if the download didn't finish.
+func (s *usedLinkStore) reserve(nonce string) (delivered int64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, used := s.links[nonce]; used || s.serving[nonce] {
+		return 0, false
+	}
+	s.serving[nonce] = true
+	return s.delivered[nonce], true
+}
+
+// release gives up a claim from reserve, noting that the file has been
+// sent as far as delivered, so the next try can resume from there.
+func (s *usedLinkStore) release(nonce string, delivered int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.serving, nonce)
+	s.delivered[nonce] = max(s.delivered[nonce], delivered)
+}
+
+// markUsed burns the link with the given nonce and saves the set.
+func (s *usedLinkStore) markUsed(nonce string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.serving, nonce)
+	delete(s.delivered, nonce)
+	s.links[nonce] = expires
+	for n, exp := range s.links {
+		if time.Now().After(exp) {
+			delete(s.links, n)
+		}
+	}
+
+	data, err := json.Marshal(s.links)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
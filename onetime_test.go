@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// usedLinksForTest keeps one-time links in a new state directory for the
+// length of the test, and returns it.
+func usedLinksForTest(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	s, err := openUsedLinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := usedLinks
+	t.Cleanup(func() { usedLinks = old })
+	usedLinks = s
+	return dir
+}
+
+func TestUsedLinkStore(t *testing.T) {
+	dir := usedLinksForTest(t)
+	s := usedLinks
+	if delivered, ok := s.reserve("n1"); !ok || delivered != 0 {
+		t.Fatalf("reserve = %d, %v; want 0, true", delivered, ok)
+	}
+	if _, ok := s.reserve("n1"); ok {
+		t.Fatal("a link was handed out twice at once")
+	}
+	s.release("n1", 100)
+	s.release("n1", 0) // Another try that got nowhere
+	if delivered, ok := s.reserve("n1"); !ok || delivered != 100 {
+		t.Fatalf("reserve after an unfinished download = %d, %v; want 100, true", delivered, ok)
+	}
+	if err := s.markUsed("n1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.reserve("n1"); ok || !s.used("n1") {
+		t.Error("a used link could be reserved again")
+	}
+
+	// A restart mustn't bring it back to life.
+	reopened, err := openUsedLinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reopened.used("n1") {
+		t.Error("the used link was forgotten after a restart")
+	}
+	if _, ok := reopened.reserve("n2"); !ok {
+		t.Error("another link couldn't be reserved")
+	}
+}
+
+// brokenWriter stops taking the body after limit bytes, like a download
+// that was cut off.
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+	limit int
+}
+
+func (w *brokenWriter) Write(p []byte) (int, error) {
+	if n := w.limit - w.Body.Len(); n < len(p) {
+		w.ResponseRecorder.Write(p[:max(n, 0)])
+		return max(n, 0), errors.New("connection reset")
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestOneTimeLink(t *testing.T) {
+	secretForTest(t)
+	usedLinksForTest(t)
+	share, _ := shareForTest(t, symlinksWithinRoot)
+	content := strings.Repeat("0123456789", 100000)
+	if err := os.WriteFile(filepath.Join(share, "big.txt"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	token := makeLinkToken(linkClaims{Path: "big.txt", Expires: time.Now().Add(time.Hour).Unix(), Nonce: "once"})
+	get := func(rangeHeader string, limit int) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/s/"+token, nil)
+		if rangeHeader != "" {
+			r.Header.Set("Range", rangeHeader)
+		}
+		w := &brokenWriter{ResponseRecorder: httptest.NewRecorder(), limit: limit}
+		shareLinkHandler(w, r)
+		return w.ResponseRecorder
+	}
+
+	// A download cut off part way leaves the link usable, and can be resumed
+	// from where it stopped, but not from further on.
+	if w := get("", 1000); w.Code != http.StatusOK || w.Body.Len() != 1000 {
+		t.Fatalf("cut off download: status %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if w := get("bytes=5000-", 10); w.Code != http.StatusOK {
+		t.Errorf("range past what was sent: status %d, want the whole file", w.Code)
+	}
+	if w := get("bytes=-1", 10); w.Code != http.StatusOK {
+		t.Errorf("suffix range: status %d, want the whole file", w.Code)
+	}
+	if usedLinks.used("once") {
+		t.Fatal("the link was used up by downloads that didn't finish")
+	}
+	w := get("bytes=1000-", len(content))
+	if w.Code != http.StatusPartialContent || w.Body.String() != content[1000:] {
+		t.Fatalf("resumed download: status %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if !usedLinks.used("once") {
+		t.Fatal("the link still works after the whole file was sent")
+	}
+	for _, h := range []string{"", "bytes=0-"} {
+		if w := get(h, len(content)); w.Code != http.StatusGone {
+			t.Errorf("used link, Range %q: status %d, want %d", h, w.Code, http.StatusGone)
+		}
+	}
+}
+
+func TestOneTimeLinkOneAtATime(t *testing.T) {
+	secretForTest(t)
+	usedLinksForTest(t)
+	shareForTest(t, symlinksWithinRoot)
+	claims := linkClaims{Path: "docs/a.txt", Expires: time.Now().Add(time.Hour).Unix(), Nonce: "busy"}
+	if _, ok := usedLinks.reserve(claims.Nonce); !ok {
+		t.Fatal("couldn't reserve the link")
+	}
+	w := httptest.NewRecorder()
+	shareLinkHandler(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/s/%s", makeLinkToken(claims)), nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("second download at once: status %d, want %d", w.Code, http.StatusConflict)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+)
+
+const (
+	defaultPerPage = 200 // Files on each page of the list
+	maxPerPage     = 1000
+)
+
+// listPage is which part of a long list of files to show, from ?page= and
+// ?per_page=, pages counting from 1.
+type listPage struct {
+	Page, PerPage int
+	Total         int // Files in the whole list
+}
+
+// parsePage reads ?page= and ?per_page=, perPage being how many there are
+// on a page if not given.
+func parsePage(q url.Values, perPage int) (listPage, error) {
+	p := listPage{Page: 1, PerPage: perPage}
+	var err error
+	if s := q.Get("page"); s != "" {
+		if p.Page, err = strconv.Atoi(s); err != nil || p.Page < 1 {
+			return p, errors.New("page must be a number from 1")
+		}
+	}
+	if s := q.Get("per_page"); s != "" {
+		if p.PerPage, err = strconv.Atoi(s); err != nil || p.PerPage < 1 || p.PerPage > maxPerPage {
+			return p, errors.New("per_page must be between 1 and " + strconv.Itoa(maxPerPage))
+		}
+	}
+	return p, nil
+}
+
+// slice returns the files on page p of files, noting how many there are
+// in all. A page past the end is taken as the last one, which also keeps
+// the multiplication from overflowing for a huge ?page=.
+func (p *listPage) slice(files []fileEntry) []fileEntry {
+	p.Total = len(files)
+	p.Page = min(p.Page, p.Pages())
+	start := (p.Page - 1) * p.PerPage
+	return files[start:min(len(files), start+p.PerPage)]
+}
+
+// Pages is how many pages there are.
+func (p listPage) Pages() int {
+	return max(1, (p.Total+p.PerPage-1)/p.PerPage)
+}
+
+// query returns the parameters for page n, leaving per_page out if it's
+// the default.
+func (p listPage) query(n int) url.Values {
+	q := url.Values{"page": {strconv.Itoa(n)}}
+	if p.PerPage != defaultPerPage {
+		q.Set("per_page", strconv.Itoa(p.PerPage))
+	}
+	return q
+}
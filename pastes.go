@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxPasteLength = 64 << 10 // Bytes
+	maxPastes      = 200      // Past this the oldest go
+	maxPasteExpiry = 30 * 24 * time.Hour
+)
+
+// paste is a piece of text shared alongside the files, like a link, a
+// Wi-Fi password or a command to paste on another machine.
+type paste struct {
+	ID       string    `json:"id"`
+	Text     string    `json:"text"`
+	Language string    `json:"language,omitempty"` // A file extension the viewer highlights, like "go" or "yaml"
+	By       string    `json:"by,omitempty"`       // Who shared it, when there are accounts
+	At       time.Time `json:"at"`
+	Expires  time.Time `json:"expires,omitzero"` // Zero if it's kept until deleted
+}
+
+func (p paste) expired() bool {
+	return !p.Expires.IsZero() && time.Now().After(p.Expires)
+}
+
+// syntax returns the syntax p's language is highlighted with.
+func (p paste) syntax() *syntax {
+	if s, ok := syntaxFor("paste." + p.Language); ok && p.Language != "" {
+		return s
+	}
+	return &plainSyntax
+}
+
+// pasteLanguages are the languages the page offers for text, out of all
+// the extensions the API takes.
+var pasteLanguages = []struct {
+	Label    string
+	Language string
+}{
+	{"Plain text", ""},
+	{"Shell", "sh"},
+	{"Python", "py"},
+	{"JavaScript", "js"},
+	{"Go", "go"},
+	{"C/C++", "c"},
+	{"Java", "java"},
+	{"Rust", "rs"},
+	{"SQL", "sql"},
+	{"JSON", "json"},
+	{"YAML", "yaml"},
+	{"INI/config", "conf"},
+	{"HTML/XML", "html"},
+	{"CSS", "css"},
+}
+
+// pasteExpiries are the choices the page gives for how long text stays.
+var pasteExpiries = []struct {
+	Label string
+	After string // As the API takes it, "" for never
+}{
+	{"keep it", ""},
+	{"for 10 minutes", "10m"},
+	{"for an hour", "1h"},
+	{"for a day", "24h"},
+	{"for a week", "168h"},
+}
+
+// pasteStore keeps the shared text, newest first, saved to the state
+// directory.
+type pasteStore struct {
+	mu    sync.Mutex
+	path  string
+	items []paste
+}
+
+var pastes *pasteStore
+
+func openPastes(dir string) (*pasteStore, error) {
+	s := &pasteStore{path: filepath.Join(dir, "pastes.json")}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.items); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// save must be called with s.mu held.
+func (s *pasteStore) save() {
+	data, err := json.Marshal(s.items)
+	if err == nil {
+		err = writeFileAtomic(s.path, data)
+	}
+	if err != nil {
+		log.Println("Error saving shared text:", err)
+	}
+}
+
+// prune drops expired pastes. It must be called with s.mu held.
+func (s *pasteStore) prune() {
+	if n := len(s.items); n > 0 {
+		s.items = slices.DeleteFunc(s.items, paste.expired)
+		if len(s.items) != n {
+			s.save()
+		}
+	}
+}
+
+// list returns the pastes that haven't expired, newest first.
+func (s *pasteStore) list() []paste {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	return slices.Clone(s.items)
+}
+
+func (s *pasteStore) add(p paste) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	s.items = slices.Insert(s.items, 0, p)
+	if len(s.items) > maxPastes {
+		s.items = s.items[:maxPastes]
+	}
+	s.save()
+}
+
+func (s *pasteStore) get(id string) (paste, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.items, func(p paste) bool { return p.ID == id })
+	if i < 0 || s.items[i].expired() {
+		return paste{}, false
+	}
+	return s.items[i], true
+}
+
+func (s *pasteStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items = slices.DeleteFunc(s.items, func(p paste) bool { return p.ID == id })
+	s.save()
+}
+
+// canDeletePaste reports whether r may delete p: whoever shared it,
+// when there are accounts, or the host.
+func canDeletePaste(r *http.Request, p paste) bool {
+	return p.By != "" && p.By == uploaderName(r) || isAdmin(r)
+}
+
+// pastesHandler serves the shared text at /api/pastes:
+//
+//	GET                                                     lists it, newest first
+//	POST   {"text": "...", "expire": "1h", "language": "py"} shares some, for anyone who can tag files
+//	DELETE ?id=ID                                            deletes some, for whoever shared it or the host
+func pastesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		list := pastes.list()
+		if list == nil {
+			list = []paste{}
+		}
+		writeJSON(w, http.StatusOK, list)
+	case http.MethodPost:
+		if !canTag(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Text     string `json:"text"`
+			Expire   string `json:"expire"`
+			Language string `json:"language"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 2*maxPasteLength)).Decode(&req); err != nil {
+			http.Error(w, "Expected JSON with the text to share", http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(req.Text) == "" || len(req.Text) > maxPasteLength {
+			http.Error(w, fmt.Sprintf("Shared text has to be from 1 byte to %s", humanSize(maxPasteLength)), http.StatusBadRequest)
+			return
+		}
+		p := paste{ID: rand.Text(), Text: req.Text, Language: strings.ToLower(strings.TrimPrefix(req.Language, ".")), By: uploaderName(r), At: time.Now()}
+		if _, ok := syntaxFor("paste." + p.Language); p.Language != "" && !ok {
+			http.Error(w, "Unknown language "+req.Language+", use a file extension like py or yaml", http.StatusBadRequest)
+			return
+		}
+		if req.Expire != "" {
+			d, err := time.ParseDuration(req.Expire)
+			if err != nil || d <= 0 || d > maxPasteExpiry {
+				http.Error(w, "expire has to be a duration like 1h, up to 30 days", http.StatusBadRequest)
+				return
+			}
+			p.Expires = p.At.Add(d)
+		}
+		pastes.add(p)
+		log.Printf("Shared %s of text, for %s", humanSize(int64(len(p.Text))), clientIP(r))
+		writeJSON(w, http.StatusCreated, p)
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		p, ok := pastes.get(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if !canDeletePaste(r, p) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		pastes.remove(id)
+		log.Printf("Deleted shared text, for %s", clientIP(r))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// pastePageHandler shows the text shared at /paste/ID on a page of its own,
+// highlighted in its language with line numbers.
+func pastePageHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := pastes.get(strings.TrimPrefix(r.URL.Path, "/paste/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	data := struct {
+		Paste paste
+		Lines []template.HTML
+	}{p, highlight(strings.TrimSuffix(strings.ReplaceAll(p.Text, "\r\n", "\n"), "\n"), p.syntax())}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pasteTemplate.Execute(w, data); err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	}
+}
+
+var pasteTemplate = newPage("paste", template.FuncMap{
+	"inc": func(i int) int { return i + 1 },
+	"since": func(t time.Time) string {
+		return time.Since(t).Round(time.Second).String()
+	},
+})
+
+// rawPasteHandler serves the text shared at /raw/ID as it is, for
+// curl on another machine.
+func rawPasteHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := pastes.get(strings.TrimPrefix(r.URL.Path, "/raw/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if p.Language != "" {
+		w.Header().Set("Content-Disposition", `inline; filename="paste.`+p.Language+`"`)
+	}
+	io.WriteString(w, p.Text)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// pdfText pulls the text layer out of a PDF, well enough to search it. It
+// reads the text drawn in each page's content, which covers PDFs made by
+// word processors and most scanners with OCR; text in fonts with their own
+// encodings, as some PDFs use for Bangla or Chinese, comes out as nothing.
+func pdfText(data []byte) string {
+	var text strings.Builder
+	for rest := data; ; {
+		i := bytes.Index(rest, []byte("stream"))
+		if i < 0 {
+			break
+		}
+		dict := rest[max(0, i-1024):i]
+		if j := bytes.LastIndex(dict, []byte("obj")); j >= 0 {
+			dict = dict[j:]
+		}
+		body := rest[i+len("stream"):]
+		body = bytes.TrimPrefix(body, []byte("\r"))
+		body = bytes.TrimPrefix(body, []byte("\n"))
+		end := bytes.Index(body, []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		rest = body[end+len("endstream"):]
+		if bytes.HasSuffix(dict, []byte("end")) { // "endstream" itself
+			continue
+		}
+		content := body[:end]
+		switch {
+		case bytes.Contains(dict, []byte("/FlateDecode")):
+			r, err := zlib.NewReader(bytes.NewReader(content))
+			if err != nil {
+				continue
+			}
+			// Streams often end early or have junk after them, which still
+			// leaves what came before.
+			content, _ = io.ReadAll(io.LimitReader(r, 16<<20))
+		case bytes.Contains(dict, []byte("/Filter")):
+			continue // Images, mostly
+		}
+		pdfContentText(content, &text)
+	}
+	return text.String()
+}
+
+// pdfContentText writes the text shown between BT and ET in a page's
+// content stream to text.
+func pdfContentText(content []byte, text *strings.Builder) {
+	inText := false
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case c == '(' && inText:
+			s, n := pdfLiteral(content[i:])
+			text.WriteString(s)
+			i += n - 1
+		case c == '<' && inText && i+1 < len(content) && content[i+1] != '<':
+			end := bytes.IndexByte(content[i:], '>')
+			if end < 0 {
+				return
+			}
+			text.WriteString(pdfHex(content[i+1 : i+end]))
+			i += end
+		case c == '-' && inText && i+1 < len(content) && content[i+1] >= '0' && content[i+1] <= '9':
+			// A big gap in a TJ array is a space between words.
+			j := i + 1
+			for j < len(content) && (content[j] >= '0' && content[j] <= '9' || content[j] == '.') {
+				j++
+			}
+			if j-i > 3 {
+				text.WriteByte(' ')
+			}
+			i = j - 1
+		case isPDFDelimiter(c):
+		default:
+			j := i
+			for j < len(content) && !isPDFDelimiter(content[j]) {
+				j++
+			}
+			switch string(content[i:j]) {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+				text.WriteByte('\n')
+			case "Td", "TD", "T*", "'", `"`:
+				text.WriteByte('\n')
+			case "Tj", "TJ":
+				text.WriteByte(' ')
+			}
+			i = j - 1
+		}
+	}
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte(" \t\r\n\f\x00()<>[]{}/%", c) >= 0
+}
+
+// pdfLiteral decodes the (string) at the start of s, returning it and how
+// many bytes it took up.
+func pdfLiteral(s []byte) (string, int) {
+	var b []byte
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '(':
+			if depth > 0 {
+				b = append(b, c)
+			}
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return pdfString(b), i + 1
+			}
+			b = append(b, c)
+		case '\\':
+			i++
+			if i >= len(s) {
+				break
+			}
+			switch e := s[i]; e {
+			case 'n', 'r':
+				b = append(b, '\n')
+			case 't':
+				b = append(b, ' ')
+			case '0', '1', '2', '3', '4', '5', '6', '7':
+				v := 0
+				for n := 0; n < 3 && i < len(s) && s[i] >= '0' && s[i] <= '7'; n++ {
+					v = v*8 + int(s[i]-'0')
+					i++
+				}
+				i--
+				b = append(b, byte(v))
+			case '\r', '\n':
+			default:
+				b = append(b, e)
+			}
+		default:
+			b = append(b, c)
+		}
+	}
+	return pdfString(b), len(s)
+}
+
+// pdfHex decodes a <hex> string.
+func pdfHex(s []byte) string {
+	var b []byte
+	var hi byte
+	half := false
+	for _, c := range s {
+		var v byte
+		switch {
+		case c >= '0' && c <= '9':
+			v = c - '0'
+		case c >= 'a' && c <= 'f':
+			v = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			v = c - 'A' + 10
+		default:
+			continue
+		}
+		if half {
+			b = append(b, hi<<4|v)
+		} else {
+			hi = v
+		}
+		half = !half
+	}
+	return pdfString(b)
+}
+
+// pdfString turns the bytes of a PDF string into text: UTF-16 if it says
+// so, and otherwise Latin-1, which is close enough to PDFDocEncoding. Bytes
+// that are neither, like font glyph numbers, are dropped.
+func pdfString(b []byte) string {
+	if len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff {
+		u := make([]uint16, 0, len(b)/2)
+		for i := 2; i+1 < len(b); i += 2 {
+			u = append(u, uint16(b[i])<<8|uint16(b[i+1]))
+		}
+		return string(utf16.Decode(u))
+	}
+	var s strings.Builder
+	for _, c := range b {
+		if c >= 0x20 && c != 0x7f || c == '\n' {
+			s.WriteRune(rune(c))
+		}
+	}
+	return s.String()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// pinStore lists the files the host has pinned to the top of the page, in
+// the order they were pinned, saved to the state directory.
+type pinStore struct {
+	mu    sync.Mutex
+	path  string
+	files []string
+}
+
+var pins *pinStore
+
+func openPins(dir string) (*pinStore, error) {
+	s := &pinStore{path: filepath.Join(dir, "pins.json")}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.files); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// save must be called with s.mu held.
+func (s *pinStore) save() {
+	data, err := json.Marshal(s.files)
+	if err == nil {
+		err = writeFileAtomic(s.path, data)
+	}
+	if err != nil {
+		log.Println("Error saving pinned files:", err)
+	}
+}
+
+func (s *pinStore) list() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.files)
+}
+
+func (s *pinStore) pinned(p string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Contains(s.files, p)
+}
+
+// set pins or unpins p.
+func (s *pinStore) set(p string, pin bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.Index(s.files, p)
+	switch {
+	case pin && i < 0:
+		s.files = append(s.files, p)
+	case !pin && i >= 0:
+		s.files = slices.Delete(s.files, i, i+1)
+	default:
+		return
+	}
+	s.save()
+}
+
+// moved keeps everything at oldname pinned at newname, after a file or
+// folder is renamed.
+func (s *pinStore) moved(oldname, newname string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for i, p := range s.files {
+		rest, ok := strings.CutPrefix(p, oldname)
+		if !ok || rest != "" && rest[0] != '/' {
+			continue
+		}
+		s.files[i] = newname + rest
+		changed = true
+	}
+	if changed {
+		s.save()
+	}
+}
+
+// pinFile pins or unpins the shared file name, for PATCH /api/files/PATH
+// with {"pinned": true}, reporting whether it did. Only the host can.
+func pinFile(w http.ResponseWriter, r *http.Request, name string, pin bool) bool {
+	if !isAdmin(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	if info, err := statShared(name); pin && (err != nil || info.IsDir()) {
+		http.NotFound(w, r)
+		return false
+	}
+	pins.set(name, pin)
+	if pin {
+		log.Printf("Pinned %s, for %s", name, clientIP(r))
+	} else {
+		log.Printf("Unpinned %s, for %s", name, clientIP(r))
+	}
+	return true
+}
+
+// pinnedEntries returns the pinned files among files, in the order they
+// were pinned, leaving out ones that are gone or locked.
+func pinnedEntries(files []fileEntry) []fileEntry {
+	var pinned []fileEntry
+	for _, p := range pins.list() {
+		i := slices.IndexFunc(files, func(f fileEntry) bool { return f.Name == p && !f.Folder })
+		if i >= 0 && !files[i].Locked {
+			pinned = append(pinned, files[i])
+		}
+	}
+	return pinned
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isAudio reports whether ctype is audio a page can play.
+func isAudio(ctype string) bool {
+	return strings.HasPrefix(mediaType(ctype), "audio/")
+}
+
+// playerJSHandler serves the audio player used by the file list. Any
+// element with a data-audio attribute naming a shared file becomes a play
+// button; playing a file queues the other audio files listed from the same
+// folder after it, and the player bar at the bottom of the page goes back
+// and forward through them. Phones' lock screens get the same controls.
+func playerJSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Write([]byte(playerJS))
+}
+
+const playerJS = `"use strict";
+(() => {
+  const style = document.createElement("style");
+  style.textContent =
+    "#player { position: fixed; left: 0; right: 0; bottom: 0; display: none; align-items: center; gap: 10px; padding: 10px 20px; background-color: var(--surface); border-top: 1px solid var(--field); }" +
+    "#player.playing { display: flex; }" +
+    "#player .title { flex-grow: 1; overflow: hidden; text-overflow: ellipsis; white-space: nowrap; color: var(--muted); }" +
+    "#player audio { max-width: 50%; }" +
+    "body.has-player { padding-bottom: 90px; }";
+  document.head.append(style);
+
+  const bar = document.createElement("div");
+  bar.id = "player";
+  bar.innerHTML = '<button class="download-btn prev" title="Previous">⏮</button>' +
+    '<button class="download-btn next" title="Next">⏭</button>' +
+    '<span class="title"></span><audio controls preload="none"></audio>';
+  const audio = bar.querySelector("audio");
+  const title = bar.querySelector(".title");
+  let queue = [];
+  let current = -1;
+
+  const folder = p => p.includes("/") ? p.slice(0, p.lastIndexOf("/")) : "";
+  const root = new URL(".", document.currentScript.src).pathname;
+  const url = p => root + "download/" + p.split("/").map(encodeURIComponent).join("/");
+
+  function playAt(i) {
+    if (i < 0 || i >= queue.length) {
+      return;
+    }
+    current = i;
+    const name = queue[i];
+    audio.src = url(name);
+    audio.play().catch(() => {});
+    title.textContent = (i + 1) + "/" + queue.length + " · " + name;
+    title.title = name;
+    document.querySelectorAll("[data-audio]").forEach(b => b.classList.toggle("now-playing", b.dataset.audio === name));
+    if ("mediaSession" in navigator) {
+      navigator.mediaSession.metadata = new MediaMetadata({title: name.slice(name.lastIndexOf("/") + 1), album: folder(name)});
+    }
+  }
+
+  function play(name) {
+    const dir = folder(name);
+    queue = [...new Set([...document.querySelectorAll("[data-audio]")].map(b => b.dataset.audio))]
+      .filter(p => folder(p) === dir);
+    if (!document.body.contains(bar)) {
+      document.body.append(bar);
+      document.body.classList.add("has-player");
+    }
+    bar.classList.add("playing");
+    playAt(queue.indexOf(name));
+  }
+
+  bar.querySelector(".prev").onclick = () => audio.currentTime > 3 ? audio.currentTime = 0 : playAt(current - 1);
+  bar.querySelector(".next").onclick = () => playAt(current + 1);
+  audio.addEventListener("ended", () => playAt(current + 1));
+  if ("mediaSession" in navigator) {
+    navigator.mediaSession.setActionHandler("previoustrack", () => playAt(current - 1));
+    navigator.mediaSession.setActionHandler("nexttrack", () => playAt(current + 1));
+  }
+  document.addEventListener("click", e => {
+    const button = e.target.closest("[data-audio]");
+    if (button) {
+      e.preventDefault();
+      play(button.dataset.audio);
+    }
+  });
+})();
+`
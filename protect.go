@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// protectFlag collects --protect path=password options. Paths are relative
+// to the share root and may name a file or a folder.
+type protectFlag map[string]string
+
+func (p protectFlag) String() string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (p protectFlag) Set(value string) error {
+	name, password, ok := strings.Cut(value, "=")
+	if !ok || password == "" {
+		return fmt.Errorf("expected path=password, got %q", value)
+	}
+	p[cleanSharePath(name)] = password
+	return nil
+}
+
+// protected maps share paths to the password guarding them.
+var protected = protectFlag{}
+
+// lockedBy returns the protected path that keeps r from accessing the share
+// path p, checking p itself and every folder above it. It returns false when
+// nothing is in the way.
+func lockedBy(r *http.Request, p string) (string, bool) {
+	if len(protected) == 0 {
+		return "", false
+	}
+	for p = cleanSharePath(p); ; p = path.Dir(p) {
+		if p == "." {
+			p = ""
+		}
+		if _, ok := protected[p]; ok && !unlocked(r, p) {
+			return p, true
+		}
+		if p == "" {
+			return "", false
+		}
+	}
+}
+
+// unlockCookieName gives each protected path its own cookie.
+func unlockCookieName(p string) string {
+	sum := sha256.Sum256([]byte(p))
+	return "unlock_" + hex.EncodeToString(sum[:8])
+}
+
+// unlockToken proves knowledge of the password for p. It changes whenever
+// the password does, so old cookies stop working.
+func unlockToken(p string) string {
+	return base64.RawURLEncoding.EncodeToString(sign([]byte("unlock\n" + p + "\n" + protected[p])))
+}
+
+func unlocked(r *http.Request, p string) bool {
+	c, err := r.Cookie(unlockCookieName(p))
+	return err == nil && hmac.Equal([]byte(c.Value), []byte(unlockToken(p)))
+}
+
+// redirectToUnlock sends the browser to the password form for the protected
+// path p, coming back to the current URL afterwards.
+func redirectToUnlock(w http.ResponseWriter, r *http.Request, p string) {
+	q := url.Values{"path": {p}, "next": {r.URL.RequestURI()}}
+	http.Redirect(w, r, "/unlock?"+q.Encode(), http.StatusSeeOther)
+}
+
+// unlockHandler shows and checks the password form for a protected path.
+func unlockHandler(w http.ResponseWriter, r *http.Request) {
+	p := cleanSharePath(r.FormValue("path"))
+	password, ok := protected[p]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	next := safeNext(r.FormValue("next"))
+
+	data := struct {
+		Path  string
+		Next  string
+		Error string
+		CSRF  string
+	}{Path: p, Next: next, CSRF: csrfToken(w, r)}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodPost {
+		switch msg := lockoutError(w, r, "/"+p); {
+		case msg != "":
+			data.Error = msg
+			w.WriteHeader(http.StatusTooManyRequests)
+		case subtle.ConstantTimeCompare([]byte(r.FormValue("password")), []byte(password)) == 1:
+			http.SetCookie(w, &http.Cookie{
+				Name:     unlockCookieName(p),
+				Value:    unlockToken(p),
+				Path:     basePath + "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+			logins.succeed(clientIP(r), "/"+p)
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		default:
+			logins.fail(clientIP(r), "/"+p)
+			data.Error = "Wrong password"
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}
+
+	err := unlockTemplate.Execute(w, data)
+	if err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	}
+}
+
+var unlockTemplate = newPage("unlock", nil)
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// withProtected guards paths with passwords for the length of the test.
+func withProtected(t *testing.T, paths map[string]string) {
+	t.Helper()
+	old := protected
+	t.Cleanup(func() { protected = old })
+	protected = protectFlag(paths)
+}
+
+func unlock(t *testing.T, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/unlock", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	unlockHandler(w, r)
+	return w
+}
+
+func TestUnlockRedirectsOnlyOnThisServer(t *testing.T) {
+	withProtected(t, map[string]string{"private": "hunter2"})
+	tests := []struct{ next, want string }{
+		{"/private/a.txt", "/private/a.txt"},
+		{"https://evil.com/", "/"},
+		{"//evil.com", "/"},
+		{`/\evil.com`, "/"},
+		{"/\t/evil.com", "/"},
+	}
+	for _, tt := range tests {
+		w := unlock(t, url.Values{"path": {"private"}, "password": {"hunter2"}, "next": {tt.next}})
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("next %q: status %d, want %d", tt.next, w.Code, http.StatusSeeOther)
+		}
+		if got := w.Header().Get("Location"); got != tt.want {
+			t.Errorf("next %q: redirected to %q, want %q", tt.next, got, tt.want)
+		}
+	}
+}
+
+func TestUnlockCookie(t *testing.T) {
+	withProtected(t, map[string]string{"private": "hunter2", "other": "letmein"})
+	if w := unlock(t, url.Values{"path": {"private"}, "password": {"wrong"}}); w.Code != http.StatusForbidden {
+		t.Fatalf("wrong password: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	logins.succeed("192.0.2.1", "/private")
+
+	w := unlock(t, url.Values{"path": {"private"}, "password": {"hunter2"}})
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == unlockCookieName("private") {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("no unlock cookie was set")
+	}
+	r := httptest.NewRequest(http.MethodGet, "/download/private/a.txt", nil)
+	r.AddCookie(cookie)
+	tests := []struct {
+		path   string
+		locked bool
+	}{
+		{"private", false},
+		{"private/docs/a.txt", false},
+		{"other/a.txt", true},
+		{"public.txt", false},
+	}
+	for _, tt := range tests {
+		if _, locked := lockedBy(r, tt.path); locked != tt.locked {
+			t.Errorf("lockedBy(%q) = %v, want %v", tt.path, locked, tt.locked)
+		}
+	}
+
+	// The cookie stops working once the password changes.
+	protected["private"] = "changed"
+	if _, locked := lockedBy(r, "private/a.txt"); !locked {
+		t.Error("the unlock cookie still works after the password changed")
+	}
+	protected["private"] = "hunter2"
+	last := "A"
+	if strings.HasSuffix(cookie.Value, last) {
+		last = "B"
+	}
+	forged := &http.Cookie{Name: cookie.Name, Value: cookie.Value[:len(cookie.Value)-1] + last}
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(forged)
+	if _, locked := lockedBy(r, "private"); !locked {
+		t.Error("a tampered unlock cookie worked")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// basePath is where the share is, below the top of the site, when a
+// reverse proxy puts it at something like https://example.com/share/,
+// --base-path. It starts with a slash and doesn't end with one, or is "".
+var basePath string
+
+// parseBasePath reads --base-path, like /share.
+func parseBasePath(s string) (string, error) {
+	if s == "" || s == "/" {
+		return "", nil
+	}
+	if !strings.HasPrefix(s, "/") || strings.ContainsAny(s, "?#") {
+		return "", fmt.Errorf("expected a path starting with /, like /share, got %q", s)
+	}
+	return strings.TrimSuffix(path.Clean(s), "/"), nil
+}
+
+// basePathMiddleware serves the share below --base-path. Proxies can pass
+// requests on with the path as it is or with the base path taken off, and
+// the share still works when it's reached directly, without the proxy.
+// Redirects to the share's own pages get the base path put in front.
+func basePathMiddleware(next http.Handler) http.Handler {
+	if basePath == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == basePath {
+			http.Redirect(w, r, basePath+"/", http.StatusMovedPermanently)
+			return
+		}
+		if rest, ok := strings.CutPrefix(r.URL.Path, basePath+"/"); ok {
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = "/" + rest
+			r2.URL.RawPath = ""
+			if raw, ok := strings.CutPrefix(r.URL.RawPath, basePath+"/"); ok {
+				r2.URL.RawPath = "/" + raw
+			}
+			r = r2
+		}
+		next.ServeHTTP(&basePathWriter{ResponseWriter: w}, r)
+	})
+}
+
+// basePathWriter puts the base path in front of redirects to "/...".
+type basePathWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *basePathWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		loc := w.Header().Get("Location")
+		if strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//") && loc != basePath && !strings.HasPrefix(loc, basePath+"/") {
+			w.Header().Set("Location", basePath+loc)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *basePathWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *basePathWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *basePathWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// fromTrustedProxy reports whether r came through one of --trusted-proxy.
+func fromTrustedProxy(r *http.Request) bool {
+	if len(trustedProxies) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && trustedProxies.contains(ip)
+}
+
+// viaProxy reports whether r was passed on by a reverse proxy: one of
+// --trusted-proxy, or any other, which says so with forwarding headers. The
+// proxy may well be on this machine, but the client it's passing on isn't,
+// so such requests never count as the host's.
+func viaProxy(r *http.Request) bool {
+	if fromTrustedProxy(r) {
+		return true
+	}
+	for _, h := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip", "Forwarded", "Via"} {
+		if r.Header.Get(h) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// externalBaseURL is the share's address as the client sees it, for links
+// to hand out. Behind a trusted proxy that's the one X-Forwarded-Proto
+// and X-Forwarded-Host say, such as https://example.com/share/; otherwise
+// it's the address on the LAN the server started with.
+func externalBaseURL(r *http.Request) string {
+	if !fromTrustedProxy(r) {
+		return baseURL
+	}
+	host := lastForwarded(r.Header.Values("X-Forwarded-Host"))
+	if host == "" {
+		return baseURL
+	}
+	proto := strings.ToLower(lastForwarded(r.Header.Values("X-Forwarded-Proto")))
+	if proto != "https" {
+		proto = "http"
+	}
+	return proto + "://" + host + basePath + "/"
+}
+
+// lastForwarded is the last of an X-Forwarded- header's comma-separated
+// values, the one our own proxy added, if it looks like a host or scheme.
+// Anything before it came from the client and could be made up.
+func lastForwarded(values []string) string {
+	all := strings.Join(values, ",")
+	v := strings.TrimSpace(all[strings.LastIndex(all, ",")+1:])
+	if strings.ContainsAny(v, "/\\@ \"<>") {
+		return ""
+	}
+	return v
+}
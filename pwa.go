@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+)
+
+// The icon's colors, the default theme's background and accent.
+var (
+	iconBackground = color.RGBA{0x0a, 0x19, 0x2f, 0xff}
+	iconForeground = color.RGBA{0x64, 0xff, 0xda, 0xff}
+)
+
+// manifestHandler serves the web app manifest that lets phones install
+// the share to their home screen.
+func manifestHandler(w http.ResponseWriter, r *http.Request) {
+	name := siteTitle
+	if name == "" {
+		name = "Shared Files"
+	}
+	type icon struct {
+		Src     string `json:"src"`
+		Sizes   string `json:"sizes"`
+		Type    string `json:"type"`
+		Purpose string `json:"purpose"`
+	}
+	manifest := struct {
+		Name            string `json:"name"`
+		ShortName       string `json:"short_name"`
+		StartURL        string `json:"start_url"`
+		Scope           string `json:"scope"`
+		Display         string `json:"display"`
+		BackgroundColor string `json:"background_color"`
+		ThemeColor      string `json:"theme_color"`
+		Icons           []icon `json:"icons"`
+	}{
+		Name:            name,
+		ShortName:       name,
+		StartURL:        "./",
+		Scope:           "./",
+		Display:         "standalone",
+		BackgroundColor: "#0a192f",
+		ThemeColor:      "#0a192f",
+		Icons: []icon{
+			{"icon-192.png", "192x192", "image/png", "any maskable"},
+			{"icon-512.png", "512x512", "image/png", "any maskable"},
+		},
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, http.StatusOK, manifest)
+}
+
+// iconHandler serves the app icon, at /icon-192.png and /icon-512.png.
+func iconHandler(size int) http.HandlerFunc {
+	var buf bytes.Buffer
+	png.Encode(&buf, appIcon(size))
+	data := buf.Bytes()
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "max-age=86400")
+		w.Write(data)
+	}
+}
+
+// appIcon draws a folder on the theme's background, inside the middle of
+// the square that maskable icons keep whatever shape they're cut to.
+func appIcon(size int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(iconBackground), image.Point{}, draw.Src)
+	fg := image.NewUniform(iconForeground)
+	unit := size / 16
+	draw.Draw(img, image.Rect(4*unit, 5*unit, 8*unit, 6*unit), fg, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(4*unit, 6*unit, 12*unit, 11*unit), fg, image.Point{}, draw.Src)
+	return img
+}
+
+// offlineHandler serves the page the service worker shows when the server
+// can't be reached.
+func offlineHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	data := struct{ Title string }{siteTitle}
+	if err := offlineTemplate.Execute(w, data); err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	}
+}
+
+var offlineTemplate = newPage("offline", nil)
+
+// serviceWorkerHandler serves the service worker, which keeps the offline
+// page and the files every page needs cached. Pages still come from the
+// server each time, so the list is never out of date, but when it can't be
+// reached the offline page is shown instead of the browser's error.
+func serviceWorkerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(serviceWorkerJS))
+}
+
+const serviceWorkerJS = `"use strict";
+const cacheName = "lanshare-shell-v1";
+// Where the share is, which is below the top of the site with --base-path.
+const root = new URL("./", location).pathname;
+const shell = ["offline", "theme.css", "player.js", "manifest.webmanifest", "icon-192.png", "icon-512.png"].map(p => root + p);
+
+self.addEventListener("install", event => {
+  event.waitUntil(caches.open(cacheName).then(cache => cache.addAll(shell)).then(() => self.skipWaiting()));
+});
+
+self.addEventListener("activate", event => {
+  event.waitUntil(caches.keys()
+    .then(names => Promise.all(names.filter(n => n !== cacheName).map(n => caches.delete(n))))
+    .then(() => self.clients.claim()));
+});
+
+self.addEventListener("fetch", event => {
+  const req = event.request;
+  const url = new URL(req.url);
+  if (req.method !== "GET" || url.origin !== location.origin) {
+    return;
+  }
+  // Downloads are left to the browser, which can resume them.
+  if (req.mode === "navigate" && !/^(download|s)\//.test(url.pathname.slice(root.length))) {
+    event.respondWith(fetch(req).catch(() => caches.match(root + "offline")));
+    return;
+  }
+  if (shell.includes(url.pathname)) {
+    // Served from the cache straight away, and refreshed for next time.
+    event.respondWith(caches.open(cacheName).then(async cache => {
+      const cached = await cache.match(url.pathname);
+      const fresh = fetch(req).then(res => {
+        if (res.ok) {
+          cache.put(url.pathname, res.clone());
+        }
+        return res;
+      });
+      return cached || fresh;
+    }));
+  }
+});
+`
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	maxUploadSize int64 // Largest file that can be uploaded, 0 is unlimited
+	uploadQuota   int64 // Bytes each client can upload a day, 0 is unlimited
+)
+
+// uploadTooLargeError is returned while reading an upload that goes past
+// --max-upload-size or the client's quota, explaining which.
+type uploadTooLargeError struct{ message string }
+
+func (e *uploadTooLargeError) Error() string { return e.message }
+
+// quotaStore counts how much each client has uploaded today, and how much
+// is still arriving, so parallel uploads can't get past the quota together.
+// The day's counts are saved to the state directory so restarting the
+// server doesn't reset anyone's quota.
+type quotaStore struct {
+	mu      sync.Mutex
+	path    string
+	clients map[string]quotaUsage
+	pending map[string]int64
+}
+
+type quotaUsage struct {
+	Day   string `json:"day"` // Local date, e.g. 2026-10-14
+	Bytes int64  `json:"bytes"`
+}
+
+var quotas *quotaStore
+
+func openQuotas(dir string) (*quotaStore, error) {
+	q := &quotaStore{
+		path:    filepath.Join(dir, "upload-quota.json"),
+		clients: make(map[string]quotaUsage),
+		pending: make(map[string]int64),
+	}
+	data, err := os.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &q.clients); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func today() string {
+	return time.Now().Format(time.DateOnly)
+}
+
+// used must be called with q.mu held.
+func (q *quotaStore) used(client string) int64 {
+	n := q.pending[client]
+	if u := q.clients[client]; u.Day == today() {
+		n += u.Bytes
+	}
+	return n
+}
+
+// left returns how many more bytes client can upload today.
+func (q *quotaStore) left(client string) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return max(uploadQuota-q.used(client), 0)
+}
+
+// reserve sets n bytes aside for an upload from client that's arriving,
+// unless that would go over the quota.
+func (q *quotaStore) reserve(client string, n int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.used(client)+n > uploadQuota {
+		return false
+	}
+	q.pending[client] += n
+	return true
+}
+
+// settle ends a reservation of n bytes, counting them against today's
+// quota if the upload was saved.
+func (q *quotaStore) settle(client string, n int64, saved bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.pending[client] -= n; q.pending[client] <= 0 {
+		delete(q.pending, client)
+	}
+	if !saved || n == 0 {
+		return
+	}
+	day := today()
+	u := q.clients[client]
+	if u.Day != day {
+		u = quotaUsage{Day: day}
+	}
+	u.Bytes += n
+	q.clients[client] = u
+	for c, u := range q.clients {
+		if u.Day != day {
+			delete(q.clients, c)
+		}
+	}
+	if err := q.save(); err != nil {
+		log.Println("Error saving upload quotas:", err)
+	}
+}
+
+func (q *quotaStore) save() error {
+	data, err := json.Marshal(q.clients)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(q.path, data)
+}
+
+// writeFileAtomic saves data as the state file name, creating its folder
+// if need be. It's written to a temporary file that then takes its place,
+// so a crash leaves the old file or the new one, never half of it.
+func writeFileAtomic(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// quotaClient is who an upload counts against: the signed-in user, or else
+// the client's address.
+func quotaClient(r *http.Request) string {
+	if name := uploaderName(r); name != "" {
+		return "user:" + name
+	}
+	return clientIP(r)
+}
+
+// quotaLeft returns how many more bytes the client making r can upload
+// today, or -1 without a quota.
+func quotaLeft(r *http.Request) int64 {
+	if uploadQuota <= 0 {
+		return -1
+	}
+	return quotas.left(quotaClient(r))
+}
+
+// tooLarge answers with a 413 if err is from an upload over the limits.
+func tooLarge(w http.ResponseWriter, r *http.Request, err error) bool {
+	var tooLargeErr *uploadTooLargeError
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLargeErr):
+		uploadTooLarge(w, r, tooLargeErr.message)
+	case errors.As(err, &maxBytesErr):
+		uploadTooLarge(w, r, quotaMessage(max(quotaLeft(r), 0)))
+	default:
+		return false
+	}
+	return true
+}
+
+// uploadLimits describes the limits on uploads from r for the upload page.
+func uploadLimits(r *http.Request) string {
+	var limits []string
+	if maxUploadSize > 0 {
+		limits = append(limits, "Up to "+humanSize(maxUploadSize)+" per file")
+	}
+	if left := quotaLeft(r); left >= 0 {
+		limits = append(limits, fmt.Sprintf("%s of your %s a day left", humanSize(left), humanSize(uploadQuota)))
+	}
+	if free := uploadSpaceSummary(); free != "" {
+		limits = append(limits, free+" of disk space left")
+	}
+	return strings.Join(limits, " · ")
+}
+
+func maxSizeMessage() string {
+	return fmt.Sprintf("Files can be at most %s.", humanSize(maxUploadSize))
+}
+
+func quotaMessage(left int64) string {
+	if left == 0 {
+		return fmt.Sprintf("You've used up today's upload quota of %s, try again tomorrow.", humanSize(uploadQuota))
+	}
+	return fmt.Sprintf("That's more than the %s you can still upload today, out of %s a day.", humanSize(left), humanSize(uploadQuota))
+}
+
+// tooLargeMessage explains why a file of size bytes can't be taken from r,
+// or returns "" if it can.
+func tooLargeMessage(r *http.Request, size int64) string {
+	if maxUploadSize > 0 && size > maxUploadSize {
+		return maxSizeMessage()
+	}
+	if left := quotaLeft(r); left >= 0 && size > left {
+		return quotaMessage(left)
+	}
+	return ""
+}
+
+// limitedUpload reads an uploaded file, reserving quota for it as it
+// arrives and failing once it goes over either limit. settle must be
+// called when the file is done.
+type limitedUpload struct {
+	r      io.Reader
+	client string
+	left   int64 // Quota left when the file started
+	got    int64
+	held   int64 // Reserved against the quota so far
+}
+
+func newLimitedUpload(r *http.Request, src io.Reader) *limitedUpload {
+	return &limitedUpload{r: src, client: quotaClient(r), left: quotaLeft(r)}
+}
+
+func (l *limitedUpload) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.got += int64(n)
+	if maxUploadSize > 0 && l.got > maxUploadSize {
+		return n, &uploadTooLargeError{maxSizeMessage()}
+	}
+	if uploadQuota > 0 && n > 0 {
+		if !quotas.reserve(l.client, int64(n)) {
+			return n, &uploadTooLargeError{quotaMessage(l.left)}
+		}
+		l.held += int64(n)
+	}
+	return n, err
+}
+
+func (l *limitedUpload) settle(saved bool) {
+	if l.held > 0 {
+		quotas.settle(l.client, l.held, saved)
+	}
+}
+
+// uploadTooLarge answers an upload that's over the limits with a 413: a page
+// for a plain form, or just the message for scripts.
+func uploadTooLarge(w http.ResponseWriter, r *http.Request, message string) {
+	if r.URL.Path != "/upload" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		http.Error(w, message, http.StatusRequestEntityTooLarge)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Connection", "close") // Don't read the rest of the body
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	tooLargeTemplate.Execute(w, message)
+}
+
+var tooLargeTemplate = newPage("too-large", nil)
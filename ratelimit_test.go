@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := &rateLimiter{rate: 1, burst: 3, buckets: make(map[string]*bucket)}
+	for i := range 3 {
+		if !l.allow("a") {
+			t.Fatalf("request %d of the burst was refused", i+1)
+		}
+	}
+	if l.allow("a") {
+		t.Fatal("a request past the burst was let through")
+	}
+	if !l.allow("b") {
+		t.Fatal("another client was limited too")
+	}
+
+	// Two seconds later two more tokens have come in, and no more than the
+	// burst after a long wait.
+	l.buckets["a"].last = l.buckets["a"].last.Add(-2 * time.Second)
+	for i := range 2 {
+		if !l.allow("a") {
+			t.Errorf("request %d after waiting was refused", i+1)
+		}
+	}
+	if l.allow("a") {
+		t.Error("more requests than tokens came in were let through")
+	}
+	l.buckets["a"].last = l.buckets["a"].last.Add(-time.Hour)
+	allowed := 0
+	for range 10 {
+		if l.allow("a") {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("%d requests let through after a long wait, want the burst of 3", allowed)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	l := &rateLimiter{rate: 0.001, burst: 1, buckets: make(map[string]*bucket)}
+	h := rateLimitMiddleware(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != want {
+			t.Errorf("request %d: status %d, want %d", i+1, w.Code, want)
+		}
+		if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Error("refused without a Retry-After")
+		}
+	}
+}
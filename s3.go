@@ -0,0 +1,604 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 settings for s3:// shares. Credentials come from the usual
+// $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY and $AWS_SESSION_TOKEN; without
+// them requests go out unsigned, which works for public buckets.
+var (
+	s3Endpoint string // e.g. http://nas:9000 for MinIO, "" for AWS
+	s3Region   string
+)
+
+// s3FS serves the objects under a prefix of an S3 bucket, treating the
+// slashes in their keys as folders. Files are streamed straight from the
+// bucket, with seeks turned into range requests.
+type s3FS struct {
+	endpoint *url.URL
+	virtual  bool // Bucket goes in the host name, as AWS prefers
+	bucket   string
+	prefix   string // "" or ends in a slash
+	region   string
+
+	accessKey, secretKey, sessionToken string
+}
+
+// openS3 returns the backend for an s3://bucket/prefix URL.
+func openS3(rawURL string) (*s3FS, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("expected s3://bucket/prefix, got %q", rawURL)
+	}
+	s := &s3FS{
+		bucket:       u.Host,
+		prefix:       strings.Trim(u.Path, "/"),
+		region:       s3Region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.prefix != "" {
+		s.prefix += "/"
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	endpoint := s3Endpoint
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + s.region + ".amazonaws.com"
+		s.virtual = !strings.Contains(s.bucket, ".") // Dots break TLS on the wildcard certificate
+	}
+	if s.endpoint, err = url.Parse(endpoint); err != nil || s.endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+	// Fail now, not on the first visitor, if the bucket can't be reached.
+	if _, err := s.list(s.prefix, "", 1); err != nil {
+		return nil, fmt.Errorf("%s: %w", rawURL, err)
+	}
+	return s, nil
+}
+
+func (s *s3FS) key(name string) string {
+	if name == "." {
+		return s.prefix
+	}
+	return s.prefix + name
+}
+
+func (s *s3FS) Open(name string) (fs.File, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &s3Dir{fsys: s, name: name, info: info}, nil
+	}
+	return &s3File{fsys: s, key: s.key(name), info: info}, nil
+}
+
+func (s *s3FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return s3Info{name: path.Base(strings.TrimSuffix(s.prefix, "/")), dir: true}, nil
+	}
+	resp, err := s.do(http.MethodHead, s.key(name), nil, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+		return s.objectInfo(name, resp), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	// Folders only exist as the common prefix of the keys inside them.
+	page, err := s.list(s.key(name)+"/", "", 1)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if len(page.Contents) == 0 && len(page.CommonPrefixes) == 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return s3Info{name: path.Base(name), dir: true}, nil
+}
+
+func (s *s3FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	dir := s.key(name)
+	if name != "." {
+		dir += "/"
+	}
+	var entries []fs.DirEntry
+	token := ""
+	for {
+		page, err := s.list(dir, token, 1000)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+		for _, p := range page.CommonPrefixes {
+			if n := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, dir), "/"); fs.ValidPath(n) && !strings.Contains(n, "/") {
+				entries = append(entries, fs.FileInfoToDirEntry(s3Info{name: n, dir: true}))
+			}
+		}
+		for _, o := range page.Contents {
+			n := strings.TrimPrefix(o.Key, dir)
+			if n == "" || !fs.ValidPath(n) || strings.Contains(n, "/") {
+				continue // The folder's own placeholder object, or a key no path can name
+			}
+			modTime, _ := time.Parse(time.RFC3339, o.LastModified)
+			entries = append(entries, fs.FileInfoToDirEntry(s3Info{name: n, size: o.Size, modTime: modTime}))
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	if len(entries) == 0 && name != "." {
+		if _, err := s.Stat(name); err != nil {
+			return nil, err
+		}
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+// Create uploads r, size bytes long, as the object name. S3 needs to know
+// the size up front, so when it's -1 r is saved to a temporary file first.
+func (s *s3FS) Create(name string, r io.Reader, size int64) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	if size < 0 {
+		tmp, err := os.CreateTemp("", "lanshare-upload-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if size, err = io.Copy(tmp, r); err != nil {
+			return err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		r = tmp
+	}
+	resp, err := s.do(http.MethodPut, s.key(name), nil, http.Header{"Content-Length": {strconv.FormatInt(size, 10)}}, r)
+	if err != nil {
+		return &fs.PathError{Op: "create", Path: name, Err: err}
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// RemoveAll deletes the object name, or every object under it if it's a
+// folder, one request each.
+func (s *s3FS) RemoveAll(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	if err := s.remove(s.key(name)); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return s.eachKey(s.key(name)+"/", s.remove)
+}
+
+// Rename copies the object oldname, or every object under it if it's a
+// folder, to newname and deletes the original, as S3 can't rename.
+func (s *s3FS) Rename(oldname, newname string) error {
+	if !fs.ValidPath(oldname) || !fs.ValidPath(newname) || oldname == "." || newname == "." {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrInvalid}
+	}
+	info, err := s.Stat(oldname)
+	if err != nil {
+		return err
+	}
+	move := func(key string) error {
+		if err := s.copy(key, s.key(newname)+strings.TrimPrefix(key, s.key(oldname))); err != nil {
+			return err
+		}
+		return s.remove(key)
+	}
+	if !info.IsDir() {
+		err = move(s.key(oldname))
+	} else {
+		err = s.eachKey(s.key(oldname)+"/", move)
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+// Copy has S3 copy the object oldname to newname.
+func (s *s3FS) Copy(oldname, newname string) error {
+	if !fs.ValidPath(oldname) || !fs.ValidPath(newname) || oldname == "." || newname == "." {
+		return &os.LinkError{Op: "copy", Old: oldname, New: newname, Err: fs.ErrInvalid}
+	}
+	if err := s.copy(s.key(oldname), s.key(newname)); err != nil {
+		return &os.LinkError{Op: "copy", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+// Mkdir uploads an empty "name/" object, as S3 has no folders of its own;
+// it keeps the folder around while nothing else is in it.
+func (s *s3FS) Mkdir(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+	resp, err := s.do(http.MethodPut, s.key(name)+"/", nil, http.Header{"Content-Length": {"0"}}, nil)
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// eachKey calls fn for every key under prefix, however deep.
+func (s *s3FS) eachKey(prefix string, fn func(key string) error) error {
+	token := ""
+	for {
+		page, err := s.list(prefix, token, 1000)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			if err := fn(obj.Key); err != nil {
+				return err
+			}
+		}
+		for _, p := range page.CommonPrefixes {
+			if err := s.eachKey(p.Prefix, fn); err != nil {
+				return err
+			}
+		}
+		if !page.IsTruncated {
+			return nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *s3FS) copy(from, to string) error {
+	source := s3Escape("/"+s.bucket+"/"+from, false)
+	resp, err := s.do(http.MethodPut, to, nil, http.Header{"X-Amz-Copy-Source": {source}}, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3FS) remove(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3FS) objectInfo(name string, resp *http.Response) s3Info {
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	return s3Info{name: path.Base(name), size: size, modTime: modTime}
+}
+
+type s3ListPage struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		LastModified string
+		Size         int64
+	}
+	CommonPrefixes []struct{ Prefix string }
+}
+
+// list fetches one page of the keys directly under prefix.
+func (s *s3FS) list(prefix, token string, max int) (*s3ListPage, error) {
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+		"delimiter": {"/"},
+		"max-keys":  {strconv.Itoa(max)},
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	resp, err := s.do(http.MethodGet, "", query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var page s3ListPage
+	if err := xml.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("reading bucket listing: %w", err)
+	}
+	return &page, nil
+}
+
+// do sends a signed request for key, or for the bucket itself if key is
+// empty. Responses other than 2xx are turned into errors, with 404 as
+// fs.ErrNotExist and 403 as fs.ErrPermission.
+func (s *s3FS) do(method, key string, query url.Values, header http.Header, body io.Reader) (*http.Response, error) {
+	u := *s.endpoint
+	p := "/" + key
+	if s.virtual {
+		u.Host = s.bucket + "." + u.Host
+	} else {
+		p = "/" + s.bucket + p
+	}
+	u.Path = path.Join(u.Path, p)
+	if strings.HasSuffix(p, "/") && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if n := req.Header.Get("Content-Length"); n != "" {
+		req.ContentLength, _ = strconv.ParseInt(n, 10, 64)
+		req.Header.Del("Content-Length")
+	}
+	s.sign(req, time.Now())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var s3err struct{ Code, Message string }
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&s3err)
+	reason := resp.Status
+	if s3err.Code != "" {
+		reason = s3err.Code + ": " + s3err.Message
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, fs.ErrNotExist
+	case http.StatusForbidden:
+		return nil, fmt.Errorf("%w: %s", fs.ErrPermission, reason)
+	}
+	return nil, fmt.Errorf("S3 %s: %s", method, reason)
+}
+
+// sign adds an AWS Signature Version 4 to req.
+func (s *s3FS) sign(req *http.Request, now time.Time) {
+	if s.accessKey == "" {
+		return
+	}
+	payload := "UNSIGNED-PAYLOAD"
+	if req.Body == nil || req.Body == http.NoBody {
+		payload = hex.EncodeToString(sha256.New().Sum(nil))
+	}
+	stamp := now.UTC().Format("20060102T150405Z")
+	day := stamp[:8]
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	names := []string{"host"}
+	canonical := "host:" + req.URL.Host + "\n"
+	var amz []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			amz = append(amz, lower)
+		}
+	}
+	slices.Sort(amz)
+	for _, name := range amz {
+		names = append(names, name)
+		canonical += name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n"
+	}
+	signed := strings.Join(names, ";")
+
+	request := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonical,
+		signed,
+		payload,
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(request))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{day, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and
+// slashes unless query is set, as SigV4 expects.
+func s3Escape(s string, query bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !query) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes query sorted by name, the canonical form SigV4 signs.
+func s3Query(query url.Values) string {
+	var parts []string
+	for name, values := range query {
+		for _, v := range values {
+			parts = append(parts, s3Escape(name, true)+"="+s3Escape(v, true))
+		}
+	}
+	slices.Sort(parts)
+	return strings.Join(parts, "&")
+}
+
+// s3File streams an object. The GET starts at the first read, from wherever
+// the file was seeked to, so http.ServeContent's range requests turn into
+// range requests to the bucket.
+type s3File struct {
+	fsys *s3FS
+	key  string
+	info fs.FileInfo
+	pos  int64
+	body io.ReadCloser
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.pos >= f.info.Size() {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		header := http.Header{}
+		if f.pos > 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", f.pos))
+		}
+		resp, err := f.fsys.do(http.MethodGet, f.key, nil, header, nil)
+		if err != nil {
+			return 0, err
+		}
+		f.body = resp.Body
+	}
+	n, err := f.body.Read(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.info.Size()
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of file")
+	}
+	if offset != f.pos && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+// s3Dir is an open folder in a bucket, listed on the first ReadDir.
+type s3Dir struct {
+	fsys    *s3FS
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *s3Dir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *s3Dir) Close() error               { return nil }
+
+func (d *s3Dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *s3Dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+type s3Info struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i s3Info) Name() string       { return i.name }
+func (i s3Info) Size() int64        { return i.size }
+func (i s3Info) ModTime() time.Time { return i.modTime }
+func (i s3Info) IsDir() bool        { return i.dir }
+func (i s3Info) Sys() any           { return nil }
+
+func (i s3Info) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
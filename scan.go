@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scanAction is what happens to an upload the scan rejects.
+type scanAction string
+
+const (
+	scanQuarantine scanAction = "quarantine" // Kept in --quarantine-dir for a look
+	scanDelete     scanAction = "delete"
+)
+
+var (
+	scanCommand   string // Run on each upload, with {} replaced by its path
+	scanSocket    string // clamd's socket, or its host:port
+	onScanFailure = scanQuarantine
+	quarantineDir string
+)
+
+func (a *scanAction) String() string { return string(*a) }
+
+func (a *scanAction) Set(value string) error {
+	switch scanAction(value) {
+	case scanQuarantine, scanDelete:
+		*a = scanAction(value)
+		return nil
+	}
+	return fmt.Errorf("expected quarantine or delete, got %q", value)
+}
+
+// scanRejectedError is returned for an upload that failed the scan, or
+// couldn't be scanned, and so wasn't saved.
+type scanRejectedError struct{ message string }
+
+func (e *scanRejectedError) Error() string { return e.message }
+
+func scanEnabled() bool {
+	return scanCommand != "" || scanSocket != ""
+}
+
+// scanFile checks the file at name, returning what was found in it, or ""
+// if it's clean.
+func scanFile(name string) (string, error) {
+	if scanSocket != "" {
+		return clamdScan(name)
+	}
+	return commandScan(name)
+}
+
+// commandScan runs --scan-command, which like clamscan and clamdscan exits
+// with 1 when it finds something and 0 when it doesn't.
+func commandScan(name string) (string, error) {
+	args := strings.Fields(scanCommand)
+	if !strings.Contains(scanCommand, "{}") {
+		args = append(args, name)
+	}
+	for i := range args {
+		args[i] = strings.ReplaceAll(args[i], "{}", name)
+	}
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 1 {
+		report := "infected"
+		if lines := strings.Split(strings.TrimSpace(string(out)), "\n"); lines[0] != "" {
+			report = strings.TrimPrefix(strings.TrimSpace(lines[0]), name+": ")
+			report = strings.TrimSuffix(report, " FOUND")
+		}
+		return report, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return "", nil
+}
+
+// clamdScan streams the file to clamd with its INSTREAM command, so clamd
+// needn't be able to read it itself.
+func clamdScan(name string) (string, error) {
+	network := "tcp"
+	if strings.ContainsRune(scanSocket, '/') || strings.ContainsRune(scanSocket, '\\') {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, scanSocket, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Minute))
+
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+	// Chunks with a 4-byte big-endian length, ending with an empty one.
+	buf := make([]byte, 4+64<<10)
+	for {
+		n, err := f.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return "", err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if _, err := conn.Write(make([]byte, 4)); err != nil {
+		return "", err
+	}
+
+	// With the z prefix, the reply ends with a NUL too.
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", err
+	}
+	result := strings.TrimSpace(strings.TrimSuffix(reply, "\x00"))
+	result = strings.TrimPrefix(result, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", result)
+}
+
+// scanUpload scans f, a temporary file holding the upload that's to be
+// saved as sharePath, and quarantines or deletes it if it doesn't pass.
+// Files that can't be scanned are always quarantined rather than passed.
+func scanUpload(t *transfer, f *os.File, sharePath string) error {
+	t.setPhase("scanning", 0)
+	report, err := scanFile(f.Name())
+	switch {
+	case err != nil:
+		log.Printf("Error scanning upload %s: %v", sharePath, err)
+		rejectUpload(f, sharePath, scanQuarantine)
+		return &scanRejectedError{path.Base(sharePath) + " couldn't be checked for viruses, so it wasn't saved"}
+	case report != "":
+		log.Printf("Scan rejected upload %s from %s: %s", sharePath, t.Client, report)
+		rejectUpload(f, sharePath, onScanFailure)
+		return &scanRejectedError{fmt.Sprintf("%s was rejected by the virus scan: %s", path.Base(sharePath), report)}
+	}
+	return nil
+}
+
+// rejectUpload moves a rejected upload to the quarantine folder, or just
+// removes it.
+func rejectUpload(f *os.File, sharePath string, action scanAction) {
+	if action == scanDelete {
+		os.Remove(f.Name())
+		return
+	}
+	dest := filepath.Join(quarantineDir, time.Now().Format("20060102-150405-")+path.Base(sharePath))
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(dest); os.IsNotExist(err) {
+			break
+		}
+		dest = filepath.Join(quarantineDir, time.Now().Format("20060102-150405-")+strconv.Itoa(i)+"-"+path.Base(sharePath))
+	}
+	err := os.MkdirAll(quarantineDir, 0o700)
+	if err == nil {
+		err = os.Rename(f.Name(), dest)
+		if err != nil {
+			// Another disk, or an open file on Windows.
+			err = copyToFile(f, dest)
+		}
+	}
+	if err != nil {
+		log.Printf("Error quarantining %s, deleting it instead: %v", sharePath, err)
+	} else {
+		log.Printf("Quarantined %s as %s", sharePath, dest)
+	}
+	os.Remove(f.Name())
+}
+
+func copyToFile(f *os.File, name string) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, f)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+	return err
+}
+
+// receiveScanned saves an upload to a temporary file first, where it's
+// scanned before it's put in the share, so nobody can download it unchecked.
+func receiveScanned(t *transfer, fsys writableFS, fsPath, sharePath string, src io.Reader) error {
+	tmp, err := os.CreateTemp("", "lanshare-scan-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, src)
+	if err != nil {
+		return err
+	}
+	if err := scanUpload(t, tmp, sharePath); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	t.setPhase("saving", size)
+	return fsys.Create(fsPath, t.phaseReader(tmp), size)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	indexMaxAge      = 15 * time.Second // How stale the file list searches use may get
+	maxSearchResults = 200
+)
+
+// fileListBuilt is when fileList was last read from the share; mu guards
+// both.
+var fileListBuilt time.Time
+
+// indexedFiles returns the files in the share, from memory unless the list
+// is more than indexMaxAge old, or something was uploaded, moved or
+// deleted since.
+func indexedFiles() ([]string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if time.Since(fileListBuilt) < indexMaxAge {
+		return fileList, nil
+	}
+	files, err := listFiles("")
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range files {
+		files[i] = filepath.ToSlash(f)
+	}
+	fileList, fileListBuilt = files, time.Now()
+	return fileList, nil
+}
+
+// shareChanged makes the next search read the share again and folder sizes
+// be added up again, and with --index-contents has the files that changed
+// indexed.
+func shareChanged() {
+	mu.Lock()
+	fileListBuilt = time.Time{}
+	mu.Unlock()
+	dirSizes.changed()
+	dlnaUpdateID.Add(1)
+	if indexContents {
+		contents.changed()
+	}
+}
+
+// searchResult is a file matching a search, with the matched letters of
+// its name marked.
+type searchResult struct {
+	Name  string
+	Parts []matchPart
+	Type  string
+	score int
+}
+
+type matchPart struct {
+	Text  string
+	Match bool
+}
+
+// contentResult is a file with the words searched for inside it.
+type contentResult struct {
+	Name    string
+	Type    string
+	Snippet []matchPart
+}
+
+// maxSnippets is how many content results show the text they matched,
+// which means reading them again.
+const maxSnippets = 50
+
+// searchGroup is the results in one folder.
+type searchGroup struct {
+	Folder  string
+	Results []searchResult
+}
+
+// matchName scores how well query, already lowercased, matches the file
+// name, and returns which runes of its base name matched. Whole words and
+// the start of the name count for most, then the query anywhere in the
+// name or its folder, then its letters in order with others between
+// ("hlday" finds "holiday"), which counts for less the more spread out
+// they are. 0 is no match.
+func matchName(name string, query []rune) (int, []bool) {
+	lower, full := lowerRunes(path.Base(name)), lowerRunes(name)
+	marks := make([]bool, len(lower))
+	if i := runeIndex(lower, query); i >= 0 {
+		for j := range query {
+			marks[i+j] = true
+		}
+		score := 700 - min(i, 100)
+		switch {
+		case len(query) == len(lower):
+			score = 1000
+		case i == 0:
+			score = 900
+		case !unicode.IsLetter(lower[i-1]) && !unicode.IsDigit(lower[i-1]):
+			score = 800
+		}
+		return score, marks
+	}
+	if runeIndex(full, query) >= 0 {
+		return 500, marks // In the folder's name
+	}
+	if gaps, ok := subsequence(lower, query, marks); ok {
+		return max(200, 400-gaps*10), marks
+	}
+	clear(marks)
+	if gaps, ok := subsequence(full, query, nil); ok {
+		return max(10, 150-gaps*5), marks
+	}
+	return 0, nil
+}
+
+// lowerRunes lowercases s rune by rune, so the result lines up with it.
+func lowerRunes(s string) []rune {
+	runes := []rune(s)
+	for i, r := range runes {
+		runes[i] = unicode.ToLower(r)
+	}
+	return runes
+}
+
+func runeIndex(s, sub []rune) int {
+	for i := 0; i+len(sub) <= len(s); i++ {
+		if slices.Equal(s[i:i+len(sub)], sub) {
+			return i
+		}
+	}
+	return -1
+}
+
+// subsequence reports whether the runes of query appear in s in order,
+// marking them in marks, if it isn't nil, and how many runes lie between
+// the first and last of them that aren't part of the query.
+func subsequence(s, query []rune, marks []bool) (int, bool) {
+	j, first := 0, -1
+	for i, r := range s {
+		if j < len(query) && r == query[j] {
+			if first < 0 {
+				first = i
+			}
+			if marks != nil {
+				marks[i] = true
+			}
+			j++
+			if j == len(query) {
+				return i - first + 1 - len(query), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// highlightParts splits name into runs of matched and unmatched runes.
+func highlightParts(name string, marks []bool) []matchPart {
+	var parts []matchPart
+	for i, r := range []rune(name) {
+		m := i < len(marks) && marks[i]
+		if len(parts) > 0 && parts[len(parts)-1].Match == m {
+			parts[len(parts)-1].Text += string(r)
+		} else {
+			parts = append(parts, matchPart{string(r), m})
+		}
+	}
+	return parts
+}
+
+// searchFiles finds the best matches for query among files, grouped by
+// folder, the folder with the best match first. It also reports whether
+// there were more than it returns.
+func searchFiles(files []string, query string) ([]searchGroup, bool) {
+	q := lowerRunes(strings.Join(strings.Fields(query), " "))
+	if len(q) == 0 {
+		return nil, false
+	}
+	var results []searchResult
+	for _, name := range files {
+		if strings.HasSuffix(name, "/") {
+			continue // A folder past --max-depth
+		}
+		score, marks := matchName(name, q)
+		if score == 0 {
+			continue
+		}
+		results = append(results, searchResult{
+			Name:  name,
+			Parts: highlightParts(path.Base(name), marks),
+			Type:  sharedFileType(name),
+			score: score,
+		})
+	}
+	slices.SortStableFunc(results, func(a, b searchResult) int { return cmp.Compare(b.score, a.score) })
+	more := len(results) > maxSearchResults
+	results = results[:min(len(results), maxSearchResults)]
+
+	var groups []searchGroup
+	at := make(map[string]int)
+	for _, res := range results {
+		dir := folderOf(res.Name)
+		i, ok := at[dir]
+		if !ok {
+			i = len(groups)
+			at[dir] = i
+			groups = append(groups, searchGroup{Folder: dir})
+		}
+		groups[i].Results = append(groups[i].Results, res)
+	}
+	return groups, more
+}
+
+// searchHandler finds files by name anywhere in the share at /search?q=,
+// and with --index-contents and &content=1, by what's in them.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	inContents := indexContents && r.URL.Query().Get("content") == "1"
+	files, err := indexedFiles()
+	if err != nil {
+		http.Error(w, "Error listing files", http.StatusInternalServerError)
+		return
+	}
+	groups, more := searchFiles(files, query)
+	count := 0
+	for _, g := range groups {
+		count += len(g.Results)
+	}
+	data := struct {
+		Query      string
+		Groups     []searchGroup
+		Count      int
+		More       bool
+		Contents   bool // Searching inside documents can be picked
+		InContents bool
+		Found      []contentResult
+		Indexing   string // How far the index has got, if it's busy
+		Lang       string
+		Languages  []language
+	}{Query: query, Groups: groups, Count: count, More: more, Contents: indexContents, InContents: inContents, Lang: pageLanguage(w, r), Languages: languages}
+	if inContents {
+		words := searchWords(query)
+		for i, name := range contents.search(query) {
+			res := contentResult{Name: name, Type: sharedFileType(name)}
+			if i < maxSnippets {
+				res.Snippet = snippet(name, words)
+			}
+			data.Found = append(data.Found, res)
+		}
+		if done, todo := contents.progress(); todo > 0 {
+			data.Indexing = fmt.Sprintf("%d/%d", done, todo)
+		}
+	}
+	tmpl := searchTemplate.withFuncs(template.FuncMap{"t": translator(data.Lang)})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	}
+}
+
+var searchTemplate = newPage("search", template.FuncMap{
+	"escapePath": escapePath,
+	"fileIcon":   typeIcon,
+	"t":          translator("en"),
+})
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// sendFile is the file shared by lanshare send, "" when sharing folders.
+var sendFile string
+
+// sendMount shares the single file name, keeping the rest of its folder
+// out of reach.
+func sendMount(name string) (*mount, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a file", name)
+	}
+	dir, err := diskFS(filepath.Dir(abs))
+	if err != nil {
+		return nil, err
+	}
+	sendFile = filepath.Base(abs)
+	return &mount{Dir: abs, ReadOnly: true, fsys: fileFS{dir, sendFile}}, nil
+}
+
+// fileFS is a folder in which only the file name can be seen.
+type fileFS struct {
+	dir  fs.FS
+	name string
+}
+
+func (f fileFS) check(op, name string) error {
+	if name != "." && name != f.name {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+func (f fileFS) Open(name string) (fs.File, error) {
+	if err := f.check("open", name); err != nil {
+		return nil, err
+	}
+	file, err := f.dir.Open(name)
+	if err != nil || name != "." {
+		return file, err
+	}
+	return &fileFSDir{File: file, fsys: f}, nil
+}
+
+func (f fileFS) Stat(name string) (fs.FileInfo, error) {
+	if err := f.check("stat", name); err != nil {
+		return nil, err
+	}
+	return fs.Stat(f.dir, name)
+}
+
+func (f fileFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	info, err := fs.Stat(f.dir, f.name)
+	if err != nil {
+		return nil, err
+	}
+	return []fs.DirEntry{fs.FileInfoToDirEntry(info)}, nil
+}
+
+// fileFSDir is the open top folder of a fileFS.
+type fileFSDir struct {
+	fs.File
+	fsys fileFS
+	read bool
+}
+
+func (d *fileFSDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.read {
+		if n > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	d.read = true
+	return d.fsys.ReadDir(".")
+}
+
+// sendPageHandler shows the one file being sent as a download card.
+func sendPageHandler(w http.ResponseWriter, r *http.Request) {
+	info, err := statShared(sendFile)
+	if err != nil {
+		http.Error(w, "The file is no longer available", http.StatusGone)
+		return
+	}
+	_, locked := lockedBy(r, sendFile)
+	data := struct {
+		Name      string
+		Size      string
+		Locked    bool
+		Left      int64 // Downloads left before the server stops, 0 if unlimited
+		ExpiresAt time.Time
+	}{
+		Name:      sendFile,
+		Size:      humanSize(info.Size()),
+		Locked:    locked,
+		ExpiresAt: expiresAt,
+	}
+	if stdinSpool != nil && stdinSpool.growing() {
+		data.Size += " so far, still arriving"
+	}
+	if downloadLimit > 0 {
+		data.Left = max(downloadLimit-completedDownloads.Load(), 0)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := sendTemplate.Execute(w, data); err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	}
+}
+
+// siSizes shows sizes in powers of 1000 rather than 1024, --si.
+var siSizes bool
+
+// humanSize formats a number of bytes for people, e.g. 1.5 MiB, or with
+// --si 1.6 MB.
+func humanSize(n int64) string {
+	base, suffix := 1024.0, "iB"
+	if siSizes {
+		base, suffix = 1000, "B"
+	}
+	if float64(n) < base {
+		return fmt.Sprintf("%d B", n)
+	}
+	size, unit := float64(n)/base, 0
+	for size >= base && unit < 5 {
+		size, unit = size/base, unit+1
+	}
+	return fmt.Sprintf("%.1f %c%s", size, "KMGTPE"[unit], suffix)
+}
+
+var sendTemplate = newPage("send", template.FuncMap{
+	"escapePath": escapePath,
+	"until": func(t time.Time) string {
+		return time.Until(t).Round(time.Second).String()
+	},
+})
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/fs"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shareIgnoreFile in the share root lists files and folders to keep out of
+// the share, in .gitignore syntax: globs with *, ? and [...], ** for any
+// number of folders, a trailing / for folders only, a leading or inner / to
+// anchor the pattern to the root, and ! to bring back something an earlier
+// pattern excluded.
+const shareIgnoreFile = ".shareignore"
+
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreList holds the parsed .shareignore of a mount, reloaded when the
+// file changes.
+type ignoreList struct {
+	mu      sync.Mutex
+	modTime time.Time
+	rules   []ignoreRule
+}
+
+func (l *ignoreList) current(fsys fs.FS) []ignoreRule {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	info, err := fs.Stat(fsys, shareIgnoreFile)
+	if err != nil {
+		l.rules, l.modTime = nil, time.Time{}
+		return nil
+	}
+	if info.ModTime().Equal(l.modTime) {
+		return l.rules
+	}
+	data, err := fs.ReadFile(fsys, shareIgnoreFile)
+	if err != nil {
+		log.Println("Error reading .shareignore:", err)
+		return l.rules
+	}
+	l.rules, l.modTime = parseIgnore(data), info.ModTime()
+	return l.rules
+}
+
+func parseIgnore(data []byte) []ignoreRule {
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate, line = true, line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:] // \# and \! stand for a literal # or !
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly, line = true, strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		re, err := compileGlob(line)
+		if err != nil {
+			log.Printf("Ignoring bad .shareignore pattern %q: %v", scanner.Text(), err)
+			continue
+		}
+		rule.re = re
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// compileGlob compiles a gitignore-style pattern matched against clean share
+// paths. Patterns with a slash are anchored to the share root, others match
+// a name in any folder.
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	anchored := strings.Contains(pattern, "/")
+	expr := globToRegexp(strings.TrimPrefix(pattern, "/"))
+	if !anchored {
+		expr = "(?:.*/)?" + expr
+	}
+	return regexp.Compile("^" + expr + "$")
+}
+
+// globToRegexp translates a gitignore glob.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			b.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// ignored reports whether the .shareignore of its shared folder excludes
+// the clean share path p. As with git, nothing inside an excluded folder can
+// be brought back.
+func ignored(p string, isDir bool) bool {
+	m, rel, ok := resolve(p)
+	if !ok || rel == "" {
+		return false
+	}
+	if rel == shareIgnoreFile {
+		return true
+	}
+	rules := m.ignore.current(m.fsys)
+	if len(rules) == 0 {
+		return false
+	}
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		prefix := strings.Join(parts[:i+1], "/")
+		if matchIgnore(rules, prefix, isDir || i < len(parts)-1) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchIgnore(rules []ignoreRule, p string, isDir bool) bool {
+	excluded := false
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(p) {
+			excluded = !rule.negate
+		}
+	}
+	return excluded
+}
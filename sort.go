@@ -0,0 +1,104 @@
+package main
+
+import (
+	"cmp"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// sortFields are what the file list can be sorted by, with ?sort=.
+var sortFields = []struct{ Field, Label string }{
+	{"name", "name"},
+	{"size", "size"},
+	{"modified", "modified"},
+	{"type", "type"},
+	{"taken", "date taken"},
+}
+
+// listSort is how the file list is sorted, from ?sort= and ?order=.
+type listSort struct {
+	Field string
+	Desc  bool
+}
+
+func parseSort(q url.Values) listSort {
+	s := listSort{Field: "name", Desc: q.Get("order") == "desc"}
+	for _, f := range sortFields {
+		if q.Get("sort") == f.Field {
+			s.Field = f.Field
+		}
+	}
+	return s
+}
+
+// url returns the link to page sorted this way, with the other parameters
+// in extra.
+func (s listSort) url(page string, extra url.Values) string {
+	q := url.Values{}
+	for k, v := range extra {
+		q[k] = v
+	}
+	if s.Field != "name" {
+		q.Set("sort", s.Field)
+	}
+	if s.Desc {
+		q.Set("order", "desc")
+	}
+	if len(q) == 0 {
+		return page
+	}
+	return page + "?" + q.Encode()
+}
+
+// sortEntries sorts files in place. By name, which is how they're listed,
+// files stay next to the rest of their folder; by size, modification time
+// or type, they're sorted across the whole share, and by date taken, only
+// the photos in each folder are reordered among themselves. Ties keep the
+// files in order of name.
+func sortEntries(files []fileEntry, s listSort) {
+	order := func(c int) int {
+		if s.Desc {
+			return -c
+		}
+		return c
+	}
+	switch s.Field {
+	case "name":
+		if s.Desc {
+			slices.Reverse(files)
+		}
+	case "size":
+		slices.SortStableFunc(files, func(a, b fileEntry) int { return order(cmp.Compare(a.Size, b.Size)) })
+	case "modified":
+		slices.SortStableFunc(files, func(a, b fileEntry) int { return order(a.Modified.Compare(b.Modified)) })
+	case "type":
+		slices.SortStableFunc(files, func(a, b fileEntry) int {
+			return order(strings.Compare(mediaType(a.Type), mediaType(b.Type)))
+		})
+	case "taken":
+		sortByTaken(files, s.Desc)
+	}
+}
+
+// sortLinks are the links above a list of files on page that sort it,
+// keeping the other parameters in extra: picking the field it's already
+// sorted by turns the order around.
+func sortLinks(page string, s listSort, extra url.Values) []sortLink {
+	links := make([]sortLink, len(sortFields))
+	for i, f := range sortFields {
+		next := listSort{Field: f.Field}
+		if f.Field == s.Field {
+			next.Desc = !s.Desc
+		}
+		links[i] = sortLink{Label: f.Label, URL: next.url(page, extra), Current: f.Field == s.Field, Desc: s.Desc}
+	}
+	return links
+}
+
+type sortLink struct {
+	Label   string
+	URL     string
+	Current bool
+	Desc    bool // The current order, for the arrow by it
+}
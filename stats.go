@@ -0,0 +1,36 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// fileStats holds download statistics for a single file.
+type fileStats struct {
+	Downloads    int
+	LastDownload time.Time
+}
+
+// statsStore counts completed downloads per file.
+type statsStore struct {
+	mu    sync.Mutex
+	files map[string]fileStats
+}
+
+var downloadStats = &statsStore{files: make(map[string]fileStats)}
+
+// record counts a completed download of name.
+func (s *statsStore) record(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.files[name]
+	stats.Downloads++
+	stats.LastDownload = time.Now()
+	s.files[name] = stats
+}
+
+func (s *statsStore) get(name string) fileStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.files[name]
+}
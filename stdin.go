@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stdinSpool holds what's piped to lanshare send -, nil otherwise.
+var stdinSpool *spool
+
+// spool saves a stream, such as lanshare send's stdin, to a temporary file
+// that any number of downloads can read while it's still being written.
+// Downloads that catch up wait for more to arrive.
+type spool struct {
+	name    string // Shared as
+	file    *os.File
+	path    string // Still to remove, where open files can't be
+	started time.Time
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	size int64 // Bytes written so far
+	done bool  // The stream has ended
+	err  error // Why it ended early
+}
+
+func newSpool(r io.Reader, name string) (*spool, error) {
+	f, err := os.CreateTemp("", "lanshare-stdin-*")
+	if err != nil {
+		return nil, err
+	}
+	s := &spool{name: name, file: f, started: time.Now()}
+	s.cond = sync.NewCond(&s.mu)
+	// Gone as soon as the process exits, however it does, except on Windows.
+	if err := os.Remove(f.Name()); err != nil {
+		s.path = f.Name()
+	}
+	go s.fill(r)
+	return s, nil
+}
+
+func (s *spool) fill(r io.Reader) {
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := s.file.Write(buf[:n]); werr != nil {
+				err = werr
+			}
+		}
+		s.mu.Lock()
+		s.size += int64(n)
+		if err != nil {
+			s.done = true
+			if err != io.EOF {
+				s.err = err
+				log.Println("Error reading stdin:", err)
+			} else {
+				fmt.Printf("Finished reading stdin, %s\n", humanSize(s.size))
+			}
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// growing reports whether the stream is still being written.
+func (s *spool) growing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.done
+}
+
+// remove cleans up the temporary file, where it couldn't be done right away.
+func (s *spool) remove() {
+	if s.path != "" {
+		s.file.Close()
+		os.Remove(s.path)
+	}
+}
+
+func (s *spool) info() spoolInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return spoolInfo{s.name, s.size, s.started}
+}
+
+// stdinMount shares what's piped to r as a single file called name.
+func stdinMount(r io.Reader, name string) (*mount, error) {
+	if !fs.ValidPath(name) || name == "." || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("invalid file name %q", name)
+	}
+	s, err := newSpool(r, name)
+	if err != nil {
+		return nil, err
+	}
+	stdinSpool, sendFile = s, name
+	return &mount{Dir: "standard input", ReadOnly: true, fsys: spoolFS{s}}, nil
+}
+
+// spoolFS is a folder holding just a spool.
+type spoolFS struct{ s *spool }
+
+func (f spoolFS) Open(name string) (fs.File, error) {
+	switch name {
+	case ".":
+		return &spoolDir{fsys: f}, nil
+	case f.s.name:
+		return &spoolReader{s: f.s}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (f spoolFS) Stat(name string) (fs.FileInfo, error) {
+	switch name {
+	case ".":
+		return rootInfo{}, nil
+	case f.s.name:
+		return f.s.info(), nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (f spoolFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return []fs.DirEntry{fs.FileInfoToDirEntry(f.s.info())}, nil
+}
+
+// spoolReader is a download of a spool.
+type spoolReader struct {
+	s   *spool
+	pos int64
+}
+
+func (r *spoolReader) Stat() (fs.FileInfo, error) { return r.s.info(), nil }
+func (r *spoolReader) Close() error               { return nil }
+
+func (r *spoolReader) growing() bool { return r.s.growing() }
+
+func (r *spoolReader) Read(p []byte) (int, error) {
+	s := r.s
+	s.mu.Lock()
+	for r.pos >= s.size && !s.done {
+		s.cond.Wait()
+	}
+	size, err := s.size, s.err
+	s.mu.Unlock()
+
+	if r.pos >= size {
+		if err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > size-r.pos {
+		p = p[:size-r.pos]
+	}
+	n, err := s.file.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *spoolReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		if r.growing() {
+			return 0, errors.New("size not known until stdin is closed")
+		}
+		offset += r.s.info().size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of file")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// spoolDir is the open top folder of a spoolFS.
+type spoolDir struct {
+	fsys spoolFS
+	read bool
+}
+
+func (d *spoolDir) Stat() (fs.FileInfo, error) { return rootInfo{}, nil }
+func (d *spoolDir) Close() error               { return nil }
+
+func (d *spoolDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: ".", Err: errors.New("is a directory")}
+}
+
+func (d *spoolDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.read {
+		if n > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	d.read = true
+	return d.fsys.ReadDir(".")
+}
+
+type spoolInfo struct {
+	name    string
+	size    int64
+	started time.Time
+}
+
+func (i spoolInfo) Name() string       { return i.name }
+func (i spoolInfo) Size() int64        { return i.size }
+func (i spoolInfo) Mode() fs.FileMode  { return 0o444 }
+func (i spoolInfo) ModTime() time.Time { return i.started }
+func (i spoolInfo) IsDir() bool        { return false }
+func (i spoolInfo) Sys() any           { return nil }
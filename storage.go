@@ -0,0 +1,417 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Each mount reads its files from an fs.FS, so the HTTP handlers don't care
+// whether they live in a folder on disk, inside an archive or somewhere
+// else. Backends should implement fs.StatFS and fs.ReadDirFS, and
+// fs.ReadLinkFS if they have symlinks; files should implement io.Seeker for
+// downloads to support ranges and resuming.
+
+// writableFS is implemented by backends that can take uploads.
+type writableFS interface {
+	fs.FS
+	// Create stores r, size bytes long or -1 if unknown, as the file name,
+	// replacing any file already there. Nothing shows up at name until all
+	// of r has been stored.
+	Create(name string, r io.Reader, size int64) error
+}
+
+// removableFS is implemented by backends files can be deleted from.
+type removableFS interface {
+	fs.FS
+	// RemoveAll deletes the file or folder name, with everything in it.
+	RemoveAll(name string) error
+}
+
+// renameFS is implemented by backends files can be renamed and moved in.
+type renameFS interface {
+	fs.FS
+	// Rename moves the file or folder oldname to newname, which mustn't exist.
+	Rename(oldname, newname string) error
+}
+
+// copyFS is implemented by backends that can copy a file within themselves,
+// without the data going through lanshare.
+type copyFS interface {
+	fs.FS
+	// Copy makes newname, which mustn't exist, a copy of the file oldname.
+	Copy(oldname, newname string) error
+}
+
+// linkFS is implemented by backends that can hard link files.
+type linkFS interface {
+	fs.FS
+	// Link makes newname, which mustn't exist, another name for oldname.
+	Link(oldname, newname string) error
+}
+
+// mkdirFS is implemented by backends folders can be made in.
+type mkdirFS interface {
+	fs.FS
+	// Mkdir makes the empty folder name, in a folder that exists.
+	Mkdir(name string) error
+}
+
+// growingFile is implemented by files still being written, like stdin piped
+// to lanshare send, which are sent as they grow since their size isn't known.
+type growingFile interface {
+	fs.File
+	growing() bool
+}
+
+// diskFS returns the backend for a folder on disk.
+func diskFS(dir string) (fs.FS, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return rootFS{root.FS(), root}, nil
+}
+
+// rootFS is a folder on disk. It goes through os.Root, so ".." and symlinks
+// can't lead outside it.
+type rootFS struct {
+	fsys fs.FS // root.FS(), which implements all of fs's optional interfaces
+	root *os.Root
+}
+
+func (r rootFS) Open(name string) (fs.File, error)          { return r.fsys.Open(name) }
+func (r rootFS) Stat(name string) (fs.FileInfo, error)      { return fs.Stat(r.fsys, name) }
+func (r rootFS) Lstat(name string) (fs.FileInfo, error)     { return fs.Lstat(r.fsys, name) }
+func (r rootFS) ReadLink(name string) (string, error)       { return fs.ReadLink(r.fsys, name) }
+func (r rootFS) ReadDir(name string) ([]fs.DirEntry, error) { return fs.ReadDir(r.fsys, name) }
+func (r rootFS) ReadFile(name string) ([]byte, error)       { return fs.ReadFile(r.fsys, name) }
+
+// Create writes to a hidden temporary file next to name, then renames it
+// into place.
+func (r rootFS) Create(name string, src io.Reader, size int64) error {
+	dir := path.Dir(name)
+	if err := r.root.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp := path.Join(dir, ".lanshare-upload-"+rand.Text())
+	f, err := r.root.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && size >= 0 && n != size {
+		err = fmt.Errorf("got %d of %d bytes", n, size)
+	}
+	if err == nil {
+		err = r.root.Rename(tmp, name)
+	}
+	if err != nil {
+		r.root.Remove(tmp)
+	}
+	return err
+}
+
+func (r rootFS) RemoveAll(name string) error          { return r.root.RemoveAll(name) }
+func (r rootFS) Rename(oldname, newname string) error { return r.root.Rename(oldname, newname) }
+func (r rootFS) Mkdir(name string) error              { return r.root.Mkdir(name, 0o755) }
+func (r rootFS) Link(oldname, newname string) error   { return r.root.Link(oldname, newname) }
+
+// Copy makes a hard link where it can, which takes no time or space, as
+// files are only ever replaced, never written to in place.
+func (r rootFS) Copy(oldname, newname string) error {
+	if err := r.root.Link(oldname, newname); err == nil {
+		return nil
+	}
+	f, err := r.root.Open(oldname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return r.Create(newname, f, -1)
+}
+
+// fsName turns a clean path inside a mount into an fs.FS name.
+func fsName(rel string) string {
+	if rel == "" {
+		return "."
+	}
+	return rel
+}
+
+// onDisk returns where rel, a clean path inside m, is on disk, for the
+// --follow-symlinks=always case that deliberately leaves the mount's root.
+func (m *mount) onDisk(rel string) (string, bool) {
+	if !m.folder || followSymlinks != symlinksAlways {
+		return "", false
+	}
+	return filepath.Join(m.Dir, filepath.FromSlash(rel)), true
+}
+
+// openShared opens the file or folder at the clean share path p, following
+// symlinks as --follow-symlinks allows and hiding what visible rules out.
+func openShared(p string) (fs.File, error) {
+	if _, err := statShared(p); err != nil {
+		return nil, err
+	}
+	m, rel, ok := resolve(p)
+	if !ok {
+		return nil, fs.ErrNotExist // The virtual root has no file to open
+	}
+	if name, ok := m.onDisk(rel); ok {
+		return os.Open(name)
+	}
+	return m.fsys.Open(fsName(rel))
+}
+
+// statShared returns information about the clean share path p under the
+// same rules as openShared.
+func statShared(p string) (fs.FileInfo, error) {
+	if p == "" && virtualRoot() {
+		return rootInfo{}, nil
+	}
+	m, rel, ok := resolve(p)
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	if rel == "" {
+		return fs.Stat(m.fsys, ".")
+	}
+	if followSymlinks == symlinksNever && hasSymlink(m, rel) {
+		return nil, fs.ErrNotExist
+	}
+	var info fs.FileInfo
+	var err error
+	if name, ok := m.onDisk(rel); ok {
+		info, err = os.Stat(name)
+	} else {
+		info, err = fs.Stat(m.fsys, rel)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !visible(p, info.IsDir()) {
+		return nil, fs.ErrNotExist
+	}
+	return info, nil
+}
+
+// readDirShared lists the folder at the clean share path p, unfiltered.
+func readDirShared(p string) ([]fs.DirEntry, error) {
+	if p == "" && virtualRoot() {
+		var entries []fs.DirEntry
+		for _, m := range mounts {
+			if info, err := fs.Stat(m.fsys, "."); err == nil {
+				entries = append(entries, fs.FileInfoToDirEntry(mountInfo{info, m.Name}))
+			}
+		}
+		return entries, nil
+	}
+	if _, err := statShared(p); err != nil {
+		return nil, err
+	}
+	m, rel, _ := resolve(p)
+	if name, ok := m.onDisk(rel); ok {
+		return os.ReadDir(name)
+	}
+	return fs.ReadDir(m.fsys, fsName(rel))
+}
+
+// mountInfo renames a mount's root folder to its alias.
+type mountInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (i mountInfo) Name() string { return i.name }
+
+// listFiles returns the files under the share folder dir, as paths relative
+// to dir. Folders at --max-depth are listed, with a trailing separator, but
+// not descended into. Symlinks are followed as openShared would, and
+// folders that can't be read or would loop back on themselves are skipped.
+func listFiles(dir string) ([]string, error) {
+	listed, err := listFileInfos(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, len(listed))
+	for i, f := range listed {
+		files[i] = f.name
+	}
+	return files, nil
+}
+
+// listedFile is a file found by listFileInfos, with what the folder listing
+// said about it; info is nil for folders at --max-depth.
+type listedFile struct {
+	name string
+	info fs.FileInfo
+}
+
+// listFileInfos is listFiles along with each file's size and modification
+// time, which come with the folder listings so cost nothing extra.
+func listFileInfos(dir string) ([]listedFile, error) {
+	dir, ok := safeSharePath(dir)
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	info, err := statShared(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New("not a folder")
+	}
+	var files []listedFile
+	walkShared(dir, "", []fs.FileInfo{info}, &files)
+	return files, nil
+}
+
+func walkShared(dir, rel string, parents []fs.FileInfo, files *[]listedFile) {
+	entries, err := readDirShared(dir)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		p := path.Join(dir, e.Name())
+		// statShared checks symlinks once it knows what they point to.
+		if e.Type()&fs.ModeSymlink == 0 && !visible(p, e.IsDir()) {
+			continue
+		}
+		name := filepath.Join(rel, e.Name())
+		isDir := e.IsDir()
+		var info fs.FileInfo
+		if e.Type()&fs.ModeSymlink != 0 {
+			if followSymlinks == symlinksNever {
+				continue
+			}
+			info, err = statShared(p)
+			if err != nil {
+				continue // Dangling, or leads out of the share
+			}
+			isDir = info.IsDir()
+		}
+		if !isDir {
+			mode := e.Type()
+			if info != nil {
+				mode = info.Mode()
+			}
+			if !mode.IsRegular() {
+				continue
+			}
+			if info == nil {
+				if info, err = e.Info(); err != nil {
+					continue
+				}
+			}
+			*files = append(*files, listedFile{name, info})
+			continue
+		}
+
+		if info == nil {
+			if info, err = e.Info(); err != nil {
+				continue
+			}
+		}
+		if mi, ok := info.(mountInfo); ok {
+			info = mi.FileInfo
+		}
+		if loops(info, parents) {
+			continue
+		}
+		if maxDepth > 0 && depth(p) >= maxDepth {
+			*files = append(*files, listedFile{name: name + string(filepath.Separator)})
+			continue
+		}
+		walkShared(p, name, append(parents, info), files)
+	}
+}
+
+// loops reports whether the folder info is one of its own parents, which a
+// symlink can make happen. Backends without inode numbers have no symlinks,
+// so os.SameFile coming up false for them is right.
+func loops(info fs.FileInfo, parents []fs.FileInfo) bool {
+	for _, parent := range parents {
+		if os.SameFile(info, parent) {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedFileExists reports whether the share path p is a regular file in
+// the share.
+func sharedFileExists(p string) bool {
+	p, ok := safeSharePath(p)
+	if !ok {
+		return false
+	}
+	info, err := statShared(p)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// seekable returns f as an io.ReadSeeker for http.ServeContent, setting the
+// Content-Type on w with detectType. Files from backends that can't seek,
+// like compressed archive members, can still skip ahead for a range request
+// by reading and throwing away what's in between, but can only be typed by
+// extension.
+func seekable(w http.ResponseWriter, f fs.File, info fs.FileInfo) io.ReadSeeker {
+	rs, ok := f.(io.ReadSeeker)
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", detectType(info.Name(), rs))
+	}
+	if ok {
+		return rs
+	}
+	return &forwardSeeker{r: f, size: info.Size()}
+}
+
+// forwardSeeker fakes io.Seeker over a plain reader, as long as nothing
+// needs to go back to data it has already read.
+type forwardSeeker struct {
+	r         io.Reader
+	size      int64
+	pos, want int64
+}
+
+func (s *forwardSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.want
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of file")
+	}
+	s.want = offset
+	return offset, nil
+}
+
+func (s *forwardSeeker) Read(p []byte) (int, error) {
+	if s.want < s.pos {
+		return 0, fmt.Errorf("can't seek back to %d in a file that only reads forward", s.want)
+	}
+	if s.want > s.pos {
+		n, err := io.CopyN(io.Discard, s.r, s.want-s.pos)
+		s.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.r.Read(p)
+	s.pos += int64(n)
+	s.want = s.pos
+	return n, err
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSafeSharePath(t *testing.T) {
+	windows := runtime.GOOS == "windows"
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"", "", true},
+		{"docs/a.txt", "docs/a.txt", true},
+		{"/docs/a.txt", "docs/a.txt", true},
+		{"/etc/passwd", "etc/passwd", true},
+		{"../../etc/passwd", "etc/passwd", true},
+		{"docs/../../../etc/passwd", "etc/passwd", true},
+		{"docs/./a.txt", "docs/a.txt", true},
+		{"a\x00.txt", "", false},
+		{"docs/a.txt\x00.jpg", "", false},
+	}
+	if windows {
+		tests = append(tests, []struct {
+			in, want string
+			ok       bool
+		}{
+			{`..\..\Windows\win.ini`, "Windows/win.ini", true},
+			{`C:\Windows\win.ini`, "", false},
+			{"C:/Windows/win.ini", "", false},
+			{"C:win.ini", "", false},
+			{`\\server\share\a.txt`, "server/share/a.txt", true},
+			{"//server/share/a.txt", "server/share/a.txt", true},
+			{`\\?\C:\Windows`, "", false},
+			{"NUL", "", false},
+			{"docs/COM1", "", false},
+			{"docs/LPT9", "", false},
+		}...)
+	} else {
+		// Backslashes are just part of a name outside Windows.
+		tests = append(tests, []struct {
+			in, want string
+			ok       bool
+		}{
+			{`..\..\etc\passwd`, `..\..\etc\passwd`, true},
+			{"C:/Windows/win.ini", "C:/Windows/win.ini", true},
+			{"NUL", "NUL", true},
+		}...)
+	}
+	for _, tt := range tests {
+		got, ok := safeSharePath(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("safeSharePath(%q) = %q, %v; want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// shareForTest shares a new folder for the length of the test, with a
+// secret file next to it that must never be served, and returns both.
+func shareForTest(t *testing.T, policy symlinkPolicy) (share, outside string) {
+	t.Helper()
+	base := t.TempDir()
+	share = filepath.Join(base, "share")
+	outside = filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(share, "docs"), outside} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, filepath.Join(share, "docs", "a.txt"), "shared")
+	writeTestFile(t, filepath.Join(outside, "secret.txt"), "secret")
+
+	oldMounts, oldPolicy := mounts, followSymlinks
+	t.Cleanup(func() { mounts, followSymlinks = oldMounts, oldPolicy })
+	followSymlinks = policy
+	if err := openMounts([]*mount{{Dir: share}}); err != nil {
+		t.Fatal(err)
+	}
+	return share, outside
+}
+
+func writeTestFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// symlinkForTest makes a symlink, skipping the test where that isn't
+// allowed, as on Windows without developer mode.
+func symlinkForTest(t *testing.T, target, link string) {
+	t.Helper()
+	if err := os.Symlink(target, link); err != nil {
+		t.Skip("can't make symlinks here:", err)
+	}
+}
+
+func readShared(p string) (string, error) {
+	f, err := openShared(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	return string(b), err
+}
+
+func TestOpenSharedStaysInside(t *testing.T) {
+	shareForTest(t, symlinksWithinRoot)
+	if got, err := readShared("docs/a.txt"); err != nil || got != "shared" {
+		t.Fatalf(`openShared("docs/a.txt") = %q, %v; want "shared"`, got, err)
+	}
+	// Paths are cleaned by safeSharePath first; openShared itself must still
+	// refuse anything that isn't inside the root.
+	for _, p := range []string{"../outside/secret.txt", "docs/../../outside/secret.txt", "/etc/passwd"} {
+		if got, err := readShared(p); err == nil {
+			t.Errorf("openShared(%q) = %q, want an error", p, got)
+		}
+		if _, err := statShared(p); err == nil {
+			t.Errorf("statShared(%q) succeeded, want an error", p)
+		}
+	}
+}
+
+func TestOpenSharedSymlinks(t *testing.T) {
+	tests := []struct {
+		policy  symlinkPolicy
+		path    string
+		want    string // "" when it mustn't open
+		comment string
+	}{
+		{symlinksWithinRoot, "inside.txt", "shared", "link to a file in the share"},
+		{symlinksWithinRoot, "escape.txt", "", "link to a file outside"},
+		{symlinksWithinRoot, "escapedir/secret.txt", "", "file in a linked folder outside"},
+		{symlinksWithinRoot, "docs/up/outside/secret.txt", "", "relative link climbing out"},
+		{symlinksNever, "inside.txt", "", "no links at all"},
+		{symlinksNever, "escape.txt", "", "no links at all"},
+		{symlinksAlways, "escape.txt", "secret", "links anywhere allowed"},
+		{symlinksAlways, "escapedir/secret.txt", "secret", "links anywhere allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy)+"/"+tt.path, func(t *testing.T) {
+			share, outside := shareForTest(t, tt.policy)
+			symlinkForTest(t, filepath.Join("docs", "a.txt"), filepath.Join(share, "inside.txt"))
+			symlinkForTest(t, filepath.Join(outside, "secret.txt"), filepath.Join(share, "escape.txt"))
+			symlinkForTest(t, outside, filepath.Join(share, "escapedir"))
+			symlinkForTest(t, filepath.Join("..", ".."), filepath.Join(share, "docs", "up"))
+
+			got, err := readShared(tt.path)
+			switch {
+			case tt.want == "" && err == nil:
+				t.Errorf("%s: openShared(%q) = %q, want an error", tt.comment, tt.path, got)
+			case tt.want != "" && (err != nil || got != tt.want):
+				t.Errorf("%s: openShared(%q) = %q, %v; want %q", tt.comment, tt.path, got, err, tt.want)
+			}
+			if _, err := statShared(tt.path); (err == nil) != (tt.want != "") {
+				t.Errorf("%s: statShared(%q) error = %v", tt.comment, tt.path, err)
+			}
+		})
+	}
+}
+
+func TestDownloadTraversal(t *testing.T) {
+	shareForTest(t, symlinksWithinRoot)
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"/download/docs/a.txt", http.StatusOK},
+		{"/download/docs%2fa.txt", http.StatusOK},
+		{"/download/..%2f..%2foutside%2fsecret.txt", http.StatusNotFound},
+		{"/download/%2e%2e/%2e%2e/outside/secret.txt", http.StatusNotFound},
+		{"/download/docs/..%2f..%2f..%2foutside/secret.txt", http.StatusNotFound},
+		{"/download/%2fetc%2fpasswd", http.StatusNotFound},
+		{"/download/..%5c..%5coutside%5csecret.txt", http.StatusNotFound},
+		{"/download/C:%5cWindows%5cwin.ini", http.StatusNotFound},
+		{"/download/docs/a.txt%00.jpg", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		downloadHandler(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if w.Code != tt.status {
+			t.Errorf("GET %s: status %d, want %d", tt.target, w.Code, tt.status)
+		}
+		if body := w.Body.String(); body == "secret" {
+			t.Errorf("GET %s served the file outside the share", tt.target)
+		}
+	}
+}
+
+func TestDiskFSRefusesEscapes(t *testing.T) {
+	share, outside := shareForTest(t, symlinksWithinRoot)
+	symlinkForTest(t, outside, filepath.Join(share, "escapedir"))
+	fsys := mounts[0].fsys.(writableFS)
+	for _, name := range []string{"../outside/new.txt", "escapedir/new.txt"} {
+		if err := fsys.Create(name, strings.NewReader("x"), -1); err == nil {
+			t.Errorf("Create(%q) succeeded, want an error", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("a file was written outside the share: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+)
+
+// symlinkPolicy decides which symbolic links in the share are followed, for
+// listings and downloads alike.
+type symlinkPolicy string
+
+const (
+	symlinksNever      symlinkPolicy = "never"       // Symlinks are invisible
+	symlinksWithinRoot symlinkPolicy = "within-root" // Only links to something inside the share
+	symlinksAlways     symlinkPolicy = "always"      // Also links pointing elsewhere on disk
+)
+
+var followSymlinks = symlinksWithinRoot
+
+func (p *symlinkPolicy) String() string { return string(*p) }
+
+func (p *symlinkPolicy) Set(value string) error {
+	switch value {
+	case "true": // A bare --follow-symlinks
+		value = string(symlinksAlways)
+	case "false":
+		value = string(symlinksNever)
+	}
+	switch symlinkPolicy(value) {
+	case symlinksNever, symlinksWithinRoot, symlinksAlways:
+		*p = symlinkPolicy(value)
+		return nil
+	}
+	return fmt.Errorf("expected never, within-root or always, got %q", value)
+}
+
+func (p *symlinkPolicy) IsBoolFlag() bool { return true }
+
+// hasSymlink reports whether rel, a clean path inside m, or any folder on
+// the way to it, is a symbolic link.
+func hasSymlink(m *mount, rel string) bool {
+	for prefix := rel; prefix != "." && prefix != ""; prefix = path.Dir(prefix) {
+		info, err := fs.Lstat(m.fsys, prefix)
+		if err != nil || info.Mode()&fs.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
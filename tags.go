@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	maxTags      = 20 // On one file
+	maxTagLength = 40
+)
+
+// tagStore keeps the tags people have put on files, like "final" or
+// "draft", by share path, saved to the state directory.
+type tagStore struct {
+	mu    sync.Mutex
+	path  string
+	files map[string][]string
+}
+
+var tags *tagStore
+
+func openTags(dir string) (*tagStore, error) {
+	s := &tagStore{
+		path:  filepath.Join(dir, "tags.json"),
+		files: make(map[string][]string),
+	}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.files); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// save must be called with s.mu held.
+func (s *tagStore) save() {
+	data, err := json.Marshal(s.files)
+	if err == nil {
+		err = writeFileAtomic(s.path, data)
+	}
+	if err != nil {
+		log.Println("Error saving tags:", err)
+	}
+}
+
+func (s *tagStore) get(p string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.files[p])
+}
+
+// set replaces the tags on p, none removing them all.
+func (s *tagStore) set(p string, list []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(list) == 0 {
+		delete(s.files, p)
+	} else {
+		s.files[p] = list
+	}
+	s.save()
+}
+
+// all returns every tag in use, in order.
+func (s *tagStore) all() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]bool)
+	for _, list := range s.files {
+		for _, t := range list {
+			seen[t] = true
+		}
+	}
+	return slices.Sorted(maps.Keys(seen))
+}
+
+// moved carries the tags of everything at oldname over to newname, after a
+// file or folder is renamed.
+func (s *tagStore) moved(oldname, newname string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for p, list := range s.files {
+		rest, ok := strings.CutPrefix(p, oldname)
+		if !ok || rest != "" && rest[0] != '/' {
+			continue
+		}
+		delete(s.files, p)
+		s.files[newname+rest] = list
+		changed = true
+	}
+	if changed {
+		s.save()
+	}
+}
+
+// canTag reports whether r may change the tags on files: anyone signed in,
+// or everyone when there are no accounts.
+func canTag(r *http.Request) bool {
+	return !receiveOnly && hasRole(r, roleViewer)
+}
+
+// cleanTags lowercases the tags and drops blanks and repeats, in the order
+// given.
+func cleanTags(list []string) ([]string, error) {
+	var clean []string
+	for _, t := range list {
+		t = strings.ToLower(strings.Join(strings.Fields(t), " "))
+		switch {
+		case t == "" || slices.Contains(clean, t):
+			continue
+		case len([]rune(t)) > maxTagLength:
+			return nil, fmt.Errorf("tags can be at most %d letters long", maxTagLength)
+		case strings.ContainsAny(t, ",#"):
+			return nil, errors.New("tags can't have commas or # in them")
+		}
+		clean = append(clean, t)
+	}
+	if len(clean) > maxTags {
+		return nil, fmt.Errorf("a file can have at most %d tags", maxTags)
+	}
+	return clean, nil
+}
+
+// tagFile sets the tags on the shared file name, for PATCH /api/files/PATH
+// with {"tags": [...]}, reporting whether it did.
+func tagFile(w http.ResponseWriter, r *http.Request, name string, list []string) bool {
+	if !canTag(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	if info, err := statShared(name); err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return false
+	}
+	if _, locked := lockedBy(r, name); locked {
+		http.Error(w, "Unlock this folder first", http.StatusForbidden)
+		return false
+	}
+	clean, err := cleanTags(list)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	tags.set(name, clean)
+	log.Printf("Tagged %s as %q, for %s", name, clean, clientIP(r))
+	return true
+}
+
+// withTag adds the ?tag= the list is filtered by, if any, to q.
+func withTag(q url.Values, tag string) url.Values {
+	if tag != "" {
+		q.Set("tag", tag)
+	}
+	return q
+}
+
+// filterByTag keeps the files tagged tag, or all of them if it's "".
+func filterByTag(files []fileEntry, tag string) []fileEntry {
+	if tag == "" {
+		return files
+	}
+	tag = strings.ToLower(tag)
+	return slices.DeleteFunc(files, func(f fileEntry) bool { return !slices.Contains(f.Tags, tag) })
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// builtinTemplates are the pages' HTML, one NAME.html for each, along with
+// the partials they all start with.
+//
+//go:embed templates
+var builtinTemplates embed.FS
+
+// templatesDir holds templates to use instead of the built-in ones,
+// --templates. Any it doesn't have are built in.
+var templatesDir string
+
+// pageTemplate is the template for one page, parsed by loadTemplates.
+type pageTemplate struct {
+	name  string
+	funcs template.FuncMap
+	tmpl  *template.Template
+}
+
+var pageTemplates []*pageTemplate
+
+// partials are included in every page: style.css, the stylesheet, and
+// theme.js, which applies the light or dark theme picked.
+var partials = []string{"style.css", "theme.js"}
+
+// commonFuncs are the functions every page can use: basePath, which goes
+// in front of the share's own links, for --base-path.
+var commonFuncs = template.FuncMap{
+	"basePath": func() string { return basePath },
+}
+
+// newPage declares the template in NAME.html, with the functions it uses.
+// Functions that depend on the request, like "t", are given placeholders
+// here and replaced with withFuncs.
+func newPage(name string, funcs template.FuncMap) *pageTemplate {
+	p := &pageTemplate{name: name, funcs: funcs}
+	pageTemplates = append(pageTemplates, p)
+	return p
+}
+
+func (p *pageTemplate) Execute(w io.Writer, data any) error {
+	return p.tmpl.Execute(w, data)
+}
+
+// withFuncs returns a copy of the template using funcs in place of those
+// newPage was given.
+func (p *pageTemplate) withFuncs(funcs template.FuncMap) *template.Template {
+	return template.Must(p.tmpl.Clone()).Funcs(funcs)
+}
+
+// loadTemplates parses every page's template, from --templates where it
+// has one, so a mistake in them stops the server from starting rather
+// than breaking a page.
+func loadTemplates() error {
+	if templatesDir != "" {
+		if _, err := os.Stat(templatesDir); err != nil {
+			return err
+		}
+	}
+	shared := make([]string, len(partials))
+	for i, file := range partials {
+		text, err := readTemplate(file)
+		if err != nil {
+			return err
+		}
+		shared[i] = text
+	}
+	for _, p := range pageTemplates {
+		text, err := readTemplate(p.name + ".html")
+		if err != nil {
+			return err
+		}
+		t, err := template.New(p.name).Funcs(commonFuncs).Funcs(p.funcs).Parse(text)
+		for i := 0; err == nil && i < len(partials); i++ {
+			_, err = t.New(partials[i]).Parse(shared[i])
+		}
+		if err != nil {
+			return err
+		}
+		p.tmpl = t
+	}
+	return nil
+}
+
+func readTemplate(file string) (string, error) {
+	if templatesDir != "" {
+		data, err := os.ReadFile(filepath.Join(templatesDir, file))
+		if err == nil {
+			return string(data), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+	data, err := builtinTemplates.ReadFile("templates/" + file)
+	return string(data), err
+}
+
+// templatesCommand implements lanshare templates DIR, which writes the
+// built-in templates to DIR to start customizing them from.
+func templatesCommand(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: lanshare templates DIR")
+		os.Exit(2)
+	}
+	if err := os.MkdirAll(args[0], 0o755); err != nil {
+		log.Fatal("Error writing templates:", err)
+	}
+	entries, _ := builtinTemplates.ReadDir("templates")
+	for _, e := range entries {
+		dest := filepath.Join(args[0], e.Name())
+		if _, err := os.Stat(dest); err == nil {
+			fmt.Fprintln(os.Stderr, "Leaving", dest, "as it is")
+			continue
+		}
+		data, _ := builtinTemplates.ReadFile("templates/" + e.Name())
+		if err := os.WriteFile(dest, data, 0o644); err != nil {
+			log.Fatal("Error writing templates:", err)
+		}
+	}
+	fmt.Println("Wrote the templates to", args[0]+"; serve them with --templates", args[0])
+}
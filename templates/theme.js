@@ -0,0 +1,8 @@
+    // Applies the theme picked at the bottom of the file list before the
+    // page is drawn; without one, the stylesheet follows the system's.
+    {
+      const theme = localStorage.getItem("theme");
+      if (theme === "light" || theme === "dark") {
+        document.documentElement.dataset.theme = theme;
+      }
+    }
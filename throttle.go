@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// byteLimiter is a token bucket measured in bytes. It is safe for concurrent
+// use, so one limiter can be shared by every transfer.
+type byteLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newByteLimiter(bytesPerSec int64) *byteLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &byteLimiter{rate: float64(bytesPerSec), last: time.Now()}
+}
+
+// wait blocks until n bytes may be sent.
+func (l *byteLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	// Allow at most one second of burst so an idle limiter doesn't let the
+	// next transfer run unthrottled for a while.
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / l.rate * float64(time.Second)))
+	}
+}
+
+// throttledReader limits reads from an io.ReadSeeker through zero or more
+// limiters. Seek is passed straight through so range requests keep working.
+type throttledReader struct {
+	rs       io.ReadSeeker
+	limiters []*byteLimiter
+}
+
+// throttleChunk bounds a single read so throttling stays smooth even when the
+// caller asks for a large buffer.
+const throttleChunk = 32 * 1024
+
+func newThrottledReader(rs io.ReadSeeker, limiters ...*byteLimiter) io.ReadSeeker {
+	var active []*byteLimiter
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		return rs
+	}
+	return &throttledReader{rs: rs, limiters: active}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := t.rs.Read(p)
+	if n > 0 {
+		for _, l := range t.limiters {
+			l.wait(n)
+		}
+	}
+	return n, err
+}
+
+func (t *throttledReader) Seek(offset int64, whence int) (int64, error) {
+	return t.rs.Seek(offset, whence)
+}
+
+// parseRate parses a transfer rate such as "500KB/s", "10MB", "1.5MiB/s" or
+// a plain number of bytes per second. Decimal (KB, MB, GB) and binary (KiB,
+// MiB, GiB) units are both accepted.
+func parseRate(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "/s"), "ps")
+	if s == "" || s == "0" {
+		return 0, nil
+	}
+
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	num, unit := s, ""
+	if i >= 0 {
+		num, unit = s[:i], strings.TrimSpace(s[i:])
+	}
+
+	value, err := strconv.ParseFloat(num, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+
+	multipliers := map[string]float64{
+		"": 1, "b": 1,
+		"k": 1e3, "kb": 1e3, "kib": 1 << 10,
+		"m": 1e6, "mb": 1e6, "mib": 1 << 20,
+		"g": 1e9, "gb": 1e9, "gib": 1 << 30,
+	}
+	mult, ok := multipliers[strings.ToLower(unit)]
+	if !ok {
+		return 0, fmt.Errorf("invalid rate unit %q", unit)
+	}
+	return int64(value * mult), nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // Decoders for image.Decode
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultThumbWidth = 200
+	maxThumbWidth     = 1024
+	maxImageWidth     = 4096 // For /img/
+	defaultQuality    = 80
+	maxThumbPixels    = 100 << 20 // Larger images aren't decoded, to save memory
+)
+
+// thumbSlots limits how many thumbnails are made at once, as decoding a big
+// photo takes a lot of memory and CPU.
+var thumbSlots = make(chan struct{}, max(2, runtime.NumCPU()/2))
+
+var errNoThumb = errors.New("no thumbnail for this kind of file")
+
+// thumbHandler serves a JPEG thumbnail of the image or video at
+// /thumb/PATH, fitting in ?w= pixels each way. Images Go can't decode, like
+// WebP, are sent as they are instead, as are videos when ffmpeg isn't
+// installed.
+func thumbHandler(w http.ResponseWriter, r *http.Request) {
+	serveResized(w, r, "/thumb/", defaultThumbWidth, maxThumbWidth, true)
+}
+
+// imgHandler serves the image at /img/PATH scaled down to fit in ?w= pixels
+// each way and recompressed as a JPEG of quality ?q=, so a big photo shows
+// quickly on a phone. Downloads still get the original.
+func imgHandler(w http.ResponseWriter, r *http.Request) {
+	serveResized(w, r, "/img/", maxImageWidth, maxImageWidth, false)
+}
+
+// serveResized serves a JPEG of the shared file after prefix, as sized by
+// the ?w= and ?q= parameters, or redirects to the file itself if it can't
+// be resized. Videos get a still only for thumbnails.
+func serveResized(w http.ResponseWriter, r *http.Request, prefix string, width, maxWidth int, videos bool) {
+	name, ok := safeSharePath(strings.TrimPrefix(r.URL.Path, prefix))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if _, locked := lockedBy(r, name); locked {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	info, err := statShared(name)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	if s := r.URL.Query().Get("w"); s != "" {
+		if width, err = strconv.Atoi(s); err != nil || width < 16 || width > maxWidth {
+			http.Error(w, fmt.Sprintf("w must be between 16 and %d", maxWidth), http.StatusBadRequest)
+			return
+		}
+	}
+	quality := defaultQuality
+	if s := r.URL.Query().Get("q"); s != "" {
+		if quality, err = strconv.Atoi(s); err != nil || quality < 10 || quality > 100 {
+			http.Error(w, "q must be between 10 and 100", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if prefix == "/thumb/" {
+		setCachePolicy(w, "thumbnails")
+	} else {
+		setCachePolicy(w, "previews")
+	}
+	if notModified(w, r, fileETag(info, prefix, width, quality), info.ModTime()) {
+		return
+	}
+	var data []byte
+	err = errNoThumb
+	if videos || !isVideo(sharedFileType(name)) {
+		data, err = thumbnail(r.Context(), name, info, width, quality)
+	}
+	if errors.Is(err, errNoThumb) {
+		http.Redirect(w, r, "/download/"+escapePath(name), http.StatusFound)
+		return
+	}
+	if err != nil {
+		if r.Context().Err() == nil {
+			log.Printf("Error resizing %s: %v", name, err)
+			http.Error(w, "Error resizing "+name, http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(data))
+}
+
+// canResize reports whether ctype is an image the server can scale down.
+func canResize(ctype string) bool {
+	switch mediaType(ctype) {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// thumbnail returns the shared file name scaled down to width, making it
+// if it isn't in the preview cache.
+func thumbnail(ctx context.Context, name string, info os.FileInfo, width, quality int) ([]byte, error) {
+	ctype := sharedFileType(name)
+	video := isVideo(ctype)
+	if !canResize(ctype) && !(video && ffmpegPath != "") {
+		return nil, errNoThumb
+	}
+
+	file, version := previewKey(name, info, fmt.Sprintf("w%d-q%d.jpg", width, quality))
+	if data, ok := previews.get(file, version); ok {
+		return data, nil
+	}
+
+	select {
+	case thumbSlots <- struct{}{}:
+		defer func() { <-thumbSlots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if data, ok := previews.get(file, version); ok {
+		return data, nil // Made while this one waited
+	}
+	var data []byte
+	var err error
+	if video {
+		data, err = videoThumbnail(ctx, name, width)
+	} else {
+		data, err = imageThumbnail(name, width, quality)
+	}
+	if err != nil {
+		return nil, err
+	}
+	previews.put(file, version, data)
+	return data, nil
+}
+
+// imageThumbnail decodes the shared image name and scales it down to fit
+// in width pixels each way. Images already smaller are only recompressed.
+func imageThumbnail(name string, width, quality int) ([]byte, error) {
+	f, err := openShared(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var head bytes.Buffer
+	config, _, err := image.DecodeConfig(io.TeeReader(f, &head))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxThumbPixels {
+		return nil, errNoThumb
+	}
+	img, _, err := image.Decode(io.MultiReader(&head, f))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, scaleDown(img, width), &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// thumbBackground is what transparent parts of images are drawn on, the
+// colour of the file icons in the list.
+var thumbBackground = color.RGBA{0x23, 0x35, 0x54, 0xff}
+
+// scaleDown shrinks img to fit in size pixels each way, averaging up to 4×4
+// samples of the original for each pixel, which is quick even for big
+// photos and looks fine at thumbnail sizes.
+func scaleDown(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(1, h*size/b.Dx())
+		} else {
+			w, h = max(1, w*size/b.Dy()), size
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := range w {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			var r, g, bl, n uint32
+			for sy := range 4 {
+				py := y0 + (y1-y0)*sy/4
+				for sx := range 4 {
+					px := x0 + (x1-x0)*sx/4
+					cr, cg, cb, ca := img.At(px, py).RGBA()
+					// Premultiplied, so this draws it over the background.
+					inv := 0xffff - ca
+					r += cr + uint32(thumbBackground.R)*0x101*inv/0xffff
+					g += cg + uint32(thumbBackground.G)*0x101*inv/0xffff
+					bl += cb + uint32(thumbBackground.B)*0x101*inv/0xffff
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), 0xff})
+		}
+	}
+	return dst
+}
+
+// videoThumbnail has ffmpeg take a frame from a second into the shared
+// video name, or its first if it's shorter, scaled to width.
+func videoThumbnail(ctx context.Context, name string, width int) ([]byte, error) {
+	m, rel, _ := resolve(name)
+	input := "pipe:0"
+	var stdin io.Reader
+	if m.folder {
+		input = filepath.Join(m.Dir, filepath.FromSlash(rel))
+	} else {
+		f, err := openShared(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		stdin = f
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	scale := fmt.Sprintf("thumbnail,scale='min(%d,iw)':'min(%d,ih)':force_original_aspect_ratio=decrease", width, width)
+	for _, seek := range []string{"1", "0"} {
+		cmd := exec.CommandContext(ctx, ffmpegPath, "-loglevel", "error", "-ss", seek, "-i", input,
+			"-frames:v", "1", "-vf", scale, "-f", "image2pipe", "-c:v", "mjpeg", "-q:v", "5", "pipe:1")
+		cmd.Stdin = stdin
+		var out, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &out, &stderr
+		err := cmd.Run()
+		if err == nil && out.Len() > 0 {
+			return out.Bytes(), nil
+		}
+		if stdin != nil || ctx.Err() != nil {
+			if err == nil {
+				err = errors.New("no frame")
+			}
+			return nil, fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+	}
+	return nil, errors.New("ffmpeg found no frame")
+}
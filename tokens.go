@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// API tokens are HS256 JWTs for scripted access to /api/. They are tied to
+// a user account, which decides what the token may do, and are signed with
+// a key derived from the state directory's secret.
+
+type tokenClaims struct {
+	Subject  string `json:"sub"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp,omitempty"`
+	ID       string `json:"jti"`
+}
+
+var errBadAPIToken = errors.New("invalid API token")
+
+// jwtKey keeps token signatures apart from the other uses of secretKey.
+func jwtKey() []byte {
+	return sign([]byte("api-token-key"))
+}
+
+func jwtSign(signingInput string) string {
+	mac := hmac.New(sha256.New, jwtKey())
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// createAPIToken issues a token for the named user, valid for d or forever
+// when d is 0.
+func createAPIToken(name string, d time.Duration) (string, error) {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := tokenClaims{Subject: name, IssuedAt: now.Unix(), ID: base64.RawURLEncoding.EncodeToString(id)}
+	if d > 0 {
+		claims.Expires = now.Add(d).Unix()
+	}
+
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := header + "." + enc.EncodeToString(payload)
+	return signingInput + "." + jwtSign(signingInput), nil
+}
+
+// parseAPIToken verifies a token from createAPIToken and returns its claims.
+func parseAPIToken(token string) (tokenClaims, error) {
+	var claims tokenClaims
+	enc := base64.RawURLEncoding
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errBadAPIToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(jwtSign(parts[0]+"."+parts[1]))) {
+		return claims, errBadAPIToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	headerJSON, err := enc.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil || header.Alg != "HS256" {
+		return claims, errBadAPIToken
+	}
+	payload, err := enc.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return claims, errBadAPIToken
+	}
+	if claims.Expires != 0 && time.Now().Unix() > claims.Expires {
+		return claims, errors.New("API token has expired")
+	}
+	return claims, nil
+}
+
+// bearerUser returns the account behind a valid "Authorization: Bearer"
+// token on r. ok is false when r carries no bearer token at all.
+func bearerUser(r *http.Request) (u *user, ok bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, false
+	}
+	claims, err := parseAPIToken(strings.TrimSpace(token))
+	if err != nil {
+		return nil, true
+	}
+	return users.lookup(claims.Subject), true
+}
+
+// tokenCommand implements the "token" subcommand.
+func tokenCommand(args []string) {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	dir := fs.String("state-dir", defaultStateDir(), "directory holding persistent state")
+	name := fs.String("user", "", "account the token acts as")
+	expire := fs.Duration("expire", 30*24*time.Hour, "how long the token stays valid (0 never expires)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: token create --user NAME [--expire D]")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "create" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	fs.Parse(args[1:])
+	if *name == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	secretKey, err = loadSecret(*dir)
+	if err != nil {
+		log.Fatal("Error loading secret key:", err)
+	}
+	users, err = openUsers(*dir)
+	if err != nil {
+		log.Fatal("Error loading users:", err)
+	}
+	if users.lookup(*name) == nil {
+		log.Fatalf("No user %q, add one with the user subcommand first", *name)
+	}
+
+	token, err := createAPIToken(*name, *expire)
+	if err != nil {
+		log.Fatal("Error creating token:", err)
+	}
+	fmt.Println(token)
+}
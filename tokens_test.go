@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAPIToken(t *testing.T) {
+	secretForTest(t)
+	enc := base64.RawURLEncoding
+	token, err := createAPIToken("alice", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	forever, _ := createAPIToken("alice", 0)
+
+	// resigned puts header and payload together with a valid signature, as
+	// only someone holding the key could.
+	resigned := func(header, payload string) string {
+		input := enc.EncodeToString([]byte(header)) + "." + payload
+		return input + "." + jwtSign(input)
+	}
+	past := time.Now().Add(-time.Minute).Unix()
+	expired := resigned(`{"alg":"HS256","typ":"JWT"}`, enc.EncodeToString(fmt.Appendf(nil, `{"sub":"alice","iat":1,"exp":%d,"jti":"x"}`, past)))
+	mallory := enc.EncodeToString([]byte(`{"sub":"mallory","iat":1,"jti":"x"}`))
+	secretKey = bytes.Repeat([]byte{8}, 32)
+	otherKey, _ := createAPIToken("alice", time.Hour)
+	secretForTest(t)
+
+	tests := []struct {
+		name, token string
+		ok          bool
+	}{
+		{"valid", token, true},
+		{"no expiry", forever, true},
+		{"expired", expired, false},
+		{"other subject", parts[0] + "." + mallory + "." + parts[2], false},
+		{"alg none", enc.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + parts[1] + ".", false},
+		{"alg none, old signature", enc.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + parts[1] + "." + parts[2], false},
+		{"alg HS512", resigned(`{"alg":"HS512","typ":"JWT"}`, parts[1]), false},
+		{"no alg", resigned(`{"typ":"JWT"}`, parts[1]), false},
+		{"no signature", parts[0] + "." + parts[1] + ".", false},
+		{"two parts", parts[0] + "." + parts[1], false},
+		{"signed with another key", otherKey, false},
+		{"bad payload", resigned(`{"alg":"HS256","typ":"JWT"}`, "!!"), false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		claims, err := parseAPIToken(tt.token)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error = %v, want ok = %v", tt.name, err, tt.ok)
+			continue
+		}
+		if err == nil && claims.Subject != "alice" {
+			t.Errorf("%s: token is for %q, want alice", tt.name, claims.Subject)
+		}
+	}
+}
+
+func TestBearerUser(t *testing.T) {
+	secretForTest(t)
+	usersForTest(t, &user{Name: "alice", Role: roleUploader})
+	alice, _ := createAPIToken("alice", time.Hour)
+	gone, _ := createAPIToken("bob", time.Hour)
+	tests := []struct {
+		name, header string
+		user         string // "" for none
+		ok           bool
+	}{
+		{"valid", "Bearer " + alice, "alice", true},
+		{"no header", "", "", false},
+		{"basic auth", "Basic YWxpY2U6eA==", "", false},
+		{"deleted account", "Bearer " + gone, "", true},
+		{"bad token", "Bearer " + alice[:len(alice)-1], "", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/files", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		u, ok := bearerUser(r)
+		got := ""
+		if u != nil {
+			got = u.Name
+		}
+		if got != tt.user || ok != tt.ok {
+			t.Errorf("%s: bearerUser = %q, %v; want %q, %v", tt.name, got, ok, tt.user, tt.ok)
+		}
+	}
+}
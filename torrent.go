@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minTorrentSize is how big a file has to be to get a Get torrent button.
+// Smaller ones download quickly enough over plain HTTP.
+const minTorrentSize = 256 << 20
+
+// seedPort is where lanshare seeds the torrents it makes over BitTorrent,
+// --seed-port, or 0 to leave it to the web seed.
+var seedPort int
+
+// torrentMeta is the torrent made for one version of a shared file.
+type torrentMeta struct {
+	path        string // Share path
+	size        int64
+	modTime     time.Time
+	pieceLength int64
+	info        []byte // The bencoded info dictionary
+	hash        [20]byte
+}
+
+func (m *torrentMeta) pieces() int {
+	return int((m.size + m.pieceLength - 1) / m.pieceLength)
+}
+
+// torrentJob is a torrent being made, or made, for a file. Working out the
+// pieces of a big file takes a while, so it's done once, in the background,
+// and kept for as long as the file doesn't change.
+type torrentJob struct {
+	size    int64
+	modTime time.Time
+	done    chan struct{}
+	meta    *torrentMeta
+	err     error
+}
+
+var torrents = struct {
+	sync.Mutex
+	jobs   map[string]*torrentJob    // By share path
+	byHash map[[20]byte]*torrentMeta // For the tracker and seeder
+}{jobs: map[string]*torrentJob{}, byHash: map[[20]byte]*torrentMeta{}}
+
+// torrentFor returns the torrent for the shared file p, making it first if
+// need be.
+func torrentFor(ctx context.Context, p string) (*torrentMeta, error) {
+	info, err := statShared(p)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, errors.New("not a file")
+	}
+	torrents.Lock()
+	job := torrents.jobs[p]
+	if job == nil || job.size != info.Size() || !job.modTime.Equal(info.ModTime()) {
+		job = &torrentJob{size: info.Size(), modTime: info.ModTime(), done: make(chan struct{})}
+		torrents.jobs[p] = job
+		go job.run(p)
+	}
+	torrents.Unlock()
+	select {
+	case <-job.done:
+		return job.meta, job.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (job *torrentJob) run(p string) {
+	defer close(job.done)
+	// About a thousand pieces, of 256 KiB to 16 MiB.
+	pieceLength := int64(256 << 10)
+	for job.size/pieceLength > 1000 && pieceLength < 16<<20 {
+		pieceLength *= 2
+	}
+	f, err := openShared(p)
+	if err != nil {
+		job.err = err
+		return
+	}
+	defer f.Close()
+	var pieces []byte
+	buf := make([]byte, pieceLength)
+	for left := job.size; left > 0; left -= pieceLength {
+		n := min(left, pieceLength)
+		if _, err := io.ReadFull(f, buf[:n]); err != nil {
+			job.err = err
+			return
+		}
+		sum := sha1.Sum(buf[:n])
+		pieces = append(pieces, sum[:]...)
+	}
+	// Private keeps clients to the tracker here, rather than telling the
+	// whole DHT about files on the LAN.
+	info := bencode(map[string]any{
+		"name":         path.Base(p),
+		"length":       job.size,
+		"piece length": pieceLength,
+		"pieces":       string(pieces),
+		"private":      1,
+	})
+	meta := &torrentMeta{path: p, size: job.size, modTime: job.modTime, pieceLength: pieceLength, info: info, hash: sha1.Sum(info)}
+	torrents.Lock()
+	torrents.byHash[meta.hash] = meta
+	torrents.Unlock()
+	job.meta = meta
+	log.Printf("Made a torrent for %s", p)
+}
+
+// torrentHandler serves /torrent/PATH, a .torrent for the file, which has
+// the file's download as a web seed so it works with no other peers, and
+// the tracker here, so the clients on the LAN find each other, and the
+// seeder with --seed-port, and swarm rather than all downloading from the
+// server.
+func torrentHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := safeSharePath(strings.TrimPrefix(r.URL.Path, "/torrent/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if p, locked := lockedBy(r, name); locked {
+		redirectToUnlock(w, r, p)
+		return
+	}
+	meta, err := torrentFor(r.Context(), name)
+	if err != nil {
+		if r.Context().Err() == nil {
+			http.NotFound(w, r)
+		}
+		return
+	}
+	// Torrent clients can't sign in, so they get a link that doesn't need to.
+	base := externalBaseURL(r)
+	seed := base + "download/" + escapePath(name)
+	if authEnabled() {
+		seed = signedDownloadURL(base, name, 24*time.Hour)
+	}
+	w.Header().Set("Content-Type", "application/x-bittorrent")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", path.Base(name)+".torrent"))
+	w.Write(bencode(map[string]any{
+		"announce":      base + "announce",
+		"url-list":      []any{seed},
+		"created by":    "lanshare",
+		"creation date": time.Now().Unix(),
+		"info":          rawBencode(meta.info),
+	}))
+}
+
+// trackerPeer is a client that announced itself for a torrent.
+type trackerPeer struct {
+	addr netip.AddrPort
+	seen time.Time
+}
+
+// trackerPeerAge is how long a peer is listed without announcing again.
+const trackerPeerAge = 30 * time.Minute
+
+var tracker = struct {
+	sync.Mutex
+	peers map[[20]byte]map[string]trackerPeer // By info hash, then peer ID
+}{peers: map[[20]byte]map[string]trackerPeer{}}
+
+// announceHandler is a BitTorrent tracker for the torrents made here, which
+// answers with the other peers in compact form, and the seeder first.
+func announceHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	fail := func(reason string) {
+		w.Write(bencode(map[string]any{"failure reason": reason}))
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	infoHash := q.Get("info_hash")
+	if len(infoHash) != 20 {
+		fail("Unknown torrent")
+		return
+	}
+	hash := [20]byte([]byte(infoHash))
+	torrents.Lock()
+	_, known := torrents.byHash[hash]
+	torrents.Unlock()
+	if !known {
+		fail("Unknown torrent")
+		return
+	}
+	port, err := strconv.Atoi(q.Get("port"))
+	ip, ipErr := netip.ParseAddr(clientIP(r))
+	if err != nil || port <= 0 || port > 65535 || ipErr != nil {
+		fail("Invalid announce")
+		return
+	}
+	id := q.Get("peer_id")
+	me := netip.AddrPortFrom(ip.Unmap(), uint16(port))
+
+	tracker.Lock()
+	peers := tracker.peers[hash]
+	if peers == nil {
+		peers = map[string]trackerPeer{}
+		tracker.peers[hash] = peers
+	}
+	if q.Get("event") == "stopped" {
+		delete(peers, id)
+	} else {
+		peers[id] = trackerPeer{addr: me, seen: time.Now()}
+	}
+	var list []netip.AddrPort
+	for pid, p := range peers {
+		switch {
+		case time.Since(p.seen) > trackerPeerAge:
+			delete(peers, pid)
+		case pid != id && len(list) < 50:
+			list = append(list, p.addr)
+		}
+	}
+	tracker.Unlock()
+	if seedPort > 0 {
+		if addr, err := netip.ParseAddr(getLocalIP()); err == nil {
+			list = slices.Insert(list, 0, netip.AddrPortFrom(addr, uint16(seedPort)))
+		}
+	}
+
+	var peers4, peers6 []byte
+	for _, p := range list {
+		if p.Addr().Is4() {
+			ip := p.Addr().As4()
+			peers4 = append(peers4, ip[:]...)
+			peers4 = binary.BigEndian.AppendUint16(peers4, p.Port())
+		} else {
+			peers6 = append(peers6, p.Addr().AsSlice()...)
+			peers6 = binary.BigEndian.AppendUint16(peers6, p.Port())
+		}
+	}
+	w.Write(bencode(map[string]any{
+		"interval": 120,
+		"peers":    string(peers4),
+		"peers6":   string(peers6),
+	}))
+}
+
+// serveSeeds seeds every torrent made here to the peers that connect on
+// ln, answering their requests from the shared file. It only ever uploads.
+func serveSeeds(ln net.Listener) {
+	var id [20]byte
+	copy(id[:], "-LS0001-")
+	rand.Read(id[8:])
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Print("Error seeding:", err)
+			return
+		}
+		go seedPeer(conn, id)
+	}
+}
+
+const (
+	btUnchoke  = 1
+	btBitfield = 5
+	btRequest  = 6
+	btPiece    = 7
+	maxBTBlock = 128 << 10
+)
+
+func seedPeer(conn net.Conn, id [20]byte) {
+	defer conn.Close()
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if ip := net.ParseIP(host); ip == nil || denyNets.contains(ip) ||
+		(len(allowNets) > 0 && !allowNets.contains(ip) && !ip.IsLoopback()) {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	var hs [68]byte
+	if _, err := io.ReadFull(conn, hs[:]); err != nil || hs[0] != 19 || string(hs[1:20]) != "BitTorrent protocol" {
+		return
+	}
+	torrents.Lock()
+	meta := torrents.byHash[[20]byte(hs[28:48])]
+	torrents.Unlock()
+	if meta == nil {
+		return
+	}
+	f, err := openShared(meta.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	file, ok := f.(io.ReaderAt)
+	if info, err := f.Stat(); !ok || err != nil || info.Size() != meta.size || !info.ModTime().Equal(meta.modTime) {
+		return // Changed since, and the torrent with it
+	}
+
+	reply := append([]byte{19}, "BitTorrent protocol"...)
+	reply = append(reply, make([]byte, 8)...)
+	reply = append(append(reply, meta.hash[:]...), id[:]...)
+	bits := bytes.Repeat([]byte{0xff}, (meta.pieces()+7)/8)
+	if extra := len(bits)*8 - meta.pieces(); extra > 0 {
+		bits[len(bits)-1] <<= extra
+	}
+	reply = append(reply, btMessage(btBitfield, bits)...)
+	reply = append(reply, btMessage(btUnchoke, nil)...)
+	if _, err := conn.Write(reply); err != nil {
+		return
+	}
+	log.Printf("Seeding %s to %s", meta.path, host)
+
+	block := make([]byte, maxBTBlock)
+	for {
+		conn.SetDeadline(time.Now().Add(3 * time.Minute))
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n == 0 {
+			continue // Keep-alive
+		}
+		if n > maxBTBlock+16 {
+			return
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return
+		}
+		if msg[0] != btRequest || len(msg) != 13 {
+			continue // What else peers say doesn't matter to a seed
+		}
+		index := int64(binary.BigEndian.Uint32(msg[1:]))
+		begin := int64(binary.BigEndian.Uint32(msg[5:]))
+		length := int64(binary.BigEndian.Uint32(msg[9:]))
+		off := index*meta.pieceLength + begin
+		if length > maxBTBlock || begin+length > meta.pieceLength || off+length > meta.size {
+			return
+		}
+		if _, err := file.ReadAt(block[:length], off); err != nil {
+			return
+		}
+		if globalLimiter != nil {
+			globalLimiter.wait(int(length))
+		}
+		if _, err := conn.Write(btMessage(btPiece, slices.Concat(msg[1:9], block[:length]))); err != nil {
+			return
+		}
+	}
+}
+
+func btMessage(id byte, payload []byte) []byte {
+	msg := binary.BigEndian.AppendUint32(nil, uint32(1+len(payload)))
+	return append(append(msg, id), payload...)
+}
+
+// rawBencode is already bencoded, and is written as it is.
+type rawBencode []byte
+
+// bencode encodes v, made of strings, integers, lists and dictionaries, as
+// .torrent files and trackers do.
+func bencode(v any) []byte {
+	var b bytes.Buffer
+	var enc func(v any)
+	enc = func(v any) {
+		switch v := v.(type) {
+		case rawBencode:
+			b.Write(v)
+		case string:
+			fmt.Fprintf(&b, "%d:%s", len(v), v)
+		case int:
+			fmt.Fprintf(&b, "i%de", v)
+		case int64:
+			fmt.Fprintf(&b, "i%de", v)
+		case []any:
+			b.WriteByte('l')
+			for _, item := range v {
+				enc(item)
+			}
+			b.WriteByte('e')
+		case map[string]any:
+			b.WriteByte('d')
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			slices.Sort(keys)
+			for _, k := range keys {
+				enc(k)
+				enc(v[k])
+			}
+			b.WriteByte('e')
+		default:
+			panic(fmt.Sprintf("can't bencode %T", v))
+		}
+	}
+	enc(v)
+	return b.Bytes()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Two-factor authentication uses time-based one-time passwords (RFC 6238)
+// as produced by authenticator apps: HMAC-SHA1, 6 digits, 30 second steps.
+
+const (
+	totpStep          = 30
+	totpDigits        = 6
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random secret in the base32 form apps expect.
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpCode returns the code for secret in the given time step.
+func totpCode(secret string, counter uint64) string {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return ""
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1000000)
+}
+
+// totpURI is the otpauth:// link authenticator apps import, usually as a
+// QR code.
+func totpURI(name, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", "lanshare")
+	return "otpauth://totp/" + url.PathEscape("lanshare:"+name) + "?" + q.Encode()
+}
+
+// The last time step accepted for each user, so an observed code can't be
+// replayed while it is still current.
+var totpUsed = struct {
+	sync.Mutex
+	steps map[string]uint64
+}{steps: make(map[string]uint64)}
+
+// checkTOTP reports whether code is valid for secret now, allowing one step
+// of clock drift either way.
+func checkTOTP(name, secret, code string) bool {
+	now := uint64(time.Now().Unix()) / totpStep
+	totpUsed.Lock()
+	defer totpUsed.Unlock()
+	for _, step := range []uint64{now - 1, now, now + 1} {
+		if step <= totpUsed.steps[name] {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			totpUsed.steps[name] = step
+			return true
+		}
+	}
+	return false
+}
+
+// newRecoveryCodes returns single-use codes for when the authenticator app
+// is lost, along with the hashes to store. The codes carry 80 bits of
+// randomness, so a plain SHA-256 is enough to keep them safe at rest.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for range recoveryCodeCount {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		s := strings.ToLower(totpEncoding.EncodeToString(b))
+		code := s[:8] + "-" + s[8:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkSecondFactor reports whether code is a current TOTP code or an
+// unused recovery code for the named user. Recovery codes are crossed off
+// as they are used.
+func (s *userStore) checkSecondFactor(name, code string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return false
+	}
+	u := s.users[name]
+	if u == nil || u.TOTP == "" {
+		return false
+	}
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		return checkTOTP(name, u.TOTP, code)
+	}
+
+	hash := hashRecoveryCode(code)
+	for i, h := range u.Recovery {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			u.Recovery = append(u.Recovery[:i:i], u.Recovery[i+1:]...)
+			return s.save() == nil
+		}
+	}
+	return false
+}
+
+// Between the password and the code, the browser holds a short-lived signed
+// cookie naming the user, so the password isn't sent twice.
+const (
+	pendingLoginCookie = "login_2fa"
+	pendingLoginTTL    = 5 * time.Minute
+)
+
+func pendingLoginSignature(u *user, exp int64) string {
+	return base64.RawURLEncoding.EncodeToString(sign([]byte("login-2fa\n" + u.Name + "\n" + strconv.FormatInt(exp, 10) + "\n" + u.Hash)))
+}
+
+func setPendingLogin(w http.ResponseWriter, u *user) {
+	exp := time.Now().Add(pendingLoginTTL)
+	value := base64.RawURLEncoding.EncodeToString([]byte(u.Name)) + "." +
+		strconv.FormatInt(exp.Unix(), 10) + "." + pendingLoginSignature(u, exp.Unix())
+	http.SetCookie(w, &http.Cookie{
+		Name:     pendingLoginCookie,
+		Value:    value,
+		Path:     basePath + "/login",
+		Expires:  exp,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// pendingLogin returns the user who got their password right but still owes
+// a code, or nil.
+func pendingLogin(r *http.Request) *user {
+	c, err := r.Cookie(pendingLoginCookie)
+	if err != nil {
+		return nil
+	}
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	name, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return nil
+	}
+	u := users.lookup(string(name))
+	if u == nil || !hmac.Equal([]byte(parts[2]), []byte(pendingLoginSignature(u, exp))) {
+		return nil
+	}
+	return u
+}
+
+func clearPendingLogin(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: pendingLoginCookie, Path: basePath + "/login", MaxAge: -1})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238's SHA-1 test vectors, cut to the 6 digits apps show.
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(secret, uint64(tt.unix/totpStep)); got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+		if got := totpCode(strings.ToLower(secret), uint64(tt.unix/totpStep)); got != tt.want {
+			t.Errorf("code at %d with a lowercase secret = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+	if got := totpCode("not base32!", 1); got != "" {
+		t.Errorf("code for a bad secret = %q, want none", got)
+	}
+}
+
+// forgetUsedTOTP lets every code be used again.
+func forgetUsedTOTP() {
+	totpUsed.Lock()
+	totpUsed.steps = make(map[string]uint64)
+	totpUsed.Unlock()
+}
+
+func TestCheckTOTPSkew(t *testing.T) {
+	forgetUsedTOTP()
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		steps int64 // Away from now
+		want  bool
+	}{
+		{-2, false},
+		{-1, true},
+		{0, true},
+		{1, true},
+		{2, false},
+	}
+	for i, tt := range tests {
+		now := time.Now().Unix() / totpStep
+		code := totpCode(secret, uint64(now+tt.steps))
+		name := "skew" + strconv.Itoa(i) // Each code is only good once per user
+		if got := checkTOTP(name, secret, code); got != tt.want && time.Now().Unix()/totpStep == now {
+			t.Errorf("code %d steps away: accepted = %v, want %v", tt.steps, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTOTPReplay(t *testing.T) {
+	forgetUsedTOTP()
+	secret, _ := newTOTPSecret()
+	now := uint64(time.Now().Unix()) / totpStep
+	current, previous := totpCode(secret, now), totpCode(secret, now-1)
+	if !checkTOTP("replay", secret, current) {
+		t.Skip("the time step changed during the test")
+	}
+	if checkTOTP("replay", secret, current) {
+		t.Error("the same code was accepted twice")
+	}
+	if checkTOTP("replay", secret, previous) {
+		t.Error("an older code was accepted after a newer one")
+	}
+	if checkTOTP("replay", secret, "000000") && current != "000000" {
+		t.Error("a made-up code was accepted")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	secret, _ := newTOTPSecret()
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), recoveryCodeCount)
+	}
+	for i, h := range hashes {
+		if strings.Contains(h, codes[i]) {
+			t.Fatal("a recovery code is stored as it is")
+		}
+	}
+	usersForTest(t, &user{Name: "alice", Role: roleViewer, TOTP: secret, Recovery: hashes}, &user{Name: "bob", Role: roleViewer})
+
+	tests := []struct {
+		name, user, code string
+		want             bool
+	}{
+		{"first code", "alice", codes[0], true},
+		{"used again", "alice", codes[0], false},
+		{"typed without the dash, in capitals", "alice", strings.ToUpper(strings.ReplaceAll(codes[1], "-", "")), true},
+		{"with spaces around", "alice", " " + codes[2] + " ", true},
+		{"someone else's account", "bob", codes[3], false},
+		{"made up", "alice", "aaaaaaaa-aaaaaaaa", false},
+		{"empty", "alice", "", false},
+	}
+	for _, tt := range tests {
+		if got := users.checkSecondFactor(tt.user, tt.code); got != tt.want {
+			t.Errorf("%s: accepted = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Used codes stay crossed off after a restart.
+	reopened, err := openUsers(filepath.Dir(users.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(reopened.lookup("alice").Recovery); got != recoveryCodeCount-3 {
+		t.Errorf("%d recovery codes left after a restart, want %d", got, recoveryCodeCount-3)
+	}
+}
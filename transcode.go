@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	transcode  bool   // Convert videos browsers can't play to HLS with ffmpeg, --transcode
+	ffmpegPath string // Found on the PATH, if it's there; also makes video thumbnails
+)
+
+const (
+	maxTranscodes  = 2                // ffmpeg processes at once
+	transcodeIdle  = 30 * time.Minute // How long a converted video is kept once nobody's watching
+	hlsPlaylist    = "index.m3u8"
+	hlsSegmentGlob = "seg%05d.ts"
+)
+
+var hlsSegment = regexp.MustCompile(`^seg\d{5}\.ts$`)
+
+// transcodeSession is a video being, or already, converted to HLS in a
+// temporary folder. It's known by the file's path, size and modification
+// time, so a file that changes is converted again.
+type transcodeSession struct {
+	dir      string
+	cancel   context.CancelFunc
+	done     chan struct{} // Closed when ffmpeg exits
+	err      error         // Why it failed, once done
+	lastUsed time.Time
+}
+
+var transcodes = struct {
+	mu       sync.Mutex
+	dir      string // Holds the sessions' folders, made on first use
+	sessions map[string]*transcodeSession
+}{sessions: make(map[string]*transcodeSession)}
+
+// checkTranscode looks for ffmpeg and, for --transcode, which needs it,
+// starts cleaning up conversions nobody watches anymore, and all of them
+// when the server is stopped with Ctrl+C, which would otherwise leave ffmpeg
+// running.
+func checkTranscode() error {
+	ffmpegPath, _ = exec.LookPath("ffmpeg")
+	if !transcode {
+		return nil
+	}
+	if ffmpegPath == "" {
+		return errors.New("--transcode needs ffmpeg, which isn't on the PATH")
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			expireTranscodes(transcodeIdle)
+		}
+	}()
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		stopTranscodes()
+		os.Exit(1)
+	}()
+	return nil
+}
+
+// expireTranscodes stops and deletes the conversions that haven't been
+// watched for idle.
+func expireTranscodes(idle time.Duration) {
+	transcodes.mu.Lock()
+	defer transcodes.mu.Unlock()
+	for key, s := range transcodes.sessions {
+		if time.Since(s.lastUsed) < idle {
+			continue
+		}
+		s.cancel()
+		delete(transcodes.sessions, key)
+		go func() {
+			<-s.done
+			os.RemoveAll(s.dir)
+		}()
+	}
+}
+
+// stopTranscodes stops all conversions and removes what they made, when
+// the server shuts down.
+func stopTranscodes() {
+	expireTranscodes(0)
+	transcodes.mu.Lock()
+	dir := transcodes.dir
+	transcodes.mu.Unlock()
+	if dir != "" {
+		time.Sleep(time.Second) // Give ffmpeg a moment to exit
+		os.RemoveAll(dir)
+	}
+}
+
+// transcodeSessionFor returns the conversion of the shared video name,
+// starting it if need be.
+func transcodeSessionFor(name string) (*transcodeSession, error) {
+	info, err := statShared(name)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s\n%d\n%d", name, info.Size(), info.ModTime().UnixNano()))
+	key := hex.EncodeToString(sum[:8])
+
+	transcodes.mu.Lock()
+	defer transcodes.mu.Unlock()
+	if s := transcodes.sessions[key]; s != nil {
+		s.lastUsed = time.Now()
+		return s, nil
+	}
+	running := 0
+	for _, s := range transcodes.sessions {
+		select {
+		case <-s.done:
+		default:
+			running++
+		}
+	}
+	if running >= maxTranscodes {
+		return nil, errTranscodeBusy
+	}
+	if transcodes.dir == "" {
+		if transcodes.dir, err = os.MkdirTemp("", "lanshare-hls-"); err != nil {
+			return nil, err
+		}
+	}
+	s := &transcodeSession{dir: filepath.Join(transcodes.dir, key), done: make(chan struct{}), lastUsed: time.Now()}
+	if err := os.Mkdir(s.dir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := s.start(name); err != nil {
+		os.RemoveAll(s.dir)
+		return nil, err
+	}
+	transcodes.sessions[key] = s
+	return s, nil
+}
+
+var errTranscodeBusy = fmt.Errorf("already converting %d videos", maxTranscodes)
+
+// start runs ffmpeg on name, reading it from disk where it is on disk, so
+// ffmpeg can seek in it, and otherwise from a pipe. The result is H.264 and
+// AAC at up to 720p, which any phone plays.
+func (s *transcodeSession) start(name string) error {
+	m, rel, _ := resolve(name)
+	args := []string{"-loglevel", "error"}
+	if m.folder {
+		args = append(args, "-nostdin", "-i", filepath.Join(m.Dir, filepath.FromSlash(rel)))
+	} else {
+		args = append(args, "-i", "pipe:0")
+	}
+	args = append(args,
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+		"-vf", "scale=-2:'min(720,ih)'",
+		"-c:a", "aac", "-ac", "2", "-b:a", "128k",
+		"-f", "hls", "-hls_time", "4", "-hls_playlist_type", "event", "-hls_flags", "temp_file",
+		"-hls_segment_filename", filepath.Join(s.dir, hlsSegmentGlob),
+		filepath.Join(s.dir, hlsPlaylist))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	var input fs.File
+	if !m.folder {
+		f, err := openShared(name)
+		if err != nil {
+			cancel()
+			return err
+		}
+		input, cmd.Stdin = f, f
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		if input != nil {
+			input.Close()
+		}
+		return err
+	}
+	log.Printf("Converting %s for streaming", name)
+	go func() {
+		err := cmd.Wait()
+		if input != nil {
+			input.Close()
+		}
+		if err != nil && ctx.Err() == nil {
+			s.err = fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+			log.Printf("Error converting %s: %v", name, s.err)
+		}
+		close(s.done)
+	}()
+	return nil
+}
+
+// hlsHandler serves conversions of the videos in the share, starting them
+// when a player first asks:
+//
+//	/hls/PATH/index.m3u8  the playlist, which grows as ffmpeg gets further
+//	/hls/PATH/segNNNNN.ts its segments
+func hlsHandler(w http.ResponseWriter, r *http.Request) {
+	if !transcode {
+		http.NotFound(w, r)
+		return
+	}
+	file, part := path.Split(strings.TrimPrefix(r.URL.Path, "/hls/"))
+	name, ok := safeSharePath(strings.TrimSuffix(file, "/"))
+	if !ok || part != hlsPlaylist && !hlsSegment.MatchString(part) {
+		http.NotFound(w, r)
+		return
+	}
+	if _, locked := lockedBy(r, name); locked {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if info, err := statShared(name); err != nil || info.IsDir() || !isVideo(sharedFileType(name)) {
+		http.NotFound(w, r)
+		return
+	}
+	s, err := transcodeSessionFor(name)
+	if err == errTranscodeBusy {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Busy converting other videos, try again in a bit", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Printf("Error converting %s: %v", name, err)
+		http.Error(w, "Error converting "+name, http.StatusInternalServerError)
+		return
+	}
+
+	// The playlist only appears once the first segment is done, and a
+	// player can ask for the next segment before it's finished. ffmpeg
+	// writes both under temporary names and renames them when they're done.
+	file = filepath.Join(s.dir, part)
+	for !fileExists(file) {
+		select {
+		case <-s.done:
+			if fileExists(file) {
+				continue
+			}
+			if s.err != nil {
+				http.Error(w, "This video can't be converted", http.StatusUnprocessableEntity)
+			} else {
+				http.NotFound(w, r)
+			}
+			return
+		case <-r.Context().Done():
+			return
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+	if part == hlsPlaylist {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "video/mp2t")
+	}
+	http.ServeFile(w, r, file)
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
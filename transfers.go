@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transfer states.
+const (
+	transferActive    = "active"
+	transferDone      = "done"
+	transferFailed    = "failed"
+	transferCancelled = "cancelled"
+)
+
+var errTransferCancelled = errors.New("transfer cancelled")
+
+// transfer is a single download or upload in progress.
+type transfer struct {
+	ID      int64
+	Kind    string // "download" or "upload"
+	Client  string
+	User    string // Signed-in user, "" without accounts
+	File    string
+	Started time.Time
+
+	size      atomic.Int64 // Expected bytes, -1 when unknown
+	bytes     atomic.Int64
+	cancelled atomic.Bool
+	// reachedEnd is set when the response covers the last byte of the file,
+	// so a resumed download counts as complete but a partial range doesn't.
+	reachedEnd atomic.Bool
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	// Server-side work after the bytes have arrived, such as checking and
+	// assembling a chunked upload, so there's something to show meanwhile.
+	phase atomic.Pointer[transferPhase]
+	work  atomic.Int64 // Bytes processed over all phases
+
+	// Guarded by transferRegistry.mu.
+	state     string
+	ended     time.Time
+	speed     float64
+	lastBytes int64
+}
+
+// transferPhase is a named step of server-side work on size bytes.
+type transferPhase struct {
+	name  string
+	size  int64
+	start int64 // transfer.work when the phase began
+}
+
+// transferStatus is the JSON view of a transfer sent to the dashboard.
+type transferStatus struct {
+	ID       int64     `json:"id"`
+	Kind     string    `json:"kind"`
+	Client   string    `json:"client"`
+	User     string    `json:"user,omitempty"`
+	File     string    `json:"file"`
+	Size     int64     `json:"size"`
+	Bytes    int64     `json:"bytes"`
+	Percent  float64   `json:"percent"`
+	Speed    float64   `json:"speed"`         // Bytes per second
+	ETA      float64   `json:"eta,omitempty"` // Seconds left, when it can be told
+	State    string    `json:"state"`
+	Started  time.Time `json:"started"`
+	Duration float64   `json:"duration"` // Seconds
+
+	// The server-side step underway, e.g. "verifying", with its own progress.
+	Phase      string `json:"phase,omitempty"`
+	PhaseBytes int64  `json:"phase_bytes,omitempty"`
+	PhaseSize  int64  `json:"phase_size,omitempty"`
+}
+
+// transferRegistry keeps track of active transfers and recently finished ones.
+type transferRegistry struct {
+	mu     sync.Mutex
+	nextID int64
+	active map[int64]*transfer
+	recent []*transfer // Finished transfers, oldest first
+}
+
+// How many finished transfers the dashboard keeps around, and for how long.
+const (
+	recentTransfers   = 50
+	recentTransferAge = 10 * time.Minute
+)
+
+var transfers = newTransferRegistry()
+
+func newTransferRegistry() *transferRegistry {
+	tr := &transferRegistry{active: make(map[int64]*transfer)}
+	go tr.sampleLoop()
+	return tr
+}
+
+// start registers a new transfer for the client making r. The returned
+// transfer's context is cancelled when either ctx is done or the host
+// cancels it.
+func (tr *transferRegistry) start(ctx context.Context, r *http.Request, kind, file string, size int64) *transfer {
+	t := &transfer{
+		Kind:    kind,
+		Client:  clientIP(r),
+		User:    uploaderName(r),
+		File:    file,
+		Started: time.Now(),
+		state:   transferActive,
+	}
+	t.size.Store(size)
+	t.ctx, t.cancel = context.WithCancel(ctx)
+
+	tr.mu.Lock()
+	tr.nextID++
+	t.ID = tr.nextID
+	tr.active[t.ID] = t
+	tr.mu.Unlock()
+	return t
+}
+
+// finish marks t as no longer running and returns its final state. Transfers
+// that never sent anything are forgotten rather than listed as finished.
+func (tr *transferRegistry) finish(t *transfer) string {
+	t.cancel()
+
+	state := transferDone
+	switch {
+	case t.cancelled.Load():
+		state = transferCancelled
+	case t.size.Load() >= 0 && t.bytes.Load() < t.size.Load():
+		state = transferFailed
+	}
+
+	tr.mu.Lock()
+	delete(tr.active, t.ID)
+	t.state = state
+	t.ended = time.Now()
+	if t.bytes.Load() > 0 || state == transferCancelled {
+		tr.recent = append(tr.recent, t)
+		if len(tr.recent) > recentTransfers {
+			tr.recent = tr.recent[len(tr.recent)-recentTransfers:]
+		}
+	}
+	tr.mu.Unlock()
+
+	if state == transferDone && t.bytes.Load() > 0 {
+		recordHistory(t)
+	}
+	return state
+}
+
+// cancelTransfer aborts the active transfer with the given id.
+func (tr *transferRegistry) cancelTransfer(id int64) bool {
+	tr.mu.Lock()
+	t, ok := tr.active[id]
+	tr.mu.Unlock()
+	if !ok {
+		return false
+	}
+	t.cancelled.Store(true)
+	t.cancel()
+	return true
+}
+
+// get returns the active or recently finished transfer with the given id.
+func (tr *transferRegistry) get(id int64) (transferStatus, bool) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if t, ok := tr.active[id]; ok {
+		return t.status(), true
+	}
+	for _, t := range tr.recent {
+		if t.ID == id {
+			return t.status(), true
+		}
+	}
+	return transferStatus{}, false
+}
+
+// snapshot returns the state of active and recent transfers, newest first.
+func (tr *transferRegistry) snapshot() []transferStatus {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	list := make([]transferStatus, 0, len(tr.active)+len(tr.recent))
+	for _, t := range tr.active {
+		list = append(list, t.status())
+	}
+	for _, t := range tr.recent {
+		list = append(list, t.status())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID > list[j].ID })
+	return list
+}
+
+// status must be called with transferRegistry.mu held.
+func (t *transfer) status() transferStatus {
+	s := transferStatus{
+		ID:      t.ID,
+		Kind:    t.Kind,
+		Client:  t.Client,
+		User:    t.User,
+		File:    t.File,
+		Size:    t.size.Load(),
+		Bytes:   t.bytes.Load(),
+		Speed:   t.speed,
+		State:   t.state,
+		Started: t.Started,
+	}
+	end := t.ended
+	if end.IsZero() {
+		end = time.Now()
+	}
+	s.Duration = end.Sub(t.Started).Seconds()
+	if s.Size > 0 {
+		s.Percent = float64(s.Bytes) / float64(s.Size) * 100
+	} else if s.State == transferDone {
+		s.Percent = 100
+	}
+	if s.State != transferActive && s.Duration > 0 {
+		s.Speed = float64(s.Bytes) / s.Duration
+	}
+	if p := t.phase.Load(); p != nil && s.State == transferActive {
+		s.Phase, s.PhaseBytes, s.PhaseSize = p.name, t.work.Load()-p.start, p.size
+		if s.Speed > 0 && s.PhaseSize > 0 {
+			s.ETA = float64(s.PhaseSize-s.PhaseBytes) / s.Speed
+		}
+	} else if s.State == transferActive && s.Speed > 0 && s.Size > 0 {
+		s.ETA = float64(s.Size-s.Bytes) / s.Speed
+	}
+	return s
+}
+
+// setPhase records that the server has moved on to another step of work on
+// t, which reads size bytes through phaseReader.
+func (t *transfer) setPhase(name string, size int64) {
+	t.phase.Store(&transferPhase{name: name, size: size, start: t.work.Load()})
+}
+
+// phaseReader counts r's bytes as work of the current phase, and fails
+// once the transfer is cancelled.
+func (t *transfer) phaseReader(r io.Reader) io.Reader {
+	return &phaseReader{r: r, t: t}
+}
+
+type phaseReader struct {
+	r io.Reader
+	t *transfer
+}
+
+func (p *phaseReader) Read(b []byte) (int, error) {
+	if p.t.ctx.Err() != nil {
+		return 0, errTransferCancelled
+	}
+	n, err := p.r.Read(b)
+	p.t.work.Add(int64(n))
+	return n, err
+}
+
+// sampleLoop updates transfer speeds once a second and expires old entries.
+func (tr *transferRegistry) sampleLoop() {
+	for range time.Tick(time.Second) {
+		tr.mu.Lock()
+		for _, t := range tr.active {
+			n := t.bytes.Load() + t.work.Load()
+			t.speed = float64(n - t.lastBytes)
+			t.lastBytes = n
+		}
+		for len(tr.recent) > 0 && time.Since(tr.recent[0].ended) > recentTransferAge {
+			tr.recent = tr.recent[1:]
+		}
+		tr.mu.Unlock()
+	}
+}
+
+// reader wraps rs so reads fail once the transfer is cancelled.
+func (t *transfer) reader(rs io.ReadSeeker) io.ReadSeeker {
+	return &transferReader{rs: rs, t: t}
+}
+
+type transferReader struct {
+	rs io.ReadSeeker
+	t  *transfer
+}
+
+func (r *transferReader) Read(p []byte) (int, error) {
+	if r.t.ctx.Err() != nil {
+		return 0, errTransferCancelled
+	}
+	return r.rs.Read(p)
+}
+
+func (r *transferReader) Seek(offset int64, whence int) (int64, error) {
+	return r.rs.Seek(offset, whence)
+}
+
+// transferWriter counts the response bytes of a download and picks up the
+// real transfer size from Content-Length, which accounts for range requests.
+type transferWriter struct {
+	http.ResponseWriter
+	t           *transfer
+	wroteHeader bool
+}
+
+func (w *transferWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		size := int64(-1)
+		if n, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil {
+			size = n
+		}
+		switch code {
+		case http.StatusOK:
+			w.t.reachedEnd.Store(true)
+		case http.StatusPartialContent:
+			w.t.reachedEnd.Store(rangeReachesEnd(w.Header().Get("Content-Range")))
+		default:
+			size = 0
+		}
+		w.t.size.Store(size)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *transferWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.t.bytes.Add(int64(n))
+	return n, err
+}
+
+// rangeReachesEnd reports whether a Content-Range header such as
+// "bytes 100-199/200" ends at the last byte of the resource.
+func rangeReachesEnd(contentRange string) bool {
+	var first, last, total int64
+	_, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &first, &last, &total)
+	return err == nil && last == total-1
+}
+
+func transfersPageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := transfersTemplate.Execute(w, struct {
+		CSRF string
+		SI   bool
+	}{csrfToken(w, r), siSizes})
+	if err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	}
+}
+
+// transfersEventsHandler streams transfer snapshots as server-sent events.
+func transfersEventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		data, err := json.Marshal(transfers.snapshot())
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// progressHandler streams the progress of one transfer as server-sent
+// events, to the client that started it or an admin, until it ends.
+func progressHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/progress/"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	s, ok := transfers.get(id)
+	if !ok || !isAdmin(r) && (s.Client != clientIP(r) || s.User != uploaderName(r)) {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		data, err := json.Marshal(s)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+		if s.State != transferActive {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		if s, ok = transfers.get(id); !ok {
+			return
+		}
+	}
+}
+
+func transferCancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid transfer id", http.StatusBadRequest)
+		return
+	}
+	if !transfers.cancelTransfer(id) {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var transfersTemplate = newPage("transfers", nil)
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trashDir is where deleted files wait in the top folder of their mount,
+// so putting them there is a quick rename. It's never shared.
+const trashDir = ".trash"
+
+// trashRetention is how long deleted files are kept, --trash-retention. 0
+// deletes them straight away.
+var trashRetention = 7 * 24 * time.Hour
+
+// trashItem is a file or folder in the trash.
+type trashItem struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"` // Where it was in the share
+	Folder  bool      `json:"folder,omitempty"`
+	Size    int64     `json:"size"`
+	Deleted time.Time `json:"deleted"`
+	By      string    `json:"by"`
+}
+
+// stored is where the item is kept in its mount.
+func (t trashItem) stored() string {
+	return trashDir + "/" + t.ID + "-" + path.Base(t.Path)
+}
+
+// trashStore lists what's in the trash, saved to the state directory as the
+// trash folders themselves say nothing about where things came from.
+type trashStore struct {
+	mu    sync.Mutex
+	path  string
+	items []trashItem
+}
+
+var trash *trashStore
+
+func openTrash(dir string) (*trashStore, error) {
+	t := &trashStore{path: filepath.Join(dir, "trash.json")}
+	data, err := os.ReadFile(t.path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &t.items); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// save must be called with t.mu held.
+func (t *trashStore) save() error {
+	data, err := json.Marshal(t.items)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(t.path, data)
+}
+
+func (t *trashStore) list() []trashItem {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.items)
+}
+
+// take removes the item id from the list, for restoring or purging it.
+func (t *trashStore) take(id string) (trashItem, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	i := slices.IndexFunc(t.items, func(it trashItem) bool { return it.ID == id })
+	if i < 0 {
+		return trashItem{}, false
+	}
+	item := t.items[i]
+	t.items = slices.Delete(t.items, i, i+1)
+	if err := t.save(); err != nil {
+		log.Println("Error saving the trash:", err)
+	}
+	return item, true
+}
+
+func (t *trashStore) put(item trashItem) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.items = append(t.items, item)
+	if err := t.save(); err != nil {
+		log.Println("Error saving the trash:", err)
+	}
+}
+
+// canTrash reports whether things can be moved in and out of the trash in m.
+func canTrash(m *mount) bool {
+	_, canRename := m.fsys.(renameFS)
+	_, canMkdir := m.fsys.(mkdirFS)
+	return canRename && canMkdir
+}
+
+// moveToTrash puts name, at rel in m, in the trash.
+func moveToTrash(r *http.Request, m *mount, rel, name string) error {
+	info, err := statShared(name)
+	if err != nil {
+		return err
+	}
+	item := trashItem{
+		ID:      rand.Text(),
+		Path:    name,
+		Folder:  info.IsDir(),
+		Deleted: time.Now(),
+		By:      cmp.Or(uploaderName(r), clientIP(r)),
+	}
+	if !item.Folder {
+		item.Size = info.Size()
+	}
+	if err := m.fsys.(mkdirFS).Mkdir(trashDir); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	if err := m.fsys.(renameFS).Rename(rel, item.stored()); err != nil {
+		return err
+	}
+	trash.put(item)
+	return nil
+}
+
+// restore puts item back where it was, making the folders it was in again
+// if they've gone since.
+func (item trashItem) restore() error {
+	m, rel, ok := resolve(item.Path)
+	if !ok || !canTrash(m) {
+		return fs.ErrNotExist
+	}
+	if sharedPathTaken(m, item.Path) {
+		return fs.ErrExist
+	}
+	if parent := path.Dir(rel); parent != "." {
+		var dir string
+		for _, part := range strings.Split(parent, "/") {
+			dir = path.Join(dir, part)
+			if err := m.fsys.(mkdirFS).Mkdir(dir); err != nil && !errors.Is(err, fs.ErrExist) {
+				return err
+			}
+		}
+	}
+	return m.fsys.(renameFS).Rename(item.stored(), rel)
+}
+
+// purge deletes item for good.
+func (item trashItem) purge() error {
+	m, _, ok := resolve(item.Path)
+	if !ok {
+		return nil // Its folder isn't shared anymore
+	}
+	fsys, ok := m.fsys.(removableFS)
+	if !ok {
+		return nil
+	}
+	return fsys.RemoveAll(item.stored())
+}
+
+// expireTrash purges whatever was deleted longer than --trash-retention ago,
+// checking every hour.
+func expireTrash() {
+	for ; ; time.Sleep(time.Hour) {
+		if trashRetention <= 0 {
+			continue
+		}
+		for _, item := range trash.list() {
+			if time.Since(item.Deleted) < trashRetention {
+				continue
+			}
+			if _, ok := trash.take(item.ID); !ok {
+				continue
+			}
+			if err := item.purge(); err != nil {
+				log.Printf("Error emptying %s from the trash: %v", item.Path, err)
+			}
+		}
+	}
+}
+
+// trashHandler serves the trash page at /admin/trash and its API:
+//
+//	GET    /api/trash             lists what's in it
+//	POST   /api/trash/ID/restore  puts ID back where it was
+//	DELETE /api/trash/ID          deletes ID for good
+//	DELETE /api/trash             empties it
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/admin/trash" {
+		trashPageHandler(w, r)
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/trash"), "/")
+	id, action, _ := strings.Cut(rest, "/")
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, trash.list())
+	case rest == "" && r.Method == http.MethodDelete:
+		for _, item := range trash.list() {
+			if _, ok := trash.take(item.ID); ok {
+				if err := item.purge(); err != nil {
+					log.Printf("Error emptying %s from the trash: %v", item.Path, err)
+				}
+			}
+		}
+		log.Printf("Emptied the trash, for %s", clientIP(r))
+		w.WriteHeader(http.StatusNoContent)
+	case action == "" && r.Method == http.MethodDelete:
+		item, ok := trash.take(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if err := item.purge(); err != nil {
+			log.Printf("Error emptying %s from the trash: %v", item.Path, err)
+			http.Error(w, "Error deleting "+item.Path, http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Deleted %s from the trash, for %s", item.Path, clientIP(r))
+		w.WriteHeader(http.StatusNoContent)
+	case action == "restore" && r.Method == http.MethodPost:
+		item, ok := trash.take(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if err := item.restore(); err != nil {
+			trash.put(item)
+			if errors.Is(err, fs.ErrExist) {
+				http.Error(w, item.Path+" already exists, move it out of the way first", http.StatusConflict)
+				return
+			}
+			log.Printf("Error restoring %s: %v", item.Path, err)
+			http.Error(w, "Error restoring "+item.Path, http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Restored %s from the trash, for %s", item.Path, clientIP(r))
+		shareChanged()
+		writeJSON(w, http.StatusOK, map[string]string{"path": item.Path})
+	default:
+		http.Error(w, "Not found or method not allowed", http.StatusNotFound)
+	}
+}
+
+func trashPageHandler(w http.ResponseWriter, r *http.Request) {
+	items := trash.list()
+	slices.Reverse(items) // Latest first
+	data := struct {
+		Items     []trashItem
+		Retention string
+		CSRF      string
+	}{
+		Items: items,
+		CSRF:  csrfToken(w, r),
+	}
+	switch day := 24 * time.Hour; {
+	case trashRetention >= day && trashRetention%day == 0:
+		data.Retention = fmt.Sprintf("%d days", trashRetention/day)
+	case trashRetention > 0:
+		data.Retention = trashRetention.String()
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := trashTemplate.Execute(w, data); err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	}
+}
+
+var trashTemplate = newPage("trash", template.FuncMap{
+	"humanSize": humanSize,
+})
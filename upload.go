@@ -0,0 +1,438 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// contentSHA256 is the header, or trailer, clients can send an upload's
+// SHA-256 in.
+const contentSHA256 = "Content-SHA256"
+
+var (
+	errTrailerForOneFile = errors.New("A " + contentSHA256 + " trailer is for a single file, send one with each part instead")
+	errInvalidTrailer    = errors.New("Invalid " + contentSHA256 + " trailer")
+)
+
+var (
+	uploadsEnabled bool // --upload, or --receive-only
+	receiveOnly    bool // Uploads only, nothing can be listed or downloaded
+)
+
+// uploading holds the share paths of uploads in progress, so two uploads
+// of the same name don't pick the same free name.
+var (
+	uploadingMu sync.Mutex
+	uploading   = map[string]bool{}
+)
+
+// uploadTarget returns where files uploaded to the share folder dir should
+// go, and whether uploads are allowed there at all.
+func uploadTarget(dir string) (fsys writableFS, rel string, ok bool) {
+	m, rel, ok := resolve(dir)
+	if !ok || m.ReadOnly {
+		return nil, "", false
+	}
+	fsys, ok = m.fsys.(writableFS)
+	if !ok {
+		return nil, "", false
+	}
+	if info, err := statShared(dir); err != nil || !info.IsDir() {
+		return nil, "", false
+	}
+	return fsys, rel, true
+}
+
+// uploadDirs lists the share folders offered as upload destinations: the
+// top of the share, or each writable --dir.
+func uploadDirs() []string {
+	var dirs []string
+	if !virtualRoot() {
+		dirs = append(dirs, "")
+	} else {
+		for _, m := range mounts {
+			dirs = append(dirs, m.Name)
+		}
+	}
+	return slices.DeleteFunc(dirs, func(dir string) bool {
+		_, _, ok := uploadTarget(dir)
+		return !ok
+	})
+}
+
+// uploadFolders lists the folders the upload page offers: uploadDirs and
+// the folders inside them, up to a few hundred. A receive-only share doesn't
+// show what's in it, so there it's just uploadDirs.
+func uploadFolders() []string {
+	dirs := uploadDirs()
+	if receiveOnly {
+		return dirs
+	}
+	const maxFolders = 500
+	var folders []string
+	var walk func(dir string)
+	walk = func(dir string) {
+		folders = append(folders, dir)
+		entries, err := readDirShared(dir)
+		if err != nil {
+			return
+		}
+		for _, e := range entries {
+			p := path.Join(dir, e.Name())
+			if e.IsDir() && visible(p, true) && len(folders) < maxFolders {
+				walk(p)
+			}
+		}
+	}
+	for _, dir := range dirs {
+		walk(dir)
+	}
+	return folders
+}
+
+// uploadName checks the name a browser gave an uploaded file, keeping just
+// the last element in case it sent a whole path.
+func uploadName(name string) (string, bool) {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == "/" || name == ".." || strings.ContainsRune(name, 0) || !filepath.IsLocal(name) {
+		return "", false
+	}
+	// A .shareignore would change what's shared, .trash and .versions are
+	// lanshare's, and other hidden files wouldn't show up.
+	if name == shareIgnoreFile || reservedName(name) || (isHiddenName(name) && !showHidden) {
+		return "", false
+	}
+	return name, true
+}
+
+// reserveName picks a share path for name in dir that no file or upload in
+// progress has, adding " (1)", " (2)" and so on before the extension as
+// needed. With --keep-versions the upload can take an existing file's place
+// instead, see replacesFiles. release must be called once the upload is done.
+func reserveName(r *http.Request, fsys fs.FS, dir, rel, name string) (sharePath, fsPath string) {
+	uploadingMu.Lock()
+	defer uploadingMu.Unlock()
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+		sharePath, fsPath = path.Join(dir, candidate), path.Join(rel, candidate)
+		if uploading[sharePath] {
+			continue
+		}
+		info, err := fs.Lstat(fsys, fsPath)
+		if errors.Is(err, fs.ErrNotExist) || i == 0 && err == nil && info.Mode().IsRegular() && replacesFiles(r, sharePath) {
+			uploading[sharePath] = true
+			return sharePath, fsPath
+		}
+	}
+}
+
+func release(sharePath string) {
+	uploadingMu.Lock()
+	delete(uploading, sharePath)
+	uploadingMu.Unlock()
+}
+
+// receiveFile stores one uploaded file, tracked as a transfer, and returns
+// the share path it was saved as and its SHA-256. With want set, or given
+// by late once the file has been read, the file is only saved if it has
+// that SHA-256. With --dedupe, duplicate is the identical file already in
+// the share, which is where a skipped upload is.
+func receiveFile(r *http.Request, fsys writableFS, dir, rel, name string, src io.Reader, want string, late func() (string, error)) (sharePath, sum, duplicate string, err error) {
+	sharePath, fsPath := reserveName(r, fsys, dir, rel, name)
+	defer release(sharePath)
+	kept := keepVersion(r, fsys, sharePath, fsPath)
+
+	t := transfers.start(r.Context(), r, "upload", sharePath, -1)
+	hashed := newHashingReader(src, name, want)
+	hashed.late = late
+	limited := newLimitedUpload(r, hashed)
+	body := &uploadReader{r: &spaceGuard{r: limited, fsys: fsys}, t: t}
+	if scanEnabled() {
+		err = receiveScanned(t, fsys, fsPath, sharePath, body)
+	} else {
+		err = fsys.Create(fsPath, body, -1)
+	}
+	kept.done(err == nil)
+	limited.settle(err == nil)
+	if err != nil {
+		// Expect more than was received, which makes the transfer a failed one.
+		t.size.Store(t.bytes.Load() + 1)
+	}
+	transfers.finish(t)
+	if err != nil {
+		return sharePath, "", "", err
+	}
+	sum = hashed.sum()
+	existing, skipped := dedupeSaved(r, fsys, sharePath, fsPath, sum, kept != nil)
+	if skipped {
+		return existing, sum, existing, nil
+	}
+	checksums.record(sharePath, sum)
+	return sharePath, sum, existing, nil
+}
+
+// uploadReader counts the bytes of an upload, and fails once the transfer
+// is cancelled.
+type uploadReader struct {
+	r io.Reader
+	t *transfer
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	if u.t.ctx.Err() != nil {
+		return 0, errTransferCancelled
+	}
+	n, err := u.r.Read(p)
+	u.t.bytes.Add(int64(n))
+	return n, err
+}
+
+// uploadHandler shows the upload form and takes the files posted to it, as
+// multipart/form-data "file" fields. They go into the folder in the "dir"
+// field, which has to come before them, or else ?dir=. Files are saved as
+// they arrive rather than after the whole form has been read.
+//
+// A file's SHA-256 can be sent in hex or base64 as a Content-SHA256 header
+// of its part, or of the request, or as a trailer, when there's just one
+// file; a file that doesn't match isn't kept.
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !uploadsEnabled {
+		http.NotFound(w, r)
+		return
+	}
+	if !hasRole(r, roleUploader) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		uploadPageHandler(w, r)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Turn away what's plainly over the quota before reading any of it, and
+	// cap the whole request at it, less a little for the form around files.
+	if left := quotaLeft(r); left >= 0 {
+		const formSlack = 1 << 20
+		if left == 0 || r.ContentLength > left+formSlack {
+			uploadTooLarge(w, r, quotaMessage(left))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, left+formSlack)
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart/form-data upload", http.StatusBadRequest)
+		return
+	}
+	requestSum, ok := "", true
+	if h := r.Header.Get(contentSHA256); h != "" {
+		if requestSum, ok = parseSHA256(h); !ok {
+			http.Error(w, "Invalid "+contentSHA256, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// A checksum can also come after the file, as a trailer. Then the rest of
+	// the request is read once the file has been, so it can be checked before
+	// the file is put in place.
+	var late func() (string, error)
+	trailed := false
+	if _, announced := r.Trailer[http.CanonicalHeaderKey(contentSHA256)]; announced && requestSum == "" {
+		late = func() (string, error) {
+			for {
+				part, err := mr.NextPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return "", err
+				}
+				another := part.FormName() == "file" && part.FileName() != ""
+				part.Close()
+				if another {
+					return "", errTrailerForOneFile
+				}
+			}
+			io.Copy(io.Discard, r.Body)
+			trailed = true
+			h := r.Trailer.Get(contentSHA256)
+			if h == "" {
+				return "", nil
+			}
+			want, ok := parseSHA256(h)
+			if !ok {
+				return "", errInvalidTrailer
+			}
+			return want, nil
+		}
+	}
+
+	dir := r.URL.Query().Get("dir")
+	var fsys writableFS
+	var rel string
+	var received, sums, duplicates []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if tooLarge(w, r, err) {
+				return
+			}
+			http.Error(w, "Error reading upload", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() == "dir" && fsys == nil {
+			b, _ := io.ReadAll(io.LimitReader(part, 4096))
+			dir = string(b)
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		if fsys == nil {
+			var ok, writable bool
+			dir, ok = safeSharePath(dir)
+			fsys, rel, writable = uploadTarget(dir)
+			if !ok || !writable {
+				part.Close()
+				http.Error(w, "Uploads aren't allowed in that folder", http.StatusForbidden)
+				return
+			}
+			if msg := spaceMessage(fsys, r.ContentLength); msg != "" {
+				part.Close()
+				uploadTooLarge(w, r, msg)
+				return
+			}
+		}
+		name, ok := uploadName(part.FileName())
+		if !ok {
+			part.Close()
+			http.Error(w, fmt.Sprintf("Can't accept a file named %q", part.FileName()), http.StatusBadRequest)
+			return
+		}
+		want := requestSum
+		if h := part.Header.Get(contentSHA256); h != "" {
+			if want, ok = parseSHA256(h); !ok {
+				part.Close()
+				http.Error(w, "Invalid "+contentSHA256+" for "+name, http.StatusBadRequest)
+				return
+			}
+		} else if want != "" && len(received) > 0 {
+			part.Close()
+			http.Error(w, "A "+contentSHA256+" header on the request is for a single file, send one with each part instead", http.StatusBadRequest)
+			return
+		}
+		fileLate := late
+		if want != "" {
+			fileLate = nil
+		}
+		saved, sum, duplicate, err := receiveFile(r, fsys, dir, rel, name, part, want, fileLate)
+		part.Close()
+		if tooLarge(w, r, err) {
+			log.Printf("Turned away upload %s from %s: %v", saved, clientIP(r), err)
+			return
+		}
+		var rejected *scanRejectedError
+		var mismatch *checksumMismatchError
+		switch {
+		case errors.As(err, &rejected):
+			http.Error(w, rejected.message, http.StatusUnprocessableEntity)
+			return
+		case errors.As(err, &mismatch):
+			log.Printf("Turned away upload %s from %s: %v", saved, clientIP(r), err)
+			http.Error(w, mismatch.Error(), http.StatusUnprocessableEntity)
+			return
+		case errors.Is(err, errTrailerForOneFile), errors.Is(err, errInvalidTrailer):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Error saving upload %s: %v", saved, err)
+			http.Error(w, "Error saving "+name, http.StatusInternalServerError)
+			return
+		}
+		if saved != duplicate {
+			log.Printf("Received %s from %s", saved, clientIP(r))
+			shareChanged()
+		}
+		received = append(received, saved)
+		sums = append(sums, sum)
+		duplicates = append(duplicates, duplicate)
+		if trailed {
+			break
+		}
+	}
+
+	// The upload page's script sends each file on its own and wants to know
+	// what it was saved as; a plain form gets the page back.
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		resp := map[string][]string{"saved": received, "sha256": sums}
+		if slices.ContainsFunc(duplicates, func(d string) bool { return d != "" }) {
+			resp["already_present"] = duplicates
+		}
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	q := url.Values{"received": {strconv.Itoa(len(received))}}
+	if dir != "" {
+		q.Set("dir", dir)
+	}
+	http.Redirect(w, r, "/upload?"+q.Encode(), http.StatusSeeOther)
+}
+
+func uploadPageHandler(w http.ResponseWriter, r *http.Request) {
+	received, _ := strconv.Atoi(r.URL.Query().Get("received"))
+	data := struct {
+		Dirs          []string
+		Dir           string
+		Received      int
+		ChunkSize     int
+		MaxUploadSize int64
+		Limits        string
+		ReceiveOnly   bool
+		CSRF          string
+		User          *user
+		SI            bool // For sizes shown by the page
+	}{
+		Dirs:          uploadFolders(),
+		Dir:           r.URL.Query().Get("dir"),
+		Received:      received,
+		ChunkSize:     defaultChunkSize,
+		MaxUploadSize: maxUploadSize,
+		Limits:        uploadLimits(r),
+		ReceiveOnly:   receiveOnly,
+		CSRF:          csrfToken(w, r),
+		User:          currentUser(r),
+		SI:            siSizes,
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := uploadTemplate.Execute(w, data); err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	}
+}
+
+var uploadTemplate = newPage("upload", nil)
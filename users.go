@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Roles, from least to most privileged. Each role can do everything the
+// ones before it can.
+const (
+	roleViewer   = "viewer"   // Browse and download
+	roleUploader = "uploader" // Also add files
+	roleAdmin    = "admin"    // Also delete, rename and use the admin pages
+)
+
+var roleRank = map[string]int{roleViewer: 1, roleUploader: 2, roleAdmin: 3}
+
+// roleAllows reports whether role grants the permissions of need.
+func roleAllows(role, need string) bool {
+	return roleRank[role] >= roleRank[need]
+}
+
+// user is an account that can sign in to the share.
+type user struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+	Hash string `json:"hash"` // See hashPassword
+
+	TOTP     string   `json:"totp,omitempty"`     // Base32 secret when two-factor sign-in is on
+	Recovery []string `json:"recovery,omitempty"` // Hashes of unused recovery codes
+
+	external bool // Signed in through OIDC or LDAP rather than users.json
+}
+
+const pbkdf2Iterations = 600000
+
+// hashPassword returns a salted PBKDF2-SHA256 hash of password in the form
+// "pbkdf2-sha256$iterations$salt$hash".
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, pbkdf2Iterations, 32)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", pbkdf2Iterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+// checkPassword reports whether password matches a hash from hashPassword.
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := enc.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, password, salt, iter, len(want))
+	return err == nil && subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// userStore holds accounts in users.json in the state directory. The file is
+// reloaded when it changes, so accounts added with the "user" subcommand
+// take effect without restarting the server.
+type userStore struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	users   map[string]*user
+	builtin *user // From --auth, never saved
+}
+
+var users *userStore
+
+func openUsers(dir string) (*userStore, error) {
+	s := &userStore{path: filepath.Join(dir, "users.json"), users: make(map[string]*user)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load must be called with s.mu held, or before s is shared.
+func (s *userStore) load() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.users = make(map[string]*user)
+		s.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var list []*user
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	s.users = make(map[string]*user, len(list))
+	for _, u := range list {
+		s.users[u.Name] = u
+	}
+	s.modTime = info.ModTime()
+	return nil
+}
+
+func (s *userStore) save() error {
+	list := make([]*user, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// lookup returns the account called name, or nil.
+func (s *userStore) lookup(name string) *user {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		log.Println("Error reloading users:", err)
+	}
+	if s.builtin != nil && s.builtin.Name == name {
+		return s.builtin
+	}
+	return s.users[name]
+}
+
+// authenticate returns the account matching name and password, or nil.
+func (s *userStore) authenticate(name, password string) *user {
+	u := s.lookup(name)
+	if u == nil || !checkPassword(u.Hash, password) {
+		return nil
+	}
+	return u
+}
+
+// enabled reports whether there is any account, and so whether visitors
+// must sign in.
+func (s *userStore) enabled() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		log.Println("Error reloading users:", err)
+	}
+	return s.builtin != nil || len(s.users) > 0
+}
+
+// userCommand implements the "user" subcommand for managing accounts.
+func userCommand(args []string) {
+	fs := flag.NewFlagSet("user", flag.ExitOnError)
+	dir := fs.String("state-dir", defaultStateDir(), "directory holding persistent state")
+	role := fs.String("role", roleViewer, "role for user add: viewer, uploader or admin")
+	password := fs.String("password", "", "password for user add (read from stdin if empty)")
+	disable := fs.Bool("disable", false, "turn two-factor sign-in off for user totp")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: user add [--role ROLE] [--password PW] name")
+		fmt.Fprintln(fs.Output(), "       user totp [--disable] name")
+		fmt.Fprintln(fs.Output(), "       user remove name")
+		fmt.Fprintln(fs.Output(), "       user list")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	action := args[0]
+	fs.Parse(args[1:])
+
+	s, err := openUsers(*dir)
+	if err != nil {
+		log.Fatal("Error loading users:", err)
+	}
+
+	switch action {
+	case "add":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		if _, ok := roleRank[*role]; !ok {
+			log.Fatalf("Unknown role %q", *role)
+		}
+		pw := *password
+		if pw == "" {
+			fmt.Fprint(os.Stderr, "Password: ")
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				log.Fatal("Error reading password:", err)
+			}
+			pw = strings.TrimRight(line, "\r\n")
+		}
+		if pw == "" {
+			log.Fatal("Password must not be empty")
+		}
+		hash, err := hashPassword(pw)
+		if err != nil {
+			log.Fatal("Error hashing password:", err)
+		}
+		u := &user{Name: fs.Arg(0), Role: *role, Hash: hash}
+		if old := s.users[u.Name]; old != nil {
+			u.TOTP, u.Recovery = old.TOTP, old.Recovery
+		}
+		s.users[u.Name] = u
+		if err := s.save(); err != nil {
+			log.Fatal("Error saving users:", err)
+		}
+		fmt.Printf("Saved %s (%s)\n", fs.Arg(0), *role)
+
+	case "totp":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		u := s.users[fs.Arg(0)]
+		if u == nil {
+			log.Fatalf("No user %q", fs.Arg(0))
+		}
+		if *disable {
+			u.TOTP, u.Recovery = "", nil
+			if err := s.save(); err != nil {
+				log.Fatal("Error saving users:", err)
+			}
+			fmt.Printf("Two-factor sign-in is off for %s\n", u.Name)
+			return
+		}
+		secret, err := newTOTPSecret()
+		if err != nil {
+			log.Fatal("Error creating secret:", err)
+		}
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			log.Fatal("Error creating recovery codes:", err)
+		}
+		u.TOTP, u.Recovery = secret, hashes
+		if err := s.save(); err != nil {
+			log.Fatal("Error saving users:", err)
+		}
+		fmt.Println("Add this to an authenticator app (as a QR code or by hand):")
+		fmt.Println("  ", totpURI(u.Name, secret))
+		fmt.Println("   secret:", secret)
+		fmt.Println("Recovery codes, each works once if the app is lost:")
+		for _, c := range codes {
+			fmt.Println("  ", c)
+		}
+
+	case "remove":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		if _, ok := s.users[fs.Arg(0)]; !ok {
+			log.Fatalf("No user %q", fs.Arg(0))
+		}
+		delete(s.users, fs.Arg(0))
+		if err := s.save(); err != nil {
+			log.Fatal("Error saving users:", err)
+		}
+
+	case "list":
+		names := make([]string, 0, len(s.users))
+		for name := range s.users {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tROLE\t2FA")
+		for _, name := range names {
+			u := s.users[name]
+			twoFactor := "off"
+			if u.TOTP != "" {
+				twoFactor = fmt.Sprintf("on, %d recovery codes left", len(u.Recovery))
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", name, u.Role, twoFactor)
+		}
+		tw.Flush()
+
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
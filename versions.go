@@ -0,0 +1,346 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// versionsDir holds earlier versions of replaced files in the top folder of
+// their mount, like trashDir. It's never shared.
+const versionsDir = ".versions"
+
+// keepVersions is how many earlier versions of a file are kept, --keep-versions.
+// With 0 an upload never replaces a file but is saved under a new name.
+var keepVersions int
+
+// fileVersion is an earlier version of a file, from before an upload
+// replaced it.
+type fileVersion struct {
+	ID       string    `json:"id"`
+	Stored   string    `json:"stored"` // Where it's kept in its mount
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"` // When this version was written
+	Replaced time.Time `json:"replaced"`
+	By       string    `json:"by"` // Who replaced it
+}
+
+// versionStore lists the earlier versions of each file by share path, newest
+// first, saved to the state directory.
+type versionStore struct {
+	mu    sync.Mutex
+	path  string
+	files map[string][]fileVersion
+}
+
+var versions *versionStore
+
+func openVersions(dir string) (*versionStore, error) {
+	s := &versionStore{
+		path:  filepath.Join(dir, "versions.json"),
+		files: make(map[string][]fileVersion),
+	}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.files); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// save must be called with s.mu held.
+func (s *versionStore) save() {
+	data, err := json.Marshal(s.files)
+	if err == nil {
+		err = writeFileAtomic(s.path, data)
+	}
+	if err != nil {
+		log.Println("Error saving file versions:", err)
+	}
+}
+
+func (s *versionStore) list(p string) []fileVersion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.files[p])
+}
+
+func (s *versionStore) count(p string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files[p])
+}
+
+// add records v as the latest earlier version of p, returning the versions
+// that no longer fit under --keep-versions.
+func (s *versionStore) add(p string, v fileVersion) []fileVersion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := append([]fileVersion{v}, s.files[p]...)
+	var dropped []fileVersion
+	if len(list) > keepVersions {
+		list, dropped = list[:keepVersions], list[keepVersions:]
+	}
+	s.files[p] = list
+	s.save()
+	return dropped
+}
+
+func (s *versionStore) remove(p, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[p] = slices.DeleteFunc(s.files[p], func(v fileVersion) bool { return v.ID == id })
+	if len(s.files[p]) == 0 {
+		delete(s.files, p)
+	}
+	s.save()
+}
+
+// moved carries the history of everything at oldname over to newname, after
+// a file or folder is renamed.
+func (s *versionStore) moved(oldname, newname string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for p, list := range s.files {
+		rest, ok := strings.CutPrefix(p, oldname)
+		if !ok || rest != "" && rest[0] != '/' {
+			continue
+		}
+		delete(s.files, p)
+		s.files[newname+rest] = list
+		changed = true
+	}
+	if changed {
+		s.save()
+	}
+}
+
+// replacesFiles reports whether an upload from r with the same name as an
+// existing file takes its place, keeping the old one as a version. In a
+// receive-only share nobody's upload can replace someone else's.
+func replacesFiles(r *http.Request, sharePath string) bool {
+	_, locked := lockedBy(r, sharePath)
+	return keepVersions > 0 && !receiveOnly && !locked && visible(sharePath, false)
+}
+
+// keptVersion is an earlier version set aside while an upload that's going
+// to replace it comes in.
+type keptVersion struct {
+	m       *mount
+	path    string
+	version fileVersion
+}
+
+// keepVersion sets aside the file at sharePath, fsPath in fsys, if there is
+// one, before an upload replaces it. done must be called with whether the
+// upload was saved.
+func keepVersion(r *http.Request, fsys fs.FS, sharePath, fsPath string) *keptVersion {
+	info, err := fs.Stat(fsys, fsPath)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	copier, ok := fsys.(copyFS)
+	if !ok {
+		return nil
+	}
+	m, _, _ := resolve(sharePath)
+	id := rand.Text()
+	k := &keptVersion{m: m, path: sharePath, version: fileVersion{
+		ID:       id,
+		Stored:   versionsDir + "/" + id + "-" + path.Base(sharePath),
+		Size:     info.Size(),
+		Modified: info.ModTime(),
+		By:       cmp.Or(uploaderName(r), clientIP(r)),
+	}}
+	if d, ok := fsys.(mkdirFS); ok {
+		if err := d.Mkdir(versionsDir); err != nil && !errors.Is(err, fs.ErrExist) {
+			log.Printf("Error keeping the old version of %s: %v", sharePath, err)
+			return nil
+		}
+	}
+	if err := copier.Copy(fsPath, k.version.Stored); err != nil {
+		log.Printf("Error keeping the old version of %s: %v", sharePath, err)
+		return nil
+	}
+	return k
+}
+
+func (k *keptVersion) done(saved bool) {
+	if k == nil {
+		return
+	}
+	if !saved {
+		purgeVersion(k.m, k.path, k.version)
+		return
+	}
+	k.version.Replaced = time.Now()
+	for _, v := range versions.add(k.path, k.version) {
+		purgeVersion(k.m, k.path, v)
+	}
+}
+
+func purgeVersion(m *mount, p string, v fileVersion) {
+	if fsys, ok := m.fsys.(removableFS); ok {
+		if err := fsys.RemoveAll(v.Stored); err != nil {
+			log.Printf("Error removing an old version of %s: %v", p, err)
+		}
+	}
+}
+
+// versionsHandler shows the history of the file at /versions/PATH, and with
+// ?id= downloads or, POSTed, restores one of its earlier versions. Restoring
+// keeps the current content as a version in turn.
+func versionsHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := safeSharePath(strings.TrimPrefix(r.URL.Path, "/versions/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if p, locked := lockedBy(r, name); locked {
+		redirectToUnlock(w, r, p)
+		return
+	}
+	info, err := statShared(name)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	list := versions.list(name)
+	id := r.FormValue("id")
+	i := slices.IndexFunc(list, func(v fileVersion) bool { return v.ID == id })
+
+	switch {
+	case id == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		versionsPageHandler(w, r, name, info, list)
+	case i < 0:
+		http.NotFound(w, r)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		serveVersion(w, r, name, list[i])
+	case r.Method == http.MethodPost:
+		restoreVersion(w, r, name, list[i])
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// apiVersionsHandler lists the earlier versions of the file at
+// /api/versions/PATH, newest first.
+func apiVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := safeSharePath(strings.TrimPrefix(r.URL.Path, "/api/versions/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if _, locked := lockedBy(r, name); locked {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if info, err := statShared(name); err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	list := versions.list(name)
+	if list == nil {
+		list = []fileVersion{}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func serveVersion(w http.ResponseWriter, r *http.Request, name string, v fileVersion) {
+	m, _, _ := resolve(name)
+	f, err := m.fsys.Open(v.Stored)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", path.Base(name)))
+	http.ServeContent(w, r, path.Base(name), v.Modified, seekable(w, f, info))
+}
+
+func restoreVersion(w http.ResponseWriter, r *http.Request, name string, v fileVersion) {
+	if !uploadsEnabled || !hasRole(r, roleUploader) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	dir := path.Dir(name)
+	if dir == "." {
+		dir = ""
+	}
+	fsys, fsPath, ok := uploadTarget(dir)
+	if !ok {
+		http.Error(w, "This folder is read-only", http.StatusForbidden)
+		return
+	}
+	fsPath = path.Join(fsPath, path.Base(name))
+	m, _, _ := resolve(name)
+	src, err := m.fsys.Open(v.Stored)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer src.Close()
+
+	kept := keepVersion(r, fsys, name, fsPath)
+	err = fsys.Create(fsPath, src, v.Size)
+	kept.done(err == nil)
+	if err != nil {
+		log.Printf("Error restoring %s: %v", name, err)
+		http.Error(w, "Error restoring "+name, http.StatusInternalServerError)
+		return
+	}
+	versions.remove(name, v.ID)
+	purgeVersion(m, name, v)
+	log.Printf("Restored the version of %s from %s, for %s", name, v.Modified.Format(time.DateTime), clientIP(r))
+	shareChanged()
+	http.Redirect(w, r, r.URL.EscapedPath(), http.StatusSeeOther)
+}
+
+func versionsPageHandler(w http.ResponseWriter, r *http.Request, name string, info fs.FileInfo, list []fileVersion) {
+	data := struct {
+		Name       string
+		Current    fs.FileInfo
+		Versions   []fileVersion
+		CanRestore bool
+		CSRF       string
+	}{
+		Name:       name,
+		Current:    info,
+		Versions:   list,
+		CanRestore: uploadsEnabled && hasRole(r, roleUploader),
+		CSRF:       csrfToken(w, r),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := versionsTemplate.Execute(w, data); err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	}
+}
+
+var versionsTemplate = newPage("versions", template.FuncMap{
+	"humanSize":  humanSize,
+	"escapePath": escapePath,
+})
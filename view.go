@@ -0,0 +1,108 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// maxViewSize is the largest file /view/ shows in a page; bigger ones get
+// a page offering to download them instead, as rendering them would take
+// long and make the page sluggish.
+const maxViewSize = 1 << 20
+
+// viewHandler shows the file at /view/PATH in a page of its own when there's
+// a better way to read it than the browser's: Markdown rendered as HTML,
+// code and other text highlighted with line numbers, PDFs in a frame with
+// a way out for phones that can't show them, and photos scaled down to the
+// screen so they load quickly. Videos go to /watch/, and
+// anything else is opened directly. Links in a page between files in the
+// share go through here too, so relative ones work from anywhere.
+func viewHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := safeSharePath(strings.TrimPrefix(r.URL.Path, "/view/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if p, locked := lockedBy(r, name); locked {
+		redirectToUnlock(w, r, p)
+		return
+	}
+	info, err := statShared(name)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	data := struct {
+		Name     string
+		Size     int64
+		Direct   string
+		Download string
+		TooBig   bool
+		PDF      bool
+		Image    string          // Scaled down to fit the screen
+		Photo    *photoInfo      // What it says about itself
+		Content  template.HTML   // Rendered Markdown
+		Lines    []template.HTML // Or highlighted code
+	}{
+		Name:     name,
+		Size:     info.Size(),
+		Direct:   basePath + "/download/" + escapePath(name) + "?view=1",
+		Download: basePath + "/download/" + escapePath(name) + "?dl=1",
+	}
+	ctype := sharedFileType(name)
+	if isVideo(ctype) {
+		http.Redirect(w, r, "/watch/"+escapePath(name), http.StatusFound)
+		return
+	}
+	if canResize(ctype) {
+		data.Image = basePath + "/img/" + escapePath(name)
+		data.Photo = photoDetails(name)
+	}
+	data.PDF = mediaType(ctype) == "application/pdf"
+	code, isCode := syntaxFor(name)
+	markdown := mediaType(ctype) == "text/markdown"
+	if !isCode && (mediaType(ctype) == "text/plain" || showAsText(ctype)) {
+		code, isCode = &plainSyntax, true
+	}
+	if !markdown && !isCode && !data.PDF && data.Image == "" {
+		http.Redirect(w, r, data.Direct, http.StatusFound)
+		return
+	}
+
+	data.TooBig = !data.PDF && data.Image == "" && info.Size() > maxViewSize
+	if (markdown || isCode) && !data.TooBig {
+		f, err := openShared(name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		src, err := io.ReadAll(io.LimitReader(f, maxViewSize))
+		if err != nil {
+			log.Printf("Error reading %s: %v", name, err)
+			http.Error(w, "Error reading "+name, http.StatusInternalServerError)
+			return
+		}
+		text := strings.ToValidUTF8(string(src), "\uFFFD")
+		if markdown {
+			data.Content = template.HTML(renderMarkdown(text))
+		} else {
+			data.Lines = highlight(strings.TrimSuffix(strings.ReplaceAll(text, "\r\n", "\n"), "\n"), code)
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	setCachePolicy(w, "previews")
+	if err := viewTemplate.Execute(w, data); err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	}
+}
+
+var viewTemplate = newPage("view", template.FuncMap{
+	"base":      path.Base,
+	"humanSize": humanSize,
+	"inc":       func(i int) int { return i + 1 },
+})
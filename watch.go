@@ -0,0 +1,65 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// watchHandler shows the video at /watch/PATH in a page of its own, with
+// keyboard controls and, if there's a .vtt file of the same name next to
+// it, its subtitles. The video itself streams from /download/, which serves
+// ranges so it can be seeked without downloading it all, or with --transcode
+// from /hls/ if the browser can't play it as it is. A Cast button plays it
+// on a Chromecast on the LAN instead, with the page as its remote.
+func watchHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := safeSharePath(strings.TrimPrefix(r.URL.Path, "/watch/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if p, locked := lockedBy(r, name); locked {
+		redirectToUnlock(w, r, p)
+		return
+	}
+	info, err := statShared(name)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	data := struct {
+		Name      string
+		Type      string
+		Source    string
+		Download  string
+		Subtitles string
+		HLS       string // Converted, with --transcode
+		Playable  bool   // In any browser as it is
+		CSRF      string
+	}{
+		Name:     name,
+		CSRF:     csrfToken(w, r),
+		Type:     mediaType(sharedFileType(name)),
+		Source:   basePath + "/download/" + escapePath(name),
+		Download: basePath + "/download/" + escapePath(name) + "?dl=1",
+		Playable: previewVideo(sharedFileType(name)),
+	}
+	if transcode {
+		data.HLS = basePath + "/hls/" + escapePath(name) + "/" + hlsPlaylist
+	}
+	if vtt := strings.TrimSuffix(name, path.Ext(name)) + ".vtt"; sharedFileExists(vtt) {
+		if _, locked := lockedBy(r, vtt); !locked {
+			data.Subtitles = basePath + "/download/" + escapePath(vtt)
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	setCachePolicy(w, "previews")
+	if err := watchTemplate.Execute(w, data); err != nil {
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	}
+}
+
+var watchTemplate = newPage("watch", template.FuncMap{
+	"base": path.Base,
+})
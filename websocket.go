@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxWebSocketMessage is the longest message a client may send.
+const maxWebSocketMessage = 1 << 20
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// wsConn is the server end of a WebSocket, as much of RFC 6455 as the
+// pages' live updates need: text messages, pings and closing.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	wmu  sync.Mutex // Held while writing a frame
+}
+
+// upgradeWebSocket answers a WebSocket handshake on r, taking over the
+// connection. Only pages from this server may open one, as browsers send
+// cookies along with cross-site WebSocket requests too.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "Expected a WebSocket", http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported WebSocket version")
+	}
+	// Behind a reverse proxy the page comes from the proxy's address rather
+	// than the Host the request arrives with.
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		ext, _ := url.Parse(externalBaseURL(r))
+		if err != nil || !strings.EqualFold(u.Host, r.Host) && (ext == nil || !strings.EqualFold(u.Host, ext.Host)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return nil, errors.New("WebSocket from another site")
+		}
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "WebSockets not supported", http.StatusInternalServerError)
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	brw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: brw.Reader}, nil
+}
+
+// readMessage returns the next text message, answering pings on the way.
+// It returns io.EOF once the client closes the connection.
+func (c *wsConn) readMessage() (string, error) {
+	var msg []byte
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(c.br, head[:]); err != nil {
+			return "", err
+		}
+		fin, op := head[0]&0x80 != 0, head[0]&0x0f
+		if head[1]&0x80 == 0 {
+			return "", errors.New("unmasked frame from a client")
+		}
+		size := uint64(head[1] & 0x7f)
+		switch size {
+		case 126:
+			var n [2]byte
+			if _, err := io.ReadFull(c.br, n[:]); err != nil {
+				return "", err
+			}
+			size = uint64(binary.BigEndian.Uint16(n[:]))
+		case 127:
+			var n [8]byte
+			if _, err := io.ReadFull(c.br, n[:]); err != nil {
+				return "", err
+			}
+			size = binary.BigEndian.Uint64(n[:])
+		}
+		if size > maxWebSocketMessage || uint64(len(msg))+size > maxWebSocketMessage {
+			c.writeFrame(wsClose, []byte{0x03, 0xf1}) // 1009, too big
+			return "", errors.New("WebSocket message too big")
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return "", err
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return "", err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch op {
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+		case wsPong:
+		case wsClose:
+			c.writeFrame(wsClose, nil)
+			return "", io.EOF
+		case wsText, wsContinuation:
+			msg = append(msg, payload...)
+			if fin {
+				return string(msg), nil
+			}
+		default:
+			return "", errors.New("unexpected WebSocket frame")
+		}
+	}
+}
+
+// writeMessage sends text as one message.
+func (c *wsConn) writeMessage(text string) error {
+	return c.writeFrame(wsText, []byte(text))
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	head := []byte{0x80 | op, 0}
+	switch n := len(payload); {
+	case n < 126:
+		head[1] = byte(n)
+	case n <= 0xffff:
+		head[1] = 126
+		head = binary.BigEndian.AppendUint16(head, uint16(n))
+	default:
+		head[1] = 127
+		head = binary.BigEndian.AppendUint64(head, uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(append(head, payload...))
+	return err
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+// keepAlive pings c until it's closed, so connections through NAT and
+// proxies aren't dropped for being quiet.
+func (c *wsConn) keepAlive(done <-chan struct{}) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if c.writeFrame(wsPing, nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+// wsHub is the WebSockets open on one page, to send each of them what
+// the others do.
+type wsHub struct {
+	mu      sync.Mutex
+	clients map[*wsConn]bool
+}
+
+func (h *wsHub) add(c *wsConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients == nil {
+		h.clients = make(map[*wsConn]bool)
+	}
+	h.clients[c] = true
+}
+
+func (h *wsHub) remove(c *wsConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, c)
+}
+
+// broadcast sends msg to every client, dropping those it can't reach.
+func (h *wsHub) broadcast(msg string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if err := c.writeMessage(msg); err != nil {
+			c.Close()
+			delete(h.clients, c)
+		}
+	}
+}